@@ -17,9 +17,15 @@ limitations under the License.
 package v1beta1
 
 import (
+	"sort"
+	"strconv"
+	"time"
+
 	v1 "k8s.io/api/core/v1"
 	netv1 "k8s.io/api/networking/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/types"
 )
 
@@ -48,6 +54,13 @@ type TeamCitySpec struct {
 	HealthEndpoint v1.HTTPGetAction `json:"healthEndpoint,omitempty"`
 	// +kubebuilder:default:={}
 	DatabaseSecret DatabaseSecret `json:"databaseSecret,omitempty"`
+	// ManagedDatabase makes the operator run a PostgreSQL instance and point spec.databaseSecret at its generated
+	// credentials. It is meant for development and test instances: the database has a single replica and no backups.
+	// +optional
+	ManagedDatabase *ManagedDatabase `json:"managedDatabase,omitempty"`
+	// JDBCDriver is placed in <dataDir>/lib/jdbc by an init container before the nodes start.
+	// +optional
+	JDBCDriver *JDBCDriver `json:"jdbcDriver,omitempty"`
 	// +kubebuilder:default:={}
 	StartupPropertiesConfig map[string]string `json:"startupPropertiesConfig,omitempty"`
 	//+kubebuilder:default:={}
@@ -56,6 +69,30 @@ type TeamCitySpec struct {
 	IngressList []Ingress `json:"ingressList,omitempty"`
 	//+kubebuilder:default:={}
 	ServiceAccount ServiceAccount `json:"serviceAccount,omitempty"`
+
+	// APITokenSecret references a Secret key holding a TeamCity access token.
+	// The operator uses it for REST API calls to the main node, e.g. to run backups.
+	APITokenSecret *v1.SecretKeySelector `json:"apiTokenSecret,omitempty"`
+
+	// Stopped scales every node to zero, secondary nodes first. PVCs, Services and an ongoing upgrade checkpoint are kept;
+	// clearing it starts the main node first and the secondary nodes once it is ready.
+	Stopped bool `json:"stopped,omitempty"`
+
+	// Hibernation stops the nodes on a schedule, e.g. outside office hours.
+	Hibernation *HibernationSpec `json:"hibernation,omitempty"`
+}
+
+// HibernationSpec defines when the nodes sleep. Whichever of Sleep and Wake was due last decides the state.
+type HibernationSpec struct {
+	// Sleep is a cron expression of when every node is stopped, e.g. "0 20 * * 1-5".
+	// Prefix it with CRON_TZ=<zone> for a time zone other than UTC.
+	Sleep string `json:"sleep"`
+	// Wake is a cron expression of when the nodes are started again, e.g. "0 7 * * 1-5".
+	Wake string `json:"wake"`
+	// WaitForRunningBuilds postpones the sleep while the server reports running builds. It requires spec.apiTokenSecret.
+	// +kubebuilder:default:=true
+	// +optional
+	WaitForRunningBuilds bool `json:"waitForRunningBuilds"`
 }
 
 type NodeSpec struct {
@@ -98,12 +135,133 @@ func (n *Node) GetNamespacedNameFromNamespace(namespace string) types.Namespaced
 
 type DatabaseSecret struct {
 	Secret string `json:"secret,omitempty"`
+
+	// Keys overrides the names of the Secret keys holding the connection settings.
+	// +optional
+	Keys DatabaseSecretKeys `json:"keys,omitempty"`
+
+	// Delivery is how the nodes receive the connection settings: as TEAMCITY_DB_* environment variables, or
+	// as a database.properties file written to the config folder of the data directory before the server starts.
+	// +kubebuilder:validation:Enum=env;file
+	// +optional
+	Delivery DatabaseSecretDelivery `json:"delivery,omitempty"`
+
+	// Properties are additional database.properties entries, e.g. connectionProperties.sslmode or maxConnections.
+	// They require the file delivery.
+	// +optional
+	Properties map[string]string `json:"properties,omitempty"`
+}
+
+// DatabaseSecretKeys names the keys of spec.databaseSecret; empty keys fall back to the TeamCity property names.
+type DatabaseSecretKeys struct {
+	// URL defaults to connectionUrl.
+	URL string `json:"url,omitempty"`
+	// User defaults to connectionProperties.user.
+	User string `json:"user,omitempty"`
+	// Password defaults to connectionProperties.password.
+	Password string `json:"password,omitempty"`
+}
+
+type DatabaseSecretDelivery string
+
+const (
+	DatabaseSecretDeliveryEnv  DatabaseSecretDelivery = "env"
+	DatabaseSecretDeliveryFile DatabaseSecretDelivery = "file"
+)
+
+// The database.properties entries holding the connection settings, and the default Secret keys for them.
+const (
+	DatabaseURLProperty      = "connectionUrl"
+	DatabaseUserProperty     = "connectionProperties.user"
+	DatabasePasswordProperty = "connectionProperties.password"
+)
+
+func (keys DatabaseSecretKeys) URLKey() string {
+	return keyOrDefault(keys.URL, DatabaseURLProperty)
+}
+
+func (keys DatabaseSecretKeys) UserKey() string {
+	return keyOrDefault(keys.User, DatabaseUserProperty)
+}
+
+func (keys DatabaseSecretKeys) PasswordKey() string {
+	return keyOrDefault(keys.Password, DatabasePasswordProperty)
+}
+
+// All returns the URL, user and password keys.
+func (keys DatabaseSecretKeys) All() []string {
+	return []string{keys.URLKey(), keys.UserKey(), keys.PasswordKey()}
+}
+
+func keyOrDefault(key string, defaultKey string) string {
+	if key == "" {
+		return defaultKey
+	}
+	return key
+}
+
+// ManagedDatabase configures the PostgreSQL StatefulSet created for spec.managedDatabase.
+type ManagedDatabase struct {
+	// Image defaults to postgres:16.
+	// +optional
+	Image string `json:"image,omitempty"`
+	// Storage is the size of the database volume, 8Gi by default. It only applies when the volume is created.
+	// +optional
+	Storage resource.Quantity `json:"storage,omitempty"`
+	// +optional
+	StorageClassName *string `json:"storageClassName,omitempty"`
+	// +optional
+	Resources v1.ResourceRequirements `json:"resources,omitempty"`
+}
+
+// JDBCDriver names the driver jar TeamCity needs for its database. Exactly one source is set: Database with Version
+// downloads the driver from Maven Central, ConfigMap and Image provide the jar themselves, e.g. for air-gapped clusters.
+type JDBCDriver struct {
+	// Database selects the driver downloaded from Maven Central.
+	// +kubebuilder:validation:Enum=postgresql;mysql;mssql;oracle
+	// +optional
+	Database JDBCDatabase `json:"database,omitempty"`
+	// Version is the Maven version of the driver, e.g. 42.7.4 for PostgreSQL.
+	// +optional
+	Version string `json:"version,omitempty"`
+
+	// ConfigMap holds the driver jar under a binaryData key, which is also the file name in lib/jdbc.
+	// +optional
+	ConfigMap *JDBCDriverConfigMap `json:"configMap,omitempty"`
+
+	// Image contains the driver jar. It must provide cp to copy the jar into the data directory.
+	// +optional
+	Image *JDBCDriverImage `json:"image,omitempty"`
+}
+
+type JDBCDatabase string
+
+const (
+	JDBCDatabasePostgreSQL JDBCDatabase = "postgresql"
+	JDBCDatabaseMySQL      JDBCDatabase = "mysql"
+	JDBCDatabaseMSSQL      JDBCDatabase = "mssql"
+	JDBCDatabaseOracle     JDBCDatabase = "oracle"
+)
+
+type JDBCDriverConfigMap struct {
+	Name string `json:"name"`
+	Key  string `json:"key"`
+}
+
+type JDBCDriverImage struct {
+	Image string `json:"image"`
+	// Path is the absolute path of the jar inside the image.
+	Path string `json:"path"`
+	// +optional
+	ImagePullPolicy v1.PullPolicy `json:"imagePullPolicy,omitempty"`
 }
 
 type CustomPersistentVolumeClaim struct {
-	Name        string                       `json:"name"`
-	Annotations map[string]string            `json:"annotations,omitempty"`
-	VolumeMount v1.VolumeMount               `json:"volumeMount"`
+	Name        string            `json:"name"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+	// VolumeMount defaults to a mount named after the claim; the data directory is mounted at /storage by default.
+	// +optional
+	VolumeMount v1.VolumeMount               `json:"volumeMount,omitempty"`
 	Spec        v1.PersistentVolumeClaimSpec `json:"spec"`
 }
 
@@ -113,10 +271,204 @@ type TeamCityStatus struct {
 	// Important: Run "make" to regenerate code after modifying this file
 	State   string `json:"state"`
 	Message string `json:"message"`
+
+	// ObservedGeneration is the TeamCity generation the status was computed for.
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+
+	// Conditions follow the Kubernetes conventions; see the Condition* constants for the known types.
+	// +listType=map
+	// +listMapKey=type
+	// +optional
+	Conditions []metav1.Condition `json:"conditions,omitempty"`
+
+	// Nodes reports the state of the StatefulSet backing every TeamCity node.
+	Nodes []NodeStatus `json:"nodes,omitempty"`
+
+	// ReadyNodes is a "<ready>/<total>" summary of Nodes, used for printing.
+	ReadyNodes string `json:"readyNodes,omitempty"`
+
+	// CurrentImage is the image the main node is running.
+	CurrentImage string `json:"currentImage,omitempty"`
+
+	// ConfigHash is a hash of the Secrets and ConfigMaps the nodes reference. It is stamped into
+	// the pod templates, so a change of the referenced data rolls the nodes.
+	ConfigHash string `json:"configHash,omitempty"`
+
+	// ConfigHashBaseline is the first ConfigHash recorded for nodes that already ran without it, e.g. after an
+	// operator upgrade. ConfigHash is only stamped into the pod templates once it differs, so recording it does
+	// not restart the nodes.
+	ConfigHashBaseline string `json:"configHashBaseline,omitempty"`
+
+	// Hibernation reports the state of spec.hibernation.
+	Hibernation *HibernationStatus `json:"hibernation,omitempty"`
+
+	// Upgrade reports a zero-downtime upgrade that is rolled back or failed.
+	Upgrade *UpgradeStatus `json:"upgrade,omitempty"`
+
+	// UpgradeCheckpoint is the progress of the ongoing zero-downtime upgrade, if any.
+	UpgradeCheckpoint *UpgradeCheckpoint `json:"upgradeCheckpoint,omitempty"`
+
+	// UpgradeHistory lists the last UpgradeHistoryLimit finished zero-downtime upgrades, the most recent first.
+	UpgradeHistory []UpgradeHistoryEntry `json:"upgradeHistory,omitempty"`
+
+	// PendingChange is a change of the spec that restarts nodes and waits for ApprovedGenerationAnnotationKey.
+	PendingChange *PendingChange `json:"pendingChange,omitempty"`
+}
+
+type HibernationStatus struct {
+	// Hibernating is true while the nodes are stopped by the sleep schedule.
+	Hibernating bool `json:"hibernating"`
+	// LastTransitionTime is when the nodes were last put to sleep or woken up.
+	LastTransitionTime *metav1.Time `json:"lastTransitionTime,omitempty"`
+	// NextTransition is Sleep or Wake.
+	NextTransition string `json:"nextTransition,omitempty"`
+	// NextTransitionTime is when NextTransition is scheduled.
+	NextTransitionTime *metav1.Time `json:"nextTransitionTime,omitempty"`
+	// Message explains a postponed sleep or an invalid schedule.
+	Message string `json:"message,omitempty"`
+}
+
+const (
+	HibernationTransitionSleep = "Sleep"
+	HibernationTransitionWake  = "Wake"
+)
+
+// UpgradePhase is the outcome of a zero-downtime upgrade.
+type UpgradePhase string
+
+const (
+	// UpgradePhaseRollingBack is set while the main node is restored to the spec it ran before the upgrade.
+	UpgradePhaseRollingBack UpgradePhase = "RollingBack"
+	// UpgradePhaseFailed is set once the rollback finished. The spec of Generation is not applied to the nodes again.
+	UpgradePhaseFailed UpgradePhase = "Failed"
+	// UpgradePhaseAborted is set once an upgrade aborted by UpgradeControlAnnotationKey is rolled back.
+	// As with UpgradePhaseFailed, the spec of Generation is not applied to the nodes again.
+	UpgradePhaseAborted UpgradePhase = "Aborted"
+	// UpgradePhaseSucceeded is recorded in the upgrade history once every node runs the new spec.
+	UpgradePhaseSucceeded UpgradePhase = "Succeeded"
+)
+
+// UpgradeHistoryLimit is the number of finished upgrades kept in status.upgradeHistory.
+const UpgradeHistoryLimit = 10
+
+type UpgradeStatus struct {
+	Phase UpgradePhase `json:"phase"`
+	// Reason is a CamelCase reason for the rollback, e.g. StageTimedOut.
+	Reason  string `json:"reason,omitempty"`
+	Message string `json:"message,omitempty"`
+	// Generation is the TeamCity generation whose spec was rolled back. Any change to the spec retries the upgrade.
+	Generation int64  `json:"generation,omitempty"`
+	FromImage  string `json:"fromImage,omitempty"`
+	ToImage    string `json:"toImage,omitempty"`
+	// LastTransitionTime is when Phase was last changed.
+	LastTransitionTime *metav1.Time `json:"lastTransitionTime,omitempty"`
+}
+
+// UpgradeCheckpoint is the state of an ongoing zero-downtime upgrade, kept so the upgrade continues where it stopped.
+type UpgradeCheckpoint struct {
+	// Stage is the current stage of the upgrade, e.g. main-shutting-down.
+	Stage string `json:"stage"`
+	// StartedTime is when the upgrade started, StageTransitionTime when Stage was entered.
+	StartedTime         *metav1.Time `json:"startedTime,omitempty"`
+	StageTransitionTime *metav1.Time `json:"stageTransitionTime,omitempty"`
+	FromImage           string       `json:"fromImage,omitempty"`
+	ToImage             string       `json:"toImage,omitempty"`
+	// Generation is the TeamCity generation that started the upgrade.
+	Generation int64 `json:"generation,omitempty"`
+	// RollbackReason and RollbackMessage explain why the upgrade is rolling back.
+	RollbackReason  string `json:"rollbackReason,omitempty"`
+	RollbackMessage string `json:"rollbackMessage,omitempty"`
+	// Paused is true while the upgrade is held by UpgradeControlAnnotationKey.
+	Paused bool `json:"paused,omitempty"`
+	// Held is true while the upgrade waits for stopped nodes, a restore or the approval of a change.
+	// Like a paused one, the stage is timed again from the moment the upgrade goes on.
+	Held bool `json:"held,omitempty"`
+	// Nodes are the secondary nodes restarted by the current batch, NodeStep is how far the batch got.
+	Nodes    []string `json:"nodes,omitempty"`
+	NodeStep string   `json:"nodeStep,omitempty"`
+	// UpgradedNodes are the secondary nodes that already run the new spec.
+	UpgradedNodes []string `json:"upgradedNodes,omitempty"`
+	// MovedResponsibilities are taken from Nodes while they restart.
+	MovedResponsibilities []MovedResponsibility `json:"movedResponsibilities,omitempty"`
+	// PreviousMainTemplate and PreviousSecondaryTemplates are the pod templates of the node StatefulSets before
+	// the upgrade, restored by a rollback.
+	// +kubebuilder:pruning:PreserveUnknownFields
+	// +kubebuilder:validation:Schemaless
+	PreviousMainTemplate *runtime.RawExtension `json:"previousMainTemplate,omitempty"`
+	// +kubebuilder:pruning:PreserveUnknownFields
+	// +kubebuilder:validation:Schemaless
+	PreviousSecondaryTemplates map[string]runtime.RawExtension `json:"previousSecondaryTemplates,omitempty"`
+}
+
+// MovedResponsibility is a responsibility disabled on a secondary node while it restarts.
+type MovedResponsibility struct {
+	Node           string `json:"node"`
+	Responsibility string `json:"responsibility"`
+	// Target is the node that holds the responsibility meanwhile. It is empty when the responsibility was
+	// already enabled on another node, which then keeps it.
+	Target string `json:"target,omitempty"`
+}
+
+// UpgradeHistoryEntry is a finished zero-downtime upgrade.
+type UpgradeHistoryEntry struct {
+	// Phase is Succeeded, Failed or Aborted.
+	Phase UpgradePhase `json:"phase"`
+	// Reason and Message explain a rollback.
+	Reason       string       `json:"reason,omitempty"`
+	Message      string       `json:"message,omitempty"`
+	Generation   int64        `json:"generation,omitempty"`
+	FromImage    string       `json:"fromImage,omitempty"`
+	ToImage      string       `json:"toImage,omitempty"`
+	StartedTime  *metav1.Time `json:"startedTime,omitempty"`
+	FinishedTime *metav1.Time `json:"finishedTime,omitempty"`
+}
+
+// PendingChange is a change of the spec that restarts nodes. It is applied once it is approved.
+type PendingChange struct {
+	// Generation is the TeamCity generation to approve.
+	Generation int64 `json:"generation"`
+	// Nodes are the nodes the change restarts.
+	Nodes []PendingNodeChange `json:"nodes"`
+	// DetectedTime is when the change was first held.
+	DetectedTime *metav1.Time `json:"detectedTime,omitempty"`
+}
+
+type PendingNodeChange struct {
+	Name string `json:"name"`
+	// Fields are the changed fields of the node StatefulSet,
+	// e.g. "spec.template.spec.containers[teamcity-server].image: current=a, desired=b".
+	Fields []string `json:"fields"`
 }
 
+type NodeStatus struct {
+	Name            string `json:"name"`
+	StatefulSetName string `json:"statefulSetName"`
+	Role            string `json:"role"`
+	Image           string `json:"image,omitempty"`
+	Ready           bool   `json:"ready"`
+	CurrentRevision string `json:"currentRevision,omitempty"`
+	UpdateRevision  string `json:"updateRevision,omitempty"`
+}
+
+const (
+	// ConditionReady is True when every node StatefulSet is rolled out and serving.
+	ConditionReady = "Ready"
+	// ConditionProgressing is True while the operator is still converging nodes to the spec.
+	ConditionProgressing = "Progressing"
+	// ConditionDegraded is True when the last reconciliation failed.
+	ConditionDegraded = "Degraded"
+	// ConditionUpgradeInProgress is True while a zero-downtime upgrade checkpoint exists.
+	ConditionUpgradeInProgress = "UpgradeInProgress"
+	// ConditionDatabaseSecretInvalid is True while spec.databaseSecret is missing or lacks a required key.
+	ConditionDatabaseSecretInvalid = "DatabaseSecretInvalid"
+)
+
 //+kubebuilder:object:root=true
 //+kubebuilder:subresource:status
+//+kubebuilder:printcolumn:name="State",type=string,JSONPath=`.status.state`
+//+kubebuilder:printcolumn:name="Ready",type=string,JSONPath=`.status.readyNodes`
+//+kubebuilder:printcolumn:name="Image",type=string,JSONPath=`.status.currentImage`
+//+kubebuilder:printcolumn:name="Age",type=date,JSONPath=`.metadata.creationTimestamp`
 
 // TeamCity is the Schema for the teamcities API
 type TeamCity struct {
@@ -130,9 +482,52 @@ type TeamCity struct {
 const UpdatePolicyAnnotationKey = "teamcity.jetbrains.com/update-policy"
 const ZeroDownTimeAnnotation = "zero-downtime"
 
+// UpgradeStageTimeoutAnnotationKey overrides how long a zero-downtime upgrade may wait for a node to become
+// ready, as a Go duration, e.g. "45m". The upgrade is rolled back when a stage takes longer.
+const UpgradeStageTimeoutAnnotationKey = "teamcity.jetbrains.com/upgrade-stage-timeout"
+
+// UpgradeControlAnnotationKey pauses, resumes or aborts an ongoing zero-downtime upgrade.
+// The operator removes the resume and abort values once they are carried out.
+const UpgradeControlAnnotationKey = "teamcity.jetbrains.com/upgrade-control"
+
+const (
+	UpgradeControlPause  = "pause"
+	UpgradeControlResume = "resume"
+	UpgradeControlAbort  = "abort"
+)
+
+// UpgradeMaxUnavailableAnnotationKey sets how many secondary nodes a zero-downtime upgrade restarts at the same time,
+// as a positive integer. The default is one node at a time.
+const UpgradeMaxUnavailableAnnotationKey = "teamcity.jetbrains.com/upgrade-max-unavailable"
+
+// ChangeApprovalAnnotationKey set to ChangeApprovalRequired holds spec changes that restart nodes in
+// status.pendingChange until ApprovedGenerationAnnotationKey is set to their generation.
+const ChangeApprovalAnnotationKey = "teamcity.jetbrains.com/change-approval"
+const ChangeApprovalRequired = "required"
+
+// ApprovedGenerationAnnotationKey approves the pending change of the TeamCity generation it is set to.
+// The operator removes it once the change is applied.
+const ApprovedGenerationAnnotationKey = "teamcity.jetbrains.com/approved-generation"
+
 const AllowStsRecreateAnnotationKey = "teamcity.jetbrains.com/allow-sts-recreate"
 const AllowStsRecreateAnnotationValue = "true"
 
+// ConfigHashAnnotationKey is set on the node pod templates to status.configHash, unless it is the baseline.
+const ConfigHashAnnotationKey = "teamcity.jetbrains.com/config-hash"
+
+// ReadOnlyReplicaNameSuffix is appended to the main node name for the read-only replica that serves
+// requests while the main node is upgraded. Node names must not end with it.
+const ReadOnlyReplicaNameSuffix = "-update-replica"
+
+// RestoreModeAnnotationKey is managed by the TeamCityRestore controller while a backup is restored into the instance.
+const RestoreModeAnnotationKey = "teamcity.jetbrains.com/restore-mode"
+
+// RestoreModeStopped scales every node to zero so the restore Job has exclusive access to the data directory.
+const RestoreModeStopped = "stopped"
+
+// RestoreModeStarting starts the nodes with a relaxed startup probe, as the first start after a restore may take hours.
+const RestoreModeStarting = "starting"
+
 //+kubebuilder:object:root=true
 
 // TeamCityList contains a list of TeamCity
@@ -154,6 +549,85 @@ func (instance *TeamCity) DatabaseSecretProvided() bool {
 	return instance.Spec.DatabaseSecret.Secret != ""
 }
 
+// ReferencedSecretNames returns the sorted names of the Secrets the node containers read:
+// spec.databaseSecret and the Secrets referenced by the env of the nodes and their init containers.
+func (instance *TeamCity) ReferencedSecretNames() []string {
+	names := map[string]struct{}{}
+	if instance.DatabaseSecretProvided() {
+		names[instance.Spec.DatabaseSecret.Secret] = struct{}{}
+	}
+	instance.visitEnvSources(func(env v1.EnvVar) {
+		if env.ValueFrom != nil && env.ValueFrom.SecretKeyRef != nil {
+			names[env.ValueFrom.SecretKeyRef.Name] = struct{}{}
+		}
+	}, func(envFrom v1.EnvFromSource) {
+		if envFrom.SecretRef != nil {
+			names[envFrom.SecretRef.Name] = struct{}{}
+		}
+	})
+	return sortedKeys(names)
+}
+
+// ReferencedConfigMapNames returns the sorted names of the ConfigMaps the nodes read: the JDBC driver ConfigMap
+// and the ConfigMaps referenced by the env of the nodes and their init containers.
+func (instance *TeamCity) ReferencedConfigMapNames() []string {
+	names := map[string]struct{}{}
+	if driver := instance.Spec.JDBCDriver; driver != nil && driver.ConfigMap != nil {
+		names[driver.ConfigMap.Name] = struct{}{}
+	}
+	instance.visitEnvSources(func(env v1.EnvVar) {
+		if env.ValueFrom != nil && env.ValueFrom.ConfigMapKeyRef != nil {
+			names[env.ValueFrom.ConfigMapKeyRef.Name] = struct{}{}
+		}
+	}, func(envFrom v1.EnvFromSource) {
+		if envFrom.ConfigMapRef != nil {
+			names[envFrom.ConfigMapRef.Name] = struct{}{}
+		}
+	})
+	return sortedKeys(names)
+}
+
+func (instance *TeamCity) visitEnvSources(visitEnv func(v1.EnvVar), visitEnvFrom func(v1.EnvFromSource)) {
+	for _, node := range instance.GetAllNodes() {
+		for _, env := range node.Spec.Env {
+			visitEnv(env)
+		}
+		for _, container := range node.Spec.InitContainers {
+			for _, env := range container.Env {
+				visitEnv(env)
+			}
+			for _, envFrom := range container.EnvFrom {
+				visitEnvFrom(envFrom)
+			}
+		}
+	}
+}
+
+func sortedKeys(set map[string]struct{}) []string {
+	keys := make([]string, 0, len(set))
+	for key := range set {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// UsesManagedDatabase reports whether the operator runs the database of the instance.
+func (instance *TeamCity) UsesManagedDatabase() bool {
+	return instance.Spec.ManagedDatabase != nil
+}
+
+// ManagedDatabaseName names the StatefulSet, Service and credentials Secret of spec.managedDatabase.
+func (instance *TeamCity) ManagedDatabaseName() string {
+	return instance.Name + "-postgresql"
+}
+
+// DatabaseSecretAsFile reports whether the connection settings are written to database.properties
+// instead of being passed as environment variables.
+func (instance *TeamCity) DatabaseSecretAsFile() bool {
+	return instance.DatabaseSecretProvided() && instance.Spec.DatabaseSecret.Delivery == DatabaseSecretDeliveryFile
+}
+
 func (instance *TeamCity) DataDirPath() string {
 	return instance.Spec.DataDirVolumeClaim.VolumeMount.MountPath
 }
@@ -162,6 +636,10 @@ func (instance *TeamCity) GetAllCustomPersistentVolumeClaim() []CustomPersistent
 	return append(instance.Spec.PersistentVolumeClaims, instance.Spec.DataDirVolumeClaim)
 }
 
+func (instance *TeamCity) APITokenSecretProvided() bool {
+	return instance.Spec.APITokenSecret != nil && instance.Spec.APITokenSecret.Name != ""
+}
+
 func (instance *TeamCity) ServiceAccountProvided() bool {
 	return instance.Spec.ServiceAccount.Name != ""
 }
@@ -174,6 +652,80 @@ func (instance *TeamCity) UsesZeroDownTimeUpgradePolicy() bool {
 	return instance.Annotations[UpdatePolicyAnnotationKey] == ZeroDownTimeAnnotation
 }
 
+// UpgradeStageTimeout returns the duration set by UpgradeStageTimeoutAnnotationKey, if it is set and valid.
+func (instance *TeamCity) UpgradeStageTimeout() (time.Duration, bool) {
+	value, ok := instance.Annotations[UpgradeStageTimeoutAnnotationKey]
+	if !ok {
+		return 0, false
+	}
+	timeout, err := time.ParseDuration(value)
+	if err != nil || timeout <= 0 {
+		return 0, false
+	}
+	return timeout, true
+}
+
+// UpgradeMaxUnavailable returns the number of secondary nodes upgraded at the same time,
+// set by UpgradeMaxUnavailableAnnotationKey. It is 1 when the annotation is missing or invalid.
+func (instance *TeamCity) UpgradeMaxUnavailable() int {
+	maxUnavailable, ok := instance.upgradeMaxUnavailable()
+	if !ok {
+		return 1
+	}
+	return maxUnavailable
+}
+
+func (instance *TeamCity) upgradeMaxUnavailable() (int, bool) {
+	value, ok := instance.Annotations[UpgradeMaxUnavailableAnnotationKey]
+	if !ok {
+		return 0, false
+	}
+	maxUnavailable, err := strconv.Atoi(value)
+	if err != nil || maxUnavailable <= 0 {
+		return 0, false
+	}
+	return maxUnavailable, true
+}
+
+// UpgradeRolledBack reports whether the zero-downtime upgrade to the current spec failed or was aborted.
+// The nodes keep running their previous spec until the spec is changed.
+func (instance *TeamCity) UpgradeRolledBack() bool {
+	upgrade := instance.Status.Upgrade
+	return upgrade != nil && (upgrade.Phase == UpgradePhaseFailed || upgrade.Phase == UpgradePhaseAborted) &&
+		upgrade.Generation == instance.Generation
+}
+
+func (instance *TeamCity) RequiresChangeApproval() bool {
+	return instance.Annotations[ChangeApprovalAnnotationKey] == ChangeApprovalRequired
+}
+
+// ChangeApproved reports whether ApprovedGenerationAnnotationKey approves the current generation.
+func (instance *TeamCity) ChangeApproved() bool {
+	return instance.Annotations[ApprovedGenerationAnnotationKey] == strconv.FormatInt(instance.Generation, 10)
+}
+
+func (instance *TeamCity) UpgradeControl() string {
+	return instance.Annotations[UpgradeControlAnnotationKey]
+}
+
+func (instance *TeamCity) InRestoreMode() bool {
+	mode := instance.Annotations[RestoreModeAnnotationKey]
+	return mode == RestoreModeStopped || mode == RestoreModeStarting
+}
+
+func (instance *TeamCity) IsStoppedForRestore() bool {
+	return instance.Annotations[RestoreModeAnnotationKey] == RestoreModeStopped
+}
+
+func (instance *TeamCity) IsHibernating() bool {
+	return instance.Spec.Hibernation != nil && instance.Status.Hibernation != nil && instance.Status.Hibernation.Hibernating
+}
+
+// IsStopped reports whether every node should be scaled to zero, by spec.stopped, a restore or hibernation.
+func (instance *TeamCity) IsStopped() bool {
+	return instance.Spec.Stopped || instance.IsStoppedForRestore() || instance.IsHibernating()
+}
+
 func (instance *TeamCity) AllowsStatefulSetRecreate() bool {
 	return instance.Annotations[AllowStsRecreateAnnotationKey] == AllowStsRecreateAnnotationValue
 }
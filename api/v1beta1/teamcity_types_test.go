@@ -138,6 +138,39 @@ func TestDatabaseSecretProvided(t *testing.T) {
 	}
 }
 
+func TestReferencedSecretAndConfigMapNames(t *testing.T) {
+	secretEnv := func(name string) corev1.EnvVar {
+		return corev1.EnvVar{Name: "SECRET", ValueFrom: &corev1.EnvVarSource{SecretKeyRef: &corev1.SecretKeySelector{
+			LocalObjectReference: corev1.LocalObjectReference{Name: name}, Key: "key"}}}
+	}
+	configMapEnv := func(name string) corev1.EnvVar {
+		return corev1.EnvVar{Name: "CONFIG", ValueFrom: &corev1.EnvVarSource{ConfigMapKeyRef: &corev1.ConfigMapKeySelector{
+			LocalObjectReference: corev1.LocalObjectReference{Name: name}, Key: "key"}}}
+	}
+	instance := TeamCity{
+		Spec: TeamCitySpec{
+			DatabaseSecret: DatabaseSecret{Secret: "database"},
+			MainNode: Node{Name: "main", Spec: NodeSpec{
+				Env: []corev1.EnvVar{secretEnv("main-secret"), configMapEnv("shared-config"), {Name: "PLAIN", Value: "value"}},
+			}},
+			SecondaryNodes: []Node{{Name: "secondary", Spec: NodeSpec{
+				Env: []corev1.EnvVar{secretEnv("database"), configMapEnv("shared-config")},
+				InitContainers: []corev1.Container{{
+					Name: "init",
+					EnvFrom: []corev1.EnvFromSource{
+						{SecretRef: &corev1.SecretEnvSource{LocalObjectReference: corev1.LocalObjectReference{Name: "init-secret"}}},
+						{ConfigMapRef: &corev1.ConfigMapEnvSource{LocalObjectReference: corev1.LocalObjectReference{Name: "init-config"}}},
+					},
+				}},
+			}}},
+		},
+	}
+
+	assert.Equal(t, []string{"database", "init-secret", "main-secret"}, instance.ReferencedSecretNames())
+	assert.Equal(t, []string{"init-config", "shared-config"}, instance.ReferencedConfigMapNames())
+	assert.Empty(t, (&TeamCity{}).ReferencedSecretNames())
+}
+
 func TestDataDirPath(t *testing.T) {
 	instance := TeamCity{
 		Spec: TeamCitySpec{
@@ -293,3 +326,17 @@ func TestUsesZeroDownTimeUpgradePolicy(t *testing.T) {
 		})
 	}
 }
+
+func TestChangeApproved(t *testing.T) {
+	instance := &TeamCity{ObjectMeta: metav1.ObjectMeta{
+		Generation:  4,
+		Annotations: map[string]string{ChangeApprovalAnnotationKey: ChangeApprovalRequired},
+	}}
+	assert.True(t, instance.RequiresChangeApproval())
+	assert.False(t, instance.ChangeApproved())
+
+	instance.Annotations[ApprovedGenerationAnnotationKey] = "3"
+	assert.False(t, instance.ChangeApproved(), "an approval is only valid for its generation")
+	instance.Annotations[ApprovedGenerationAnnotationKey] = "4"
+	assert.True(t, instance.ChangeApproved())
+}
@@ -0,0 +1,116 @@
+package v1beta1
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// ImageVersionAnnotationKey declares the TeamCity version of spec.image, for images referenced by digest
+// or tagged without a version, e.g. "2024.07.3".
+const ImageVersionAnnotationKey = "teamcity.jetbrains.com/image-version"
+
+// AllowDowngradeAnnotationKey lets spec.image move to a TeamCity version with an older data format.
+const AllowDowngradeAnnotationKey = "teamcity.jetbrains.com/allow-downgrade"
+const AllowDowngradeAnnotationValue = "true"
+
+// teamCityVersionPattern matches tags such as 2024.07, 2024.07.3, 2024.07.3-linux-amd64 and 2024.12-EAP2.
+var teamCityVersionPattern = regexp.MustCompile(`(?i)^(\d{4})\.(\d{1,2})(?:\.(\d+))?(?:-(eap|rc)(\d*))?(?:-.*)?$`)
+
+// TeamCityVersion is a TeamCity release. Major.Minor, e.g. 2024.07, is the release that defines the
+// format of the data directory; bugfix releases of the same major release share it.
+type TeamCityVersion struct {
+	Major int
+	Minor int
+	Patch int
+	// PreRelease is e.g. "EAP2" or "RC" for builds published before the release.
+	PreRelease string
+}
+
+// ParseTeamCityVersion parses the version of a TeamCity image tag.
+func ParseTeamCityVersion(tag string) (TeamCityVersion, error) {
+	match := teamCityVersionPattern.FindStringSubmatch(tag)
+	if match == nil {
+		return TeamCityVersion{}, fmt.Errorf("%q is not a TeamCity version such as 2024.07.3", tag)
+	}
+	version := TeamCityVersion{PreRelease: strings.ToUpper(match[4] + match[5])}
+	version.Major, _ = strconv.Atoi(match[1])
+	version.Minor, _ = strconv.Atoi(match[2])
+	if match[3] != "" {
+		version.Patch, _ = strconv.Atoi(match[3])
+	}
+	return version, nil
+}
+
+func (v TeamCityVersion) String() string {
+	version := fmt.Sprintf("%d.%02d", v.Major, v.Minor)
+	if v.Patch > 0 {
+		version += fmt.Sprintf(".%d", v.Patch)
+	}
+	if v.PreRelease != "" {
+		version += "-" + v.PreRelease
+	}
+	return version
+}
+
+// DataFormat is the major release whose data directory format the version uses, e.g. "2024.07".
+// Pre-releases already use the format of their release.
+func (v TeamCityVersion) DataFormat() string {
+	return fmt.Sprintf("%d.%02d", v.Major, v.Minor)
+}
+
+// HasOlderDataFormatThan reports whether the version cannot run on a data directory used by other.
+func (v TeamCityVersion) HasOlderDataFormatThan(other TeamCityVersion) bool {
+	if v.Major != other.Major {
+		return v.Major < other.Major
+	}
+	return v.Minor < other.Minor
+}
+
+// SupportsZeroDowntimeUpgradeTo reports whether nodes running the version can be upgraded to target one at a time,
+// next to nodes that still run the version. TeamCity only supports this between bugfix releases of the same release.
+func (v TeamCityVersion) SupportsZeroDowntimeUpgradeTo(target TeamCityVersion) bool {
+	return v.PreRelease == "" && target.PreRelease == "" && v.DataFormat() == target.DataFormat()
+}
+
+// ImageTag returns the tag of an image reference, or an empty string for untagged images and digests.
+func ImageTag(image string) string {
+	if strings.Contains(image, "@") {
+		return ""
+	}
+	name := image[strings.LastIndex(image, "/")+1:]
+	if idx := strings.LastIndex(name, ":"); idx >= 0 {
+		return name[idx+1:]
+	}
+	return ""
+}
+
+// ImageVersion returns the TeamCity version of spec.image, parsed from the tag. The image-version annotation is only
+// used for digests and tags without a version; when the tag has a version, the annotation must declare the same one.
+func (instance *TeamCity) ImageVersion() (TeamCityVersion, error) {
+	declared := instance.Annotations[ImageVersionAnnotationKey]
+	tag := ImageTag(instance.Spec.Image)
+	tagVersion, tagErr := ParseTeamCityVersion(tag)
+	if tagErr == nil {
+		if declared == "" {
+			return tagVersion, nil
+		}
+		if declaredVersion, err := ParseTeamCityVersion(declared); err != nil || declaredVersion != tagVersion {
+			return TeamCityVersion{}, fmt.Errorf("annotation %s=%q does not match version %s of image %q; remove the annotation or set it to the version of the tag",
+				ImageVersionAnnotationKey, declared, tagVersion, instance.Spec.Image)
+		}
+		return tagVersion, nil
+	}
+	if declared != "" {
+		return ParseTeamCityVersion(declared)
+	}
+	if tag == "" {
+		return TeamCityVersion{}, fmt.Errorf("image %q has no tag; set annotation %s to its TeamCity version", instance.Spec.Image, ImageVersionAnnotationKey)
+	}
+	return TeamCityVersion{}, tagErr
+}
+
+func (instance *TeamCity) AllowsDowngrade() bool {
+	return instance.Annotations[AllowDowngradeAnnotationKey] == AllowDowngradeAnnotationValue
+}
@@ -0,0 +1,85 @@
+package v1beta1
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseTeamCityVersion(t *testing.T) {
+	tests := []struct {
+		tag        string
+		expected   TeamCityVersion
+		dataFormat string
+	}{
+		{tag: "2024.07.3", expected: TeamCityVersion{Major: 2024, Minor: 7, Patch: 3}, dataFormat: "2024.07"},
+		{tag: "2024.07", expected: TeamCityVersion{Major: 2024, Minor: 7}, dataFormat: "2024.07"},
+		{tag: "2023.11.4-linux-amd64", expected: TeamCityVersion{Major: 2023, Minor: 11, Patch: 4}, dataFormat: "2023.11"},
+		{tag: "2024.12-eap2", expected: TeamCityVersion{Major: 2024, Minor: 12, PreRelease: "EAP2"}, dataFormat: "2024.12"},
+		{tag: "2025.03-RC-linux", expected: TeamCityVersion{Major: 2025, Minor: 3, PreRelease: "RC"}, dataFormat: "2025.03"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.tag, func(t *testing.T) {
+			version, err := ParseTeamCityVersion(tt.tag)
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, version)
+			assert.Equal(t, tt.dataFormat, version.DataFormat())
+		})
+	}
+
+	for _, tag := range []string{"latest", "EAP", "24.07", ""} {
+		_, err := ParseTeamCityVersion(tag)
+		assert.Error(t, err, tag)
+	}
+}
+
+func TestHasOlderDataFormatThan(t *testing.T) {
+	v2024_07_3 := TeamCityVersion{Major: 2024, Minor: 7, Patch: 3}
+	assert.True(t, TeamCityVersion{Major: 2024, Minor: 3}.HasOlderDataFormatThan(v2024_07_3))
+	assert.True(t, TeamCityVersion{Major: 2023, Minor: 11}.HasOlderDataFormatThan(v2024_07_3))
+	assert.False(t, TeamCityVersion{Major: 2024, Minor: 7, Patch: 1}.HasOlderDataFormatThan(v2024_07_3), "bugfix releases share the data format")
+	assert.False(t, TeamCityVersion{Major: 2024, Minor: 12, PreRelease: "EAP1"}.HasOlderDataFormatThan(v2024_07_3))
+}
+
+func TestSupportsZeroDowntimeUpgradeTo(t *testing.T) {
+	v2024_07_1 := TeamCityVersion{Major: 2024, Minor: 7, Patch: 1}
+	assert.True(t, v2024_07_1.SupportsZeroDowntimeUpgradeTo(TeamCityVersion{Major: 2024, Minor: 7, Patch: 3}))
+	assert.False(t, v2024_07_1.SupportsZeroDowntimeUpgradeTo(TeamCityVersion{Major: 2024, Minor: 12}))
+	assert.False(t, v2024_07_1.SupportsZeroDowntimeUpgradeTo(TeamCityVersion{Major: 2024, Minor: 7, PreRelease: "RC"}))
+}
+
+func TestImageVersion(t *testing.T) {
+	instance := &TeamCity{}
+	instance.Spec.Image = "registry.local:5000/jetbrains/teamcity-server:2024.07.3"
+	version, err := instance.ImageVersion()
+	require.NoError(t, err)
+	assert.Equal(t, "2024.07.3", version.String())
+
+	instance.Spec.Image = "jetbrains/teamcity-server@sha256:0123"
+	_, err = instance.ImageVersion()
+	assert.ErrorContains(t, err, ImageVersionAnnotationKey)
+
+	instance.Annotations = map[string]string{ImageVersionAnnotationKey: "2024.12"}
+	version, err = instance.ImageVersion()
+	require.NoError(t, err)
+	assert.Equal(t, "2024.12", version.String())
+
+	instance.Spec.Image = "jetbrains/teamcity-server:latest"
+	version, err = instance.ImageVersion()
+	require.NoError(t, err)
+	assert.Equal(t, "2024.12", version.String(), "the annotation applies to tags without a version")
+}
+
+func TestImageVersionPrefersTag(t *testing.T) {
+	instance := &TeamCity{}
+	instance.Spec.Image = "jetbrains/teamcity-server:2024.07.3-linux-amd64"
+	instance.Annotations = map[string]string{ImageVersionAnnotationKey: "2024.07.3"}
+	version, err := instance.ImageVersion()
+	require.NoError(t, err)
+	assert.Equal(t, "2024.07.3", version.String())
+
+	instance.Annotations[ImageVersionAnnotationKey] = "2024.12"
+	_, err = instance.ImageVersion()
+	assert.ErrorContains(t, err, "does not match version 2024.07.3")
+}
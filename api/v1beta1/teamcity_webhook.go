@@ -18,12 +18,23 @@ package v1beta1
 
 import (
 	"fmt"
+	"git.jetbrains.team/tch/teamcity-operator/internal/metadata"
+	"github.com/robfig/cron/v3"
+	v1 "k8s.io/api/core/v1"
+	netv1 "k8s.io/api/networking/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/apimachinery/pkg/util/validation/field"
 	ctrl "sigs.k8s.io/controller-runtime"
 	logf "sigs.k8s.io/controller-runtime/pkg/log"
 	"sigs.k8s.io/controller-runtime/pkg/webhook"
 	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
-	"sigs.k8s.io/structured-merge-diff/v4/typed"
+	"strconv"
 	"strings"
 )
 
@@ -47,6 +58,20 @@ var validSecondaryNodeResponsibilities = []string{
 }
 var validMainNodeResponsibilities = allTeamCityResponsibilities
 
+const (
+	// DefaultDataDirMountPath is where the data directory is mounted when spec.dataDirVolumeClaim.volumeMount is empty.
+	DefaultDataDirMountPath = "/storage"
+	// DefaultManagedDatabaseImage and DefaultManagedDatabaseStorage apply to an empty spec.managedDatabase.
+	DefaultManagedDatabaseImage   = "postgres:16"
+	DefaultManagedDatabaseStorage = "8Gi"
+	// DefaultPostgreSQLDriverVersion is the driver provisioned for spec.managedDatabase without spec.jdbcDriver.
+	DefaultPostgreSQLDriverVersion = "42.7.4"
+	// HeadlessServiceSuffix is appended to the node name for the governing Service created by default.
+	HeadlessServiceSuffix = "-headless"
+
+	defaultServerPort = 8111
+)
+
 // log is for logging in this package.
 var teamcitylog = logf.Log.WithName("teamcity-resource")
 
@@ -60,10 +85,101 @@ func (instance *TeamCity) SetupWebhookWithManager(mgr ctrl.Manager) error {
 
 var _ webhook.Defaulter = &TeamCity{}
 
-// Default implements webhook.Defaulter so a webhook will be registered for the type
+// Default implements webhook.Defaulter so a webhook will be registered for the type.
+// Defaults that change the pod template are only applied on create, so updating an existing TeamCity never restarts nodes.
 func (instance *TeamCity) Default() {
 	teamcitylog.Info("default", "name", instance.Name)
 
+	defaultVolumeMount(&instance.Spec.DataDirVolumeClaim, DefaultDataDirMountPath)
+	for idx := range instance.Spec.PersistentVolumeClaims {
+		defaultVolumeMount(&instance.Spec.PersistentVolumeClaims[idx], "")
+	}
+	defaultManagedDatabase(instance)
+	if !instance.CreationTimestamp.IsZero() {
+		return
+	}
+	if !instance.IsMultiNode() && len(instance.Spec.MainNode.Spec.Responsibilities) == 0 {
+		instance.Spec.MainNode.Spec.Responsibilities = append([]string{}, allTeamCityResponsibilities...)
+	}
+	defaultNode(instance, &instance.Spec.MainNode)
+	for idx := range instance.Spec.SecondaryNodes {
+		defaultNode(instance, &instance.Spec.SecondaryNodes[idx])
+	}
+}
+
+// defaultVolumeMount names the mount after the claim and sets the mount path when one is given.
+func defaultVolumeMount(claim *CustomPersistentVolumeClaim, mountPath string) {
+	if claim.VolumeMount.Name == "" {
+		claim.VolumeMount.Name = claim.Name
+	}
+	if claim.VolumeMount.MountPath == "" {
+		claim.VolumeMount.MountPath = mountPath
+	}
+}
+
+// defaultManagedDatabase points spec.databaseSecret at the credentials generated for spec.managedDatabase,
+// and provisions the PostgreSQL driver unless another one is configured.
+func defaultManagedDatabase(instance *TeamCity) {
+	database := instance.Spec.ManagedDatabase
+	if database == nil {
+		return
+	}
+	if database.Image == "" {
+		database.Image = DefaultManagedDatabaseImage
+	}
+	if database.Storage.IsZero() {
+		database.Storage = resource.MustParse(DefaultManagedDatabaseStorage)
+	}
+	if instance.Spec.DatabaseSecret.Secret == "" {
+		instance.Spec.DatabaseSecret.Secret = instance.ManagedDatabaseName()
+	}
+	if instance.Spec.JDBCDriver == nil {
+		instance.Spec.JDBCDriver = &JDBCDriver{Database: JDBCDatabasePostgreSQL, Version: DefaultPostgreSQLDriverVersion}
+	}
+}
+
+// defaultNode limits the memory of the node to its request, as the heap size is derived from the request,
+// and gives a node without spec.serviceName a headless governing Service.
+func defaultNode(instance *TeamCity, node *Node) {
+	if memory, ok := node.Spec.Requests[v1.ResourceMemory]; ok {
+		if _, limited := node.Spec.Limits[v1.ResourceMemory]; !limited {
+			limits := v1.ResourceList{}
+			for name, quantity := range node.Spec.Limits {
+				limits[name] = quantity
+			}
+			limits[v1.ResourceMemory] = memory.DeepCopy()
+			node.Spec.Limits = limits
+		}
+	}
+
+	if node.Spec.ServiceName != "" {
+		return
+	}
+	node.Spec.ServiceName = node.Name + HeadlessServiceSuffix
+	for _, service := range instance.Spec.ServiceList {
+		if service.Name == node.Spec.ServiceName {
+			return
+		}
+	}
+	port := instance.Spec.TeamCityServerPort.ContainerPort
+	if port == 0 {
+		port = defaultServerPort
+	}
+	instance.Spec.ServiceList = append(instance.Spec.ServiceList, Service{
+		Name: node.Spec.ServiceName,
+		ServiceSpec: v1.ServiceSpec{
+			ClusterIP: v1.ClusterIPNone,
+			Selector:  metadata.GetNodeSelectorLabels(instance.Name, node.Name),
+			Ports: []v1.ServicePort{{
+				Name:       "http",
+				Protocol:   v1.ProtocolTCP,
+				Port:       port,
+				TargetPort: intstr.FromInt(int(port)),
+			}},
+			// the pods resolve before they are ready, so a starting node can already be reached by its DNS name
+			PublishNotReadyAddresses: true,
+		},
+	})
 }
 
 //+kubebuilder:webhook:path=/validate-jetbrains-com-v1beta1-teamcity,mutating=false,failurePolicy=fail,sideEffects=None,groups=jetbrains.com,resources=teamcities,verbs=create;update,versions=v1beta1,name=vv1beta1teamcity.kb.io,admissionReviewVersions=v1
@@ -73,10 +189,7 @@ var _ webhook.Validator = &TeamCity{}
 // ValidateCreate implements webhook.Validator so a webhook will be registered for the type
 func (instance *TeamCity) ValidateCreate() (admission.Warnings, error) {
 	teamcitylog.Info("validate create", "name", instance.Name)
-	if warn, err := validateCommonFields(instance); err != nil {
-		return warn, err
-	}
-	return nil, nil
+	return validateCommonFields(nil, instance)
 }
 
 // ValidateUpdate implements webhook.Validator so a webhook will be registered for the type
@@ -86,11 +199,27 @@ func (instance *TeamCity) ValidateUpdate(old runtime.Object) (admission.Warnings
 	if !ok {
 		return nil, fmt.Errorf("expected a TeamCity object but got %T", old)
 	}
+	// removing the finalizer of a deleted TeamCity must not be blocked by a rule added after it was created,
+	// and neither must any other update that leaves the spec and annotations alone
+	if instance.DeletionTimestamp != nil || !specOrAnnotationsChanged(oldTeamCity, instance) {
+		return nil, nil
+	}
+
+	warn, err := validateCommonFields(oldTeamCity, instance)
+	if err != nil {
+		return nil, err
+	}
 
-	warn, err := validateCommonFields(instance)
+	downgradeWarnings, err := validateImageDowngrade(oldTeamCity, instance)
 	if err != nil {
 		return nil, err
 	}
+	warn = append(warn, downgradeWarnings...)
+	warn = append(warn, validateZeroDowntimeUpgrade(oldTeamCity, instance)...)
+
+	if errs := validateManagedDatabaseRemoval(oldTeamCity, instance); len(errs) > 0 {
+		return nil, apierrors.NewInvalid(GroupVersion.WithKind("TeamCity").GroupKind(), instance.Name, errs)
+	}
 
 	if ServiceNameChangedInSpec(oldTeamCity, instance) {
 		if !instance.AllowsStatefulSetRecreate() {
@@ -117,116 +246,546 @@ func (instance *TeamCity) ValidateDelete() (admission.Warnings, error) {
 	return nil, nil
 }
 
-func validateCommonFields(teamcity *TeamCity) (admission.Warnings, error) {
-	if err := validateRequestsOfAllNodes(teamcity); err != nil {
-		return nil, err
+// specPath is the root of the field paths in validation errors.
+var specPath = field.NewPath("teamcity", "spec")
+
+// validateCommonFields reports every invalid field at once, as an Invalid error listing the field paths.
+// On update, old is the stored TeamCity and the cross-checks of Services are only run when they changed.
+func validateCommonFields(old *TeamCity, teamcity *TeamCity) (admission.Warnings, error) {
+	var errs field.ErrorList
+	errs = append(errs, validateNodes(teamcity)...)
+	errs = append(errs, validateXmxPercentage(teamcity)...)
+	errs = append(errs, validateAllCustomPersistentVolumeClaimsInObject(teamcity)...)
+	errs = append(errs, validateHibernation(teamcity)...)
+	errs = append(errs, validateUpgradeStageTimeout(teamcity)...)
+	errs = append(errs, validateUpgradeControl(teamcity)...)
+	errs = append(errs, validateUpgradeMaxUnavailable(teamcity)...)
+	errs = append(errs, validateChangeApproval(teamcity)...)
+	errs = append(errs, validateImageVersion(teamcity)...)
+	errs = append(errs, validateDatabaseSecret(teamcity)...)
+	errs = append(errs, validateJDBCDriver(teamcity)...)
+	errs = append(errs, validateUniqueNames(specPath.Child("serviceList"), serviceNames(teamcity.Spec.ServiceList))...)
+	errs = append(errs, validateUniqueNames(specPath.Child("ingressList"), ingressNames(teamcity.Spec.IngressList))...)
+
+	var referenceWarnings admission.Warnings
+	if old == nil || serviceReferencesChanged(old, teamcity) {
+		var referenceErrs field.ErrorList
+		referenceWarnings, referenceErrs = validateServiceReferences(teamcity)
+		errs = append(errs, referenceErrs...)
+	}
+
+	responsibilityWarning, responsibilityErrs := validateResponsibilitiesOfAllNodes(teamcity)
+	errs = append(errs, responsibilityErrs...)
+
+	managedDatabaseWarnings, managedDatabaseErrs := validateManagedDatabase(teamcity)
+	errs = append(errs, managedDatabaseErrs...)
+
+	warnings := append(referenceWarnings, managedDatabaseWarnings...)
+	warnings = append(warnings, validateImageTag(teamcity)...)
+	if responsibilityWarning != "" {
+		warnings = append(warnings, responsibilityWarning)
+	}
+	if len(errs) > 0 {
+		return warnings, apierrors.NewInvalid(GroupVersion.WithKind("TeamCity").GroupKind(), teamcity.Name, errs)
+	}
+	return warnings, nil
+}
+
+// validateImageTag warns about a spec.image without a tag or digest. The image is not changed, as the runtime pulls
+// the latest tag for it, which may be a different TeamCity version on every node restart.
+func validateImageTag(teamcity *TeamCity) admission.Warnings {
+	image := teamcity.Spec.Image
+	if image == "" || strings.Contains(image, "@") || ImageTag(image) != "" {
+		return nil
 	}
-	if err := validateXmxPercentage(teamcity); err != nil {
-		return nil, err
+	return admission.Warnings{fmt.Sprintf("spec.image %q has no tag, so every node restart may pull a different TeamCity version. "+
+		"Pin the image to a version tag or digest", image)}
+}
+
+// validateImageDowngrade rejects an image with an older data format than the current one, as TeamCity cannot start
+// on a data directory upgraded by a newer version. Images of unknown versions are allowed with a warning.
+func validateImageDowngrade(old *TeamCity, updated *TeamCity) (admission.Warnings, error) {
+	if old.Spec.Image == updated.Spec.Image && old.Annotations[ImageVersionAnnotationKey] == updated.Annotations[ImageVersionAnnotationKey] {
+		return nil, nil
+	}
+	oldVersion, oldErr := old.ImageVersion()
+	newVersion, newErr := updated.ImageVersion()
+	if oldErr != nil || newErr != nil {
+		return admission.Warnings{fmt.Sprintf("The TeamCity version of spec.image is unknown, so downgrades cannot be prevented. Set annotation %s to the version of the image", ImageVersionAnnotationKey)}, nil
+	}
+	if !newVersion.HasOlderDataFormatThan(oldVersion) {
+		return nil, nil
+	}
+	if updated.AllowsDowngrade() {
+		return admission.Warnings{fmt.Sprintf("spec.image is downgraded from TeamCity %s to %s. It only starts on a data directory that was never upgraded to %s", oldVersion, newVersion, oldVersion.DataFormat())}, nil
+	}
+	return nil, apierrors.NewInvalid(GroupVersion.WithKind("TeamCity").GroupKind(), updated.Name, field.ErrorList{
+		field.Forbidden(specPath.Child("image"), fmt.Sprintf(
+			"TeamCity %s cannot use the data directory of TeamCity %s: the data directory is upgraded to the %s format when a newer version starts, and older versions refuse to start on it. "+
+				"Restore a backup made with %s or older instead, or set annotation %s=%q if the data directory was never upgraded",
+			newVersion, oldVersion, oldVersion.DataFormat(), newVersion.DataFormat(), AllowDowngradeAnnotationKey, AllowDowngradeAnnotationValue)),
+	})
+}
+
+// validateZeroDowntimeUpgrade warns when an image change cannot be rolled out with the zero-downtime policy.
+// The operator then upgrades the way it does without the policy, restarting every node at once.
+func validateZeroDowntimeUpgrade(old *TeamCity, updated *TeamCity) admission.Warnings {
+	if !updated.UsesZeroDownTimeUpgradePolicy() || old.Spec.Image == updated.Spec.Image {
+		return nil
 	}
-	if err := validateAllCustomPersistentVolumeClaimsInObject(teamcity); err != nil {
-		return nil, err
+	oldVersion, oldErr := old.ImageVersion()
+	newVersion, newErr := updated.ImageVersion()
+	if oldErr != nil || newErr != nil {
+		return admission.Warnings{"The TeamCity version of spec.image is unknown, so it cannot be checked whether a zero-downtime upgrade is supported. " +
+			"The operator attempts one; it only works between bugfix releases of the same release"}
 	}
-	if responsibilityWarning, err := validateResponsibilitiesOfAllNodes(teamcity); err != nil || responsibilityWarning != "" {
-		return admission.Warnings{responsibilityWarning}, err
+	if oldVersion.SupportsZeroDowntimeUpgradeTo(newVersion) {
+		return nil
 	}
-	return nil, nil
+	return admission.Warnings{fmt.Sprintf("Zero-downtime upgrades only work between bugfix releases of the same release. "+
+		"The upgrade from TeamCity %s to %s restarts every node instead, and TeamCity is unavailable until the main node has started", oldVersion, newVersion)}
 }
 
-func validateXmxPercentage(teamcity *TeamCity) (err error) {
-	if teamcity.Spec.XmxPercentage <= 0 {
-		return typed.ValidationError{
-			Path:         "teamcity.spec.xmxPercentage",
-			ErrorMessage: "Xmx percentage cannot be set to 0 or lower",
+func validateUpgradeStageTimeout(teamcity *TeamCity) (errs field.ErrorList) {
+	value, ok := teamcity.Annotations[UpgradeStageTimeoutAnnotationKey]
+	if !ok {
+		return nil
+	}
+	if _, valid := teamcity.UpgradeStageTimeout(); !valid {
+		errs = append(errs, field.Invalid(field.NewPath("teamcity", "metadata", "annotations").Key(UpgradeStageTimeoutAnnotationKey), value,
+			"Must be a positive duration, e.g. 45m"))
+	}
+	return errs
+}
+
+func validateUpgradeControl(teamcity *TeamCity) field.ErrorList {
+	value, ok := teamcity.Annotations[UpgradeControlAnnotationKey]
+	if !ok {
+		return nil
+	}
+	switch value {
+	case UpgradeControlPause, UpgradeControlResume, UpgradeControlAbort:
+		return nil
+	default:
+		return field.ErrorList{field.NotSupported(field.NewPath("teamcity", "metadata", "annotations").Key(UpgradeControlAnnotationKey), value,
+			[]string{UpgradeControlPause, UpgradeControlResume, UpgradeControlAbort})}
+	}
+}
+
+func validateUpgradeMaxUnavailable(teamcity *TeamCity) (errs field.ErrorList) {
+	value, ok := teamcity.Annotations[UpgradeMaxUnavailableAnnotationKey]
+	if !ok {
+		return nil
+	}
+	if _, valid := teamcity.upgradeMaxUnavailable(); !valid {
+		errs = append(errs, field.Invalid(field.NewPath("teamcity", "metadata", "annotations").Key(UpgradeMaxUnavailableAnnotationKey), value,
+			"Must be a positive integer"))
+	}
+	return errs
+}
+
+func validateChangeApproval(teamcity *TeamCity) (errs field.ErrorList) {
+	annotationsPath := field.NewPath("teamcity", "metadata", "annotations")
+	if value, ok := teamcity.Annotations[ChangeApprovalAnnotationKey]; ok && value != ChangeApprovalRequired {
+		errs = append(errs, field.NotSupported(annotationsPath.Key(ChangeApprovalAnnotationKey), value, []string{ChangeApprovalRequired}))
+	}
+	if value, ok := teamcity.Annotations[ApprovedGenerationAnnotationKey]; ok {
+		if generation, err := strconv.ParseInt(value, 10, 64); err != nil || generation <= 0 {
+			errs = append(errs, field.Invalid(annotationsPath.Key(ApprovedGenerationAnnotationKey), value,
+				"Must be a positive integer"))
 		}
 	}
+	return errs
+}
+
+// validateImageVersion rejects an image-version annotation that contradicts the version of the image tag.
+func validateImageVersion(teamcity *TeamCity) field.ErrorList {
+	declared, ok := teamcity.Annotations[ImageVersionAnnotationKey]
+	if !ok {
+		return nil
+	}
+	if _, err := ParseTeamCityVersion(ImageTag(teamcity.Spec.Image)); err != nil {
+		return nil
+	}
+	if _, err := teamcity.ImageVersion(); err != nil {
+		return field.ErrorList{field.Invalid(field.NewPath("teamcity", "metadata", "annotations").Key(ImageVersionAnnotationKey), declared,
+			fmt.Sprintf("Must match the version of the spec.image tag %q, or be removed", ImageTag(teamcity.Spec.Image)))}
+	}
 	return nil
 }
 
-func validateRequestsInNode(objectPath string, node Node) (err error) {
-	if len(node.Spec.Requests.Memory().String()) <= 0 {
-		return typed.ValidationError{
-			Path:         fmt.Sprintf("%s.%s", objectPath, "requests.memory"),
-			ErrorMessage: "Requested memory cannot be empty",
+func validateHibernation(teamcity *TeamCity) (errs field.ErrorList) {
+	hibernation := teamcity.Spec.Hibernation
+	if hibernation == nil {
+		return nil
+	}
+	hibernationPath := specPath.Child("hibernation")
+	if _, err := cron.ParseStandard(hibernation.Sleep); err != nil {
+		errs = append(errs, field.Invalid(hibernationPath.Child("sleep"), hibernation.Sleep, fmt.Sprintf("Invalid cron expression: %s", err)))
+	}
+	if _, err := cron.ParseStandard(hibernation.Wake); err != nil {
+		errs = append(errs, field.Invalid(hibernationPath.Child("wake"), hibernation.Wake, fmt.Sprintf("Invalid cron expression: %s", err)))
+	}
+	return errs
+}
+
+// validateDatabaseSecret rejects extra database.properties entries that would be ignored by the environment delivery
+// or that would override the connection settings read from the Secret.
+func validateDatabaseSecret(teamcity *TeamCity) (errs field.ErrorList) {
+	databaseSecret := teamcity.Spec.DatabaseSecret
+	propertiesPath := specPath.Child("databaseSecret", "properties")
+	if len(databaseSecret.Properties) == 0 {
+		return nil
+	}
+	if databaseSecret.Secret == "" {
+		errs = append(errs, field.Required(specPath.Child("databaseSecret", "secret"), "Database properties require a database Secret"))
+	} else if databaseSecret.Delivery != DatabaseSecretDeliveryFile {
+		errs = append(errs, field.Invalid(specPath.Child("databaseSecret", "delivery"), databaseSecret.Delivery,
+			fmt.Sprintf("Database properties are only written with the %q delivery", DatabaseSecretDeliveryFile)))
+	}
+	for _, property := range []string{DatabaseURLProperty, DatabaseUserProperty, DatabasePasswordProperty} {
+		if _, found := databaseSecret.Properties[property]; found {
+			errs = append(errs, field.Forbidden(propertiesPath.Key(property), "The connection settings are read from the database Secret"))
+		}
+	}
+	return errs
+}
+
+// validateManagedDatabase warns that spec.managedDatabase is not meant for production, and rejects database settings
+// and names that conflict with the objects created for it.
+func validateManagedDatabase(teamcity *TeamCity) (warnings admission.Warnings, errs field.ErrorList) {
+	if !teamcity.UsesManagedDatabase() {
+		return nil, nil
+	}
+	warnings = admission.Warnings{"spec.managedDatabase runs a single PostgreSQL instance without backups or high availability. " +
+		"It is meant for development and test instances, not for production"}
+	name := teamcity.ManagedDatabaseName()
+	databaseSecretPath := specPath.Child("databaseSecret")
+	if teamcity.Spec.DatabaseSecret.Secret != name {
+		errs = append(errs, field.Invalid(databaseSecretPath.Child("secret"), teamcity.Spec.DatabaseSecret.Secret,
+			fmt.Sprintf("Must be %q, the Secret generated for spec.managedDatabase", name)))
+	}
+	if teamcity.Spec.DatabaseSecret.Keys != (DatabaseSecretKeys{}) {
+		errs = append(errs, field.Forbidden(databaseSecretPath.Child("keys"), "The Secret generated for spec.managedDatabase uses the default keys"))
+	}
+	for idx, service := range teamcity.Spec.ServiceList {
+		if service.Name == name {
+			errs = append(errs, field.Invalid(specPath.Child("serviceList").Index(idx).Child("name"), service.Name, "Conflicts with the Service of spec.managedDatabase"))
+		}
+	}
+	for _, node := range teamcity.GetAllNodes() {
+		if node.Name == name {
+			errs = append(errs, field.Invalid(specPath.Child("managedDatabase"), name, fmt.Sprintf("The StatefulSet of the database conflicts with node %q", node.Name)))
+		}
+	}
+	return warnings, errs
+}
+
+// validateManagedDatabaseRemoval rejects removing spec.managedDatabase while spec.databaseSecret still points at its
+// credentials. The operator deletes that Secret with the database, and the nodes could not start anymore.
+func validateManagedDatabaseRemoval(old *TeamCity, updated *TeamCity) field.ErrorList {
+	if !old.UsesManagedDatabase() || updated.UsesManagedDatabase() ||
+		updated.Spec.DatabaseSecret.Secret != old.Spec.DatabaseSecret.Secret {
+		return nil
+	}
+	return field.ErrorList{field.Forbidden(specPath.Child("managedDatabase"), fmt.Sprintf(
+		"Removing spec.managedDatabase deletes the database and its credentials Secret %q. "+
+			"Point spec.databaseSecret.secret at the Secret of another database in the same update", old.ManagedDatabaseName()))}
+}
+
+// validateJDBCDriver requires exactly one source of the driver jar.
+func validateJDBCDriver(teamcity *TeamCity) (errs field.ErrorList) {
+	driver := teamcity.Spec.JDBCDriver
+	if driver == nil {
+		return nil
+	}
+	driverPath := specPath.Child("jdbcDriver")
+	var sources []string
+	if driver.Database != "" || driver.Version != "" {
+		sources = append(sources, "database")
+		if driver.Database == "" {
+			errs = append(errs, field.Required(driverPath.Child("database"), "The database of the driver version is required"))
+		}
+		if driver.Version == "" {
+			errs = append(errs, field.Required(driverPath.Child("version"), "The driver version is required"))
+		} else if strings.ContainsAny(driver.Version, "/?#") {
+			errs = append(errs, field.Invalid(driverPath.Child("version"), driver.Version, "Must be a Maven version"))
+		}
+	}
+	if configMap := driver.ConfigMap; configMap != nil {
+		sources = append(sources, "configMap")
+		if configMap.Name == "" {
+			errs = append(errs, field.Required(driverPath.Child("configMap", "name"), ""))
 		}
+		if !strings.HasSuffix(configMap.Key, ".jar") {
+			errs = append(errs, field.Invalid(driverPath.Child("configMap", "key"), configMap.Key, "Must be the file name of a jar"))
+		}
+	}
+	if image := driver.Image; image != nil {
+		sources = append(sources, "image")
+		if image.Image == "" {
+			errs = append(errs, field.Required(driverPath.Child("image", "image"), ""))
+		}
+		if !strings.HasPrefix(image.Path, "/") || !strings.HasSuffix(image.Path, ".jar") {
+			errs = append(errs, field.Invalid(driverPath.Child("image", "path"), image.Path, "Must be the absolute path of a jar"))
+		}
+	}
+	if len(sources) != 1 {
+		errs = append(errs, field.Invalid(driverPath, strings.Join(sources, ", "), "Exactly one of database, configMap and image must be set"))
+	}
+	return errs
+}
+
+func validateXmxPercentage(teamcity *TeamCity) field.ErrorList {
+	if teamcity.Spec.XmxPercentage <= 0 {
+		return field.ErrorList{field.Invalid(specPath.Child("xmxPercentage"), teamcity.Spec.XmxPercentage, "Xmx percentage cannot be set to 0 or lower")}
 	}
 	return nil
 }
 
-func validateAllCustomPersistentVolumeClaimsInObject(teamcity *TeamCity) (err error) {
-	if err = validateCustomPersistentVolumeClaim("teamcity.spec.dataDirVolumeClaim", teamcity.Spec.DataDirVolumeClaim); err != nil {
-		return err
+// validateNodes checks the names and requests of all nodes. Node names become StatefulSet and pod names,
+// so they must be DNS-1123 labels, unique, and must not clash with the read-only replica of an upgrade.
+func validateNodes(teamcity *TeamCity) (errs field.ErrorList) {
+	paths := []*field.Path{specPath.Child("mainNode")}
+	for idx := range teamcity.Spec.SecondaryNodes {
+		paths = append(paths, specPath.Child("secondaryNodes").Index(idx))
 	}
-	for idx, additionalVolumeClaim := range teamcity.Spec.PersistentVolumeClaims {
-		if err = validateCustomPersistentVolumeClaim(fmt.Sprintf("teamcity.spec.persistentVolumeClaims[%d]", idx), additionalVolumeClaim); err != nil {
-			return err
+	nodes := append([]Node{teamcity.Spec.MainNode}, teamcity.Spec.SecondaryNodes...)
+
+	seen := map[string]bool{}
+	for idx, node := range nodes {
+		namePath := paths[idx].Child("name")
+		for _, msg := range validation.IsDNS1123Label(node.Name) {
+			errs = append(errs, field.Invalid(namePath, node.Name, msg))
 		}
+		if strings.HasSuffix(node.Name, ReadOnlyReplicaNameSuffix) {
+			errs = append(errs, field.Invalid(namePath, node.Name,
+				fmt.Sprintf("must not end with %q, which is reserved for the read-only replica of the main node during upgrades", ReadOnlyReplicaNameSuffix)))
+		}
+		if seen[node.Name] {
+			errs = append(errs, field.Duplicate(namePath, node.Name))
+		}
+		seen[node.Name] = true
+		errs = append(errs, validateRequestsInNode(paths[idx].Child("spec"), node)...)
+	}
+	return errs
+}
+
+func validateRequestsInNode(nodeSpecPath *field.Path, node Node) field.ErrorList {
+	if len(node.Spec.Requests.Memory().String()) <= 0 {
+		return field.ErrorList{field.Required(nodeSpecPath.Child("requests", "memory"), "Requested memory cannot be empty")}
 	}
 	return nil
 }
 
-func validateCustomPersistentVolumeClaim(objectPath string, claim CustomPersistentVolumeClaim) error {
-	if len(claim.Name) <= 0 {
-		return typed.ValidationError{
-			Path:         fmt.Sprintf("%s.%s", objectPath, "name"),
-			ErrorMessage: "Claim name is not set",
+// validateAllCustomPersistentVolumeClaimsInObject checks every claim, and that claims, volume mounts and mount paths
+// are unique across the data directory and the additional claims, as they all end up in the same pod.
+func validateAllCustomPersistentVolumeClaimsInObject(teamcity *TeamCity) (errs field.ErrorList) {
+	paths := []*field.Path{specPath.Child("dataDirVolumeClaim")}
+	for idx := range teamcity.Spec.PersistentVolumeClaims {
+		paths = append(paths, specPath.Child("persistentVolumeClaims").Index(idx))
+	}
+	claims := append([]CustomPersistentVolumeClaim{teamcity.Spec.DataDirVolumeClaim}, teamcity.Spec.PersistentVolumeClaims...)
+
+	claimNames := map[string]bool{}
+	mountNames := map[string]bool{}
+	mountPaths := map[string]bool{}
+	for idx, claim := range claims {
+		errs = append(errs, validateCustomPersistentVolumeClaim(paths[idx], claim)...)
+		if claim.Name != "" && claimNames[claim.Name] {
+			errs = append(errs, field.Duplicate(paths[idx].Child("name"), claim.Name))
+		}
+		if claim.VolumeMount.Name != "" && mountNames[claim.VolumeMount.Name] {
+			errs = append(errs, field.Duplicate(paths[idx].Child("volumeMount", "name"), claim.VolumeMount.Name))
 		}
+		if claim.VolumeMount.MountPath != "" && mountPaths[claim.VolumeMount.MountPath] {
+			errs = append(errs, field.Duplicate(paths[idx].Child("volumeMount", "mountPath"), claim.VolumeMount.MountPath))
+		}
+		claimNames[claim.Name] = true
+		mountNames[claim.VolumeMount.Name] = true
+		mountPaths[claim.VolumeMount.MountPath] = true
+	}
+	return errs
+}
+
+func validateCustomPersistentVolumeClaim(claimPath *field.Path, claim CustomPersistentVolumeClaim) (errs field.ErrorList) {
+	if len(claim.Name) <= 0 {
+		errs = append(errs, field.Required(claimPath.Child("name"), "Claim name is not set"))
 	}
 	if len(claim.VolumeMount.Name) <= 0 {
-		return typed.ValidationError{
-			Path:         fmt.Sprintf("%s.%s", objectPath, "volumeMount.name"),
-			ErrorMessage: "Volume mount name is not set",
-		}
+		errs = append(errs, field.Required(claimPath.Child("volumeMount", "name"), "Volume mount name is not set"))
 	}
 	if len(claim.VolumeMount.MountPath) <= 0 {
-		return typed.ValidationError{
-			Path:         fmt.Sprintf("%s.%s", objectPath, "volumeMount.mountPath"),
-			ErrorMessage: "Volume mount path is not set",
+		errs = append(errs, field.Required(claimPath.Child("volumeMount", "mountPath"), "Volume mount path is not set"))
+	}
+	if len(claim.Spec.Resources.Requests.Storage().String()) <= 0 {
+		errs = append(errs, field.Required(claimPath.Child("spec", "resources", "requests", "storage"), "Storage request is not set"))
+	}
+	return errs
+}
+
+func specOrAnnotationsChanged(old *TeamCity, updated *TeamCity) bool {
+	return !equality.Semantic.DeepEqual(old.Spec, updated.Spec) || !equality.Semantic.DeepEqual(old.Annotations, updated.Annotations)
+}
+
+// serviceReferencesChanged reports whether a field validateServiceReferences reads changed.
+func serviceReferencesChanged(old *TeamCity, updated *TeamCity) bool {
+	return !equality.Semantic.DeepEqual(old.Spec.ServiceList, updated.Spec.ServiceList) ||
+		!equality.Semantic.DeepEqual(old.Spec.IngressList, updated.Spec.IngressList) ||
+		!equality.Semantic.DeepEqual(old.Spec.MainNode, updated.Spec.MainNode) ||
+		!equality.Semantic.DeepEqual(old.Spec.SecondaryNodes, updated.Spec.SecondaryNodes) ||
+		!equality.Semantic.DeepEqual(old.Labels, updated.Labels)
+}
+
+// validateServiceReferences cross-checks Ingress backends, Service selectors and node serviceNames. References to
+// objects outside of the TeamCity spec, and selectors matching no node, may be intended and only cause warnings.
+func validateServiceReferences(teamcity *TeamCity) (warnings admission.Warnings, errs field.ErrorList) {
+	services := map[string]Service{}
+	for _, service := range teamcity.Spec.ServiceList {
+		services[service.Name] = service
+	}
+
+	for idx, ingress := range teamcity.Spec.IngressList {
+		ingressSpecPath := specPath.Child("ingressList").Index(idx).Child("spec")
+		if ingress.IngressSpec.DefaultBackend != nil {
+			w, e := validateIngressBackend(ingressSpecPath.Child("defaultBackend"), *ingress.IngressSpec.DefaultBackend, services)
+			warnings, errs = append(warnings, w...), append(errs, e...)
+		}
+		for ruleIdx, rule := range ingress.IngressSpec.Rules {
+			if rule.HTTP == nil {
+				continue
+			}
+			for pathIdx, path := range rule.HTTP.Paths {
+				backendPath := ingressSpecPath.Child("rules").Index(ruleIdx).Child("http", "paths").Index(pathIdx).Child("backend")
+				w, e := validateIngressBackend(backendPath, path.Backend, services)
+				warnings, errs = append(warnings, w...), append(errs, e...)
+			}
 		}
 	}
 
-	if len(claim.Spec.Resources.Requests.Storage().String()) <= 0 {
-		return typed.ValidationError{
-			Path:         fmt.Sprintf("%s.%s", objectPath, "spec.resources.requests.storage"),
-			ErrorMessage: "Storage request is not set",
+	nodes := append([]Node{teamcity.Spec.MainNode}, teamcity.Spec.SecondaryNodes...)
+	for idx, service := range teamcity.Spec.ServiceList {
+		if len(service.ServiceSpec.Selector) == 0 || selectsAnyNode(teamcity, service.ServiceSpec.Selector, nodes) {
+			continue
 		}
+		warnings = append(warnings, fmt.Sprintf("%s: the selector matches no TeamCity node, so the Service has no endpoints",
+			specPath.Child("serviceList").Index(idx).Child("spec", "selector")))
 	}
 
-	return nil
+	nodePaths := []*field.Path{specPath.Child("mainNode")}
+	for idx := range teamcity.Spec.SecondaryNodes {
+		nodePaths = append(nodePaths, specPath.Child("secondaryNodes").Index(idx))
+	}
+	for idx, node := range nodes {
+		if node.Spec.ServiceName == "" {
+			continue
+		}
+		serviceNamePath := nodePaths[idx].Child("spec", "serviceName")
+		service, found := services[node.Spec.ServiceName]
+		if !found {
+			warnings = append(warnings, fmt.Sprintf("%s: Service %q is not in spec.serviceList and must be created separately", serviceNamePath, node.Spec.ServiceName))
+			continue
+		}
+		if service.ServiceSpec.ClusterIP != v1.ClusterIPNone {
+			errs = append(errs, field.Invalid(serviceNamePath, node.Spec.ServiceName,
+				"the governing Service of a node must be headless (clusterIP: None), otherwise its pods get no stable DNS names"))
+		}
+	}
+	return warnings, errs
 }
-func validateRequestsOfAllNodes(teamcity *TeamCity) (err error) {
-	if err := validateRequestsInNode("teamcity.spec.mainNode", teamcity.Spec.MainNode); err != nil {
-		return err
+
+func validateIngressBackend(backendPath *field.Path, backend netv1.IngressBackend, services map[string]Service) (admission.Warnings, field.ErrorList) {
+	if backend.Service == nil {
+		return nil, nil
 	}
-	for idx, secondaryNode := range teamcity.Spec.SecondaryNodes {
-		if err := validateRequestsInNode(fmt.Sprintf("teamcity.spec.secondaryNode[%d]", idx), secondaryNode); err != nil {
-			return err
+	service, found := services[backend.Service.Name]
+	if !found {
+		return admission.Warnings{fmt.Sprintf("%s: Service %q is not in spec.serviceList and must be created separately", backendPath.Child("service", "name"), backend.Service.Name)}, nil
+	}
+	port := backend.Service.Port
+	for _, servicePort := range service.ServiceSpec.Ports {
+		if (port.Name != "" && servicePort.Name == port.Name) || (port.Name == "" && servicePort.Port == port.Number) {
+			return nil, nil
 		}
 	}
-	return err
+	if port.Name != "" {
+		return nil, field.ErrorList{field.NotFound(backendPath.Child("service", "port", "name"), port.Name)}
+	}
+	return nil, field.ErrorList{field.NotFound(backendPath.Child("service", "port", "number"), port.Number)}
 }
 
-func validateResponsibilitiesOfAllNodes(teamcity *TeamCity) (warning string, err error) {
+func selectsAnyNode(teamcity *TeamCity, selector map[string]string, nodes []Node) bool {
+	for idx, node := range nodes {
+		role := "secondary"
+		if idx == 0 {
+			role = "main"
+		}
+		podLabels := metadata.GetStatefulSetLabels(teamcity.Name, node.Name, role, teamcity.Labels)
+		if labels.SelectorFromSet(selector).Matches(labels.Set(podLabels)) {
+			return true
+		}
+	}
+	return false
+}
+
+func validateUniqueNames(listPath *field.Path, names []string) (errs field.ErrorList) {
+	seen := map[string]bool{}
+	for idx, name := range names {
+		if seen[name] {
+			errs = append(errs, field.Duplicate(listPath.Index(idx).Child("name"), name))
+		}
+		seen[name] = true
+	}
+	return errs
+}
+
+func serviceNames(services []Service) (names []string) {
+	for _, service := range services {
+		names = append(names, service.Name)
+	}
+	return names
+}
+
+func ingressNames(ingresses []Ingress) (names []string) {
+	for _, ingress := range ingresses {
+		names = append(names, ingress.Name)
+	}
+	return names
+}
+
+func validateResponsibilitiesOfAllNodes(teamcity *TeamCity) (warning string, errs field.ErrorList) {
+	errs = validateUniqueResponsibilities(specPath.Child("mainNode"), teamcity.Spec.MainNode)
+	for idx, secondaryNode := range teamcity.Spec.SecondaryNodes {
+		errs = append(errs, validateUniqueResponsibilities(specPath.Child("secondaryNodes").Index(idx), secondaryNode)...)
+	}
+
 	//it is allowed to have empty responsibilities for all nodes
 	if allNodesHaveEmptyResponsibility(teamcity.Spec.MainNode, teamcity.Spec.SecondaryNodes) {
-		return "", nil
+		return "", errs
 	}
 
 	//if responsibilities are specified for at least one node, we need to check all of them
-	if err = validateMainNodeResponsibilities("teamcity.spec.mainNode", teamcity.Spec.MainNode, validMainNodeResponsibilities, minimumRequiredMainNodeResponsibilities); err != nil {
-		return "", err
-	}
+	errs = append(errs, validateMainNodeResponsibilities(specPath.Child("mainNode"), teamcity.Spec.MainNode, validMainNodeResponsibilities, minimumRequiredMainNodeResponsibilities)...)
 	for idx, secondaryNode := range teamcity.Spec.SecondaryNodes {
-		if err = validateNodeResponsibilities(fmt.Sprintf("teamcity.spec.secondaryNode[%d]", idx), secondaryNode, validSecondaryNodeResponsibilities); err != nil {
-			return "", err
-		}
+		errs = append(errs, validateNodeResponsibilities(specPath.Child("secondaryNodes").Index(idx), secondaryNode, validSecondaryNodeResponsibilities)...)
+	}
+	if len(errs) > 0 {
+		return "", errs
 	}
 
 	//make sure that all responsibilities are assigned
-	if warning := validatePresenceOfAllResponsibilities(allTeamCityResponsibilities, teamcity.Spec.MainNode, teamcity.Spec.SecondaryNodes); warning != "" {
-		return warning, err
+	return validatePresenceOfAllResponsibilities(allTeamCityResponsibilities, teamcity.Spec.MainNode, teamcity.Spec.SecondaryNodes), nil
+}
+
+func validateUniqueResponsibilities(nodePath *field.Path, node Node) (errs field.ErrorList) {
+	seen := map[string]bool{}
+	for idx, responsibility := range node.Spec.Responsibilities {
+		if seen[responsibility] {
+			errs = append(errs, field.Duplicate(nodePath.Child("spec", "responsibilities").Index(idx), responsibility))
+		}
+		seen[responsibility] = true
 	}
-	return "", nil
+	return errs
 }
 
 func validatePresenceOfAllResponsibilities(allResponsibilities []string, mainNode Node, secondaryNodes []Node) string {
@@ -250,39 +809,30 @@ func getAllResponsibilitiesFromAllNodes(mainNode Node, secondaryNodes []Node) []
 	return responsibilities
 }
 
-func validateMainNodeResponsibilities(objectPath string, node Node, validResponsibilities []string, requiredResponsibilities []string) error {
+func validateMainNodeResponsibilities(nodePath *field.Path, node Node, validResponsibilities []string, requiredResponsibilities []string) field.ErrorList {
 	responsibilities := node.Spec.Responsibilities
+	responsibilitiesPath := nodePath.Child("spec", "responsibilities")
 	if len(responsibilities) < 1 {
-		return typed.ValidationError{
-			Path:         fmt.Sprintf("%s.%s", objectPath, "responsibilities"),
-			ErrorMessage: fmt.Sprintf("Main node cannot have empty responsibilities. Minimum required values are: %s. Valid values are: %s.", strings.Join(requiredResponsibilities, ", "), strings.Join(validResponsibilities, ", ")),
-		}
+		return field.ErrorList{field.Required(responsibilitiesPath,
+			fmt.Sprintf("Main node cannot have empty responsibilities. Minimum required values are: %s. Valid values are: %s.", strings.Join(requiredResponsibilities, ", "), strings.Join(validResponsibilities, ", ")))}
 	}
 	if !areAllElementsAllowed(responsibilities, validResponsibilities) {
-		return typed.ValidationError{
-			Path:         fmt.Sprintf("%s.%s", objectPath, "responsibilities"),
-			ErrorMessage: fmt.Sprintf("Main node does not have valid responsibilities. Minimum required values are: %s. Valid values are: %s", strings.Join(requiredResponsibilities, ", "), strings.Join(validResponsibilities, ", ")),
-		}
+		return field.ErrorList{field.Invalid(responsibilitiesPath, responsibilities,
+			fmt.Sprintf("Main node does not have valid responsibilities. Minimum required values are: %s. Valid values are: %s", strings.Join(requiredResponsibilities, ", "), strings.Join(validResponsibilities, ", ")))}
 	}
 	if !allElementsInOtherSlice(requiredResponsibilities, responsibilities) {
-		return typed.ValidationError{
-			Path:         fmt.Sprintf("%s.%s", objectPath, "responsibilities"),
-			ErrorMessage: fmt.Sprintf("Main node does not have required responsibilities. Minimum required values are: %s", strings.Join(requiredResponsibilities, ", ")),
-		}
+		return field.ErrorList{field.Invalid(responsibilitiesPath, responsibilities,
+			fmt.Sprintf("Main node does not have required responsibilities. Minimum required values are: %s", strings.Join(requiredResponsibilities, ", ")))}
 	}
-
 	return nil
 }
 
-func validateNodeResponsibilities(objectPath string, node Node, validResponsibilities []string) error {
+func validateNodeResponsibilities(nodePath *field.Path, node Node, validResponsibilities []string) field.ErrorList {
 	responsibilities := node.Spec.Responsibilities
 	if !areAllElementsAllowed(responsibilities, validResponsibilities) {
-		return typed.ValidationError{
-			Path:         fmt.Sprintf("%s.%s", objectPath, "responsibilities"),
-			ErrorMessage: fmt.Sprintf("Secondary node does not contain valid responsibilities. Valid values are: %s", strings.Join(validResponsibilities, ", ")),
-		}
+		return field.ErrorList{field.Invalid(nodePath.Child("spec", "responsibilities"), responsibilities,
+			fmt.Sprintf("Secondary node does not contain valid responsibilities. Valid values are: %s", strings.Join(validResponsibilities, ", ")))}
 	}
-
 	return nil
 }
 
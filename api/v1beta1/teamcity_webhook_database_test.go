@@ -0,0 +1,209 @@
+package v1beta1
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+)
+
+func TestValidateCreateDatabaseSecret(t *testing.T) {
+	tests := []struct {
+		name           string
+		databaseSecret DatabaseSecret
+		expectedErrs   []string
+	}{
+		{
+			name:           "accepts custom keys with env delivery",
+			databaseSecret: DatabaseSecret{Secret: "db", Keys: DatabaseSecretKeys{URL: "url", User: "user", Password: "password"}},
+		},
+		{
+			name: "accepts properties with file delivery",
+			databaseSecret: DatabaseSecret{Secret: "db", Delivery: DatabaseSecretDeliveryFile,
+				Properties: map[string]string{"connectionProperties.sslmode": "require", "maxConnections": "50"}},
+		},
+		{
+			name:           "rejects properties with env delivery",
+			databaseSecret: DatabaseSecret{Secret: "db", Properties: map[string]string{"maxConnections": "50"}},
+			expectedErrs:   []string{"teamcity.spec.databaseSecret.delivery"},
+		},
+		{
+			name:           "rejects properties without a Secret",
+			databaseSecret: DatabaseSecret{Delivery: DatabaseSecretDeliveryFile, Properties: map[string]string{"maxConnections": "50"}},
+			expectedErrs:   []string{"teamcity.spec.databaseSecret.secret"},
+		},
+		{
+			name: "rejects properties overriding the connection settings",
+			databaseSecret: DatabaseSecret{Secret: "db", Delivery: DatabaseSecretDeliveryFile,
+				Properties: map[string]string{DatabaseURLProperty: "jdbc:postgresql://other/db", DatabasePasswordProperty: "secret"}},
+			expectedErrs: []string{
+				"teamcity.spec.databaseSecret.properties[connectionUrl]",
+				"teamcity.spec.databaseSecret.properties[connectionProperties.password]",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			instance := validTeamCityForWebhookTest()
+			instance.Spec.DatabaseSecret = tt.databaseSecret
+			_, err := instance.ValidateCreate()
+			if len(tt.expectedErrs) == 0 {
+				require.NoError(t, err)
+				return
+			}
+			require.Error(t, err)
+			for _, expectedErr := range tt.expectedErrs {
+				assert.Contains(t, err.Error(), expectedErr)
+			}
+		})
+	}
+}
+
+func TestDatabaseSecretKeysDefaults(t *testing.T) {
+	assert.Equal(t, []string{DatabaseURLProperty, DatabaseUserProperty, DatabasePasswordProperty}, DatabaseSecretKeys{}.All())
+	assert.Equal(t, []string{"url", DatabaseUserProperty, "pass"}, DatabaseSecretKeys{URL: "url", Password: "pass"}.All())
+}
+
+func TestValidateCreateJDBCDriver(t *testing.T) {
+	tests := []struct {
+		name         string
+		driver       *JDBCDriver
+		expectedErrs []string
+	}{
+		{
+			name:   "accepts a Maven driver",
+			driver: &JDBCDriver{Database: JDBCDatabasePostgreSQL, Version: "42.7.4"},
+		},
+		{
+			name:   "accepts a driver from a ConfigMap",
+			driver: &JDBCDriver{ConfigMap: &JDBCDriverConfigMap{Name: "drivers", Key: "ojdbc11.jar"}},
+		},
+		{
+			name:   "accepts a driver from an image",
+			driver: &JDBCDriver{Image: &JDBCDriverImage{Image: "registry.example.com/jdbc:1", Path: "/drivers/mysql.jar"}},
+		},
+		{
+			name:         "rejects a database without version",
+			driver:       &JDBCDriver{Database: JDBCDatabaseMySQL},
+			expectedErrs: []string{"teamcity.spec.jdbcDriver.version"},
+		},
+		{
+			name:         "rejects a version that is not part of a Maven path",
+			driver:       &JDBCDriver{Database: JDBCDatabaseMySQL, Version: "../9.1.0"},
+			expectedErrs: []string{"teamcity.spec.jdbcDriver.version"},
+		},
+		{
+			name:         "rejects no source",
+			driver:       &JDBCDriver{},
+			expectedErrs: []string{"teamcity.spec.jdbcDriver: Invalid value"},
+		},
+		{
+			name: "rejects several sources",
+			driver: &JDBCDriver{Database: JDBCDatabasePostgreSQL, Version: "42.7.4",
+				ConfigMap: &JDBCDriverConfigMap{Name: "drivers", Key: "postgresql.jar"}},
+			expectedErrs: []string{"Exactly one of database, configMap and image must be set"},
+		},
+		{
+			name:         "rejects files that are not jars",
+			driver:       &JDBCDriver{Image: &JDBCDriverImage{Image: "registry.example.com/jdbc:1", Path: "drivers/mysql.zip"}},
+			expectedErrs: []string{"teamcity.spec.jdbcDriver.image.path"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			instance := validTeamCityForWebhookTest()
+			instance.Spec.JDBCDriver = tt.driver
+			_, err := instance.ValidateCreate()
+			if len(tt.expectedErrs) == 0 {
+				require.NoError(t, err)
+				return
+			}
+			require.Error(t, err)
+			for _, expectedErr := range tt.expectedErrs {
+				assert.Contains(t, err.Error(), expectedErr)
+			}
+		})
+	}
+}
+
+func TestDefaultWiresManagedDatabase(t *testing.T) {
+	instance := validTeamCityForWebhookTest()
+	instance.Spec.ManagedDatabase = &ManagedDatabase{}
+
+	instance.Default()
+
+	assert.Equal(t, "teamcity-postgresql", instance.Spec.DatabaseSecret.Secret)
+	assert.Equal(t, DefaultManagedDatabaseImage, instance.Spec.ManagedDatabase.Image)
+	assert.Equal(t, resource.MustParse(DefaultManagedDatabaseStorage), instance.Spec.ManagedDatabase.Storage)
+	assert.Equal(t, &JDBCDriver{Database: JDBCDatabasePostgreSQL, Version: DefaultPostgreSQLDriverVersion}, instance.Spec.JDBCDriver)
+
+	warnings, err := instance.ValidateCreate()
+	require.NoError(t, err)
+	assert.Contains(t, strings.Join(warnings, "\n"), "not for production")
+}
+
+func TestValidateCreateManagedDatabase(t *testing.T) {
+	tests := []struct {
+		name         string
+		modify       func(instance *TeamCity)
+		expectedErrs []string
+	}{
+		{
+			name: "rejects another database Secret",
+			modify: func(instance *TeamCity) {
+				instance.Spec.DatabaseSecret.Secret = "external-database"
+			},
+			expectedErrs: []string{"teamcity.spec.databaseSecret.secret"},
+		},
+		{
+			name: "rejects custom keys",
+			modify: func(instance *TeamCity) {
+				instance.Spec.DatabaseSecret.Keys = DatabaseSecretKeys{URL: "url"}
+			},
+			expectedErrs: []string{"teamcity.spec.databaseSecret.keys"},
+		},
+		{
+			name: "rejects a Service with the name of the database",
+			modify: func(instance *TeamCity) {
+				instance.Spec.ServiceList = append(instance.Spec.ServiceList, Service{Name: "teamcity-postgresql"})
+			},
+			expectedErrs: []string{"teamcity.spec.serviceList[1].name"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			instance := validTeamCityForWebhookTest()
+			instance.Spec.ManagedDatabase = &ManagedDatabase{}
+			instance.Default()
+			tt.modify(instance)
+			_, err := instance.ValidateCreate()
+			require.Error(t, err)
+			for _, expectedErr := range tt.expectedErrs {
+				assert.Contains(t, err.Error(), expectedErr)
+			}
+		})
+	}
+}
+
+func TestValidateUpdateManagedDatabaseRemoval(t *testing.T) {
+	old := validTeamCityForWebhookTest()
+	old.Spec.ManagedDatabase = &ManagedDatabase{}
+	old.Default()
+
+	updated := old.DeepCopy()
+	updated.Spec.ManagedDatabase = nil
+	updated.Default()
+	_, err := updated.ValidateUpdate(old)
+	fields := validationErrorFields(t, err)
+	assert.Equal(t, field.ErrorTypeForbidden, fields["teamcity.spec.managedDatabase"])
+
+	updated.Spec.DatabaseSecret.Secret = "external-database"
+	_, err = updated.ValidateUpdate(old)
+	assert.NoError(t, err)
+}
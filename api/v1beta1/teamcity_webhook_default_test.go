@@ -0,0 +1,93 @@
+package v1beta1
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestDefaultFillsMinimalTeamCity(t *testing.T) {
+	instance := validTeamCityForWebhookTest()
+	instance.Spec.Image = "jetbrains/teamcity-server"
+	instance.Spec.DataDirVolumeClaim.VolumeMount = corev1.VolumeMount{}
+
+	instance.Default()
+
+	assert.Equal(t, corev1.VolumeMount{Name: "data", MountPath: DefaultDataDirMountPath}, instance.Spec.DataDirVolumeClaim.VolumeMount)
+	assert.Equal(t, "jetbrains/teamcity-server", instance.Spec.Image, "an image without a tag is only warned about")
+	assert.Equal(t, allTeamCityResponsibilities, instance.Spec.MainNode.Spec.Responsibilities)
+	assert.Equal(t, resource.MustParse("1Gi"), instance.Spec.MainNode.Spec.Limits[corev1.ResourceMemory])
+	assert.NotContains(t, instance.Spec.MainNode.Spec.Limits, corev1.ResourceCPU)
+
+	assert.Equal(t, "main-headless", instance.Spec.MainNode.Spec.ServiceName)
+	require.Len(t, instance.Spec.ServiceList, 1)
+	service := instance.Spec.ServiceList[0]
+	assert.Equal(t, "main-headless", service.Name)
+	assert.Equal(t, corev1.ClusterIPNone, service.ServiceSpec.ClusterIP)
+	assert.Equal(t, "main", service.ServiceSpec.Selector["teamcity.jetbrains.com/node-name"])
+	assert.Equal(t, int32(8111), service.ServiceSpec.Ports[0].Port)
+
+	warnings, err := instance.ValidateCreate()
+	assert.NoError(t, err)
+	assert.Contains(t, strings.Join(warnings, "\n"), `spec.image "jetbrains/teamcity-server" has no tag`)
+}
+
+func TestDefaultKeepsExplicitSettings(t *testing.T) {
+	instance := validTeamCityForWebhookTest()
+	instance.Spec.Image = "registry.local:5000/teamcity-server@sha256:0123"
+	instance.Spec.MainNode.Spec.ServiceName = "custom"
+	instance.Spec.MainNode.Spec.Limits = corev1.ResourceList{corev1.ResourceMemory: resource.MustParse("2Gi")}
+	instance.Spec.SecondaryNodes = []Node{{Name: "secondary", Spec: NodeSpec{ServiceName: "custom"}}}
+
+	instance.Default()
+
+	assert.Equal(t, "registry.local:5000/teamcity-server@sha256:0123", instance.Spec.Image)
+	assert.Empty(t, instance.Spec.MainNode.Spec.Responsibilities, "multi-node installs keep their responsibilities")
+	assert.Equal(t, resource.MustParse("2Gi"), instance.Spec.MainNode.Spec.Limits[corev1.ResourceMemory])
+	assert.Empty(t, instance.Spec.ServiceList)
+}
+
+func TestDefaultReusesServiceOfTheSameName(t *testing.T) {
+	instance := validTeamCityForWebhookTest()
+	instance.Spec.ServiceList = []Service{{Name: "main-headless"}}
+
+	instance.Default()
+
+	assert.Equal(t, "main-headless", instance.Spec.MainNode.Spec.ServiceName)
+	assert.Len(t, instance.Spec.ServiceList, 1)
+}
+
+func TestDefaultLeavesExistingTeamCityRunning(t *testing.T) {
+	instance := validTeamCityForWebhookTest()
+	instance.CreationTimestamp = metav1.NewTime(time.Now())
+	instance.Spec.Image = "jetbrains/teamcity-server"
+	instance.Spec.DataDirVolumeClaim.VolumeMount.MountPath = ""
+
+	instance.Default()
+
+	assert.Equal(t, DefaultDataDirMountPath, instance.Spec.DataDirVolumeClaim.VolumeMount.MountPath)
+	assert.Equal(t, "jetbrains/teamcity-server", instance.Spec.Image)
+	assert.Empty(t, instance.Spec.MainNode.Spec.ServiceName)
+	assert.Empty(t, instance.Spec.MainNode.Spec.Responsibilities)
+	assert.Empty(t, instance.Spec.MainNode.Spec.Limits)
+}
+
+func TestValidateImageTag(t *testing.T) {
+	for image, warned := range map[string]bool{
+		"jetbrains/teamcity-server":                       true,
+		"registry.local:5000/teamcity":                    true,
+		"jetbrains/teamcity-server:2024.03":               false,
+		"registry.local:5000/teamcity-server@sha256:0123": false,
+		"": false,
+	} {
+		instance := validTeamCityForWebhookTest()
+		instance.Spec.Image = image
+		assert.Equal(t, warned, len(validateImageTag(instance)) == 1, image)
+	}
+}
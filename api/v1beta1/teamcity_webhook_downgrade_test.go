@@ -0,0 +1,82 @@
+package v1beta1
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+)
+
+func teamCityWithImageForWebhookTest(image string) *TeamCity {
+	instance := validTeamCityForWebhookTest()
+	instance.Spec.Image = image
+	return instance
+}
+
+func TestValidateUpdateRejectsDowngradeAcrossDataFormats(t *testing.T) {
+	old := teamCityWithImageForWebhookTest("jetbrains/teamcity-server:2024.07.3")
+	updated := teamCityWithImageForWebhookTest("jetbrains/teamcity-server:2024.03.3")
+
+	_, err := updated.ValidateUpdate(old)
+	require.Error(t, err)
+	assert.True(t, apierrors.IsInvalid(err))
+	assert.Contains(t, err.Error(), "teamcity.spec.image")
+	assert.Contains(t, err.Error(), "data directory")
+	assert.Contains(t, err.Error(), AllowDowngradeAnnotationKey)
+}
+
+func TestValidateUpdateAllowsUpgradesAndBugfixDowngrades(t *testing.T) {
+	old := teamCityWithImageForWebhookTest("jetbrains/teamcity-server:2024.07.3")
+
+	for _, image := range []string{"jetbrains/teamcity-server:2024.07.1", "jetbrains/teamcity-server:2024.12", "jetbrains/teamcity-server:2025.03-eap1"} {
+		warnings, err := teamCityWithImageForWebhookTest(image).ValidateUpdate(old)
+		assert.NoError(t, err, image)
+		assert.Empty(t, warnings, image)
+	}
+}
+
+func TestValidateUpdateAllowsDowngradeWithAnnotation(t *testing.T) {
+	old := teamCityWithImageForWebhookTest("jetbrains/teamcity-server:2024.07.3")
+	updated := teamCityWithImageForWebhookTest("jetbrains/teamcity-server:2024.03")
+	updated.Annotations = map[string]string{AllowDowngradeAnnotationKey: AllowDowngradeAnnotationValue}
+
+	warnings, err := updated.ValidateUpdate(old)
+	require.NoError(t, err)
+	require.Len(t, warnings, 1)
+	assert.Contains(t, warnings[0], "downgraded from TeamCity 2024.07.3 to 2024.03")
+}
+
+func TestValidateUpdateUsesDeclaredVersionOfDigests(t *testing.T) {
+	old := teamCityWithImageForWebhookTest("jetbrains/teamcity-server@sha256:aaaa")
+	old.Annotations = map[string]string{ImageVersionAnnotationKey: "2024.07"}
+	updated := teamCityWithImageForWebhookTest("jetbrains/teamcity-server@sha256:bbbb")
+	updated.Annotations = map[string]string{ImageVersionAnnotationKey: "2023.11.4"}
+
+	_, err := updated.ValidateUpdate(old)
+	assert.ErrorContains(t, err, "TeamCity 2023.11.4 cannot use the data directory of TeamCity 2024.07")
+}
+
+func TestValidateUpdateWarnsAboutUnknownVersions(t *testing.T) {
+	old := teamCityWithImageForWebhookTest("jetbrains/teamcity-server:2024.07.3")
+	updated := teamCityWithImageForWebhookTest("jetbrains/teamcity-server:latest")
+
+	warnings, err := updated.ValidateUpdate(old)
+	require.NoError(t, err)
+	require.Len(t, warnings, 1)
+	assert.Contains(t, warnings[0], ImageVersionAnnotationKey)
+}
+
+func TestValidateCreateRejectsImageVersionContradictingTheTag(t *testing.T) {
+	instance := teamCityWithImageForWebhookTest("jetbrains/teamcity-server:2024.07.3")
+	instance.Annotations = map[string]string{ImageVersionAnnotationKey: "2024.12"}
+
+	_, err := instance.ValidateCreate()
+	fields := validationErrorFields(t, err)
+	assert.Equal(t, field.ErrorTypeInvalid, fields["teamcity.metadata.annotations[teamcity.jetbrains.com/image-version]"])
+
+	instance.Annotations[ImageVersionAnnotationKey] = "2024.07.3"
+	_, err = instance.ValidateCreate()
+	assert.NoError(t, err)
+}
@@ -0,0 +1,56 @@
+package v1beta1
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidateCreateHibernationSchedules(t *testing.T) {
+	tests := []struct {
+		name        string
+		hibernation *HibernationSpec
+		expectedErr string
+	}{
+		{
+			name:        "accepts valid schedules",
+			hibernation: &HibernationSpec{Sleep: "0 20 * * 1-5", Wake: "0 7 * * 1-5"},
+		},
+		{
+			name:        "rejects invalid sleep schedule",
+			hibernation: &HibernationSpec{Sleep: "every evening", Wake: "0 7 * * 1-5"},
+			expectedErr: "teamcity.spec.hibernation.sleep",
+		},
+		{
+			name:        "rejects invalid wake schedule",
+			hibernation: &HibernationSpec{Sleep: "0 20 * * 1-5", Wake: "0 25 * * *"},
+			expectedErr: "teamcity.spec.hibernation.wake",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			instance := validTeamCityForWebhookTest()
+			instance.Spec.Hibernation = tt.hibernation
+			_, err := instance.ValidateCreate()
+			if tt.expectedErr == "" {
+				require.NoError(t, err)
+				return
+			}
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), tt.expectedErr)
+		})
+	}
+}
+
+func TestIsHibernating(t *testing.T) {
+	instance := validTeamCityForWebhookTest()
+	instance.Status.Hibernation = &HibernationStatus{Hibernating: true}
+	assert.False(t, instance.IsHibernating())
+	assert.False(t, instance.IsStopped())
+
+	instance.Spec.Hibernation = &HibernationSpec{Sleep: "0 20 * * 1-5", Wake: "0 7 * * 1-5"}
+	assert.True(t, instance.IsHibernating())
+	assert.True(t, instance.IsStopped())
+}
@@ -27,6 +27,7 @@ func TestValidateUpdateServiceNameWithAnnotationWarns(t *testing.T) {
 		AllowStsRecreateAnnotationKey: AllowStsRecreateAnnotationValue,
 	}
 	updated.Spec.MainNode.Spec.ServiceName = "headless-svc"
+	updated.Spec.ServiceList = []Service{{Name: "headless-svc", ServiceSpec: corev1.ServiceSpec{ClusterIP: corev1.ClusterIPNone}}}
 
 	warnings, err := updated.ValidateUpdate(old)
 	require.NoError(t, err)
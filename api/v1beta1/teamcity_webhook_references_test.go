@@ -0,0 +1,117 @@
+package v1beta1
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	netv1 "k8s.io/api/networking/v1"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+)
+
+func headlessServiceForWebhookTest(name string, selector map[string]string) Service {
+	return Service{
+		Name: name,
+		ServiceSpec: corev1.ServiceSpec{
+			ClusterIP: corev1.ClusterIPNone,
+			Selector:  selector,
+			Ports:     []corev1.ServicePort{{Name: "http", Port: 8111}},
+		},
+	}
+}
+
+func ingressForWebhookTest(serviceName string, port netv1.ServiceBackendPort) Ingress {
+	pathType := netv1.PathTypePrefix
+	return Ingress{
+		Name: "web",
+		IngressSpec: netv1.IngressSpec{
+			Rules: []netv1.IngressRule{{
+				Host: "teamcity.example.com",
+				IngressRuleValue: netv1.IngressRuleValue{HTTP: &netv1.HTTPIngressRuleValue{
+					Paths: []netv1.HTTPIngressPath{{
+						Path:     "/",
+						PathType: &pathType,
+						Backend:  netv1.IngressBackend{Service: &netv1.IngressServiceBackend{Name: serviceName, Port: port}},
+					}},
+				}},
+			}},
+		},
+	}
+}
+
+func TestValidateCreateAcceptsConsistentServiceReferences(t *testing.T) {
+	instance := validTeamCityForWebhookTest()
+	instance.Spec.ServiceList = []Service{headlessServiceForWebhookTest("web", map[string]string{"app.kubernetes.io/name": "teamcity"})}
+	instance.Spec.MainNode.Spec.ServiceName = "web"
+	instance.Spec.IngressList = []Ingress{ingressForWebhookTest("web", netv1.ServiceBackendPort{Number: 8111})}
+
+	warnings, err := instance.ValidateCreate()
+	require.NoError(t, err)
+	assert.Empty(t, warnings)
+}
+
+func TestValidateCreateRejectsUnknownIngressPorts(t *testing.T) {
+	instance := validTeamCityForWebhookTest()
+	instance.Spec.ServiceList = []Service{headlessServiceForWebhookTest("web", nil)}
+	instance.Spec.IngressList = []Ingress{ingressForWebhookTest("web", netv1.ServiceBackendPort{Name: "https"})}
+
+	_, err := instance.ValidateCreate()
+	fields := validationErrorFields(t, err)
+	assert.Equal(t, field.ErrorTypeNotFound, fields["teamcity.spec.ingressList[0].spec.rules[0].http.paths[0].backend.service.port.name"])
+}
+
+func TestValidateCreateWarnsAboutServicesOutsideTheSpec(t *testing.T) {
+	instance := validTeamCityForWebhookTest()
+	instance.Spec.IngressList = []Ingress{ingressForWebhookTest("external", netv1.ServiceBackendPort{Number: 80})}
+	instance.Spec.MainNode.Spec.ServiceName = "external-headless"
+
+	warnings, err := instance.ValidateCreate()
+	require.NoError(t, err)
+	require.Len(t, warnings, 2)
+	assert.Contains(t, warnings[0], `Service "external" is not in spec.serviceList`)
+	assert.Contains(t, warnings[1], `Service "external-headless" is not in spec.serviceList`)
+}
+
+func TestValidateCreateWarnsAboutSelectorsMatchingNoNode(t *testing.T) {
+	instance := validTeamCityForWebhookTest()
+	instance.Spec.ServiceList = []Service{
+		headlessServiceForWebhookTest("main", map[string]string{"teamcity.jetbrains.com/node-name": "main"}),
+		headlessServiceForWebhookTest("typo", map[string]string{"teamcity.jetbrains.com/node-name": "mian"}),
+	}
+
+	warnings, err := instance.ValidateCreate()
+	require.NoError(t, err)
+	require.Len(t, warnings, 1)
+	assert.Contains(t, warnings[0], "teamcity.spec.serviceList[1].spec.selector")
+}
+
+func TestValidateCreateRejectsNodeServiceThatIsNotHeadless(t *testing.T) {
+	instance := validTeamCityForWebhookTest()
+	service := headlessServiceForWebhookTest("web", nil)
+	service.ServiceSpec.ClusterIP = ""
+	instance.Spec.ServiceList = []Service{service}
+	instance.Spec.MainNode.Spec.ServiceName = "web"
+
+	_, err := instance.ValidateCreate()
+	fields := validationErrorFields(t, err)
+	assert.Equal(t, field.ErrorTypeInvalid, fields["teamcity.spec.mainNode.spec.serviceName"])
+	assert.Contains(t, err.Error(), "headless")
+}
+
+func TestValidateUpdateChecksServiceReferencesOnlyWhenTheyChange(t *testing.T) {
+	old := validTeamCityForWebhookTest()
+	old.Spec.ServiceList = []Service{{Name: "web", ServiceSpec: corev1.ServiceSpec{Ports: []corev1.ServicePort{{Port: 8111}}}}}
+	old.Spec.MainNode.Spec.ServiceName = "web"
+
+	updated := old.DeepCopy()
+	updated.Spec.XmxPercentage = 70
+	_, err := updated.ValidateUpdate(old)
+	assert.NoError(t, err, "a Service accepted by an older operator does not block unrelated updates")
+
+	updated = old.DeepCopy()
+	updated.Spec.ServiceList[0].ServiceSpec.Ports[0].Port = 8112
+	_, err = updated.ValidateUpdate(old)
+	fields := validationErrorFields(t, err)
+	assert.Equal(t, field.ErrorTypeInvalid, fields["teamcity.spec.mainNode.spec.serviceName"])
+}
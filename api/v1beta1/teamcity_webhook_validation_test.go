@@ -0,0 +1,160 @@
+package v1beta1
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+)
+
+func secondaryNodeForWebhookTest(name string) Node {
+	return Node{
+		Name: name,
+		Spec: NodeSpec{Requests: corev1.ResourceList{"memory": resource.MustParse("1Gi")}},
+	}
+}
+
+func additionalClaimForWebhookTest(name string, mountPath string) CustomPersistentVolumeClaim {
+	return CustomPersistentVolumeClaim{
+		Name:        name,
+		VolumeMount: corev1.VolumeMount{Name: name, MountPath: mountPath},
+		Spec: corev1.PersistentVolumeClaimSpec{
+			Resources: corev1.ResourceRequirements{
+				Requests: corev1.ResourceList{corev1.ResourceStorage: resource.MustParse("1Gi")},
+			},
+		},
+	}
+}
+
+// validationErrorFields returns the field path and type of every cause of an Invalid error.
+func validationErrorFields(t *testing.T, err error) map[string]field.ErrorType {
+	var statusErr *apierrors.StatusError
+	require.ErrorAs(t, err, &statusErr)
+	require.True(t, apierrors.IsInvalid(err))
+	fields := map[string]field.ErrorType{}
+	for _, cause := range statusErr.ErrStatus.Details.Causes {
+		fields[cause.Field] = field.ErrorType(cause.Type)
+	}
+	return fields
+}
+
+func TestValidateCreateAcceptsValidTeamCity(t *testing.T) {
+	instance := validTeamCityForWebhookTest()
+	instance.Spec.SecondaryNodes = []Node{secondaryNodeForWebhookTest("secondary")}
+	instance.Spec.PersistentVolumeClaims = []CustomPersistentVolumeClaim{additionalClaimForWebhookTest("cache", "/cache")}
+
+	_, err := instance.ValidateCreate()
+	assert.NoError(t, err)
+}
+
+func TestValidateCreateRejectsInvalidNodeNames(t *testing.T) {
+	instance := validTeamCityForWebhookTest()
+	instance.Spec.SecondaryNodes = []Node{
+		secondaryNodeForWebhookTest("main"),
+		secondaryNodeForWebhookTest("Secondary_Node"),
+		secondaryNodeForWebhookTest("main-update-replica"),
+	}
+
+	_, err := instance.ValidateCreate()
+	fields := validationErrorFields(t, err)
+	assert.Equal(t, field.ErrorTypeDuplicate, fields["teamcity.spec.secondaryNodes[0].name"])
+	assert.Equal(t, field.ErrorTypeInvalid, fields["teamcity.spec.secondaryNodes[1].name"])
+	assert.Equal(t, field.ErrorTypeInvalid, fields["teamcity.spec.secondaryNodes[2].name"])
+	assert.Contains(t, err.Error(), ReadOnlyReplicaNameSuffix)
+}
+
+func TestValidateCreateRejectsDuplicateVolumes(t *testing.T) {
+	instance := validTeamCityForWebhookTest()
+	duplicateClaim := additionalClaimForWebhookTest("data", "/storage")
+	instance.Spec.PersistentVolumeClaims = []CustomPersistentVolumeClaim{duplicateClaim, additionalClaimForWebhookTest("cache", "/storage")}
+
+	_, err := instance.ValidateCreate()
+	fields := validationErrorFields(t, err)
+	assert.Equal(t, field.ErrorTypeDuplicate, fields["teamcity.spec.persistentVolumeClaims[0].name"])
+	assert.Equal(t, field.ErrorTypeDuplicate, fields["teamcity.spec.persistentVolumeClaims[0].volumeMount.name"])
+	assert.Equal(t, field.ErrorTypeDuplicate, fields["teamcity.spec.persistentVolumeClaims[1].volumeMount.mountPath"])
+	assert.NotContains(t, fields, "teamcity.spec.persistentVolumeClaims[1].name")
+}
+
+func TestValidateCreateRejectsDuplicateResponsibilitiesServicesAndIngresses(t *testing.T) {
+	instance := validTeamCityForWebhookTest()
+	instance.Spec.MainNode.Spec.Responsibilities = append(append([]string{}, allTeamCityResponsibilities...), "MAIN_NODE")
+	instance.Spec.ServiceList = []Service{{Name: "web"}, {Name: "web"}}
+	instance.Spec.IngressList = []Ingress{{Name: "web"}, {Name: "web"}}
+
+	_, err := instance.ValidateCreate()
+	fields := validationErrorFields(t, err)
+	assert.Equal(t, field.ErrorTypeDuplicate, fields["teamcity.spec.mainNode.spec.responsibilities[5]"])
+	assert.Equal(t, field.ErrorTypeDuplicate, fields["teamcity.spec.serviceList[1].name"])
+	assert.Equal(t, field.ErrorTypeDuplicate, fields["teamcity.spec.ingressList[1].name"])
+}
+
+func TestValidateCreateReportsEveryError(t *testing.T) {
+	instance := validTeamCityForWebhookTest()
+	instance.Spec.XmxPercentage = 0
+	instance.Spec.DataDirVolumeClaim.VolumeMount.MountPath = ""
+	instance.Spec.Hibernation = &HibernationSpec{Sleep: "never", Wake: "0 7 * * *"}
+
+	_, err := instance.ValidateCreate()
+	fields := validationErrorFields(t, err)
+	assert.Len(t, fields, 3)
+	assert.Equal(t, field.ErrorTypeInvalid, fields["teamcity.spec.xmxPercentage"])
+	assert.Equal(t, field.ErrorTypeRequired, fields["teamcity.spec.dataDirVolumeClaim.volumeMount.mountPath"])
+	assert.Equal(t, field.ErrorTypeInvalid, fields["teamcity.spec.hibernation.sleep"])
+}
+
+func TestValidateCreateReturnsResponsibilityWarning(t *testing.T) {
+	instance := validTeamCityForWebhookTest()
+	instance.Spec.MainNode.Spec.Responsibilities = minimumRequiredMainNodeResponsibilities
+
+	warnings, err := instance.ValidateCreate()
+	require.NoError(t, err)
+	require.Len(t, warnings, 1)
+	assert.Contains(t, warnings[0], "Not all responsibilities")
+}
+
+func TestValidateCreateRejectsInvalidChangeApproval(t *testing.T) {
+	instance := validTeamCityForWebhookTest()
+	instance.Annotations = map[string]string{
+		ChangeApprovalAnnotationKey:     "always",
+		ApprovedGenerationAnnotationKey: "latest",
+	}
+
+	_, err := instance.ValidateCreate()
+	assert.Equal(t, map[string]field.ErrorType{
+		"teamcity.metadata.annotations[teamcity.jetbrains.com/change-approval]":     field.ErrorTypeNotSupported,
+		"teamcity.metadata.annotations[teamcity.jetbrains.com/approved-generation]": field.ErrorTypeInvalid,
+	}, validationErrorFields(t, err))
+
+	instance.Annotations[ChangeApprovalAnnotationKey] = ChangeApprovalRequired
+	instance.Annotations[ApprovedGenerationAnnotationKey] = "4"
+	_, err = instance.ValidateCreate()
+	assert.NoError(t, err)
+}
+
+func TestValidateUpdateSkipsDeletedAndMetadataOnlyUpdates(t *testing.T) {
+	old := validTeamCityForWebhookTest()
+	old.Spec.MainNode.Name = "Invalid_Name"
+
+	deleted := old.DeepCopy()
+	now := metav1.Now()
+	deleted.DeletionTimestamp = &now
+	deleted.Finalizers = nil
+	_, err := deleted.ValidateUpdate(old)
+	assert.NoError(t, err, "removing the finalizer of a deleted TeamCity is never blocked")
+
+	relabeled := old.DeepCopy()
+	relabeled.Labels = map[string]string{"team": "ci"}
+	_, err = relabeled.ValidateUpdate(old)
+	assert.NoError(t, err)
+
+	changed := old.DeepCopy()
+	changed.Spec.XmxPercentage = 70
+	_, err = changed.ValidateUpdate(old)
+	assert.Error(t, err)
+}
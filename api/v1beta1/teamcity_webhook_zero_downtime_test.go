@@ -0,0 +1,111 @@
+package v1beta1
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func zeroDowntimeTeamCityForWebhookTest(image string) *TeamCity {
+	instance := teamCityWithImageForWebhookTest(image)
+	instance.Annotations = map[string]string{UpdatePolicyAnnotationKey: ZeroDownTimeAnnotation}
+	return instance
+}
+
+func TestValidateUpdateAcceptsZeroDowntimeBugfixUpgrade(t *testing.T) {
+	old := zeroDowntimeTeamCityForWebhookTest("jetbrains/teamcity-server:2024.07.1")
+	updated := zeroDowntimeTeamCityForWebhookTest("jetbrains/teamcity-server:2024.07.3")
+
+	warnings, err := updated.ValidateUpdate(old)
+	require.NoError(t, err)
+	assert.Empty(t, warnings)
+}
+
+func TestValidateUpdateWarnsAboutRestartingMajorUpgrade(t *testing.T) {
+	old := zeroDowntimeTeamCityForWebhookTest("jetbrains/teamcity-server:2024.07.3")
+	updated := zeroDowntimeTeamCityForWebhookTest("jetbrains/teamcity-server:2024.12")
+
+	warnings, err := updated.ValidateUpdate(old)
+	require.NoError(t, err)
+	require.Len(t, warnings, 1)
+	assert.Contains(t, warnings[0], "from TeamCity 2024.07.3 to 2024.12 restarts every node")
+}
+
+func TestValidateUpdateSkipsZeroDowntimeCheckWithoutPolicy(t *testing.T) {
+	old := teamCityWithImageForWebhookTest("jetbrains/teamcity-server:2024.07.3")
+	updated := teamCityWithImageForWebhookTest("jetbrains/teamcity-server:2024.12")
+
+	warnings, err := updated.ValidateUpdate(old)
+	require.NoError(t, err)
+	assert.Empty(t, warnings)
+}
+
+func TestValidateUpgradeStageTimeout(t *testing.T) {
+	tests := []struct {
+		name    string
+		timeout string
+		valid   bool
+	}{
+		{"duration", "45m", true},
+		{"hours and minutes", "1h30m", true},
+		{"missing unit", "45", false},
+		{"zero", "0s", false},
+		{"negative", "-10m", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			instance := zeroDowntimeTeamCityForWebhookTest("jetbrains/teamcity-server:2024.07.3")
+			instance.Annotations[UpgradeStageTimeoutAnnotationKey] = tt.timeout
+
+			errs := validateUpgradeStageTimeout(instance)
+			if tt.valid {
+				assert.Empty(t, errs)
+			} else {
+				require.Len(t, errs, 1)
+				assert.Contains(t, errs[0].Field, UpgradeStageTimeoutAnnotationKey)
+			}
+		})
+	}
+}
+
+func TestValidateUpgradeControl(t *testing.T) {
+	for _, control := range []string{UpgradeControlPause, UpgradeControlResume, UpgradeControlAbort} {
+		instance := zeroDowntimeTeamCityForWebhookTest("jetbrains/teamcity-server:2024.07.3")
+		instance.Annotations[UpgradeControlAnnotationKey] = control
+		assert.Empty(t, validateUpgradeControl(instance), control)
+	}
+
+	instance := zeroDowntimeTeamCityForWebhookTest("jetbrains/teamcity-server:2024.07.3")
+	instance.Annotations[UpgradeControlAnnotationKey] = "cancel"
+	errs := validateUpgradeControl(instance)
+	require.Len(t, errs, 1)
+	assert.Contains(t, errs[0].Error(), "supported values")
+}
+
+func TestValidateUpgradeMaxUnavailable(t *testing.T) {
+	tests := []struct {
+		name           string
+		maxUnavailable string
+		valid          bool
+	}{
+		{"one node", "1", true},
+		{"several nodes", "3", true},
+		{"zero", "0", false},
+		{"percentage", "50%", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			instance := zeroDowntimeTeamCityForWebhookTest("jetbrains/teamcity-server:2024.07.3")
+			instance.Annotations[UpgradeMaxUnavailableAnnotationKey] = tt.maxUnavailable
+
+			errs := validateUpgradeMaxUnavailable(instance)
+			if tt.valid {
+				assert.Empty(t, errs)
+			} else {
+				require.Len(t, errs, 1)
+				assert.Equal(t, 1, instance.UpgradeMaxUnavailable())
+			}
+		})
+	}
+}
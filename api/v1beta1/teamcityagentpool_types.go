@@ -0,0 +1,139 @@
+package v1beta1
+
+import (
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// TeamCityAgentPoolSpec defines a group of identical build agents connected to a TeamCity instance.
+type TeamCityAgentPoolSpec struct {
+	// TeamCityRef is the name of the TeamCity resource in the same namespace.
+	TeamCityRef string `json:"teamCityRef"`
+
+	// Replicas is the number of agents, unless Autoscaling is set. The agents are scaled to zero while the TeamCity is stopped.
+	// +kubebuilder:default:=1
+	// +kubebuilder:validation:Minimum=0
+	Replicas *int32 `json:"replicas,omitempty"`
+
+	// +kubebuilder:default:="jetbrains/teamcity-agent"
+	Image string `json:"image,omitempty"`
+
+	// ServerURL the agents connect to. Defaults to the URL of ServiceName.
+	ServerURL string `json:"serverURL,omitempty"`
+	// ServiceName is a Service of spec.serviceList of the TeamCity the agents connect through.
+	// Defaults to the main node, the same way the operator reaches the REST API.
+	ServiceName string `json:"serviceName,omitempty"`
+
+	Requests v1.ResourceList `json:"requests,omitempty"`
+	Limits   v1.ResourceList `json:"limits,omitempty"`
+	Env      []v1.EnvVar     `json:"env,omitempty"`
+
+	NodeSelector       map[string]string      `json:"nodeSelector,omitempty"`
+	Affinity           *v1.Affinity           `json:"affinity,omitempty"`
+	Tolerations        []v1.Toleration        `json:"tolerations,omitempty"`
+	PodSecurityContext *v1.PodSecurityContext `json:"podSecurityContext,omitempty"`
+	ServiceAccountName string                 `json:"serviceAccountName,omitempty"`
+
+	// WorkVolumeClaim keeps the work directory of every agent on its own claim, so checkouts survive restarts.
+	// The agents then run as a StatefulSet instead of a Deployment. The claim template cannot be changed later.
+	WorkVolumeClaim *v1.PersistentVolumeClaimSpec `json:"workVolumeClaim,omitempty"`
+	// TempSizeLimit limits the emptyDir used as the temp directory of every agent.
+	TempSizeLimit *resource.Quantity `json:"tempSizeLimit,omitempty"`
+
+	// Authorization authorizes the agents through the REST API. It requires spec.apiTokenSecret of the TeamCity.
+	Authorization *AgentAuthorization `json:"authorization,omitempty"`
+
+	// Autoscaling scales the agents with the builds queued for spec.authorization.pool, which it requires.
+	// It also requires spec.apiTokenSecret of the TeamCity.
+	Autoscaling *AgentAutoscaling `json:"autoscaling,omitempty"`
+}
+
+// AgentAutoscaling scales the agents to the builds queued for spec.authorization.pool plus the agents running a build.
+// Builds queued for other agent pools are not counted, as the agents could not run them.
+type AgentAutoscaling struct {
+	// +kubebuilder:validation:Minimum=0
+	MinReplicas int32 `json:"minReplicas,omitempty"`
+	// +kubebuilder:validation:Minimum=1
+	MaxReplicas int32 `json:"maxReplicas"`
+	// ScaleDownDelay is the cool-down after the last scaling before idle agents are removed.
+	// +kubebuilder:default:="10m"
+	ScaleDownDelay *metav1.Duration `json:"scaleDownDelay,omitempty"`
+}
+
+type AgentAuthorization struct {
+	// Pool is the name of a TeamCity agent pool the agents are moved to. Empty keeps the server's default pool.
+	Pool string `json:"pool,omitempty"`
+}
+
+// TeamCityAgentPoolStatus defines the observed state of TeamCityAgentPool
+type TeamCityAgentPoolStatus struct {
+	// WorkloadKind is Deployment or StatefulSet.
+	WorkloadKind  string `json:"workloadKind,omitempty"`
+	ServerURL     string `json:"serverURL,omitempty"`
+	Replicas      int32  `json:"replicas,omitempty"`
+	ReadyReplicas int32  `json:"readyReplicas,omitempty"`
+
+	// AuthorizedAgents are the names of the agents authorized by the operator. They are unauthorized again once
+	// their pod is gone, so removed agents do not keep agent licenses.
+	AuthorizedAgents []string `json:"authorizedAgents,omitempty"`
+
+	// Autoscaling reports the last decision of spec.autoscaling.
+	Autoscaling *AgentAutoscalingStatus `json:"autoscaling,omitempty"`
+
+	Message string `json:"message,omitempty"`
+}
+
+type AgentAutoscalingStatus struct {
+	// DesiredReplicas is the number of agents the workload is scaled to.
+	DesiredReplicas int32 `json:"desiredReplicas"`
+	QueuedBuilds    int32 `json:"queuedBuilds"`
+	// BusyAgents is the number of agents of the pool running a build.
+	BusyAgents int32 `json:"busyAgents"`
+	// LastScaleTime is when DesiredReplicas last changed.
+	LastScaleTime *metav1.Time `json:"lastScaleTime,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+//+kubebuilder:subresource:status
+//+kubebuilder:printcolumn:name="TeamCity",type=string,JSONPath=`.spec.teamCityRef`
+//+kubebuilder:printcolumn:name="Kind",type=string,JSONPath=`.status.workloadKind`
+//+kubebuilder:printcolumn:name="Replicas",type=integer,JSONPath=`.status.replicas`
+//+kubebuilder:printcolumn:name="Ready",type=integer,JSONPath=`.status.readyReplicas`
+//+kubebuilder:printcolumn:name="Queued",type=integer,JSONPath=`.status.autoscaling.queuedBuilds`,priority=1
+//+kubebuilder:printcolumn:name="Age",type=date,JSONPath=`.metadata.creationTimestamp`
+
+// TeamCityAgentPool is the Schema for the teamcityagentpools API
+type TeamCityAgentPool struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   TeamCityAgentPoolSpec   `json:"spec,omitempty"`
+	Status TeamCityAgentPoolStatus `json:"status,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+
+// TeamCityAgentPoolList contains a list of TeamCityAgentPool
+type TeamCityAgentPoolList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []TeamCityAgentPool `json:"items"`
+}
+
+func (pool *TeamCityAgentPool) GetTeamCityNamespacedName() types.NamespacedName {
+	return types.NamespacedName{
+		Name:      pool.Spec.TeamCityRef,
+		Namespace: pool.Namespace,
+	}
+}
+
+// UsesStatefulSet reports whether the agents need a stable identity for their work volume claims.
+func (pool *TeamCityAgentPool) UsesStatefulSet() bool {
+	return pool.Spec.WorkVolumeClaim != nil
+}
+
+func init() {
+	SchemeBuilder.Register(&TeamCityAgentPool{}, &TeamCityAgentPoolList{})
+}
@@ -0,0 +1,111 @@
+package v1beta1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// TeamCityBackupSpec defines which TeamCity instance is backed up and what the backup contains.
+type TeamCityBackupSpec struct {
+	// TeamCityRef is the name of the TeamCity resource in the same namespace.
+	TeamCityRef string `json:"teamCityRef"`
+
+	TeamCityBackupOptions `json:",inline"`
+}
+
+// TeamCityBackupOptions map to the parameters of the TeamCity REST API backup endpoint.
+type TeamCityBackupOptions struct {
+	// FileName is the backup file name prefix. The file is written to <data dir>/backup.
+	// +kubebuilder:default:="TeamCity_Backup"
+	FileName string `json:"fileName,omitempty"`
+	// AddTimestamp appends the server time to FileName.
+	// +kubebuilder:default:=true
+	// +optional
+	AddTimestamp bool `json:"addTimestamp"`
+
+	// +kubebuilder:default:=true
+	// +optional
+	IncludeConfigs bool `json:"includeConfigs"`
+	// +kubebuilder:default:=true
+	// +optional
+	IncludeDatabase bool `json:"includeDatabase"`
+	// +kubebuilder:default:=false
+	IncludeBuildLogs bool `json:"includeBuildLogs,omitempty"`
+	// +kubebuilder:default:=false
+	IncludePersonalChanges bool `json:"includePersonalChanges,omitempty"`
+	// +kubebuilder:default:=false
+	IncludeRunningBuilds bool `json:"includeRunningBuilds,omitempty"`
+	// IncludeSupplimentaryData keeps the spelling of the server parameter.
+	// +kubebuilder:default:=false
+	IncludeSupplimentaryData bool `json:"includeSupplimentaryData,omitempty"`
+}
+
+type BackupPhase string
+
+const (
+	// BackupPhasePending means the backup has not been started yet, e.g. while another backup is running on the server.
+	BackupPhasePending BackupPhase = "Pending"
+	// BackupPhaseRunning means the server accepted the backup and is writing the file.
+	BackupPhaseRunning BackupPhase = "Running"
+	// BackupPhaseSucceeded means the server finished the backup and the file exists.
+	BackupPhaseSucceeded BackupPhase = "Succeeded"
+	// BackupPhaseFailed means the server rejected or did not finish the backup.
+	BackupPhaseFailed BackupPhase = "Failed"
+)
+
+// TeamCityBackupStatus defines the observed state of TeamCityBackup
+type TeamCityBackupStatus struct {
+	Phase   BackupPhase `json:"phase,omitempty"`
+	Message string      `json:"message,omitempty"`
+
+	// FileName is the name of the backup file reported by the server.
+	FileName string `json:"fileName,omitempty"`
+	// Size of the backup file in bytes, when the server reports it.
+	Size int64 `json:"size,omitempty"`
+
+	StartTime      *metav1.Time `json:"startTime,omitempty"`
+	CompletionTime *metav1.Time `json:"completionTime,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+//+kubebuilder:subresource:status
+//+kubebuilder:printcolumn:name="TeamCity",type=string,JSONPath=`.spec.teamCityRef`
+//+kubebuilder:printcolumn:name="Phase",type=string,JSONPath=`.status.phase`
+//+kubebuilder:printcolumn:name="File",type=string,JSONPath=`.status.fileName`
+//+kubebuilder:printcolumn:name="Age",type=date,JSONPath=`.metadata.creationTimestamp`
+
+// TeamCityBackup is the Schema for the teamcitybackups API
+type TeamCityBackup struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   TeamCityBackupSpec   `json:"spec,omitempty"`
+	Status TeamCityBackupStatus `json:"status,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+
+// TeamCityBackupList contains a list of TeamCityBackup
+type TeamCityBackupList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []TeamCityBackup `json:"items"`
+}
+
+func (backup *TeamCityBackup) GetTeamCityNamespacedName() types.NamespacedName {
+	return types.NamespacedName{
+		Name:      backup.Spec.TeamCityRef,
+		Namespace: backup.Namespace,
+	}
+}
+
+func (backup *TeamCityBackup) IsFinished() bool {
+	return backup.Status.Phase == BackupPhaseSucceeded || backup.Status.Phase == BackupPhaseFailed
+}
+
+func init() {
+	SchemeBuilder.Register(&TeamCityBackup{}, &TeamCityBackupList{})
+}
+
+// BackupScheduleLabelKey is set on TeamCityBackups created by a TeamCityBackupSchedule to the name of the schedule.
+const BackupScheduleLabelKey = "teamcity.jetbrains.com/backup-schedule"
@@ -0,0 +1,95 @@
+package v1beta1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// TeamCityBackupScheduleSpec defines when backups of a TeamCity instance are taken and how many are kept.
+type TeamCityBackupScheduleSpec struct {
+	// TeamCityRef is the name of the TeamCity resource in the same namespace.
+	TeamCityRef string `json:"teamCityRef"`
+
+	// Schedule is a standard five-field cron expression or a descriptor such as @daily.
+	// Prefix it with CRON_TZ=<zone> to evaluate it in a time zone other than the operator's.
+	Schedule string `json:"schedule"`
+
+	// Suspend stops creating new backups. Retention still applies to existing ones.
+	Suspend bool `json:"suspend,omitempty"`
+
+	// +kubebuilder:default:={}
+	Retention BackupRetention `json:"retention,omitempty"`
+
+	// +kubebuilder:default:={}
+	BackupTemplate TeamCityBackupOptions `json:"backupTemplate,omitempty"`
+}
+
+// BackupRetention limits the successful backups kept by a schedule. Older backup files are deleted
+// from the data directory together with their TeamCityBackup.
+type BackupRetention struct {
+	// Count is the number of successful backups to keep.
+	// +kubebuilder:default:=7
+	// +kubebuilder:validation:Minimum:=1
+	Count int32 `json:"count,omitempty"`
+	// MaxAge deletes successful backups older than the given duration, e.g. 720h. The newest successful backup is always kept.
+	MaxAge *metav1.Duration `json:"maxAge,omitempty"`
+	// FailedCount is the number of failed TeamCityBackups to keep for inspection.
+	// +kubebuilder:default:=3
+	// +kubebuilder:validation:Minimum:=0
+	FailedCount int32 `json:"failedCount,omitempty"`
+}
+
+// TeamCityBackupScheduleStatus defines the observed state of TeamCityBackupSchedule
+type TeamCityBackupScheduleStatus struct {
+	Message string `json:"message,omitempty"`
+
+	// Active lists TeamCityBackups of this schedule that did not finish yet.
+	Active []string `json:"active,omitempty"`
+
+	LastScheduleTime *metav1.Time `json:"lastScheduleTime,omitempty"`
+	NextScheduleTime *metav1.Time `json:"nextScheduleTime,omitempty"`
+
+	LastSuccessfulTime   *metav1.Time `json:"lastSuccessfulTime,omitempty"`
+	LastSuccessfulBackup string       `json:"lastSuccessfulBackup,omitempty"`
+
+	LastFailureTime    *metav1.Time `json:"lastFailureTime,omitempty"`
+	LastFailedBackup   string       `json:"lastFailedBackup,omitempty"`
+	LastFailureMessage string       `json:"lastFailureMessage,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+//+kubebuilder:subresource:status
+//+kubebuilder:printcolumn:name="TeamCity",type=string,JSONPath=`.spec.teamCityRef`
+//+kubebuilder:printcolumn:name="Schedule",type=string,JSONPath=`.spec.schedule`
+//+kubebuilder:printcolumn:name="Suspend",type=boolean,JSONPath=`.spec.suspend`
+//+kubebuilder:printcolumn:name="Last Success",type=date,JSONPath=`.status.lastSuccessfulTime`
+//+kubebuilder:printcolumn:name="Age",type=date,JSONPath=`.metadata.creationTimestamp`
+
+// TeamCityBackupSchedule is the Schema for the teamcitybackupschedules API
+type TeamCityBackupSchedule struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   TeamCityBackupScheduleSpec   `json:"spec,omitempty"`
+	Status TeamCityBackupScheduleStatus `json:"status,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+
+// TeamCityBackupScheduleList contains a list of TeamCityBackupSchedule
+type TeamCityBackupScheduleList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []TeamCityBackupSchedule `json:"items"`
+}
+
+func (schedule *TeamCityBackupSchedule) GetTeamCityNamespacedName() types.NamespacedName {
+	return types.NamespacedName{
+		Name:      schedule.Spec.TeamCityRef,
+		Namespace: schedule.Namespace,
+	}
+}
+
+func init() {
+	SchemeBuilder.Register(&TeamCityBackupSchedule{}, &TeamCityBackupScheduleList{})
+}
@@ -0,0 +1,99 @@
+package v1beta1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// TeamCityRestoreSpec defines which backup is restored into which TeamCity instance.
+// The instance is stopped for the duration of the restore, so it should be a fresh installation.
+type TeamCityRestoreSpec struct {
+	// TeamCityRef is the name of the TeamCity resource in the same namespace.
+	TeamCityRef string `json:"teamCityRef"`
+
+	// Source of the backup file. Exactly one field must be set.
+	Source RestoreSource `json:"source"`
+
+	// DatabaseSecret is the Secret with the connection properties of the empty target database,
+	// using the same keys as spec.databaseSecret of TeamCity. Must be empty or equal to the database secret of the TeamCity.
+	DatabaseSecret string `json:"databaseSecret,omitempty"`
+}
+
+type RestoreSource struct {
+	// FileName of a backup in <data dir>/backup of the target TeamCity.
+	FileName string `json:"fileName,omitempty"`
+	// BackupRef is the name of a succeeded TeamCityBackup whose file is in <data dir>/backup of the target TeamCity.
+	BackupRef string `json:"backupRef,omitempty"`
+	// PersistentVolumeClaim holding the backup file.
+	PersistentVolumeClaim *RestoreSourceVolume `json:"persistentVolumeClaim,omitempty"`
+}
+
+type RestoreSourceVolume struct {
+	ClaimName string `json:"claimName"`
+	// Path of the backup file inside the claim.
+	Path string `json:"path"`
+}
+
+type RestorePhase string
+
+const (
+	RestorePhasePending   RestorePhase = "Pending"
+	RestorePhaseStopping  RestorePhase = "Stopping"
+	RestorePhaseRestoring RestorePhase = "Restoring"
+	RestorePhaseStarting  RestorePhase = "Starting"
+	RestorePhaseSucceeded RestorePhase = "Succeeded"
+	RestorePhaseFailed    RestorePhase = "Failed"
+)
+
+// TeamCityRestoreStatus defines the observed state of TeamCityRestore
+type TeamCityRestoreStatus struct {
+	Phase   RestorePhase `json:"phase,omitempty"`
+	Message string       `json:"message,omitempty"`
+
+	// BackupFile is the path of the backup file inside the restore Job.
+	BackupFile string `json:"backupFile,omitempty"`
+	// JobName is the Job running maintainDB restore.
+	JobName string `json:"jobName,omitempty"`
+
+	StartTime      *metav1.Time `json:"startTime,omitempty"`
+	CompletionTime *metav1.Time `json:"completionTime,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+//+kubebuilder:subresource:status
+//+kubebuilder:printcolumn:name="TeamCity",type=string,JSONPath=`.spec.teamCityRef`
+//+kubebuilder:printcolumn:name="Phase",type=string,JSONPath=`.status.phase`
+//+kubebuilder:printcolumn:name="Age",type=date,JSONPath=`.metadata.creationTimestamp`
+
+// TeamCityRestore is the Schema for the teamcityrestores API
+type TeamCityRestore struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   TeamCityRestoreSpec   `json:"spec,omitempty"`
+	Status TeamCityRestoreStatus `json:"status,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+
+// TeamCityRestoreList contains a list of TeamCityRestore
+type TeamCityRestoreList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []TeamCityRestore `json:"items"`
+}
+
+func (restore *TeamCityRestore) GetTeamCityNamespacedName() types.NamespacedName {
+	return types.NamespacedName{
+		Name:      restore.Spec.TeamCityRef,
+		Namespace: restore.Namespace,
+	}
+}
+
+func (restore *TeamCityRestore) IsFinished() bool {
+	return restore.Status.Phase == RestorePhaseSucceeded || restore.Status.Phase == RestorePhaseFailed
+}
+
+func init() {
+	SchemeBuilder.Register(&TeamCityRestore{}, &TeamCityRestoreList{})
+}
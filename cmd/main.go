@@ -34,6 +34,8 @@ import (
 
 	jetbrainscomv1beta1 "git.jetbrains.team/tch/teamcity-operator/api/v1beta1"
 	"git.jetbrains.team/tch/teamcity-operator/internal/controller"
+	teamcitymetrics "git.jetbrains.team/tch/teamcity-operator/internal/metrics"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
 	metricsserver "sigs.k8s.io/controller-runtime/pkg/metrics/server"
 	//+kubebuilder:scaffold:imports
 )
@@ -48,6 +50,8 @@ func init() {
 
 	utilruntime.Must(jetbrainscomv1beta1.AddToScheme(scheme))
 	//+kubebuilder:scaffold:scheme
+
+	teamcitymetrics.Register(metrics.Registry)
 }
 
 func main() {
@@ -109,6 +113,38 @@ func main() {
 		setupLog.Error(err, "unable to create controller", "controller", "TeamCity")
 		os.Exit(1)
 	}
+	if err = (&controller.TeamCityBackupReconciler{
+		Client:   mgr.GetClient(),
+		Scheme:   mgr.GetScheme(),
+		Recorder: mgr.GetEventRecorderFor("teamcitybackup-controller"),
+	}).SetupWithManager(mgr); err != nil {
+		setupLog.Error(err, "unable to create controller", "controller", "TeamCityBackup")
+		os.Exit(1)
+	}
+	if err = (&controller.TeamCityBackupScheduleReconciler{
+		Client:   mgr.GetClient(),
+		Scheme:   mgr.GetScheme(),
+		Recorder: mgr.GetEventRecorderFor("teamcitybackupschedule-controller"),
+	}).SetupWithManager(mgr); err != nil {
+		setupLog.Error(err, "unable to create controller", "controller", "TeamCityBackupSchedule")
+		os.Exit(1)
+	}
+	if err = (&controller.TeamCityRestoreReconciler{
+		Client:   mgr.GetClient(),
+		Scheme:   mgr.GetScheme(),
+		Recorder: mgr.GetEventRecorderFor("teamcityrestore-controller"),
+	}).SetupWithManager(mgr); err != nil {
+		setupLog.Error(err, "unable to create controller", "controller", "TeamCityRestore")
+		os.Exit(1)
+	}
+	if err = (&controller.TeamCityAgentPoolReconciler{
+		Client:   mgr.GetClient(),
+		Scheme:   mgr.GetScheme(),
+		Recorder: mgr.GetEventRecorderFor("teamcityagentpool-controller"),
+	}).SetupWithManager(mgr); err != nil {
+		setupLog.Error(err, "unable to create controller", "controller", "TeamCityAgentPool")
+		os.Exit(1)
+	}
 	if os.Getenv("ENABLE_WEBHOOKS") != "false" {
 		if err = (&jetbrainscomv1beta1.TeamCity{}).SetupWebhookWithManager(mgr); err != nil {
 			setupLog.Error(err, "unable to create webhook", "webhook", "TeamCity")
@@ -2,20 +2,62 @@ package checkpoint
 
 import (
 	"context"
+	"encoding/json"
+	stderrors "errors"
 	"fmt"
+	"time"
+
 	. "git.jetbrains.team/tch/teamcity-operator/api/v1beta1"
+	"git.jetbrains.team/tch/teamcity-operator/internal/resource"
+	appsv1 "k8s.io/api/apps/v1"
 	v1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/util/retry"
 
 	"sigs.k8s.io/controller-runtime/pkg/client"
 )
 
+// ErrNoCheckpoint is returned when no zero-downtime upgrade is in progress.
+var ErrNoCheckpoint = stderrors.New("no zero-downtime upgrade checkpoint")
+
+// Checkpoint is the state of an ongoing zero-downtime upgrade. It is stored in status.upgradeCheckpoint of the TeamCity.
 type Checkpoint struct {
 	Client       client.Client
 	CurrentStage Stage
 	Instance     TeamCity
+
+	// StartedTime is when the upgrade started, StageTransitionTime when CurrentStage was entered.
+	StartedTime         time.Time
+	StageTransitionTime time.Time
+	// PreviousMainTemplate is the pod template of the main StatefulSet before the upgrade, restored by a rollback.
+	PreviousMainTemplate *v1.PodTemplateSpec
+	FromImage            string
+	ToImage              string
+	// Generation is the TeamCity generation that started the upgrade.
+	Generation int64
+	// RollbackReason and RollbackMessage explain why the upgrade is RollingBack.
+	RollbackReason  string
+	RollbackMessage string
+	// Paused is true while the stages are held by UpgradeControlAnnotationKey.
+	Paused bool
+	// Held is true while the stages wait for stopped nodes, a restore or the approval of a change.
+	Held bool
+
+	// PreviousSecondaryTemplates are the pod templates of the secondary StatefulSets before the upgrade, by node name.
+	PreviousSecondaryTemplates map[string]v1.PodTemplateSpec
+	// Nodes are the secondary nodes restarted in the current batch of SecondaryNodesUpgrading, and NodeStep
+	// is how far the batch got. UpgradedNodes already run the new spec.
+	Nodes         []string
+	NodeStep      NodeStep
+	UpgradedNodes []string
+	// MovedResponsibilities are taken from Nodes while they restart and given back afterwards.
+	MovedResponsibilities []MovedResponsibility
+
+	// Now returns the current time for the stage timeouts; defaults to time.Now.
+	Now func() time.Time
 }
 
 func NewCheckpoint(client client.Client, instance TeamCity) *Checkpoint {
@@ -27,114 +69,327 @@ func NewCheckpoint(client client.Client, instance TeamCity) *Checkpoint {
 }
 
 func (c *Checkpoint) DoCheckpointWithDesiredStage(ctx context.Context, desiredStage Stage) error {
-	currentStage, err := c.FetchCurrentStageFromCluster(ctx)
-	if err != nil {
-		if errors.IsNotFound(err) {
+	if err := c.load(ctx); err != nil {
+		if stderrors.Is(err, ErrNoCheckpoint) {
 			c.CurrentStage = desiredStage
-			err = c.Create(ctx)
-			if err != nil {
-				return err
-			}
-			return nil
+			return c.Create(ctx)
 		}
 		return err
 	}
-	c.CurrentStage = currentStage
 	canChangeStage, err := c.CurrentStage.canChangeStageValue(desiredStage)
 	if err != nil {
 		return err
 	}
-	if canChangeStage {
+	if canChangeStage && c.CurrentStage != desiredStage {
 		c.CurrentStage = desiredStage
-		err = c.Update(ctx)
+		c.StageTransitionTime = c.now()
+		return c.Update(ctx)
 	}
 	return nil
 }
 
+// StartRollback moves the checkpoint to RollingBack. The reason and message are kept for the status of the failed upgrade.
+func (c *Checkpoint) StartRollback(ctx context.Context, reason string, message string) error {
+	if err := c.load(ctx); err != nil {
+		return err
+	}
+	if _, err := c.CurrentStage.canChangeStageValue(RollingBack); err != nil {
+		return err
+	}
+	c.CurrentStage = RollingBack
+	c.StageTransitionTime = c.now()
+	c.RollbackReason = reason
+	c.RollbackMessage = message
+	c.Paused = false
+	return c.Update(ctx)
+}
+
+// SetPaused pauses or resumes the upgrade. A resumed stage is timed from the moment it is resumed.
+func (c *Checkpoint) SetPaused(ctx context.Context, paused bool) error {
+	if err := c.load(ctx); err != nil {
+		return err
+	}
+	if c.Paused == paused {
+		return nil
+	}
+	c.Paused = paused
+	if !paused {
+		c.StageTransitionTime = c.now()
+	}
+	return c.Update(ctx)
+}
+
+// SetHeld records whether the upgrade waits for stopped nodes, a restore or the approval of a change. As with
+// SetPaused, a released stage is timed from the moment it is released.
+func (c *Checkpoint) SetHeld(ctx context.Context, held bool) error {
+	if err := c.load(ctx); err != nil {
+		return err
+	}
+	if c.Held == held {
+		return nil
+	}
+	c.Held = held
+	if !held {
+		c.StageTransitionTime = c.now()
+	}
+	return c.Update(ctx)
+}
+
+// StageTimeout returns how long the upgrade may stay in the current stage, or 0 if the stage does not time out.
+// UpgradeStageTimeoutAnnotationKey overrides the default of the stages that wait for a node.
+func (c *Checkpoint) StageTimeout() time.Duration {
+	timeout := c.CurrentStage.Timeout()
+	if timeout == 0 {
+		return 0
+	}
+	if override, ok := c.Instance.UpgradeStageTimeout(); ok {
+		return override
+	}
+	return timeout
+}
+
+// TimedOut reports whether the upgrade stayed in the current stage for longer than StageTimeout.
+func (c *Checkpoint) TimedOut() bool {
+	timeout := c.StageTimeout()
+	if timeout == 0 || c.StageTransitionTime.IsZero() {
+		return false
+	}
+	return c.now().Sub(c.StageTransitionTime) > timeout
+}
+
+// Create stores a new checkpoint together with the pod templates the node StatefulSets have before the upgrade.
 func (c *Checkpoint) Create(ctx context.Context) error {
-	configMap := c.toConfigMapObject()
-	if err := c.Client.Create(ctx, &configMap); err != nil {
+	if err := c.recordPreviousMainNode(ctx); err != nil {
 		return err
 	}
-	return nil
+	if err := c.recordPreviousSecondaryNodes(ctx); err != nil {
+		return err
+	}
+	c.StartedTime = c.now()
+	c.StageTransitionTime = c.StartedTime
+	c.ToImage = c.Instance.Spec.Image
+	c.Generation = c.Instance.Generation
+	return c.Update(ctx)
 }
-func (c *Checkpoint) UpdateStageFromConfigMap(ctx context.Context) error {
-	stage, err := c.FetchCurrentStageFromCluster(ctx)
-	if err != nil {
-		if errors.IsNotFound(err) {
-			initialStage := getInitialStageFromInstance(c.Instance)
-			c.CurrentStage = initialStage
+
+// UpdateStageFromStatus loads the checkpoint of the ongoing upgrade, or resets it to the initial stage if there is none.
+func (c *Checkpoint) UpdateStageFromStatus(ctx context.Context) error {
+	if err := c.load(ctx); err != nil {
+		if stderrors.Is(err, ErrNoCheckpoint) {
+			c.CurrentStage = getInitialStageFromInstance(c.Instance)
 			return nil
 		}
 		return err
 	}
-	c.CurrentStage = stage
+	// checkpoints written before the stage timeouts existed are timed from now on
+	if c.StageTransitionTime.IsZero() {
+		c.StageTransitionTime = c.now()
+		return c.Update(ctx)
+	}
 	return nil
 }
 
+// FetchCurrentStageFromCluster returns the stage of the ongoing upgrade, or ErrNoCheckpoint.
 func (c *Checkpoint) FetchCurrentStageFromCluster(ctx context.Context) (Stage, error) {
-	stage := NewStage("")
-	configMap, err := c.GetConfigMap(ctx)
-	if err != nil {
-		return stage, err
+	if err := c.load(ctx); err != nil {
+		return NewStage(""), err
 	}
-	stage, err = GetStageStringValueFromConfigMap(&configMap)
-	if err != nil {
-		return stage, err
+	return c.CurrentStage, nil
+}
+
+// Update writes the checkpoint to status.upgradeCheckpoint.
+func (c *Checkpoint) Update(ctx context.Context) error {
+	return c.updateStatus(ctx, func(status *TeamCityStatus) {
+		status.UpgradeCheckpoint = c.toStatus()
+	})
+}
+
+// Finish removes the checkpoint and records the upgrade in status.upgradeHistory with the given phase.
+// The oldest entries are dropped beyond UpgradeHistoryLimit.
+func (c *Checkpoint) Finish(ctx context.Context, phase UpgradePhase) error {
+	finished := metav1.NewTime(c.now())
+	entry := UpgradeHistoryEntry{
+		Phase:        phase,
+		Generation:   c.Generation,
+		FromImage:    c.FromImage,
+		ToImage:      c.ToImage,
+		StartedTime:  metaTime(c.StartedTime),
+		FinishedTime: &finished,
+	}
+	if phase != UpgradePhaseSucceeded {
+		entry.Reason = c.RollbackReason
+		entry.Message = c.RollbackMessage
 	}
-	return stage, nil
+	return c.updateStatus(ctx, func(status *TeamCityStatus) {
+		status.UpgradeCheckpoint = nil
+		status.UpgradeHistory = append([]UpgradeHistoryEntry{entry}, status.UpgradeHistory...)
+		if len(status.UpgradeHistory) > UpgradeHistoryLimit {
+			status.UpgradeHistory = status.UpgradeHistory[:UpgradeHistoryLimit]
+		}
+	})
 }
 
-func (c *Checkpoint) GetConfigMap(ctx context.Context) (v1.ConfigMap, error) {
-	var configMap v1.ConfigMap
-	namespacedName := c.getNamespacedName()
-	if err := c.Client.Get(ctx, namespacedName, &configMap); err != nil {
-		return configMap, err
+func (c *Checkpoint) getNamespacedName() types.NamespacedName {
+	return types.NamespacedName{
+		Name:      c.Instance.Name,
+		Namespace: c.Instance.Namespace,
 	}
-	return configMap, nil
 }
 
-func (c *Checkpoint) Update(ctx context.Context) error {
-	checkpointCM := c.toConfigMapObject()
-	if err := c.Client.Update(ctx, &checkpointCM); err != nil {
-		return nil
+// load reads the checkpoint from the status of the TeamCity.
+func (c *Checkpoint) load(ctx context.Context) error {
+	var teamcity TeamCity
+	if err := c.Client.Get(ctx, c.getNamespacedName(), &teamcity); err != nil {
+		if errors.IsNotFound(err) {
+			return ErrNoCheckpoint
+		}
+		return err
 	}
-	return nil
+	if teamcity.Status.UpgradeCheckpoint == nil {
+		return ErrNoCheckpoint
+	}
+	return c.fromStatus(teamcity.Status.UpgradeCheckpoint)
 }
 
-func (c *Checkpoint) Delete(ctx context.Context) error {
-	configMap, err := c.GetConfigMap(ctx)
-	if err != nil {
-		if !errors.IsNotFound(err) {
+func (c *Checkpoint) updateStatus(ctx context.Context, update func(status *TeamCityStatus)) error {
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		var teamcity TeamCity
+		if err := c.Client.Get(ctx, c.getNamespacedName(), &teamcity); err != nil {
+			if errors.IsNotFound(err) {
+				return nil
+			}
 			return err
 		}
+		update(&teamcity.Status)
+		return c.Client.Status().Update(ctx, &teamcity)
+	})
+}
+
+func (c *Checkpoint) now() time.Time {
+	if c.Now != nil {
+		return c.Now()
 	}
-	if err := c.Client.Delete(ctx, &configMap); err != nil {
+	return time.Now()
+}
+
+// recordPreviousMainNode remembers the pod template and image of the main StatefulSet, if it exists.
+func (c *Checkpoint) recordPreviousMainNode(ctx context.Context) error {
+	var mainStatefulSet appsv1.StatefulSet
+	if err := c.Client.Get(ctx, c.Instance.Spec.MainNode.GetNamespacedNameFromNamespace(c.Instance.Namespace), &mainStatefulSet); err != nil {
+		if errors.IsNotFound(err) {
+			return nil
+		}
 		return err
 	}
+	c.PreviousMainTemplate = mainStatefulSet.Spec.Template.DeepCopy()
+	for _, container := range mainStatefulSet.Spec.Template.Spec.Containers {
+		if container.Name == resource.TEAMCITY_CONTAINER_NAME {
+			c.FromImage = container.Image
+		}
+	}
+	return nil
+}
 
+// recordPreviousSecondaryNodes remembers the pod templates of the existing secondary StatefulSets.
+func (c *Checkpoint) recordPreviousSecondaryNodes(ctx context.Context) error {
+	for _, node := range c.Instance.Spec.SecondaryNodes {
+		var statefulSet appsv1.StatefulSet
+		if err := c.Client.Get(ctx, node.GetNamespacedNameFromNamespace(c.Instance.Namespace), &statefulSet); err != nil {
+			if errors.IsNotFound(err) {
+				continue
+			}
+			return err
+		}
+		if c.PreviousSecondaryTemplates == nil {
+			c.PreviousSecondaryTemplates = map[string]v1.PodTemplateSpec{}
+		}
+		c.PreviousSecondaryTemplates[node.Name] = *statefulSet.Spec.Template.DeepCopy()
+	}
 	return nil
 }
 
-func (c *Checkpoint) getCheckpointConfigMapName() string {
-	return fmt.Sprintf("%s-%s", StageConfigMapNamePrefix, c.Instance.Name)
+func (c *Checkpoint) toStatus() *UpgradeCheckpoint {
+	status := &UpgradeCheckpoint{
+		Stage:                 c.CurrentStage.String(),
+		StartedTime:           metaTime(c.StartedTime),
+		StageTransitionTime:   metaTime(c.StageTransitionTime),
+		FromImage:             c.FromImage,
+		ToImage:               c.ToImage,
+		Generation:            c.Generation,
+		RollbackReason:        c.RollbackReason,
+		RollbackMessage:       c.RollbackMessage,
+		Paused:                c.Paused,
+		Held:                  c.Held,
+		Nodes:                 c.Nodes,
+		NodeStep:              string(c.NodeStep),
+		UpgradedNodes:         c.UpgradedNodes,
+		MovedResponsibilities: c.MovedResponsibilities,
+	}
+	if c.PreviousMainTemplate != nil {
+		status.PreviousMainTemplate = rawTemplate(c.PreviousMainTemplate)
+	}
+	for name, template := range c.PreviousSecondaryTemplates {
+		if status.PreviousSecondaryTemplates == nil {
+			status.PreviousSecondaryTemplates = map[string]runtime.RawExtension{}
+		}
+		status.PreviousSecondaryTemplates[name] = *rawTemplate(&template)
+	}
+	return status
 }
 
-func (c *Checkpoint) getNamespacedName() types.NamespacedName {
-	return types.NamespacedName{
-		Name:      c.getCheckpointConfigMapName(),
-		Namespace: c.Instance.Namespace,
+func (c *Checkpoint) fromStatus(status *UpgradeCheckpoint) error {
+	c.CurrentStage = NewStage(status.Stage)
+	c.StartedTime = timeOf(status.StartedTime)
+	c.StageTransitionTime = timeOf(status.StageTransitionTime)
+	c.FromImage = status.FromImage
+	c.ToImage = status.ToImage
+	c.Generation = status.Generation
+	c.RollbackReason = status.RollbackReason
+	c.RollbackMessage = status.RollbackMessage
+	c.Paused = status.Paused
+	c.Held = status.Held
+	c.Nodes = status.Nodes
+	c.NodeStep = NodeStep(status.NodeStep)
+	c.UpgradedNodes = status.UpgradedNodes
+	c.MovedResponsibilities = status.MovedResponsibilities
+	c.PreviousMainTemplate = nil
+	if status.PreviousMainTemplate != nil {
+		c.PreviousMainTemplate = &v1.PodTemplateSpec{}
+		if err := json.Unmarshal(status.PreviousMainTemplate.Raw, c.PreviousMainTemplate); err != nil {
+			return fmt.Errorf("status.upgradeCheckpoint has an invalid previousMainTemplate: %w", err)
+		}
+	}
+	c.PreviousSecondaryTemplates = nil
+	for name, raw := range status.PreviousSecondaryTemplates {
+		var template v1.PodTemplateSpec
+		if err := json.Unmarshal(raw.Raw, &template); err != nil {
+			return fmt.Errorf("status.upgradeCheckpoint has an invalid previous template of node %s: %w", name, err)
+		}
+		if c.PreviousSecondaryTemplates == nil {
+			c.PreviousSecondaryTemplates = map[string]v1.PodTemplateSpec{}
+		}
+		c.PreviousSecondaryTemplates[name] = template
+	}
+	return nil
+}
+
+func rawTemplate(template *v1.PodTemplateSpec) *runtime.RawExtension {
+	// the template was read from the API server, so it always serializes
+	raw, _ := json.Marshal(template)
+	return &runtime.RawExtension{Raw: raw}
+}
+
+func metaTime(t time.Time) *metav1.Time {
+	if t.IsZero() {
+		return nil
 	}
+	result := metav1.NewTime(t)
+	return &result
 }
 
-func (c *Checkpoint) toConfigMapObject() v1.ConfigMap {
-	return v1.ConfigMap{
-		ObjectMeta: metav1.ObjectMeta{
-			Name:      ConstructCheckpointName(c.Instance.Name),
-			Namespace: c.Instance.Namespace,
-		},
-		Data: map[string]string{
-			StageConfigMapKey: c.CurrentStage.String(),
-		},
+func timeOf(t *metav1.Time) time.Time {
+	if t == nil {
+		return time.Time{}
 	}
+	return t.Time
 }
@@ -0,0 +1,242 @@
+package checkpoint
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"git.jetbrains.team/tch/teamcity-operator/api/v1beta1"
+	"git.jetbrains.team/tch/teamcity-operator/internal/resource"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+var checkpointTestStart = time.Date(2024, 8, 1, 10, 0, 0, 0, time.UTC)
+
+func newCheckpointForTest(t *testing.T, objects ...client.Object) *Checkpoint {
+	testScheme := runtime.NewScheme()
+	require.NoError(t, clientgoscheme.AddToScheme(testScheme))
+	require.NoError(t, v1beta1.AddToScheme(testScheme))
+	instance := v1beta1.TeamCity{
+		ObjectMeta: metav1.ObjectMeta{Name: "tc", Namespace: "default", Generation: 3},
+		Spec:       v1beta1.TeamCitySpec{Image: "jetbrains/teamcity-server:2024.07.3", MainNode: v1beta1.Node{Name: "main"}},
+	}
+	fakeClient := fake.NewClientBuilder().WithScheme(testScheme).
+		WithObjects(append(objects, instance.DeepCopy())...).
+		WithStatusSubresource(&v1beta1.TeamCity{}).
+		Build()
+	checkpoint := NewCheckpoint(fakeClient, instance)
+	checkpoint.Now = func() time.Time { return checkpointTestStart }
+	return checkpoint
+}
+
+func TestCreateRecordsPreviousMainNode(t *testing.T) {
+	mainStatefulSet := &appsv1.StatefulSet{
+		ObjectMeta: metav1.ObjectMeta{Name: "main", Namespace: "default"},
+		Spec: appsv1.StatefulSetSpec{Template: corev1.PodTemplateSpec{Spec: corev1.PodSpec{Containers: []corev1.Container{
+			{Name: resource.TEAMCITY_CONTAINER_NAME, Image: "jetbrains/teamcity-server:2024.07.1"},
+		}}}},
+	}
+	checkpoint := newCheckpointForTest(t, mainStatefulSet)
+	ctx := context.Background()
+
+	require.NoError(t, checkpoint.DoCheckpointWithDesiredStage(ctx, ReplicaCreated))
+
+	loaded := NewCheckpoint(checkpoint.Client, checkpoint.Instance)
+	require.NoError(t, loaded.UpdateStageFromStatus(ctx))
+	assert.Equal(t, ReplicaCreated, loaded.CurrentStage)
+	assert.True(t, checkpointTestStart.Equal(loaded.StageTransitionTime))
+	assert.Equal(t, "jetbrains/teamcity-server:2024.07.1", loaded.FromImage)
+	assert.Equal(t, "jetbrains/teamcity-server:2024.07.3", loaded.ToImage)
+	assert.Equal(t, int64(3), loaded.Generation)
+	require.NotNil(t, loaded.PreviousMainTemplate)
+	assert.Equal(t, mainStatefulSet.Spec.Template.Spec.Containers, loaded.PreviousMainTemplate.Spec.Containers)
+}
+
+func TestStageTransitionTimeChangesWithStage(t *testing.T) {
+	checkpoint := newCheckpointForTest(t)
+	ctx := context.Background()
+	require.NoError(t, checkpoint.DoCheckpointWithDesiredStage(ctx, ReplicaStarting))
+
+	checkpoint.Now = func() time.Time { return checkpointTestStart.Add(time.Minute) }
+	require.NoError(t, checkpoint.DoCheckpointWithDesiredStage(ctx, ReplicaStarting))
+	assert.True(t, checkpointTestStart.Equal(checkpoint.StageTransitionTime))
+
+	require.NoError(t, checkpoint.DoCheckpointWithDesiredStage(ctx, ReplicaReady))
+	assert.True(t, checkpointTestStart.Add(time.Minute).Equal(checkpoint.StageTransitionTime))
+}
+
+func TestTimedOut(t *testing.T) {
+	checkpoint := newCheckpointForTest(t)
+	ctx := context.Background()
+	require.NoError(t, checkpoint.DoCheckpointWithDesiredStage(ctx, ReplicaStarting))
+
+	checkpoint.Now = func() time.Time { return checkpointTestStart.Add(DefaultStageTimeout) }
+	assert.False(t, checkpoint.TimedOut())
+	checkpoint.Now = func() time.Time { return checkpointTestStart.Add(DefaultStageTimeout + time.Second) }
+	assert.True(t, checkpoint.TimedOut())
+
+	checkpoint.Instance.Annotations = map[string]string{v1beta1.UpgradeStageTimeoutAnnotationKey: "2h"}
+	assert.False(t, checkpoint.TimedOut())
+
+	require.NoError(t, checkpoint.DoCheckpointWithDesiredStage(ctx, ReplicaReady))
+	checkpoint.Now = func() time.Time { return checkpointTestStart.Add(24 * time.Hour) }
+	assert.False(t, checkpoint.TimedOut(), "stages that do not wait for a node do not time out")
+}
+
+// buildLegacyCheckpointConfigMap builds the checkpoint ConfigMap older operators kept the stage of an upgrade in.
+func buildLegacyCheckpointConfigMap(stage Stage, instanceName string, instanceNamespace string) corev1.ConfigMap {
+	return corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      ConstructCheckpointName(instanceName),
+			Namespace: instanceNamespace,
+		},
+		Data: map[string]string{
+			StageConfigMapKey: stage.String(),
+		},
+	}
+}
+
+func TestCheckpointConfigMapIsMigrated(t *testing.T) {
+	legacy := buildLegacyCheckpointConfigMap(ReplicaStarting, "tc", "default")
+	checkpoint := newCheckpointForTest(t, &legacy)
+	ctx := context.Background()
+	_, err := checkpoint.FetchCurrentStageFromCluster(ctx)
+	assert.ErrorIs(t, err, ErrNoCheckpoint, "reading the checkpoint does not migrate it")
+	require.NoError(t, checkpoint.Client.Get(ctx, client.ObjectKeyFromObject(&legacy), &corev1.ConfigMap{}))
+
+	migrated, err := checkpoint.MigrateConfigMap(ctx)
+	require.NoError(t, err)
+	assert.True(t, migrated)
+	require.NoError(t, checkpoint.UpdateStageFromStatus(ctx))
+	assert.Equal(t, ReplicaStarting, checkpoint.CurrentStage)
+	assert.True(t, checkpointTestStart.Equal(checkpoint.StageTransitionTime), "checkpoints without a transition time are timed from now")
+
+	var teamcity v1beta1.TeamCity
+	require.NoError(t, checkpoint.Client.Get(ctx, client.ObjectKeyFromObject(&checkpoint.Instance), &teamcity))
+	require.NotNil(t, teamcity.Status.UpgradeCheckpoint)
+	assert.Equal(t, StageReplicaStarting, teamcity.Status.UpgradeCheckpoint.Stage)
+	assert.Equal(t, "jetbrains/teamcity-server:2024.07.3", teamcity.Status.UpgradeCheckpoint.ToImage)
+	assert.Equal(t, int64(3), teamcity.Status.UpgradeCheckpoint.Generation)
+	assert.Nil(t, teamcity.Status.UpgradeCheckpoint.PreviousMainTemplate, "older operators did not record the pod template")
+	err = checkpoint.Client.Get(ctx, client.ObjectKeyFromObject(&legacy), &corev1.ConfigMap{})
+	assert.True(t, errors.IsNotFound(err), "the ConfigMap is deleted once migrated")
+
+	migrated, err = checkpoint.MigrateConfigMap(ctx)
+	require.NoError(t, err)
+	assert.False(t, migrated)
+}
+
+func TestStartRollback(t *testing.T) {
+	checkpoint := newCheckpointForTest(t)
+	ctx := context.Background()
+	require.NoError(t, checkpoint.DoCheckpointWithDesiredStage(ctx, MainShuttingDown))
+
+	require.NoError(t, checkpoint.StartRollback(ctx, "StageTimedOut", "main node not ready"))
+
+	loaded := NewCheckpoint(checkpoint.Client, checkpoint.Instance)
+	require.NoError(t, loaded.UpdateStageFromStatus(ctx))
+	assert.Equal(t, RollingBack, loaded.CurrentStage)
+	assert.Equal(t, "StageTimedOut", loaded.RollbackReason)
+	assert.Equal(t, "main node not ready", loaded.RollbackMessage)
+	assert.Error(t, loaded.DoCheckpointWithDesiredStage(ctx, UpdateFinished))
+}
+
+func TestSetPaused(t *testing.T) {
+	checkpoint := newCheckpointForTest(t)
+	ctx := context.Background()
+	require.NoError(t, checkpoint.DoCheckpointWithDesiredStage(ctx, ReplicaStarting))
+
+	require.NoError(t, checkpoint.SetPaused(ctx, true))
+	loaded := NewCheckpoint(checkpoint.Client, checkpoint.Instance)
+	require.NoError(t, loaded.UpdateStageFromStatus(ctx))
+	assert.True(t, loaded.Paused)
+
+	checkpoint.Now = func() time.Time { return checkpointTestStart.Add(time.Hour) }
+	require.NoError(t, checkpoint.SetPaused(ctx, false))
+	require.NoError(t, loaded.UpdateStageFromStatus(ctx))
+	assert.False(t, loaded.Paused)
+	assert.True(t, checkpointTestStart.Add(time.Hour).Equal(loaded.StageTransitionTime))
+}
+
+func TestSetHeld(t *testing.T) {
+	checkpoint := newCheckpointForTest(t)
+	ctx := context.Background()
+	require.NoError(t, checkpoint.DoCheckpointWithDesiredStage(ctx, ReplicaStarting))
+
+	require.NoError(t, checkpoint.SetHeld(ctx, true))
+	loaded := NewCheckpoint(checkpoint.Client, checkpoint.Instance)
+	require.NoError(t, loaded.UpdateStageFromStatus(ctx))
+	assert.True(t, loaded.Held)
+	assert.True(t, checkpointTestStart.Equal(loaded.StageTransitionTime))
+
+	checkpoint.Now = func() time.Time { return checkpointTestStart.Add(time.Hour) }
+	require.NoError(t, checkpoint.SetHeld(ctx, false))
+	require.NoError(t, loaded.UpdateStageFromStatus(ctx))
+	assert.False(t, loaded.Held)
+	assert.True(t, checkpointTestStart.Add(time.Hour).Equal(loaded.StageTransitionTime))
+}
+
+func TestNodeBatch(t *testing.T) {
+	checkpoint := newCheckpointForTest(t)
+	ctx := context.Background()
+	require.NoError(t, checkpoint.DoCheckpointWithDesiredStage(ctx, SecondaryNodesUpgrading))
+
+	checkpoint.Now = func() time.Time { return checkpointTestStart.Add(time.Hour) }
+	require.NoError(t, checkpoint.StartNodeBatch(ctx, []string{"secondary-1", "secondary-2"}))
+	moved := []v1beta1.MovedResponsibility{{Node: "secondary-1", Responsibility: "CAN_CHECK_FOR_CHANGES", Target: "main"}}
+	require.NoError(t, checkpoint.RecordMovedResponsibilities(ctx, moved))
+	require.NoError(t, checkpoint.SetNodeStep(ctx, NodeStepRestarting))
+	loaded := NewCheckpoint(checkpoint.Client, checkpoint.Instance)
+	require.NoError(t, loaded.UpdateStageFromStatus(ctx))
+	assert.Equal(t, []string{"secondary-1", "secondary-2"}, loaded.Nodes)
+	assert.Equal(t, NodeStepRestarting, loaded.NodeStep)
+	assert.Equal(t, moved, loaded.MovedResponsibilities)
+	assert.True(t, checkpointTestStart.Add(time.Hour).Equal(loaded.StageTransitionTime), "every batch is timed on its own")
+
+	require.NoError(t, checkpoint.FinishNodeBatch(ctx))
+	require.NoError(t, loaded.UpdateStageFromStatus(ctx))
+	assert.Empty(t, loaded.Nodes)
+	assert.Empty(t, loaded.NodeStep)
+	assert.Empty(t, loaded.MovedResponsibilities)
+	assert.Equal(t, []string{"secondary-1", "secondary-2"}, loaded.UpgradedNodes)
+}
+
+func TestFinishRecordsHistory(t *testing.T) {
+	checkpoint := newCheckpointForTest(t)
+	ctx := context.Background()
+	var teamcity v1beta1.TeamCity
+	require.NoError(t, checkpoint.Client.Get(ctx, client.ObjectKeyFromObject(&checkpoint.Instance), &teamcity))
+	for i := 0; i < v1beta1.UpgradeHistoryLimit; i++ {
+		teamcity.Status.UpgradeHistory = append(teamcity.Status.UpgradeHistory, v1beta1.UpgradeHistoryEntry{Phase: v1beta1.UpgradePhaseSucceeded, Generation: 2})
+	}
+	require.NoError(t, checkpoint.Client.Status().Update(ctx, &teamcity))
+
+	require.NoError(t, checkpoint.DoCheckpointWithDesiredStage(ctx, MainShuttingDown))
+	checkpoint.Now = func() time.Time { return checkpointTestStart.Add(time.Hour) }
+	require.NoError(t, checkpoint.StartRollback(ctx, "StageTimedOut", "main node not ready"))
+	require.NoError(t, checkpoint.Finish(ctx, v1beta1.UpgradePhaseFailed))
+
+	require.NoError(t, checkpoint.Client.Get(ctx, client.ObjectKeyFromObject(&checkpoint.Instance), &teamcity))
+	assert.Nil(t, teamcity.Status.UpgradeCheckpoint)
+	require.Len(t, teamcity.Status.UpgradeHistory, v1beta1.UpgradeHistoryLimit)
+	latest := teamcity.Status.UpgradeHistory[0]
+	assert.Equal(t, v1beta1.UpgradePhaseFailed, latest.Phase)
+	assert.Equal(t, "StageTimedOut", latest.Reason)
+	assert.Equal(t, "main node not ready", latest.Message)
+	assert.Equal(t, int64(3), latest.Generation)
+	assert.Equal(t, "jetbrains/teamcity-server:2024.07.3", latest.ToImage)
+	assert.True(t, checkpointTestStart.Equal(latest.StartedTime.Time))
+	assert.True(t, checkpointTestStart.Add(time.Hour).Equal(latest.FinishedTime.Time))
+
+	_, err := checkpoint.FetchCurrentStageFromCluster(ctx)
+	assert.ErrorIs(t, err, ErrNoCheckpoint)
+}
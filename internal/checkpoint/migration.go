@@ -0,0 +1,86 @@
+package checkpoint
+
+import (
+	"context"
+	"time"
+
+	. "git.jetbrains.team/tch/teamcity-operator/api/v1beta1"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// MigrateConfigMap moves the checkpoint ConfigMap of an older operator into status.upgradeCheckpoint, so an upgrade
+// started before the operator was updated goes on where it stopped. Older operators only kept the stage in it.
+// It reports whether the status was written; a TeamCity that already has a checkpoint in its status is left alone.
+func (c *Checkpoint) MigrateConfigMap(ctx context.Context) (bool, error) {
+	var teamcity TeamCity
+	if err := c.Client.Get(ctx, c.getNamespacedName(), &teamcity); err != nil {
+		return false, client.IgnoreNotFound(err)
+	}
+	if teamcity.Status.UpgradeCheckpoint != nil {
+		return false, nil
+	}
+	configMap, err := c.getConfigMap(ctx)
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	if err := c.fromConfigMapObject(&configMap); err != nil {
+		return false, err
+	}
+	c.StartedTime = configMap.CreationTimestamp.Time
+	if err := c.Update(ctx); err != nil {
+		return false, err
+	}
+	if err := c.DeleteConfigMap(ctx); err != nil {
+		return false, err
+	}
+	log.FromContext(ctx).Info("Migrated the upgrade checkpoint ConfigMap into status.upgradeCheckpoint",
+		"configMap", configMap.Name, "stage", c.CurrentStage.String())
+	return true, nil
+}
+
+func (c *Checkpoint) getConfigMap(ctx context.Context) (v1.ConfigMap, error) {
+	var configMap v1.ConfigMap
+	err := c.Client.Get(ctx, c.getConfigMapNamespacedName(), &configMap)
+	return configMap, err
+}
+
+// DeleteConfigMap deletes the checkpoint ConfigMap of an older operator, if there is one.
+func (c *Checkpoint) DeleteConfigMap(ctx context.Context) error {
+	configMap, err := c.getConfigMap(ctx)
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return nil
+		}
+		return err
+	}
+	if err := c.Client.Delete(ctx, &configMap); err != nil && !errors.IsNotFound(err) {
+		return err
+	}
+	return nil
+}
+
+func (c *Checkpoint) getConfigMapNamespacedName() types.NamespacedName {
+	return types.NamespacedName{
+		Name:      ConstructCheckpointName(c.Instance.Name),
+		Namespace: c.Instance.Namespace,
+	}
+}
+
+func (c *Checkpoint) fromConfigMapObject(configMap *v1.ConfigMap) error {
+	stage, err := GetStageStringValueFromConfigMap(configMap)
+	if err != nil {
+		return err
+	}
+	c.CurrentStage = stage
+	c.StageTransitionTime = time.Time{}
+	c.ToImage = c.Instance.Spec.Image
+	c.Generation = c.Instance.Generation
+	return nil
+}
@@ -0,0 +1,65 @@
+package checkpoint
+
+import (
+	"context"
+
+	. "git.jetbrains.team/tch/teamcity-operator/api/v1beta1"
+)
+
+// NodeStep is how far the current batch of secondary nodes got in SecondaryNodesUpgrading.
+type NodeStep string
+
+const (
+	// NodeStepMovingResponsibilities takes the responsibilities of the nodes over to the main node.
+	NodeStepMovingResponsibilities NodeStep = "moving-responsibilities"
+	// NodeStepRestarting applies the new spec to the StatefulSets of the nodes and waits for them to come back.
+	NodeStepRestarting NodeStep = "restarting"
+	// NodeStepRestoringResponsibilities gives the nodes their responsibilities back.
+	NodeStepRestoringResponsibilities NodeStep = "restoring-responsibilities"
+)
+
+// StartNodeBatch records the secondary nodes restarted next. The stage timeout starts over for every batch.
+func (c *Checkpoint) StartNodeBatch(ctx context.Context, nodes []string) error {
+	if err := c.load(ctx); err != nil {
+		return err
+	}
+	c.Nodes = nodes
+	c.NodeStep = NodeStepMovingResponsibilities
+	c.MovedResponsibilities = nil
+	c.StageTransitionTime = c.now()
+	return c.Update(ctx)
+}
+
+// RecordMovedResponsibilities remembers the responsibilities taken from the current batch before they are moved,
+// so they are given back even if the operator restarts in between.
+func (c *Checkpoint) RecordMovedResponsibilities(ctx context.Context, moved []MovedResponsibility) error {
+	if err := c.load(ctx); err != nil {
+		return err
+	}
+	c.MovedResponsibilities = moved
+	return c.Update(ctx)
+}
+
+// SetNodeStep moves the current batch to the given step.
+func (c *Checkpoint) SetNodeStep(ctx context.Context, step NodeStep) error {
+	if err := c.load(ctx); err != nil {
+		return err
+	}
+	if c.NodeStep == step {
+		return nil
+	}
+	c.NodeStep = step
+	return c.Update(ctx)
+}
+
+// FinishNodeBatch marks the nodes of the current batch as upgraded.
+func (c *Checkpoint) FinishNodeBatch(ctx context.Context) error {
+	if err := c.load(ctx); err != nil {
+		return err
+	}
+	c.UpgradedNodes = append(c.UpgradedNodes, c.Nodes...)
+	c.Nodes = nil
+	c.NodeStep = ""
+	c.MovedResponsibilities = nil
+	return c.Update(ctx)
+}
@@ -2,8 +2,9 @@ package checkpoint
 
 import (
 	"fmt"
+	"time"
+
 	corev1 "k8s.io/api/core/v1"
-	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
 type Stage int64
@@ -16,6 +17,11 @@ const (
 	MainShuttingDown
 	MainReady
 	UpdateFinished
+	// RollingBack restores the main node after a stage timed out. It can be entered from every stage before UpdateFinished.
+	RollingBack
+	// SecondaryNodesUpgrading restarts the secondary nodes of a multi-node setup in batches before the main node
+	// is switched. It is the first stage of a multi-node upgrade and is followed by ReplicaReady.
+	SecondaryNodesUpgrading
 	StageConfigMapKey        string = "stage"
 	StageConfigMapNamePrefix string = "update-checkpoint"
 )
@@ -28,8 +34,14 @@ const (
 	StageMainShuttingDown = "main-shutting-down"
 	StageMainReady        = "main-ready"
 	StageUpdateFinished   = "update-finished"
+	StageRollingBack      = "rolling-back"
+
+	StageSecondaryNodesUpgrading = "secondary-nodes-upgrading"
 )
 
+// DefaultStageTimeout is how long an upgrade waits for a node to become ready before it is rolled back.
+const DefaultStageTimeout = 30 * time.Minute
+
 func NewStage(stage string) Stage {
 	switch stage {
 	case StageReplicaCreated:
@@ -44,6 +56,10 @@ func NewStage(stage string) Stage {
 		return MainShuttingDown
 	case StageUpdateFinished:
 		return UpdateFinished
+	case StageRollingBack:
+		return RollingBack
+	case StageSecondaryNodesUpgrading:
+		return SecondaryNodesUpgrading
 	default:
 		return UpdateInitiated
 	}
@@ -63,24 +79,43 @@ func (s Stage) String() string {
 		return StageMainShuttingDown
 	case UpdateFinished:
 		return StageUpdateFinished
+	case RollingBack:
+		return StageRollingBack
+	case SecondaryNodesUpgrading:
+		return StageSecondaryNodesUpgrading
 	default:
 		return StageUpdateInitiated
 	}
 }
 
-func (s Stage) BuildCheckpointConfigMap(instanceName string, instanceNamespace string) corev1.ConfigMap {
-	return corev1.ConfigMap{
-		ObjectMeta: metav1.ObjectMeta{
-			Name:      ConstructCheckpointName(instanceName),
-			Namespace: instanceNamespace,
-		},
-		Data: map[string]string{
-			StageConfigMapKey: s.String(),
-		},
+// Timeout returns how long an upgrade may stay in the stage before it is rolled back,
+// or 0 for the stages that do not wait for a node. SecondaryNodesUpgrading is timed per batch of nodes.
+func (s Stage) Timeout() time.Duration {
+	switch s {
+	case ReplicaStarting, MainShuttingDown, SecondaryNodesUpgrading:
+		return DefaultStageTimeout
+	default:
+		return 0
 	}
 }
 
 func (s Stage) canChangeStageValue(desired Stage) (bool, error) {
+	if desired == RollingBack {
+		if s == UpdateFinished {
+			return false, fmt.Errorf("illegal stage transition: the upgrade already finished, desired stage '%s'", desired)
+		}
+		return true, nil
+	}
+	if s == RollingBack {
+		return false, fmt.Errorf("illegal stage transition: the upgrade is rolled back, desired stage '%s'", desired)
+	}
+	// the secondary nodes are upgraded before the main node is switched
+	if s == SecondaryNodesUpgrading || desired == SecondaryNodesUpgrading {
+		if desired == s || (s == SecondaryNodesUpgrading && desired == ReplicaReady) {
+			return true, nil
+		}
+		return false, fmt.Errorf("illegal stage transition: current stage '%s', desired stage '%s'", s, desired)
+	}
 	if desired < s || desired-s > 1 {
 		return false, fmt.Errorf("illegal stage transition: current stage '%s', desired stage '%s', difference must be 0 or 1",
 			s, desired)
@@ -88,6 +123,11 @@ func (s Stage) canChangeStageValue(desired Stage) (bool, error) {
 	return true, nil
 }
 
+// MainNodeUpgraded reports whether the main node already runs the new spec in the stage.
+func (s Stage) MainNodeUpgraded() bool {
+	return s == MainReady || s == UpdateFinished
+}
+
 func ConstructCheckpointName(instanceName string) string {
 	return fmt.Sprintf("%s-%s", StageConfigMapNamePrefix, instanceName)
 }
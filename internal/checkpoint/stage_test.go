@@ -19,6 +19,8 @@ func TestNewStage(t *testing.T) {
 		{"main-ready", StageMainReady, MainReady},
 		{"main-shutting-down", StageMainShuttingDown, MainShuttingDown},
 		{"update-finished", StageUpdateFinished, UpdateFinished},
+		{"rolling-back", StageRollingBack, RollingBack},
+		{"secondary-nodes-upgrading", StageSecondaryNodesUpgrading, SecondaryNodesUpgrading},
 		{"update-initiated", StageUpdateInitiated, UpdateInitiated},
 		{"unknown defaults to update-initiated", "unknown", UpdateInitiated},
 		{"empty defaults to update-initiated", "", UpdateInitiated},
@@ -45,6 +47,8 @@ func TestStageString(t *testing.T) {
 		{"MainShuttingDown", MainShuttingDown, StageMainShuttingDown},
 		{"MainReady", MainReady, StageMainReady},
 		{"UpdateFinished", UpdateFinished, StageUpdateFinished},
+		{"RollingBack", RollingBack, StageRollingBack},
+		{"SecondaryNodesUpgrading", SecondaryNodesUpgrading, StageSecondaryNodesUpgrading},
 		{"unknown stage defaults to update-initiated", Stage(999), StageUpdateInitiated},
 	}
 
@@ -56,16 +60,6 @@ func TestStageString(t *testing.T) {
 	}
 }
 
-func TestBuildCheckpointConfigMap(t *testing.T) {
-	stage := ReplicaReady
-
-	configMap := stage.BuildCheckpointConfigMap("my-teamcity", "default")
-
-	assert.Equal(t, "update-checkpoint-my-teamcity", configMap.Name)
-	assert.Equal(t, "default", configMap.Namespace)
-	assert.Equal(t, StageReplicaReady, configMap.Data[StageConfigMapKey])
-}
-
 func TestCanChangeStageValue(t *testing.T) {
 	tests := []struct {
 		name        string
@@ -80,6 +74,16 @@ func TestCanChangeStageValue(t *testing.T) {
 		{"going backwards is not allowed", ReplicaReady, ReplicaCreated, false, true},
 		{"from start to next", UpdateInitiated, ReplicaCreated, true, false},
 		{"from second to last to last", MainReady, UpdateFinished, true, false},
+		{"rollback from a waiting stage", MainShuttingDown, RollingBack, true, false},
+		{"rollback from the first stage", UpdateInitiated, RollingBack, true, false},
+		{"rollback after the update finished is not allowed", UpdateFinished, RollingBack, false, true},
+		{"rollback continues", RollingBack, RollingBack, true, false},
+		{"rollback cannot be left", RollingBack, UpdateFinished, false, true},
+		{"next batch of secondary nodes", SecondaryNodesUpgrading, SecondaryNodesUpgrading, true, false},
+		{"main node after the secondary nodes", SecondaryNodesUpgrading, ReplicaReady, true, false},
+		{"main node must not be skipped", SecondaryNodesUpgrading, MainShuttingDown, false, true},
+		{"secondary nodes are upgraded first", ReplicaReady, SecondaryNodesUpgrading, false, true},
+		{"rollback of the secondary nodes", SecondaryNodesUpgrading, RollingBack, true, false},
 	}
 
 	for _, tt := range tests {
@@ -95,6 +99,15 @@ func TestCanChangeStageValue(t *testing.T) {
 	}
 }
 
+func TestStageTimeout(t *testing.T) {
+	assert.Equal(t, DefaultStageTimeout, ReplicaStarting.Timeout())
+	assert.Equal(t, DefaultStageTimeout, MainShuttingDown.Timeout())
+	assert.Equal(t, DefaultStageTimeout, SecondaryNodesUpgrading.Timeout())
+	for _, stage := range []Stage{UpdateInitiated, ReplicaCreated, ReplicaReady, MainReady, UpdateFinished, RollingBack} {
+		assert.Zero(t, stage.Timeout(), stage.String())
+	}
+}
+
 func TestConstructCheckpointName(t *testing.T) {
 	result := ConstructCheckpointName("my-instance")
 	assert.Equal(t, "update-checkpoint-my-instance", result)
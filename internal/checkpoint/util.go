@@ -6,7 +6,7 @@ import (
 
 func getInitialStageFromInstance(teamcity TeamCity) Stage {
 	if teamcity.IsMultiNode() {
-		return ReplicaReady
+		return SecondaryNodesUpgrading
 	}
 	return UpdateInitiated
 }
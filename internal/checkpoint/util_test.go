@@ -8,7 +8,7 @@ import (
 )
 
 func TestGetInitialStageFromInstance(t *testing.T) {
-	t.Run("returns ReplicaReady for multi-node setup", func(t *testing.T) {
+	t.Run("returns SecondaryNodesUpgrading for multi-node setup", func(t *testing.T) {
 		instance := v1beta1.TeamCity{
 			Spec: v1beta1.TeamCitySpec{
 				MainNode: v1beta1.Node{Name: "main"},
@@ -20,7 +20,7 @@ func TestGetInitialStageFromInstance(t *testing.T) {
 
 		stage := getInitialStageFromInstance(instance)
 
-		assert.Equal(t, ReplicaReady, stage)
+		assert.Equal(t, SecondaryNodesUpgrading, stage)
 	})
 
 	t.Run("returns UpdateInitiated for single-node setup", func(t *testing.T) {
@@ -0,0 +1,95 @@
+package controller
+
+import (
+	"context"
+	stderrors "errors"
+	"fmt"
+
+	. "git.jetbrains.team/tch/teamcity-operator/api/v1beta1"
+	. "git.jetbrains.team/tch/teamcity-operator/internal/checkpoint"
+	v12 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	eventReasonUpgradePaused         = "UpgradePaused"
+	eventReasonUpgradeResumed        = "UpgradeResumed"
+	eventReasonUpgradeControlIgnored = "UpgradeControlIgnored"
+)
+
+// applyUpgradeControl carries out UpgradeControlAnnotationKey for the checkpoint of an ongoing upgrade.
+// It reports whether the stages are held, in which case the reconciliation is requeued without touching the nodes.
+func applyUpgradeControl(r *TeamcityReconciler, ctx context.Context, instance *TeamCity, checkpoint *Checkpoint) (bool, error) {
+	control := instance.UpgradeControl()
+	switch {
+	case control == UpgradeControlPause && checkpoint.CurrentStage != RollingBack:
+		if !checkpoint.Paused {
+			if err := checkpoint.SetPaused(ctx, true); err != nil {
+				return false, err
+			}
+			r.recordEvent(instance, v12.EventTypeNormal, eventReasonUpgradePaused, fmt.Sprintf(
+				"Paused the zero-downtime upgrade at stage %s. Set annotation %s to %q to continue or to %q to roll it back",
+				checkpoint.CurrentStage, UpgradeControlAnnotationKey, UpgradeControlResume, UpgradeControlAbort))
+		}
+		return true, nil
+	case control == UpgradeControlAbort && checkpoint.CurrentStage != RollingBack:
+		// the main node already runs the new spec
+		if checkpoint.CurrentStage.MainNodeUpgraded() {
+			r.recordEvent(instance, v12.EventTypeWarning, eventReasonUpgradeControlIgnored, fmt.Sprintf(
+				"The zero-downtime upgrade cannot be aborted at stage %s, the main node is already upgraded", checkpoint.CurrentStage))
+			return false, removeUpgradeControl(r, ctx, instance, UpgradeControlAbort)
+		}
+		message := fmt.Sprintf("The zero-downtime upgrade to %s was aborted at stage %s with annotation %s",
+			instance.Spec.Image, checkpoint.CurrentStage, UpgradeControlAnnotationKey)
+		rollingBack, err := startRollback(r, ctx, checkpoint, upgradeReasonAborted, message)
+		// an upgrade that failed without a rollback has no stage left to run
+		return err == nil && !rollingBack, err
+	case control != UpgradeControlPause && checkpoint.Paused:
+		if err := checkpoint.SetPaused(ctx, false); err != nil {
+			return false, err
+		}
+		r.recordEvent(instance, v12.EventTypeNormal, eventReasonUpgradeResumed,
+			fmt.Sprintf("Resumed the zero-downtime upgrade at stage %s", checkpoint.CurrentStage))
+	}
+	if control == UpgradeControlResume {
+		return false, removeUpgradeControl(r, ctx, instance, UpgradeControlResume)
+	}
+	return false, nil
+}
+
+// setUpgradeHeld records whether the ongoing upgrade waits for stopped nodes, a restore or the approval of a change,
+// so its stage does not time out meanwhile.
+func setUpgradeHeld(r *TeamcityReconciler, ctx context.Context, instance *TeamCity, held bool) error {
+	checkpoint := NewCheckpoint(r.Client, *instance)
+	checkpoint.Now = r.Now
+	if err := checkpoint.SetHeld(ctx, held); err != nil && !stderrors.Is(err, ErrNoCheckpoint) {
+		return err
+	}
+	return nil
+}
+
+// resetUpgradeControl removes a resume or abort request made while no upgrade is ongoing, so it does not act on the next one.
+func resetUpgradeControl(r *TeamcityReconciler, ctx context.Context, instance *TeamCity) error {
+	control := instance.UpgradeControl()
+	if control != UpgradeControlResume && control != UpgradeControlAbort {
+		return nil
+	}
+	r.recordEvent(instance, v12.EventTypeNormal, eventReasonUpgradeControlIgnored, fmt.Sprintf(
+		"Removed annotation %s=%s, no zero-downtime upgrade is in progress", UpgradeControlAnnotationKey, control))
+	return removeUpgradeControl(r, ctx, instance, control)
+}
+
+// removeUpgradeControl patches UpgradeControlAnnotationKey away if it still has the given value.
+func removeUpgradeControl(r *TeamcityReconciler, ctx context.Context, instance *TeamCity, control string) error {
+	var teamcity TeamCity
+	if err := r.Get(ctx, types.NamespacedName{Name: instance.Name, Namespace: instance.Namespace}, &teamcity); err != nil {
+		return err
+	}
+	if teamcity.UpgradeControl() != control {
+		return nil
+	}
+	patch := client.MergeFrom(teamcity.DeepCopy())
+	delete(teamcity.Annotations, UpgradeControlAnnotationKey)
+	return r.Patch(ctx, &teamcity, patch)
+}
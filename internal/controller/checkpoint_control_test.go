@@ -0,0 +1,155 @@
+package controller
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	. "git.jetbrains.team/tch/teamcity-operator/api/v1beta1"
+	"git.jetbrains.team/tch/teamcity-operator/internal/checkpoint"
+	"git.jetbrains.team/tch/teamcity-operator/internal/resource"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	v1 "k8s.io/api/apps/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+)
+
+// setUpgradeControlForTest sets the annotation on the stored TeamCity and returns it, as a reconciliation would read it.
+func setUpgradeControlForTest(t *testing.T, r *TeamcityReconciler, control string) *TeamCity {
+	var instance TeamCity
+	require.NoError(t, r.Get(context.Background(), types.NamespacedName{Name: "tc", Namespace: testNamespace}, &instance))
+	instance.Annotations[UpgradeControlAnnotationKey] = control
+	require.NoError(t, r.Update(context.Background(), &instance))
+	return &instance
+}
+
+func storedUpgradeControl(t *testing.T, r *TeamcityReconciler) string {
+	var instance TeamCity
+	require.NoError(t, r.Get(context.Background(), types.NamespacedName{Name: "tc", Namespace: testNamespace}, &instance))
+	return instance.UpgradeControl()
+}
+
+func loadCheckpointForTest(t *testing.T, r *TeamcityReconciler, instance *TeamCity) *checkpoint.Checkpoint {
+	loaded := checkpoint.NewCheckpoint(r.Client, *instance)
+	require.NoError(t, loaded.UpdateStageFromStatus(context.Background()))
+	return loaded
+}
+
+func TestPauseAndResumeUpgrade(t *testing.T) {
+	r, _ := newRollbackTestReconciler(t)
+	ctx := context.Background()
+	events := r.Recorder.(*record.FakeRecorder).Events
+	paused := rollbackTestStart.Add(checkpoint.DefaultStageTimeout + time.Hour)
+	r.Now = func() time.Time { return paused }
+
+	instance := setUpgradeControlForTest(t, r, UpgradeControlPause)
+	for i := 0; i < 2; i++ {
+		requeue, err := r.performZeroDowntimeUpgradeOrRequeue(ctx, instance, true)
+		require.NoError(t, err)
+		assert.True(t, requeue)
+	}
+	held := loadCheckpointForTest(t, r, instance)
+	assert.True(t, held.Paused)
+	assert.Equal(t, checkpoint.MainShuttingDown, held.CurrentStage, "a paused stage does not time out")
+	require.Len(t, events, 1)
+	assert.Contains(t, <-events, eventReasonUpgradePaused)
+
+	instance = setUpgradeControlForTest(t, r, UpgradeControlResume)
+	_, err := r.performZeroDowntimeUpgradeOrRequeue(ctx, instance, true)
+	require.NoError(t, err)
+	resumed := loadCheckpointForTest(t, r, instance)
+	assert.False(t, resumed.Paused)
+	assert.Equal(t, checkpoint.MainShuttingDown, resumed.CurrentStage)
+	assert.True(t, paused.Equal(resumed.StageTransitionTime), "the resumed stage is timed from the resume")
+	assert.Empty(t, storedUpgradeControl(t, r))
+	require.Len(t, events, 1)
+	assert.Contains(t, <-events, eventReasonUpgradeResumed)
+}
+
+func TestStoppedUpgradeIsTimedFromTheRestart(t *testing.T) {
+	r, instance := newRollbackTestReconciler(t)
+	ctx := context.Background()
+	// spec.stopped is set a few minutes into the stage and cleared long after the stage timeout
+	r.Now = func() time.Time { return rollbackTestStart.Add(5 * time.Minute) }
+	require.NoError(t, setUpgradeHeld(r, ctx, instance, true))
+	assert.True(t, loadCheckpointForTest(t, r, instance).Held)
+
+	restarted := rollbackTestStart.Add(checkpoint.DefaultStageTimeout + 2*time.Hour)
+	r.Now = func() time.Time { return restarted }
+	require.NoError(t, setUpgradeHeld(r, ctx, instance, false))
+	requeue, err := r.performZeroDowntimeUpgradeOrRequeue(ctx, instance, true)
+	require.NoError(t, err)
+	assert.True(t, requeue)
+	resumed := loadCheckpointForTest(t, r, instance)
+	assert.False(t, resumed.Held)
+	assert.Equal(t, checkpoint.MainShuttingDown, resumed.CurrentStage, "the held stage is not rolled back")
+	assert.True(t, restarted.Equal(resumed.StageTransitionTime), "the stage is timed from the restart")
+	assert.Empty(t, r.Recorder.(*record.FakeRecorder).Events)
+}
+
+func TestAbortUpgrade(t *testing.T) {
+	r, _ := newRollbackTestReconciler(t)
+	ctx := context.Background()
+	events := r.Recorder.(*record.FakeRecorder).Events
+
+	instance := setUpgradeControlForTest(t, r, UpgradeControlAbort)
+	requeue, err := r.performZeroDowntimeUpgradeOrRequeue(ctx, instance, true)
+	require.NoError(t, err)
+	assert.True(t, requeue)
+	assert.Equal(t, checkpoint.RollingBack, loadCheckpointForTest(t, r, instance).CurrentStage)
+	mainStatefulSet := getRollbackTestMainStatefulSet(t, r)
+	assert.Equal(t, rollbackTestPreviousImage, mainStatefulSet.Spec.Template.Spec.Containers[0].Image)
+	assert.Equal(t, UpgradeControlAbort, storedUpgradeControl(t, r))
+
+	mainStatefulSet.Status.UpdateRevision = "main-old"
+	mainStatefulSet.Status.ReadyReplicas = 1
+	require.NoError(t, r.Status().Update(ctx, mainStatefulSet))
+	_, err = r.performZeroDowntimeUpgradeOrRequeue(ctx, instance, true)
+	require.NoError(t, err)
+
+	assert.False(t, ongoingZeroDowntimeUpgrade(r, ctx, instance))
+	err = r.Get(ctx, resource.GetROStatefulSetNamespacedName(instance), &v1.StatefulSet{})
+	assert.True(t, errors.IsNotFound(err))
+	assert.Empty(t, storedUpgradeControl(t, r))
+	var updated TeamCity
+	require.NoError(t, r.Get(ctx, types.NamespacedName{Name: "tc", Namespace: testNamespace}, &updated))
+	require.NotNil(t, updated.Status.Upgrade)
+	assert.Equal(t, UpgradePhaseAborted, updated.Status.Upgrade.Phase)
+	assert.Equal(t, upgradeReasonAborted, updated.Status.Upgrade.Reason)
+	assert.True(t, updated.UpgradeRolledBack())
+
+	require.Len(t, events, 4)
+	assert.Contains(t, <-events, eventReasonUpgradeRollingBack)
+	assert.Contains(t, <-events, eventReasonMainNodeRestored)
+	assert.Contains(t, <-events, eventReasonUpdateReplicaRemoved)
+	assert.Contains(t, <-events, eventReasonUpgradeAborted)
+}
+
+func TestAbortIsIgnoredOnceTheMainNodeIsUpgraded(t *testing.T) {
+	r, instance := newRollbackTestReconciler(t)
+	ctx := context.Background()
+	require.NoError(t, loadCheckpointForTest(t, r, instance).DoCheckpointWithDesiredStage(ctx, checkpoint.MainReady))
+
+	instance = setUpgradeControlForTest(t, r, UpgradeControlAbort)
+	_, err := r.performZeroDowntimeUpgradeOrRequeue(ctx, instance, true)
+	require.NoError(t, err)
+
+	assert.Equal(t, checkpoint.UpdateFinished, loadCheckpointForTest(t, r, instance).CurrentStage)
+	assert.Equal(t, rollbackTestImage, getRollbackTestMainStatefulSet(t, r).Spec.Template.Spec.Containers[0].Image)
+	assert.Empty(t, storedUpgradeControl(t, r))
+	assert.Contains(t, <-r.Recorder.(*record.FakeRecorder).Events, eventReasonUpgradeControlIgnored)
+}
+
+func TestUpgradeControlWithoutUpgradeIsRemoved(t *testing.T) {
+	instance := newZeroDowntimeTestTeamCity(rollbackTestImage)
+	instance.Annotations[UpgradeControlAnnotationKey] = UpgradeControlAbort
+	r := newTestTeamcityReconciler(t, instance, newZeroDowntimeTestStatefulSet(rollbackTestImage))
+	r.Recorder = record.NewFakeRecorder(10)
+
+	_, err := r.performZeroDowntimeUpgradeOrRequeue(context.Background(), instance, false)
+	require.NoError(t, err)
+	assert.Empty(t, storedUpgradeControl(t, r))
+	assert.Contains(t, <-r.Recorder.(*record.FakeRecorder).Events, eventReasonUpgradeControlIgnored)
+}
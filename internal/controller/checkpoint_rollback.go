@@ -0,0 +1,256 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+
+	. "git.jetbrains.team/tch/teamcity-operator/api/v1beta1"
+	. "git.jetbrains.team/tch/teamcity-operator/internal/checkpoint"
+	"git.jetbrains.team/tch/teamcity-operator/internal/metrics"
+	"git.jetbrains.team/tch/teamcity-operator/internal/resource"
+	v1 "k8s.io/api/apps/v1"
+	v12 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/util/retry"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+const (
+	upgradeReasonStageTimedOut = "StageTimedOut"
+	upgradeReasonAborted       = "Aborted"
+
+	eventReasonUpgradeRollingBack   = "UpgradeRollingBack"
+	eventReasonMainNodeRestored     = "MainNodeRestored"
+	eventReasonUpdateReplicaRemoved = "UpdateReplicaRemoved"
+	eventReasonUpgradeFailed        = "UpgradeFailed"
+	eventReasonUpgradeAborted       = "UpgradeAborted"
+)
+
+// rollbackTimedOutStage rolls back an upgrade that stayed in its stage for longer than the stage timeout.
+// It reports whether the upgrade is rolling back, see startRollback.
+func rollbackTimedOutStage(r *TeamcityReconciler, ctx context.Context, checkpoint *Checkpoint) (bool, error) {
+	instance := checkpoint.Instance
+	timedOutStage := checkpoint.CurrentStage
+	message := fmt.Sprintf("The zero-downtime upgrade to %s did not leave stage %s within %s",
+		instance.Spec.Image, timedOutStage, checkpoint.StageTimeout())
+	rollingBack, err := startRollback(r, ctx, checkpoint, upgradeReasonStageTimedOut, message)
+	if err != nil || !rollingBack {
+		return false, err
+	}
+	metrics.UpgradeRollbacks.WithLabelValues(instance.Namespace, instance.Name, timedOutStage.String()).Inc()
+	return true, nil
+}
+
+// startRollback moves the checkpoint to RollingBack and reports it in status.upgrade. Without a recorded pod template
+// of the main node there is nothing to restore, so the upgrade is marked Failed right away and false is returned:
+// the checkpoint is gone and no stage is left to run.
+func startRollback(r *TeamcityReconciler, ctx context.Context, checkpoint *Checkpoint, reason string, message string) (bool, error) {
+	if checkpoint.PreviousMainTemplate == nil {
+		return false, failUpgradeWithoutRollback(r, ctx, checkpoint, reason, message)
+	}
+	instance := checkpoint.Instance
+	stage := checkpoint.CurrentStage
+	if err := checkpoint.StartRollback(ctx, reason, message); err != nil {
+		return false, err
+	}
+	log.FromContext(ctx).Info("Rolling back zero-downtime upgrade", "stage", stage.String(), "reason", reason)
+	r.recordEvent(&instance, v12.EventTypeWarning, eventReasonUpgradeRollingBack, message+"; restoring the main node")
+	return true, setUpgradeStatus(r, ctx, &instance, upgradeStatusFromCheckpoint(r, checkpoint, UpgradePhaseRollingBack))
+}
+
+// failUpgradeWithoutRollback marks an upgrade Failed that cannot be rolled back, as no pod template of the main node
+// was recorded, e.g. because the main StatefulSet did not exist when the upgrade started or the checkpoint was
+// migrated from an older operator. The nodes are left as they are; status.upgrade and the event report the failure.
+func failUpgradeWithoutRollback(r *TeamcityReconciler, ctx context.Context, checkpoint *Checkpoint, reason string, message string) error {
+	instance := checkpoint.Instance
+	checkpoint.RollbackReason = reason
+	checkpoint.RollbackMessage = message + "; no pod template of the main node was recorded, so it cannot be rolled back"
+	if err := setUpgradeStatus(r, ctx, &instance, upgradeStatusFromCheckpoint(r, checkpoint, UpgradePhaseFailed)); err != nil {
+		return err
+	}
+	if err := checkpoint.Finish(ctx, UpgradePhaseFailed); err != nil {
+		return err
+	}
+	metrics.FinishUpgrade(instance.Namespace, instance.Name)
+	log.FromContext(ctx).Info("Zero-downtime upgrade failed without a rollback", "reason", reason)
+	r.recordEvent(&instance, v12.EventTypeWarning, eventReasonUpgradeFailed, checkpoint.RollbackMessage+
+		". Fix the main node by hand or change the spec to retry the upgrade")
+	return nil
+}
+
+// HandleRollingBack restores the main node and the secondary nodes restarted so far to the pod templates recorded
+// when the upgrade started. Once they are ready again the replica is torn down, the checkpoint is removed and the upgrade is marked Failed, or Aborted, which keeps
+// the spec from being applied again until it changes.
+func HandleRollingBack(r *TeamcityReconciler, ctx context.Context, checkpoint *Checkpoint) (bool, error) {
+	// a rollback started by an older operator, which did not check for the template
+	if checkpoint.PreviousMainTemplate == nil {
+		return true, failUpgradeWithoutRollback(r, ctx, checkpoint, checkpoint.RollbackReason, checkpoint.RollbackMessage)
+	}
+	secondaryNodesRestored, err := restoreSecondaryStatefulSets(r, ctx, checkpoint)
+	if err != nil {
+		return true, err
+	}
+	restored, err := restoreMainStatefulSet(r, ctx, checkpoint)
+	if err != nil || !restored || !secondaryNodesRestored {
+		return true, err
+	}
+	// the secondary nodes of the interrupted batch get back the responsibilities they gave up
+	if err := restoreResponsibilities(r, ctx, checkpoint); err != nil {
+		return true, err
+	}
+	instance := checkpoint.Instance
+	var roStatefulSet v1.StatefulSet
+	if err := r.Get(ctx, resource.GetROStatefulSetNamespacedName(&instance), &roStatefulSet); err == nil {
+		if err := r.Delete(ctx, &roStatefulSet); err != nil && !errors.IsNotFound(err) {
+			return false, err
+		}
+		r.recordEvent(&instance, v12.EventTypeNormal, eventReasonUpdateReplicaRemoved,
+			fmt.Sprintf("Deleted the update replica StatefulSet %s", roStatefulSet.Name))
+	} else if !errors.IsNotFound(err) {
+		return false, err
+	}
+
+	phase, eventType, eventReason := UpgradePhaseFailed, v12.EventTypeWarning, eventReasonUpgradeFailed
+	if checkpoint.RollbackReason == upgradeReasonAborted {
+		phase, eventType, eventReason = UpgradePhaseAborted, v12.EventTypeNormal, eventReasonUpgradeAborted
+		if err := removeUpgradeControl(r, ctx, &instance, UpgradeControlAbort); err != nil {
+			return false, err
+		}
+	}
+	if err := setUpgradeStatus(r, ctx, &instance, upgradeStatusFromCheckpoint(r, checkpoint, phase)); err != nil {
+		return false, err
+	}
+	if err := checkpoint.Finish(ctx, phase); err != nil {
+		return false, err
+	}
+	metrics.FinishUpgrade(instance.Namespace, instance.Name)
+	r.recordEvent(&instance, eventType, eventReason, checkpoint.RollbackMessage+
+		"; deleted the upgrade checkpoint and the main node runs its previous spec again. Change the spec to retry the upgrade")
+	// the next reconciliation reads the status and leaves the nodes alone
+	return true, nil
+}
+
+// restoreMainStatefulSet puts the recorded pod template back on the main StatefulSet and reports whether the main
+// node runs it again.
+func restoreMainStatefulSet(r *TeamcityReconciler, ctx context.Context, checkpoint *Checkpoint) (bool, error) {
+	instance := checkpoint.Instance
+	return restoreStatefulSet(r, ctx, &instance, instance.Spec.MainNode.GetNamespacedNameFromNamespace(instance.Namespace),
+		checkpoint.PreviousMainTemplate, eventReasonMainNodeRestored, "main")
+}
+
+// restoreSecondaryStatefulSets does the same as restoreMainStatefulSet for the secondary nodes restarted so far.
+func restoreSecondaryStatefulSets(r *TeamcityReconciler, ctx context.Context, checkpoint *Checkpoint) (bool, error) {
+	instance := checkpoint.Instance
+	restored := true
+	for _, nodeName := range append(append([]string{}, checkpoint.UpgradedNodes...), checkpoint.Nodes...) {
+		template, ok := checkpoint.PreviousSecondaryTemplates[nodeName]
+		if !ok {
+			continue
+		}
+		nodeRestored, err := restoreStatefulSet(r, ctx, &instance, types.NamespacedName{Name: nodeName, Namespace: instance.Namespace},
+			&template, eventReasonSecondaryNodeRestored, "secondary")
+		if err != nil {
+			return false, err
+		}
+		restored = restored && nodeRestored
+	}
+	return restored, nil
+}
+
+// restoreStatefulSet puts the recorded pod template back on a node StatefulSet and reports whether the node runs it
+// again. The StatefulSet controller does not replace a pod that never became ready, so a pod of the failed revision
+// is deleted.
+func restoreStatefulSet(r *TeamcityReconciler, ctx context.Context, instance *TeamCity, namespacedName types.NamespacedName,
+	previousTemplate *v12.PodTemplateSpec, eventReason string, role string) (bool, error) {
+	var statefulSet v1.StatefulSet
+	if err := r.Get(ctx, namespacedName, &statefulSet); err != nil {
+		if errors.IsNotFound(err) {
+			return true, nil
+		}
+		return false, err
+	}
+	if previousTemplate != nil && !equality.Semantic.DeepEqual(statefulSet.Spec.Template, *previousTemplate) {
+		log.FromContext(ctx).V(1).Info("Restoring the pod template of the node", "statefulSet", statefulSet.Name)
+		statefulSet.Spec.Template = *previousTemplate.DeepCopy()
+		if err := r.Update(ctx, &statefulSet); err != nil {
+			return false, err
+		}
+		r.recordEvent(instance, v12.EventTypeNormal, eventReason,
+			fmt.Sprintf("Restored the pod template the %s StatefulSet %s had before the upgrade", role, statefulSet.Name))
+		return false, nil
+	}
+	if statefulSet.Generation != statefulSet.Status.ObservedGeneration {
+		return false, nil
+	}
+	if isStatefulSetUpdateFinished(&statefulSet) {
+		return true, nil
+	}
+	return false, deleteFailedRevisionPod(r, ctx, &statefulSet)
+}
+
+func deleteFailedRevisionPod(r *TeamcityReconciler, ctx context.Context, statefulSet *v1.StatefulSet) error {
+	var pod v12.Pod
+	if err := r.Get(ctx, types.NamespacedName{Namespace: statefulSet.Namespace, Name: statefulSet.Name + "-0"}, &pod); err != nil {
+		if errors.IsNotFound(err) {
+			return nil
+		}
+		return err
+	}
+	if pod.DeletionTimestamp != nil || pod.Labels[v1.ControllerRevisionHashLabelKey] == statefulSet.Status.UpdateRevision || podReady(&pod) {
+		return nil
+	}
+	log.FromContext(ctx).V(1).Info("Deleting the pod of the failed revision", "pod", pod.Name)
+	if err := r.Delete(ctx, &pod); err != nil && !errors.IsNotFound(err) {
+		return err
+	}
+	return nil
+}
+
+func podReady(pod *v12.Pod) bool {
+	for _, condition := range pod.Status.Conditions {
+		if condition.Type == v12.PodReady {
+			return condition.Status == v12.ConditionTrue
+		}
+	}
+	return false
+}
+
+func upgradeStatusFromCheckpoint(r *TeamcityReconciler, checkpoint *Checkpoint, phase UpgradePhase) *UpgradeStatus {
+	generation := checkpoint.Generation
+	if generation == 0 {
+		generation = checkpoint.Instance.Generation
+	}
+	toImage := checkpoint.ToImage
+	if toImage == "" {
+		toImage = checkpoint.Instance.Spec.Image
+	}
+	transitionTime := metav1.NewTime(r.now())
+	return &UpgradeStatus{
+		Phase:              phase,
+		Reason:             checkpoint.RollbackReason,
+		Message:            checkpoint.RollbackMessage,
+		Generation:         generation,
+		FromImage:          checkpoint.FromImage,
+		ToImage:            toImage,
+		LastTransitionTime: &transitionTime,
+	}
+}
+
+// setUpgradeStatus writes status.upgrade of the instance; nil removes it.
+func setUpgradeStatus(r *TeamcityReconciler, ctx context.Context, instance *TeamCity, upgrade *UpgradeStatus) error {
+	namespacedName := types.NamespacedName{Name: instance.Name, Namespace: instance.Namespace}
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		teamcity, err := getTeamCityObjectE(r, ctx, namespacedName)
+		if err != nil {
+			return err
+		}
+		if equality.Semantic.DeepEqual(teamcity.Status.Upgrade, upgrade) {
+			return nil
+		}
+		teamcity.Status.Upgrade = upgrade
+		return r.Status().Update(ctx, &teamcity)
+	})
+}
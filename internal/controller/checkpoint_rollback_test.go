@@ -0,0 +1,242 @@
+package controller
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	. "git.jetbrains.team/tch/teamcity-operator/api/v1beta1"
+	"git.jetbrains.team/tch/teamcity-operator/internal/checkpoint"
+	"git.jetbrains.team/tch/teamcity-operator/internal/resource"
+	"git.jetbrains.team/tch/teamcity-operator/internal/teamcity"
+	"git.jetbrains.team/tch/teamcity-operator/internal/teamcity/teamcitytest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	v1 "k8s.io/api/apps/v1"
+	v12 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	rollbackTestPreviousImage = "jetbrains/teamcity-server:2024.07.1"
+	rollbackTestImage         = "jetbrains/teamcity-server:2024.07.3"
+)
+
+var rollbackTestStart = time.Date(2024, 8, 1, 10, 0, 0, 0, time.UTC)
+
+// newRollbackTestReconciler returns a reconciler with an upgrade that entered MainShuttingDown at rollbackTestStart,
+// after the main StatefulSet was moved from rollbackTestPreviousImage to rollbackTestImage.
+func newRollbackTestReconciler(t *testing.T) (*TeamcityReconciler, *TeamCity) {
+	instance := newZeroDowntimeTestTeamCity(rollbackTestImage)
+	instance.Generation = 2
+	mainStatefulSet := newZeroDowntimeTestStatefulSet(rollbackTestPreviousImage)
+	updateReplica := newTestStatefulSet(resource.GetROStatefulSetNamespacedName(instance).Name, 1)
+	r := newTestTeamcityReconciler(t, instance, mainStatefulSet, updateReplica)
+	r.Recorder = record.NewFakeRecorder(10)
+	ctx := context.Background()
+
+	upgrade := checkpoint.NewCheckpoint(r.Client, *instance)
+	upgrade.Now = func() time.Time { return rollbackTestStart }
+	require.NoError(t, upgrade.DoCheckpointWithDesiredStage(ctx, checkpoint.MainShuttingDown))
+
+	require.NoError(t, r.Get(ctx, types.NamespacedName{Name: "main", Namespace: testNamespace}, mainStatefulSet))
+	mainStatefulSet.Spec.Template.Spec.Containers[0].Image = rollbackTestImage
+	require.NoError(t, r.Update(ctx, mainStatefulSet))
+	mainStatefulSet.Status.UpdateRevision = "main-new"
+	mainStatefulSet.Status.CurrentRevision = "main-old"
+	mainStatefulSet.Status.ReadyReplicas = 0
+	require.NoError(t, r.Status().Update(ctx, mainStatefulSet))
+	return r, instance
+}
+
+func getRollbackTestMainStatefulSet(t *testing.T, r *TeamcityReconciler) *v1.StatefulSet {
+	var statefulSet v1.StatefulSet
+	require.NoError(t, r.Get(context.Background(), types.NamespacedName{Name: "main", Namespace: testNamespace}, &statefulSet))
+	return &statefulSet
+}
+
+func TestUpgradeWaitsWithinStageTimeout(t *testing.T) {
+	r, instance := newRollbackTestReconciler(t)
+	r.Now = func() time.Time { return rollbackTestStart.Add(checkpoint.DefaultStageTimeout - time.Minute) }
+
+	requeue, err := r.performZeroDowntimeUpgradeOrRequeue(context.Background(), instance, true)
+	require.NoError(t, err)
+	assert.True(t, requeue)
+	assert.Equal(t, checkpoint.MainShuttingDown.String(), currentRollbackTestStage(t, r, instance))
+	assert.Equal(t, rollbackTestImage, getRollbackTestMainStatefulSet(t, r).Spec.Template.Spec.Containers[0].Image)
+}
+
+func TestUpgradeStageTimeoutAnnotation(t *testing.T) {
+	r, instance := newRollbackTestReconciler(t)
+	instance.Annotations[UpgradeStageTimeoutAnnotationKey] = "5m"
+	r.Now = func() time.Time { return rollbackTestStart.Add(6 * time.Minute) }
+
+	_, err := r.performZeroDowntimeUpgradeOrRequeue(context.Background(), instance, true)
+	require.NoError(t, err)
+	assert.Equal(t, checkpoint.RollingBack.String(), currentRollbackTestStage(t, r, instance))
+}
+
+func TestUpgradeWaitsForTeamCityOnTheMainNode(t *testing.T) {
+	server := teamcitytest.NewServer("")
+	defer server.Close()
+	server.SetMaintenance(true)
+	r, instance := newRollbackTestReconciler(t)
+	instance.Spec.APITokenSecret = &v12.SecretKeySelector{LocalObjectReference: v12.LocalObjectReference{Name: "token"}, Key: "token"}
+	r.ClientFactory = func(ctx context.Context, reader client.Reader, instance *TeamCity) (*teamcity.Client, error) {
+		return teamcity.NewClient(server.URL, server.Token, http.DefaultClient), nil
+	}
+	r.Now = func() time.Time { return rollbackTestStart.Add(time.Minute) }
+	ctx := context.Background()
+	mainStatefulSet := getRollbackTestMainStatefulSet(t, r)
+	mainStatefulSet.Status.CurrentRevision = "main-new"
+	mainStatefulSet.Status.ReadyReplicas = 1
+	require.NoError(t, r.Status().Update(ctx, mainStatefulSet))
+
+	// the pod is ready, but the server waits on the maintenance page
+	requeue, err := r.performZeroDowntimeUpgradeOrRequeue(ctx, instance, true)
+	require.NoError(t, err)
+	assert.True(t, requeue)
+	assert.Equal(t, checkpoint.MainShuttingDown.String(), currentRollbackTestStage(t, r, instance))
+
+	server.SetMaintenance(false)
+	requeue, err = r.performZeroDowntimeUpgradeOrRequeue(ctx, instance, true)
+	require.NoError(t, err)
+	assert.True(t, requeue)
+	assert.Equal(t, checkpoint.MainReady.String(), currentRollbackTestStage(t, r, instance))
+	events := r.Recorder.(*record.FakeRecorder).Events
+	require.Len(t, events, 1)
+	assert.Equal(t, "Normal MainNodeUpgraded Main node runs TeamCity 2024.03 (build 156287)", <-events)
+}
+
+func TestTimedOutUpgradeIsRolledBack(t *testing.T) {
+	r, instance := newRollbackTestReconciler(t)
+	ctx := context.Background()
+	r.Now = func() time.Time { return rollbackTestStart.Add(checkpoint.DefaultStageTimeout + time.Minute) }
+
+	requeue, err := r.performZeroDowntimeUpgradeOrRequeue(ctx, instance, true)
+	require.NoError(t, err)
+	assert.True(t, requeue)
+	assert.Equal(t, checkpoint.RollingBack.String(), currentRollbackTestStage(t, r, instance))
+	mainStatefulSet := getRollbackTestMainStatefulSet(t, r)
+	assert.Equal(t, rollbackTestPreviousImage, mainStatefulSet.Spec.Template.Spec.Containers[0].Image)
+	var updated TeamCity
+	require.NoError(t, r.Get(ctx, types.NamespacedName{Name: "tc", Namespace: testNamespace}, &updated))
+	require.NotNil(t, updated.Status.Upgrade)
+	assert.Equal(t, UpgradePhaseRollingBack, updated.Status.Upgrade.Phase)
+	assert.Equal(t, upgradeReasonStageTimedOut, updated.Status.Upgrade.Reason)
+	assert.Contains(t, updated.Status.Upgrade.Message, "main-shutting-down")
+
+	// the main node waits for the previous revision
+	requeue, err = r.performZeroDowntimeUpgradeOrRequeue(ctx, instance, true)
+	require.NoError(t, err)
+	assert.True(t, requeue)
+	assert.Equal(t, checkpoint.RollingBack.String(), currentRollbackTestStage(t, r, instance))
+
+	mainStatefulSet.Status.UpdateRevision = "main-old"
+	mainStatefulSet.Status.ReadyReplicas = 1
+	require.NoError(t, r.Status().Update(ctx, mainStatefulSet))
+	requeue, err = r.performZeroDowntimeUpgradeOrRequeue(ctx, instance, true)
+	require.NoError(t, err)
+	assert.True(t, requeue)
+
+	assert.False(t, ongoingZeroDowntimeUpgrade(r, ctx, instance))
+	var updateReplica v1.StatefulSet
+	err = r.Get(ctx, resource.GetROStatefulSetNamespacedName(instance), &updateReplica)
+	assert.True(t, errors.IsNotFound(err))
+	require.NoError(t, r.Get(ctx, types.NamespacedName{Name: "tc", Namespace: testNamespace}, &updated))
+	assert.True(t, updated.UpgradeRolledBack())
+	assert.Equal(t, rollbackTestPreviousImage, updated.Status.Upgrade.FromImage)
+	assert.Equal(t, rollbackTestImage, updated.Status.Upgrade.ToImage)
+	assert.Nil(t, updated.Status.UpgradeCheckpoint)
+	require.Len(t, updated.Status.UpgradeHistory, 1)
+	assert.Equal(t, UpgradePhaseFailed, updated.Status.UpgradeHistory[0].Phase)
+	assert.Equal(t, upgradeReasonStageTimedOut, updated.Status.UpgradeHistory[0].Reason)
+	assert.Equal(t, rollbackTestImage, updated.Status.UpgradeHistory[0].ToImage)
+	events := r.Recorder.(*record.FakeRecorder).Events
+	require.Len(t, events, 4)
+	assert.Contains(t, <-events, eventReasonUpgradeRollingBack)
+	assert.Contains(t, <-events, eventReasonMainNodeRestored)
+	assert.Contains(t, <-events, eventReasonUpdateReplicaRemoved)
+	assert.Contains(t, <-events, eventReasonUpgradeFailed)
+
+	// the failed spec does not start another upgrade
+	requeue, err = r.performZeroDowntimeUpgradeOrRequeue(ctx, &updated, false)
+	require.NoError(t, err)
+	assert.False(t, requeue)
+	assert.False(t, ongoingZeroDowntimeUpgrade(r, ctx, &updated))
+
+	updated.Generation++
+	assert.False(t, updated.UpgradeRolledBack())
+}
+
+func TestTimedOutUpgradeWithoutRecordedTemplateFails(t *testing.T) {
+	r, instance := newRollbackTestReconciler(t)
+	ctx := context.Background()
+	var stored TeamCity
+	require.NoError(t, r.Get(ctx, types.NamespacedName{Name: "tc", Namespace: testNamespace}, &stored))
+	// the main StatefulSet did not exist when the upgrade started
+	stored.Status.UpgradeCheckpoint.PreviousMainTemplate = nil
+	require.NoError(t, r.Status().Update(ctx, &stored))
+	r.Now = func() time.Time { return rollbackTestStart.Add(checkpoint.DefaultStageTimeout + time.Minute) }
+
+	_, err := r.performZeroDowntimeUpgradeOrRequeue(ctx, instance, true)
+	require.NoError(t, err, "the failure is reported in the status, not retried")
+
+	assert.False(t, ongoingZeroDowntimeUpgrade(r, ctx, instance), "the upgrade does not stay in RollingBack")
+	assert.Equal(t, rollbackTestImage, getRollbackTestMainStatefulSet(t, r).Spec.Template.Spec.Containers[0].Image)
+	require.NoError(t, r.Get(ctx, types.NamespacedName{Name: "tc", Namespace: testNamespace}, &stored))
+	require.NotNil(t, stored.Status.Upgrade)
+	assert.Equal(t, UpgradePhaseFailed, stored.Status.Upgrade.Phase)
+	assert.Equal(t, upgradeReasonStageTimedOut, stored.Status.Upgrade.Reason)
+	assert.Contains(t, stored.Status.Upgrade.Message, "no pod template of the main node was recorded")
+	assert.True(t, stored.UpgradeRolledBack())
+	require.Len(t, stored.Status.UpgradeHistory, 1)
+	assert.Equal(t, UpgradePhaseFailed, stored.Status.UpgradeHistory[0].Phase)
+	events := r.Recorder.(*record.FakeRecorder).Events
+	require.Len(t, events, 1)
+	assert.Contains(t, <-events, eventReasonUpgradeFailed)
+}
+
+func TestRollbackDeletesPodOfFailedRevision(t *testing.T) {
+	statefulSet := newTestStatefulSet("main", 1)
+	statefulSet.Status.UpdateRevision = "main-old"
+	pod := func(revision string, ready v12.ConditionStatus) *v12.Pod {
+		return &v12.Pod{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "main-0",
+				Namespace: testNamespace,
+				Labels:    map[string]string{v1.ControllerRevisionHashLabelKey: revision},
+			},
+			Status: v12.PodStatus{Conditions: []v12.PodCondition{{Type: v12.PodReady, Status: ready}}},
+		}
+	}
+	tests := []struct {
+		name    string
+		pod     *v12.Pod
+		deleted bool
+	}{
+		{"failed revision", pod("main-new", v12.ConditionFalse), true},
+		{"ready pod of the failed revision", pod("main-new", v12.ConditionTrue), false},
+		{"previous revision", pod("main-old", v12.ConditionFalse), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newTestTeamcityReconciler(t, tt.pod)
+
+			require.NoError(t, deleteFailedRevisionPod(r, context.Background(), statefulSet))
+			err := r.Get(context.Background(), types.NamespacedName{Name: "main-0", Namespace: testNamespace}, &v12.Pod{})
+			assert.Equal(t, tt.deleted, errors.IsNotFound(err))
+		})
+	}
+}
+
+func currentRollbackTestStage(t *testing.T, r *TeamcityReconciler, instance *TeamCity) string {
+	stage, err := checkpoint.NewCheckpoint(r.Client, *instance).FetchCurrentStageFromCluster(context.Background())
+	require.NoError(t, err)
+	return stage.String()
+}
@@ -0,0 +1,268 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	. "git.jetbrains.team/tch/teamcity-operator/api/v1beta1"
+	. "git.jetbrains.team/tch/teamcity-operator/internal/checkpoint"
+	"git.jetbrains.team/tch/teamcity-operator/internal/resource"
+	"git.jetbrains.team/tch/teamcity-operator/internal/teamcity"
+	v1 "k8s.io/api/apps/v1"
+	v12 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+const (
+	eventReasonUpgradingSecondaryNodes = "UpgradingSecondaryNodes"
+	eventReasonSecondaryNodesUpgraded  = "SecondaryNodesUpgraded"
+	eventReasonSecondaryNodeRestored   = "SecondaryNodeRestored"
+)
+
+// HandleSecondaryNodesUpgrading restarts the secondary nodes in batches of UpgradeMaxUnavailable nodes. The
+// responsibilities of a batch are moved to the main node while it restarts and given back once every node of the
+// batch runs the new spec and is online again. The main node is switched after the last batch.
+func HandleSecondaryNodesUpgrading(r *TeamcityReconciler, ctx context.Context, checkpoint *Checkpoint) (bool, error) {
+	// the first call creates the checkpoint and records the nodes as they are before the upgrade
+	if err := checkpoint.DoCheckpointWithDesiredStage(ctx, SecondaryNodesUpgrading); err != nil {
+		return false, err
+	}
+	instance := checkpoint.Instance
+	if len(checkpoint.Nodes) == 0 {
+		batch, err := nextSecondaryNodeBatch(r, ctx, checkpoint)
+		if err != nil {
+			return false, err
+		}
+		if len(batch) == 0 {
+			return true, checkpoint.DoCheckpointWithDesiredStage(ctx, ReplicaReady)
+		}
+		if err := checkpoint.StartNodeBatch(ctx, batch); err != nil {
+			return false, err
+		}
+		r.recordEvent(&instance, v12.EventTypeNormal, eventReasonUpgradingSecondaryNodes,
+			fmt.Sprintf("Upgrading secondary nodes %s", strings.Join(batch, ", ")))
+		return true, nil
+	}
+
+	switch checkpoint.NodeStep {
+	case NodeStepMovingResponsibilities:
+		if err := moveResponsibilities(r, ctx, checkpoint); err != nil {
+			return false, err
+		}
+		if err := applySecondaryNodes(r, ctx, checkpoint); err != nil {
+			return false, err
+		}
+		return true, checkpoint.SetNodeStep(ctx, NodeStepRestarting)
+	case NodeStepRestarting:
+		restarted, err := secondaryNodesRestarted(r, ctx, checkpoint)
+		if err != nil || !restarted {
+			return true, err
+		}
+		return true, checkpoint.SetNodeStep(ctx, NodeStepRestoringResponsibilities)
+	case NodeStepRestoringResponsibilities:
+		if err := restoreResponsibilities(r, ctx, checkpoint); err != nil {
+			return false, err
+		}
+		nodes := checkpoint.Nodes
+		if err := checkpoint.FinishNodeBatch(ctx); err != nil {
+			return false, err
+		}
+		r.recordEvent(&instance, v12.EventTypeNormal, eventReasonSecondaryNodesUpgraded,
+			fmt.Sprintf("Secondary nodes %s run the new spec", strings.Join(nodes, ", ")))
+		return true, nil
+	default:
+		return false, fmt.Errorf("unknown step %q of secondary nodes %s", checkpoint.NodeStep, strings.Join(checkpoint.Nodes, ", "))
+	}
+}
+
+// nextSecondaryNodeBatch returns up to UpgradeMaxUnavailable secondary nodes, in spec order, whose StatefulSet still
+// has to be restarted. Nodes without a StatefulSet are created with the new spec once the upgrade is finished.
+func nextSecondaryNodeBatch(r *TeamcityReconciler, ctx context.Context, checkpoint *Checkpoint) ([]string, error) {
+	instance := checkpoint.Instance
+	var batch []string
+	for _, node := range instance.Spec.SecondaryNodes {
+		if len(batch) == instance.UpgradeMaxUnavailable() {
+			break
+		}
+		if containsNodeName(checkpoint.UpgradedNodes, node.Name) {
+			continue
+		}
+		var statefulSet v1.StatefulSet
+		if err := r.Get(ctx, node.GetNamespacedNameFromNamespace(instance.Namespace), &statefulSet); err != nil {
+			if errors.IsNotFound(err) {
+				continue
+			}
+			return nil, err
+		}
+		if resource.ChangesRequireNodeStatefulSetRestart(&instance, node, &statefulSet) {
+			batch = append(batch, node.Name)
+		}
+	}
+	return batch, nil
+}
+
+// applySecondaryNodes applies the new spec to the StatefulSets of the current batch.
+func applySecondaryNodes(r *TeamcityReconciler, ctx context.Context, checkpoint *Checkpoint) error {
+	instance := checkpoint.Instance
+	resourceBuilder := resource.TeamCityResourceBuilder{Instance: &instance, Scheme: r.Scheme, Client: r.Client}
+	namespacedName := types.NamespacedName{Name: instance.Name, Namespace: instance.Namespace}
+	_, err := r.reconcileCreateOrUpdate(ctx, resourceBuilder.SecondaryStatefulSetOf(checkpoint.Nodes...), &instance, namespacedName)
+	return err
+}
+
+// secondaryNodesRestarted reports whether every node of the current batch runs the new spec, is ready and, with REST
+// access, online in TeamCity again.
+func secondaryNodesRestarted(r *TeamcityReconciler, ctx context.Context, checkpoint *Checkpoint) (bool, error) {
+	instance := checkpoint.Instance
+	for _, nodeName := range checkpoint.Nodes {
+		statefulSet, err := getStatefulSetByName(r, ctx, types.NamespacedName{Name: nodeName, Namespace: instance.Namespace})
+		if err != nil {
+			return false, err
+		}
+		node, _ := secondaryNodeByName(&instance, nodeName)
+		// a StatefulSet read before the new spec was applied looks rolled out as well
+		if resource.ChangesRequireNodeStatefulSetRestart(&instance, node, &statefulSet) ||
+			statefulSet.Generation != statefulSet.Status.ObservedGeneration || !isStatefulSetUpdateFinished(&statefulSet) {
+			log.FromContext(ctx).V(1).Info("Waiting for the secondary node to restart", "node", nodeName)
+			return false, nil
+		}
+	}
+	if !instance.APITokenSecretProvided() {
+		return true, nil
+	}
+	tcClient, err := r.clientFactory()(ctx, r.Client, &instance)
+	if err != nil {
+		return false, err
+	}
+	serverNodes, err := tcClient.ListNodes(ctx)
+	if err != nil {
+		return false, err
+	}
+	for _, nodeName := range checkpoint.Nodes {
+		if serverNode, ok := serverNodeByID(serverNodes, nodeName); !ok || !serverNode.Online {
+			log.FromContext(ctx).V(1).Info("Waiting for the secondary node to come online", "node", nodeName)
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// moveResponsibilities disables the responsibilities of the current batch and enables them on the main node, unless
+// a node outside the batch already holds them. The moves are recorded first, so a restarted operator gives them back.
+// Without spec.apiTokenSecret the nodes keep their responsibilities while they restart.
+func moveResponsibilities(r *TeamcityReconciler, ctx context.Context, checkpoint *Checkpoint) error {
+	instance := checkpoint.Instance
+	if !instance.APITokenSecretProvided() {
+		log.FromContext(ctx).Info("Restarting secondary nodes without moving their responsibilities, spec.apiTokenSecret is not set")
+		return nil
+	}
+	tcClient, err := r.clientFactory()(ctx, r.Client, &instance)
+	if err != nil {
+		return err
+	}
+	moved := checkpoint.MovedResponsibilities
+	if moved == nil {
+		serverNodes, err := tcClient.ListNodes(ctx)
+		if err != nil {
+			return err
+		}
+		moved = planResponsibilityMoves(&instance, checkpoint.Nodes, serverNodes)
+		if err := checkpoint.RecordMovedResponsibilities(ctx, moved); err != nil {
+			return err
+		}
+	}
+	for _, responsibility := range moved {
+		// the responsibility is taken over before it is given up
+		if responsibility.Target != "" {
+			if err := tcClient.SetNodeResponsibility(ctx, responsibility.Target, responsibility.Responsibility, true); err != nil {
+				return err
+			}
+		}
+		if err := tcClient.SetNodeResponsibility(ctx, responsibility.Node, responsibility.Responsibility, false); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// restoreResponsibilities gives the responsibilities recorded by moveResponsibilities back to the nodes of the batch.
+func restoreResponsibilities(r *TeamcityReconciler, ctx context.Context, checkpoint *Checkpoint) error {
+	if len(checkpoint.MovedResponsibilities) == 0 {
+		return nil
+	}
+	instance := checkpoint.Instance
+	tcClient, err := r.clientFactory()(ctx, r.Client, &instance)
+	if err != nil {
+		return err
+	}
+	for _, responsibility := range checkpoint.MovedResponsibilities {
+		if err := tcClient.SetNodeResponsibility(ctx, responsibility.Node, responsibility.Responsibility, true); err != nil {
+			return err
+		}
+		if responsibility.Target != "" {
+			if err := tcClient.SetNodeResponsibility(ctx, responsibility.Target, responsibility.Responsibility, false); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func planResponsibilityMoves(instance *TeamCity, nodes []string, serverNodes []teamcity.ServerNode) []MovedResponsibility {
+	mainNodeID := instance.Spec.MainNode.Name
+	for _, serverNode := range serverNodes {
+		if serverNode.EffectiveResponsibilities.Has(teamcity.ResponsibilityMainNode) {
+			mainNodeID = serverNode.ID
+		}
+	}
+	moved := []MovedResponsibility{}
+	for _, nodeName := range nodes {
+		serverNode, ok := serverNodeByID(serverNodes, nodeName)
+		if !ok {
+			continue
+		}
+		for _, responsibility := range serverNode.EnabledResponsibilities.Responsibility {
+			if responsibility.Name == teamcity.ResponsibilityMainNode {
+				continue
+			}
+			target := mainNodeID
+			for _, other := range serverNodes {
+				if other.Online && !containsNodeName(nodes, other.ID) && other.EnabledResponsibilities.Has(responsibility.Name) {
+					target = ""
+				}
+			}
+			moved = append(moved, MovedResponsibility{Node: nodeName, Responsibility: responsibility.Name, Target: target})
+		}
+	}
+	return moved
+}
+
+func secondaryNodeByName(instance *TeamCity, name string) (Node, bool) {
+	for _, node := range instance.Spec.SecondaryNodes {
+		if node.Name == name {
+			return node, true
+		}
+	}
+	return Node{}, false
+}
+
+func serverNodeByID(serverNodes []teamcity.ServerNode, id string) (teamcity.ServerNode, bool) {
+	for _, serverNode := range serverNodes {
+		if serverNode.ID == id {
+			return serverNode, true
+		}
+	}
+	return teamcity.ServerNode{}, false
+}
+
+func containsNodeName(nodeNames []string, name string) bool {
+	for _, nodeName := range nodeNames {
+		if nodeName == name {
+			return true
+		}
+	}
+	return false
+}
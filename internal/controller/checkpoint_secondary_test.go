@@ -0,0 +1,221 @@
+package controller
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	. "git.jetbrains.team/tch/teamcity-operator/api/v1beta1"
+	"git.jetbrains.team/tch/teamcity-operator/internal/checkpoint"
+	"git.jetbrains.team/tch/teamcity-operator/internal/resource"
+	"git.jetbrains.team/tch/teamcity-operator/internal/teamcity"
+	"git.jetbrains.team/tch/teamcity-operator/internal/teamcity/teamcitytest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	v1 "k8s.io/api/apps/v1"
+	v12 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// newSecondaryUpgradeTestReconciler returns a reconciler for a multi-node TeamCity moving from rollbackTestPreviousImage
+// to rollbackTestImage. The fake server knows both secondary nodes; secondary-1 checks for changes.
+func newSecondaryUpgradeTestReconciler(t *testing.T, server *teamcitytest.Server, annotations map[string]string) (*TeamcityReconciler, *TeamCity) {
+	instance := newZeroDowntimeTestTeamCity(rollbackTestImage)
+	instance.Spec.SecondaryNodes = []Node{{Name: "secondary-1"}, {Name: "secondary-2"}}
+	instance.Spec.APITokenSecret = &v12.SecretKeySelector{LocalObjectReference: v12.LocalObjectReference{Name: "token"}, Key: "token"}
+	for key, value := range annotations {
+		instance.Annotations[key] = value
+	}
+	previous := instance.DeepCopy()
+	previous.Spec.Image = rollbackTestPreviousImage
+	objects := []client.Object{instance, newZeroDowntimeTestStatefulSet(rollbackTestPreviousImage)}
+	builder := resource.TeamCityResourceBuilder{Instance: previous, Scheme: newTestScheme(t)}
+	secondaryStatefulSets, err := builder.SecondaryStatefulSet().BuildObjectList()
+	require.NoError(t, err)
+	for _, object := range secondaryStatefulSets {
+		require.NoError(t, builder.SecondaryStatefulSet().Update(object))
+		object.(*v1.StatefulSet).Status = v1.StatefulSetStatus{Replicas: 1, ReadyReplicas: 1}
+		objects = append(objects, object)
+	}
+	r := newTestTeamcityReconciler(t, objects...)
+	r.Recorder = record.NewFakeRecorder(20)
+	r.ClientFactory = func(ctx context.Context, reader client.Reader, instance *TeamCity) (*teamcity.Client, error) {
+		return teamcity.NewClient(server.URL, server.Token, http.DefaultClient), nil
+	}
+	server.AddNode("secondary-1", teamcity.ResponsibilityVCSChangesCollector)
+	server.AddNode("secondary-2")
+	return r, instance
+}
+
+func getSecondaryUpgradeTestStatefulSet(t *testing.T, r *TeamcityReconciler, name string) *v1.StatefulSet {
+	var statefulSet v1.StatefulSet
+	require.NoError(t, r.Get(context.Background(), types.NamespacedName{Name: name, Namespace: testNamespace}, &statefulSet))
+	return &statefulSet
+}
+
+// startSecondaryUpgradeTestRollout and finishSecondaryUpgradeTestRollout update the status of the StatefulSet
+// as the StatefulSet controller would.
+func startSecondaryUpgradeTestRollout(t *testing.T, r *TeamcityReconciler, name string) {
+	statefulSet := getSecondaryUpgradeTestStatefulSet(t, r, name)
+	statefulSet.Status.UpdateRevision = name + "-new"
+	statefulSet.Status.ReadyReplicas = 0
+	require.NoError(t, r.Status().Update(context.Background(), statefulSet))
+}
+
+func finishSecondaryUpgradeTestRollout(t *testing.T, r *TeamcityReconciler, name string) {
+	statefulSet := getSecondaryUpgradeTestStatefulSet(t, r, name)
+	statefulSet.Status.CurrentRevision = statefulSet.Status.UpdateRevision
+	statefulSet.Status.ReadyReplicas = 1
+	require.NoError(t, r.Status().Update(context.Background(), statefulSet))
+}
+
+func secondaryUpgradeTestImage(t *testing.T, r *TeamcityReconciler, name string) string {
+	return getSecondaryUpgradeTestStatefulSet(t, r, name).Spec.Template.Spec.Containers[0].Image
+}
+
+func performSecondaryUpgradeTestStep(t *testing.T, r *TeamcityReconciler, instance *TeamCity) *checkpoint.Checkpoint {
+	ctx := context.Background()
+	requeue, err := r.performZeroDowntimeUpgradeOrRequeue(ctx, instance, ongoingZeroDowntimeUpgrade(r, ctx, instance))
+	require.NoError(t, err)
+	assert.True(t, requeue)
+	return loadCheckpointForTest(t, r, instance)
+}
+
+func TestSecondaryNodesAreUpgradedOneByOne(t *testing.T) {
+	server := teamcitytest.NewServer("")
+	defer server.Close()
+	r, instance := newSecondaryUpgradeTestReconciler(t, server, nil)
+
+	upgrade := performSecondaryUpgradeTestStep(t, r, instance)
+	assert.Equal(t, checkpoint.SecondaryNodesUpgrading, upgrade.CurrentStage)
+	assert.Equal(t, []string{"secondary-1"}, upgrade.Nodes)
+	assert.Equal(t, checkpoint.NodeStepMovingResponsibilities, upgrade.NodeStep)
+	assert.Len(t, upgrade.PreviousSecondaryTemplates, 2)
+
+	upgrade = performSecondaryUpgradeTestStep(t, r, instance)
+	assert.Equal(t, checkpoint.NodeStepRestarting, upgrade.NodeStep)
+	assert.Equal(t, []MovedResponsibility{{
+		Node: "secondary-1", Responsibility: teamcity.ResponsibilityVCSChangesCollector, Target: teamcitytest.MainNodeID,
+	}}, upgrade.MovedResponsibilities)
+	secondary, _ := server.Node("secondary-1")
+	assert.False(t, secondary.EnabledResponsibilities.Has(teamcity.ResponsibilityVCSChangesCollector))
+	mainNode, _ := server.Node(teamcitytest.MainNodeID)
+	assert.True(t, mainNode.EnabledResponsibilities.Has(teamcity.ResponsibilityVCSChangesCollector))
+
+	// the node restarts, the other secondary node and the main node keep their spec
+	startSecondaryUpgradeTestRollout(t, r, "secondary-1")
+	server.SetNodeState("secondary-1", "starting")
+	upgrade = performSecondaryUpgradeTestStep(t, r, instance)
+	assert.Equal(t, checkpoint.NodeStepRestarting, upgrade.NodeStep)
+	assert.Equal(t, rollbackTestImage, secondaryUpgradeTestImage(t, r, "secondary-1"))
+	assert.Equal(t, rollbackTestPreviousImage, secondaryUpgradeTestImage(t, r, "secondary-2"))
+	assert.Equal(t, rollbackTestPreviousImage, getRollbackTestMainStatefulSet(t, r).Spec.Template.Spec.Containers[0].Image)
+
+	// it is ready, but not back in the cluster yet
+	finishSecondaryUpgradeTestRollout(t, r, "secondary-1")
+	upgrade = performSecondaryUpgradeTestStep(t, r, instance)
+	assert.Equal(t, checkpoint.NodeStepRestarting, upgrade.NodeStep)
+
+	server.SetNodeState("secondary-1", "online")
+	upgrade = performSecondaryUpgradeTestStep(t, r, instance)
+	assert.Equal(t, checkpoint.NodeStepRestoringResponsibilities, upgrade.NodeStep)
+
+	upgrade = performSecondaryUpgradeTestStep(t, r, instance)
+	assert.Empty(t, upgrade.Nodes)
+	assert.Equal(t, []string{"secondary-1"}, upgrade.UpgradedNodes)
+	secondary, _ = server.Node("secondary-1")
+	assert.True(t, secondary.EnabledResponsibilities.Has(teamcity.ResponsibilityVCSChangesCollector))
+	mainNode, _ = server.Node(teamcitytest.MainNodeID)
+	assert.False(t, mainNode.EnabledResponsibilities.Has(teamcity.ResponsibilityVCSChangesCollector))
+
+	upgrade = performSecondaryUpgradeTestStep(t, r, instance)
+	assert.Equal(t, []string{"secondary-2"}, upgrade.Nodes)
+	performSecondaryUpgradeTestStep(t, r, instance)
+	startSecondaryUpgradeTestRollout(t, r, "secondary-2")
+	performSecondaryUpgradeTestStep(t, r, instance)
+	finishSecondaryUpgradeTestRollout(t, r, "secondary-2")
+	performSecondaryUpgradeTestStep(t, r, instance)
+	performSecondaryUpgradeTestStep(t, r, instance)
+	upgrade = performSecondaryUpgradeTestStep(t, r, instance)
+	assert.Equal(t, checkpoint.ReplicaReady, upgrade.CurrentStage)
+	assert.Equal(t, []string{"secondary-1", "secondary-2"}, upgrade.UpgradedNodes)
+
+	// the main node is switched last
+	requeue, err := r.performZeroDowntimeUpgradeOrRequeue(context.Background(), instance, true)
+	require.NoError(t, err)
+	assert.False(t, requeue)
+	assert.Equal(t, checkpoint.MainShuttingDown, loadCheckpointForTest(t, r, instance).CurrentStage)
+
+	events := r.Recorder.(*record.FakeRecorder).Events
+	require.Len(t, events, 4)
+	assert.Contains(t, <-events, eventReasonUpgradingSecondaryNodes)
+	assert.Contains(t, <-events, eventReasonSecondaryNodesUpgraded)
+	assert.Contains(t, <-events, eventReasonUpgradingSecondaryNodes)
+	assert.Contains(t, <-events, eventReasonSecondaryNodesUpgraded)
+}
+
+func TestSecondaryNodesAreUpgradedByMaxUnavailable(t *testing.T) {
+	server := teamcitytest.NewServer("")
+	defer server.Close()
+	r, instance := newSecondaryUpgradeTestReconciler(t, server, map[string]string{UpgradeMaxUnavailableAnnotationKey: "2"})
+
+	upgrade := performSecondaryUpgradeTestStep(t, r, instance)
+	assert.Equal(t, []string{"secondary-1", "secondary-2"}, upgrade.Nodes)
+	performSecondaryUpgradeTestStep(t, r, instance)
+	assert.Equal(t, rollbackTestImage, secondaryUpgradeTestImage(t, r, "secondary-1"))
+	assert.Equal(t, rollbackTestImage, secondaryUpgradeTestImage(t, r, "secondary-2"))
+}
+
+func TestSecondaryNodesKeepResponsibilitiesWithoutAPIToken(t *testing.T) {
+	server := teamcitytest.NewServer("")
+	defer server.Close()
+	r, instance := newSecondaryUpgradeTestReconciler(t, server, nil)
+	instance.Spec.APITokenSecret = nil
+
+	performSecondaryUpgradeTestStep(t, r, instance)
+	upgrade := performSecondaryUpgradeTestStep(t, r, instance)
+	assert.Equal(t, checkpoint.NodeStepRestarting, upgrade.NodeStep)
+	assert.Empty(t, upgrade.MovedResponsibilities)
+	secondary, _ := server.Node("secondary-1")
+	assert.True(t, secondary.EnabledResponsibilities.Has(teamcity.ResponsibilityVCSChangesCollector))
+
+	// the node is not looked up in TeamCity either
+	server.SetNodeState("secondary-1", "starting")
+	startSecondaryUpgradeTestRollout(t, r, "secondary-1")
+	performSecondaryUpgradeTestStep(t, r, instance)
+	finishSecondaryUpgradeTestRollout(t, r, "secondary-1")
+	upgrade = performSecondaryUpgradeTestStep(t, r, instance)
+	assert.Equal(t, checkpoint.NodeStepRestoringResponsibilities, upgrade.NodeStep)
+}
+
+func TestRollbackRestoresSecondaryNodes(t *testing.T) {
+	server := teamcitytest.NewServer("")
+	defer server.Close()
+	r, instance := newSecondaryUpgradeTestReconciler(t, server, nil)
+	ctx := context.Background()
+	for i := 0; i < 2; i++ {
+		performSecondaryUpgradeTestStep(t, r, instance)
+	}
+	startSecondaryUpgradeTestRollout(t, r, "secondary-1")
+	require.Equal(t, rollbackTestImage, secondaryUpgradeTestImage(t, r, "secondary-1"))
+
+	instance = setUpgradeControlForTest(t, r, UpgradeControlAbort)
+	performSecondaryUpgradeTestStep(t, r, instance)
+	assert.Equal(t, rollbackTestPreviousImage, secondaryUpgradeTestImage(t, r, "secondary-1"))
+	// the responsibilities stay with the main node until the node runs its previous spec
+	mainNode, _ := server.Node(teamcitytest.MainNodeID)
+	assert.True(t, mainNode.EnabledResponsibilities.Has(teamcity.ResponsibilityVCSChangesCollector))
+
+	finishSecondaryUpgradeTestRollout(t, r, "secondary-1")
+	requeue, err := r.performZeroDowntimeUpgradeOrRequeue(ctx, instance, true)
+	require.NoError(t, err)
+	assert.True(t, requeue)
+	assert.False(t, ongoingZeroDowntimeUpgrade(r, ctx, instance))
+	secondary, _ := server.Node("secondary-1")
+	assert.True(t, secondary.EnabledResponsibilities.Has(teamcity.ResponsibilityVCSChangesCollector))
+	mainNode, _ = server.Node(teamcitytest.MainNodeID)
+	assert.False(t, mainNode.EnabledResponsibilities.Has(teamcity.ResponsibilityVCSChangesCollector))
+	assert.Equal(t, rollbackTestPreviousImage, secondaryUpgradeTestImage(t, r, "secondary-2"))
+}
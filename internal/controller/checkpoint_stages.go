@@ -2,18 +2,35 @@ package controller
 
 import (
 	"context"
+	"fmt"
+	. "git.jetbrains.team/tch/teamcity-operator/api/v1beta1"
 	. "git.jetbrains.team/tch/teamcity-operator/internal/checkpoint"
+	"git.jetbrains.team/tch/teamcity-operator/internal/metrics"
 	"git.jetbrains.team/tch/teamcity-operator/internal/resource"
 	v1 "k8s.io/api/apps/v1"
+	v12 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/client-go/util/retry"
 	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
 	"sigs.k8s.io/controller-runtime/pkg/log"
 )
 
+const eventReasonMainNodeUpgraded = "MainNodeUpgraded"
+
 func doActionBasedOnCheckpointOrRequeue(r *TeamcityReconciler, ctx context.Context, checkpoint *Checkpoint) (bool, error) {
 	log := log.FromContext(ctx)
 	log.V(1).Info("Current update stage is " + checkpoint.CurrentStage.String())
+	if checkpoint.TimedOut() {
+		rollingBack, err := rollbackTimedOutStage(r, ctx, checkpoint)
+		if err != nil {
+			return false, err
+		}
+		// the upgrade failed without a rollback; the next reconciliation reads the status and leaves the nodes alone
+		if !rollingBack {
+			return true, nil
+		}
+	}
+	metrics.ObserveUpgradeStage(checkpoint.Instance.Namespace, checkpoint.Instance.Name, checkpoint.CurrentStage)
 	switch checkpoint.CurrentStage {
 	case UpdateInitiated:
 		result, err := HandleUpdateInitiated(ctx, checkpoint)
@@ -52,7 +69,19 @@ func doActionBasedOnCheckpointOrRequeue(r *TeamcityReconciler, ctx context.Conte
 		}
 		return result, nil
 	case UpdateFinished:
-		result, err := HandleUpdateFinished(ctx, checkpoint)
+		result, err := HandleUpdateFinished(r, ctx, checkpoint)
+		if err != nil {
+			return false, err
+		}
+		return result, nil
+	case RollingBack:
+		result, err := HandleRollingBack(r, ctx, checkpoint)
+		if err != nil {
+			return false, err
+		}
+		return result, nil
+	case SecondaryNodesUpgrading:
+		result, err := HandleSecondaryNodesUpgrading(r, ctx, checkpoint)
 		if err != nil {
 			return false, err
 		}
@@ -126,10 +155,20 @@ func HandleMainShuttingDown(r *TeamcityReconciler, ctx context.Context, checkpoi
 	}
 
 	if mainNodeUpdateFinished && isMainNodeStatefulSetNewestGeneration {
-		err := checkpoint.DoCheckpointWithDesiredStage(ctx, MainReady)
+		ready, version, err := mainNodeServerReady(r, ctx, &instance)
 		if err != nil {
 			return false, err
 		}
+		if !ready {
+			log.FromContext(ctx).V(1).Info("Waiting for TeamCity on the main node to become ready")
+			return true, nil
+		}
+		if version != "" {
+			r.recordEvent(&instance, v12.EventTypeNormal, eventReasonMainNodeUpgraded, fmt.Sprintf("Main node runs TeamCity %s", version))
+		}
+		if err := checkpoint.DoCheckpointWithDesiredStage(ctx, MainReady); err != nil {
+			return false, err
+		}
 	}
 	return true, nil
 
@@ -160,10 +199,14 @@ func HandleMainReady(r *TeamcityReconciler, ctx context.Context, checkpoint *Che
 	}
 	return true, nil
 }
-func HandleUpdateFinished(ctx context.Context, checkpoint *Checkpoint) (bool, error) {
-	err := checkpoint.Delete(ctx)
-	if err != nil {
+func HandleUpdateFinished(r *TeamcityReconciler, ctx context.Context, checkpoint *Checkpoint) (bool, error) {
+	// a successful upgrade replaces the report of an earlier rollback
+	if err := setUpgradeStatus(r, ctx, &checkpoint.Instance, nil); err != nil {
+		return false, err
+	}
+	if err := checkpoint.Finish(ctx, UpgradePhaseSucceeded); err != nil {
 		return false, err
 	}
+	metrics.FinishUpgrade(checkpoint.Instance.Namespace, checkpoint.Instance.Name)
 	return false, nil
 }
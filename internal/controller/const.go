@@ -4,4 +4,5 @@ const (
 	TEAMCITY_CRD_OBJECT_SUCCESS_STATE  = "Success"
 	TEAMCITY_CRD_OBJECT_ERROR_STATE    = "Error"
 	TEAMCITY_CRD_OBJECT_UPDATING_STATE = "Updating"
+	TEAMCITY_CRD_OBJECT_STOPPED_STATE  = "Stopped"
 )
@@ -0,0 +1,145 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	. "git.jetbrains.team/tch/teamcity-operator/api/v1beta1"
+	"git.jetbrains.team/tch/teamcity-operator/internal/resource"
+	v12 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/util/retry"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+const (
+	eventReasonChangeAwaitingApproval = "ChangeAwaitingApproval"
+	eventReasonChangeApproved         = "ChangeApproved"
+)
+
+// reconcileChangeApproval reports whether the node StatefulSets may be updated. With ChangeApprovalAnnotationKey, a
+// spec change that restarts nodes is held in status.pendingChange until ApprovedGenerationAnnotationKey is set to its
+// generation. Stopped nodes, an ongoing zero-downtime upgrade and a rolled back spec are not held. The approval is
+// removed once nothing is pending, so a later restart without a new generation, e.g. of a rotated Secret, is held again.
+func (r *TeamcityReconciler) reconcileChangeApproval(ctx context.Context, instance *TeamCity, ongoingUpdate bool) (bool, error) {
+	if !instance.RequiresChangeApproval() || instance.IsStopped() || instance.InRestoreMode() || ongoingUpdate ||
+		instance.UpgradeRolledBack() {
+		return true, setPendingChange(r, ctx, instance, nil)
+	}
+	pending, err := computePendingChange(r, ctx, instance)
+	if err != nil {
+		return false, err
+	}
+	if pending == nil {
+		if err := removeApprovedGeneration(r, ctx, instance); err != nil {
+			return false, err
+		}
+		return true, setPendingChange(r, ctx, instance, nil)
+	}
+	if instance.ChangeApproved() {
+		if instance.Status.PendingChange != nil {
+			r.recordEvent(instance, v12.EventTypeNormal, eventReasonChangeApproved,
+				fmt.Sprintf("Restarting nodes %s for the approved generation %d", pendingNodeNames(pending), instance.Generation))
+		}
+		return true, setPendingChange(r, ctx, instance, nil)
+	}
+
+	if held := instance.Status.PendingChange; held != nil && held.Generation == instance.Generation {
+		pending.DetectedTime = held.DetectedTime
+	} else {
+		detectedTime := metav1.NewTime(r.now())
+		pending.DetectedTime = &detectedTime
+		r.recordEvent(instance, v12.EventTypeNormal, eventReasonChangeAwaitingApproval, fmt.Sprintf(
+			"Generation %d restarts nodes %s. Approve it with: kubectl annotate teamcity/%s %s=%d --overwrite",
+			instance.Generation, pendingNodeNames(pending), instance.Name, ApprovedGenerationAnnotationKey, instance.Generation))
+	}
+	log.FromContext(ctx).Info("Change restarts nodes and waits for approval", "generation", instance.Generation,
+		"nodes", pendingNodeNames(pending))
+	return false, setPendingChange(r, ctx, instance, pending)
+}
+
+// computePendingChange lists the nodes whose StatefulSet the spec restarts, or returns nil if there are none.
+// Nodes without a StatefulSet are created without restarting anything.
+func computePendingChange(r *TeamcityReconciler, ctx context.Context, instance *TeamCity) (*PendingChange, error) {
+	var nodes []PendingNodeChange
+	for _, node := range instance.GetAllNodes() {
+		statefulSet, err := getStatefulSetByName(r, ctx, node.GetNamespacedNameFromNamespace(instance.Namespace))
+		if errors.IsNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		changes := resource.GetNodeRestartFieldChanges(instance, node, &statefulSet)
+		if len(changes) == 0 {
+			continue
+		}
+		fields := make([]string, 0, len(changes))
+		for _, change := range changes {
+			fields = append(fields, resource.FormatNodeRestartFieldChange(change))
+		}
+		nodes = append(nodes, PendingNodeChange{Name: node.Name, Fields: fields})
+	}
+	if len(nodes) == 0 {
+		return nil, nil
+	}
+	return &PendingChange{Generation: instance.Generation, Nodes: nodes}, nil
+}
+
+// setPendingChange writes status.pendingChange of the instance; nil removes it.
+func setPendingChange(r *TeamcityReconciler, ctx context.Context, instance *TeamCity, pending *PendingChange) error {
+	if pending == nil && instance.Status.PendingChange == nil {
+		return nil
+	}
+	namespacedName := types.NamespacedName{Name: instance.Name, Namespace: instance.Namespace}
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		teamcity, err := getTeamCityObjectE(r, ctx, namespacedName)
+		if err != nil {
+			return err
+		}
+		if equality.Semantic.DeepEqual(teamcity.Status.PendingChange, pending) {
+			return nil
+		}
+		teamcity.Status.PendingChange = pending
+		return r.Status().Update(ctx, &teamcity)
+	})
+	if err != nil {
+		return err
+	}
+	instance.Status.PendingChange = pending
+	return nil
+}
+
+// removeApprovedGeneration patches ApprovedGenerationAnnotationKey away if it still has the value the instance was read with.
+func removeApprovedGeneration(r *TeamcityReconciler, ctx context.Context, instance *TeamCity) error {
+	approved, ok := instance.Annotations[ApprovedGenerationAnnotationKey]
+	if !ok {
+		return nil
+	}
+	var teamcity TeamCity
+	if err := r.Get(ctx, types.NamespacedName{Name: instance.Name, Namespace: instance.Namespace}, &teamcity); err != nil {
+		return err
+	}
+	if value, ok := teamcity.Annotations[ApprovedGenerationAnnotationKey]; ok && value == approved {
+		patch := client.MergeFrom(teamcity.DeepCopy())
+		delete(teamcity.Annotations, ApprovedGenerationAnnotationKey)
+		if err := r.Patch(ctx, &teamcity, patch); err != nil {
+			return err
+		}
+	}
+	delete(instance.Annotations, ApprovedGenerationAnnotationKey)
+	return nil
+}
+
+func pendingNodeNames(pending *PendingChange) string {
+	names := make([]string, 0, len(pending.Nodes))
+	for _, node := range pending.Nodes {
+		names = append(names, node.Name)
+	}
+	return strings.Join(names, ", ")
+}
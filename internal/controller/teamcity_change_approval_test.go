@@ -0,0 +1,155 @@
+package controller
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	. "git.jetbrains.team/tch/teamcity-operator/api/v1beta1"
+	"git.jetbrains.team/tch/teamcity-operator/internal/resource"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+)
+
+const (
+	changeApprovalTestPreviousImage = "jetbrains/teamcity-server:2024.07.1"
+	changeApprovalTestImage         = "jetbrains/teamcity-server:2024.07.3"
+)
+
+var changeApprovalTestNow = time.Date(2024, 8, 1, 10, 0, 0, 0, time.UTC)
+
+func newChangeApprovalTestReconciler(t *testing.T) (*TeamcityReconciler, *TeamCity) {
+	instance := newTestTeamCity()
+	instance.Generation = 2
+	instance.Annotations = map[string]string{ChangeApprovalAnnotationKey: ChangeApprovalRequired}
+	instance.Spec.Image = changeApprovalTestPreviousImage
+	instance.Spec.DataDirVolumeClaim = CustomPersistentVolumeClaim{
+		Name:        "data",
+		VolumeMount: corev1.VolumeMount{Name: "data", MountPath: "/storage"},
+	}
+	instance.Spec.SecondaryNodes = []Node{{Name: "secondary"}}
+	mainStatefulSet := resource.BuildDesiredStatefulSet(instance, instance.Spec.MainNode, nil)
+	secondaryStatefulSet := resource.BuildDesiredStatefulSet(instance, instance.Spec.SecondaryNodes[0], nil)
+	instance.Spec.Image = changeApprovalTestImage
+
+	r := newTestTeamcityReconciler(t, instance, mainStatefulSet, secondaryStatefulSet)
+	r.Recorder = record.NewFakeRecorder(10)
+	r.Now = func() time.Time { return changeApprovalTestNow }
+	return r, instance
+}
+
+func TestChangeRestartingNodesWaitsForApproval(t *testing.T) {
+	r, instance := newChangeApprovalTestReconciler(t)
+	ctx := context.Background()
+
+	approved, err := r.reconcileChangeApproval(ctx, instance, false)
+	require.NoError(t, err)
+	assert.False(t, approved)
+	var updated TeamCity
+	require.NoError(t, r.Get(ctx, types.NamespacedName{Name: "tc", Namespace: testNamespace}, &updated))
+	pending := updated.Status.PendingChange
+	require.NotNil(t, pending)
+	assert.Equal(t, int64(2), pending.Generation)
+	assert.True(t, changeApprovalTestNow.Equal(pending.DetectedTime.Time))
+	imageChange := "spec.template.spec.containers[teamcity-server].image: current=" + changeApprovalTestPreviousImage +
+		", desired=" + changeApprovalTestImage
+	assert.Equal(t, []PendingNodeChange{
+		{Name: "secondary", Fields: []string{imageChange}},
+		{Name: "main", Fields: []string{imageChange}},
+	}, pending.Nodes)
+	events := r.Recorder.(*record.FakeRecorder).Events
+	require.Len(t, events, 1)
+	event := <-events
+	assert.Contains(t, event, eventReasonChangeAwaitingApproval)
+	assert.Contains(t, event, "teamcity.jetbrains.com/approved-generation=2")
+
+	// the change stays held, and is reported once
+	r.Now = func() time.Time { return changeApprovalTestNow.Add(time.Hour) }
+	approved, err = r.reconcileChangeApproval(ctx, instance, false)
+	require.NoError(t, err)
+	assert.False(t, approved)
+	require.NoError(t, r.Get(ctx, types.NamespacedName{Name: "tc", Namespace: testNamespace}, &updated))
+	assert.True(t, changeApprovalTestNow.Equal(updated.Status.PendingChange.DetectedTime.Time))
+	assert.Empty(t, events)
+
+	instance.Annotations[ApprovedGenerationAnnotationKey] = "1"
+	approved, err = r.reconcileChangeApproval(ctx, instance, false)
+	require.NoError(t, err)
+	assert.False(t, approved, "an approval of an earlier generation does not apply")
+
+	instance.Annotations[ApprovedGenerationAnnotationKey] = "2"
+	approved, err = r.reconcileChangeApproval(ctx, instance, false)
+	require.NoError(t, err)
+	assert.True(t, approved)
+	require.NoError(t, r.Get(ctx, types.NamespacedName{Name: "tc", Namespace: testNamespace}, &updated))
+	assert.Nil(t, updated.Status.PendingChange)
+	require.Len(t, events, 1)
+	event = <-events
+	assert.Contains(t, event, eventReasonChangeApproved)
+	assert.Contains(t, event, "secondary, main")
+}
+
+func TestChangeApprovalIsOptIn(t *testing.T) {
+	r, instance := newChangeApprovalTestReconciler(t)
+	ctx := context.Background()
+	delete(instance.Annotations, ChangeApprovalAnnotationKey)
+
+	approved, err := r.reconcileChangeApproval(ctx, instance, false)
+	require.NoError(t, err)
+	assert.True(t, approved)
+
+	// an ongoing zero-downtime upgrade was started by an applied change
+	instance.Annotations[ChangeApprovalAnnotationKey] = ChangeApprovalRequired
+	approved, err = r.reconcileChangeApproval(ctx, instance, true)
+	require.NoError(t, err)
+	assert.True(t, approved)
+	assert.Empty(t, r.Recorder.(*record.FakeRecorder).Events)
+}
+
+func TestChangeWithoutRestartIsNotHeld(t *testing.T) {
+	r, instance := newChangeApprovalTestReconciler(t)
+	ctx := context.Background()
+	instance.Spec.Image = changeApprovalTestPreviousImage
+
+	approved, err := r.reconcileChangeApproval(ctx, instance, false)
+	require.NoError(t, err)
+	assert.True(t, approved)
+	assert.Nil(t, instance.Status.PendingChange)
+}
+
+func TestApprovalIsRemovedOnceTheChangeIsApplied(t *testing.T) {
+	r, instance := newChangeApprovalTestReconciler(t)
+	ctx := context.Background()
+	instance.Annotations[ApprovedGenerationAnnotationKey] = "2"
+	approved, err := r.reconcileChangeApproval(ctx, instance, false)
+	require.NoError(t, err)
+	require.True(t, approved)
+
+	// the approved change is applied to the node StatefulSets
+	for _, node := range instance.GetAllNodes() {
+		var statefulSet appsv1.StatefulSet
+		require.NoError(t, r.Get(ctx, node.GetNamespacedNameFromNamespace(testNamespace), &statefulSet))
+		statefulSet.Spec = resource.BuildDesiredStatefulSet(instance, node, nil).Spec
+		require.NoError(t, r.Update(ctx, &statefulSet))
+	}
+	approved, err = r.reconcileChangeApproval(ctx, instance, false)
+	require.NoError(t, err)
+	assert.True(t, approved)
+	var updated TeamCity
+	require.NoError(t, r.Get(ctx, types.NamespacedName{Name: "tc", Namespace: testNamespace}, &updated))
+	assert.NotContains(t, updated.Annotations, ApprovedGenerationAnnotationKey)
+
+	// a referenced Secret changes, which restarts the nodes without a new generation
+	instance.Status.ConfigHash = "rotated"
+	approved, err = r.reconcileChangeApproval(ctx, instance, false)
+	require.NoError(t, err)
+	assert.False(t, approved, "the approval of generation 2 was used up")
+	require.NoError(t, r.Get(ctx, types.NamespacedName{Name: "tc", Namespace: testNamespace}, &updated))
+	require.NotNil(t, updated.Status.PendingChange)
+	assert.True(t, strings.HasPrefix(updated.Status.PendingChange.Nodes[0].Fields[0], "spec.template.metadata.annotations"))
+}
@@ -0,0 +1,148 @@
+package controller
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"sort"
+
+	. "git.jetbrains.team/tch/teamcity-operator/api/v1beta1"
+	"golang.org/x/exp/slices"
+	v12 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+// reconcileConfigHash stores the hash of the Secrets and ConfigMaps the nodes reference in status.configHash.
+// ConfigureStatefulSet stamps it into the pod templates, so rotated credentials roll the nodes like any
+// other template change, through the zero-downtime flow when the update policy asks for it.
+// The first hash of nodes that run without one becomes status.configHashBaseline, which is not stamped,
+// so the first reconciliation after an operator upgrade does not restart them.
+func (r *TeamcityReconciler) reconcileConfigHash(ctx context.Context, instance *TeamCity) error {
+	configHash, err := r.computeConfigHash(ctx, instance)
+	if err != nil {
+		return err
+	}
+	if configHash == instance.Status.ConfigHash {
+		return nil
+	}
+	baseline := instance.Status.ConfigHashBaseline
+	if instance.Status.ConfigHash == "" && baseline == "" {
+		unstamped, err := r.mainNodeRunsWithoutConfigHash(ctx, instance)
+		if err != nil {
+			return err
+		}
+		if unstamped {
+			baseline = configHash
+		}
+	}
+	log.FromContext(ctx).Info("Referenced Secrets or ConfigMaps changed", "configHash", configHash, "baseline", baseline == configHash)
+	teamcity, err := getTeamCityObjectE(r, ctx, types.NamespacedName{Name: instance.Name, Namespace: instance.Namespace})
+	if err != nil {
+		return err
+	}
+	teamcity.Status.ConfigHash = configHash
+	teamcity.Status.ConfigHashBaseline = baseline
+	if err := r.Status().Update(ctx, &teamcity); err != nil {
+		return err
+	}
+	instance.Status = teamcity.Status
+	instance.ResourceVersion = teamcity.ResourceVersion
+	return nil
+}
+
+// mainNodeRunsWithoutConfigHash reports whether the main node StatefulSet exists and its pods have no config hash.
+func (r *TeamcityReconciler) mainNodeRunsWithoutConfigHash(ctx context.Context, instance *TeamCity) (bool, error) {
+	statefulSet, err := getStatefulSetByName(r, ctx, instance.Spec.MainNode.GetNamespacedNameFromNamespace(instance.Namespace))
+	if errors.IsNotFound(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	_, stamped := statefulSet.Spec.Template.Annotations[ConfigHashAnnotationKey]
+	return !stamped, nil
+}
+
+// computeConfigHash hashes the data of every referenced Secret and ConfigMap. Missing ones only contribute
+// their name, so creating them later changes the hash as well.
+func (r *TeamcityReconciler) computeConfigHash(ctx context.Context, instance *TeamCity) (string, error) {
+	secretNames := instance.ReferencedSecretNames()
+	configMapNames := instance.ReferencedConfigMapNames()
+	if len(secretNames) == 0 && len(configMapNames) == 0 {
+		return "", nil
+	}
+	digest := sha256.New()
+	for _, name := range secretNames {
+		var secret v12.Secret
+		if err := r.Get(ctx, types.NamespacedName{Name: name, Namespace: instance.Namespace}, &secret); err != nil && !errors.IsNotFound(err) {
+			return "", err
+		}
+		writeHashEntry(digest, "secret/"+name)
+		for _, key := range sortedMapKeys(secret.Data) {
+			writeHashEntry(digest, key)
+			digest.Write(secret.Data[key])
+		}
+	}
+	for _, name := range configMapNames {
+		var configMap v12.ConfigMap
+		if err := r.Get(ctx, types.NamespacedName{Name: name, Namespace: instance.Namespace}, &configMap); err != nil && !errors.IsNotFound(err) {
+			return "", err
+		}
+		writeHashEntry(digest, "configmap/"+name)
+		for _, key := range sortedMapKeys(configMap.Data) {
+			writeHashEntry(digest, key)
+			writeHashEntry(digest, configMap.Data[key])
+		}
+		for _, key := range sortedMapKeys(configMap.BinaryData) {
+			writeHashEntry(digest, key)
+			digest.Write(configMap.BinaryData[key])
+		}
+	}
+	return hex.EncodeToString(digest.Sum(nil)), nil
+}
+
+func writeHashEntry(digest hash.Hash, value string) {
+	digest.Write([]byte(value))
+	digest.Write([]byte{0})
+}
+
+func sortedMapKeys[V any](values map[string]V) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// teamCitiesForSecret maps a Secret to the TeamCity objects whose nodes read it, so that fixing or rotating
+// the Secret reconciles them.
+func (r *TeamcityReconciler) teamCitiesForSecret(ctx context.Context, secret client.Object) []reconcile.Request {
+	return r.teamCitiesReferencing(ctx, secret, (*TeamCity).ReferencedSecretNames)
+}
+
+// teamCitiesForConfigMap maps a ConfigMap to the TeamCity objects whose nodes read it.
+func (r *TeamcityReconciler) teamCitiesForConfigMap(ctx context.Context, configMap client.Object) []reconcile.Request {
+	return r.teamCitiesReferencing(ctx, configMap, (*TeamCity).ReferencedConfigMapNames)
+}
+
+func (r *TeamcityReconciler) teamCitiesReferencing(ctx context.Context, object client.Object, referencedNames func(*TeamCity) []string) []reconcile.Request {
+	var teamcities TeamCityList
+	if err := r.List(ctx, &teamcities, client.InNamespace(object.GetNamespace())); err != nil {
+		log.FromContext(ctx).Error(err, "Failed to list TeamCity objects", "referencedObject", object.GetName())
+		return nil
+	}
+	var requests []reconcile.Request
+	for i := range teamcities.Items {
+		teamcity := &teamcities.Items[i]
+		if slices.Contains(referencedNames(teamcity), object.GetName()) {
+			requests = append(requests, reconcile.Request{NamespacedName: types.NamespacedName{Name: teamcity.Name, Namespace: teamcity.Namespace}})
+		}
+	}
+	return requests
+}
@@ -0,0 +1,145 @@
+package controller
+
+import (
+	"context"
+	"testing"
+
+	. "git.jetbrains.team/tch/teamcity-operator/api/v1beta1"
+	"git.jetbrains.team/tch/teamcity-operator/internal/resource"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	v12 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+func newConfigHashTestTeamCity() *TeamCity {
+	instance := newDatabaseSecretTestTeamCity()
+	instance.Spec.MainNode.Spec.Env = []v12.EnvVar{{
+		Name: "FEATURE_FLAGS",
+		ValueFrom: &v12.EnvVarSource{ConfigMapKeyRef: &v12.ConfigMapKeySelector{
+			LocalObjectReference: v12.LocalObjectReference{Name: "feature-flags"},
+			Key:                  "flags",
+		}},
+	}}
+	return instance
+}
+
+func newConfigHashTestConfigMap(flags string) *v12.ConfigMap {
+	return &v12.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "feature-flags", Namespace: testNamespace},
+		Data:       map[string]string{"flags": flags},
+	}
+}
+
+func TestComputeConfigHash(t *testing.T) {
+	instance := newConfigHashTestTeamCity()
+	secret := newDatabaseSecretTestSecret(DatabaseSecretKeys{}.All()...)
+	hash := func(objects ...client.Object) string {
+		r := newTestTeamcityReconciler(t, objects...)
+		configHash, err := r.computeConfigHash(context.Background(), instance)
+		require.NoError(t, err)
+		return configHash
+	}
+
+	initial := hash(secret, newConfigHashTestConfigMap("a"))
+	assert.NotEmpty(t, initial)
+	assert.Equal(t, initial, hash(secret, newConfigHashTestConfigMap("a")))
+	assert.NotEqual(t, initial, hash(secret, newConfigHashTestConfigMap("b")), "ConfigMap change")
+
+	rotated := newDatabaseSecretTestSecret(DatabaseSecretKeys{}.All()...)
+	rotated.Data[DatabasePasswordProperty] = []byte("rotated")
+	assert.NotEqual(t, initial, hash(rotated, newConfigHashTestConfigMap("a")), "Secret rotation")
+	assert.NotEqual(t, initial, hash(secret), "missing ConfigMap")
+}
+
+func TestComputeConfigHashWithoutReferences(t *testing.T) {
+	instance := newDatabaseSecretTestTeamCity()
+	instance.Spec.DatabaseSecret = DatabaseSecret{}
+	r := newTestTeamcityReconciler(t)
+
+	configHash, err := r.computeConfigHash(context.Background(), instance)
+	require.NoError(t, err)
+	assert.Empty(t, configHash)
+}
+
+func TestComputeConfigHashIncludesJDBCDriverConfigMap(t *testing.T) {
+	instance := newDatabaseSecretTestTeamCity()
+	instance.Spec.JDBCDriver = &JDBCDriver{ConfigMap: &JDBCDriverConfigMap{Name: "jdbc-driver", Key: "postgresql.jar"}}
+	secret := newDatabaseSecretTestSecret(DatabaseSecretKeys{}.All()...)
+	driver := func(jar string) *v12.ConfigMap {
+		return &v12.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: "jdbc-driver", Namespace: testNamespace},
+			BinaryData: map[string][]byte{"postgresql.jar": []byte(jar)},
+		}
+	}
+	hash := func(objects ...client.Object) string {
+		configHash, err := newTestTeamcityReconciler(t, objects...).computeConfigHash(context.Background(), instance)
+		require.NoError(t, err)
+		return configHash
+	}
+
+	assert.Equal(t, []string{"jdbc-driver"}, instance.ReferencedConfigMapNames())
+	assert.NotEqual(t, hash(secret, driver("42.7.3")), hash(secret, driver("42.7.4")), "a new driver jar rolls the nodes")
+
+	r := newTestTeamcityReconciler(t, instance)
+	requests := r.teamCitiesForConfigMap(context.Background(), driver("42.7.4"))
+	require.Len(t, requests, 1)
+	assert.Equal(t, "tc", requests[0].Name)
+}
+
+func TestReconcileConfigHashUpdatesStatus(t *testing.T) {
+	instance := newConfigHashTestTeamCity()
+	secret := newDatabaseSecretTestSecret(DatabaseSecretKeys{}.All()...)
+	r := newTestTeamcityReconciler(t, instance, secret, newConfigHashTestConfigMap("a"))
+
+	require.NoError(t, r.reconcileConfigHash(context.Background(), instance))
+	initial := instance.Status.ConfigHash
+	require.NotEmpty(t, initial)
+
+	var stored TeamCity
+	require.NoError(t, r.Get(context.Background(), types.NamespacedName{Name: "tc", Namespace: testNamespace}, &stored))
+	assert.Equal(t, initial, stored.Status.ConfigHash)
+
+	secret.Data[DatabasePasswordProperty] = []byte("rotated")
+	require.NoError(t, r.Update(context.Background(), secret))
+	require.NoError(t, r.reconcileConfigHash(context.Background(), instance))
+	assert.NotEqual(t, initial, instance.Status.ConfigHash)
+}
+
+func TestReconcileConfigHashKeepsNodesOfAnOlderOperatorRunning(t *testing.T) {
+	instance := newConfigHashTestTeamCity()
+	secret := newDatabaseSecretTestSecret(DatabaseSecretKeys{}.All()...)
+	r := newTestTeamcityReconciler(t, instance, secret, newConfigHashTestConfigMap("a"), newTestStatefulSet("main", 1))
+
+	require.NoError(t, r.reconcileConfigHash(context.Background(), instance))
+	require.NotEmpty(t, instance.Status.ConfigHash)
+	assert.Equal(t, instance.Status.ConfigHash, instance.Status.ConfigHashBaseline)
+	statefulSet := resource.BuildDesiredStatefulSet(instance, instance.Spec.MainNode, nil)
+	assert.NotContains(t, statefulSet.Spec.Template.Annotations, ConfigHashAnnotationKey, "recording the first hash restarts nothing")
+
+	secret.Data[DatabasePasswordProperty] = []byte("rotated")
+	require.NoError(t, r.Update(context.Background(), secret))
+	require.NoError(t, r.reconcileConfigHash(context.Background(), instance))
+	assert.NotEqual(t, instance.Status.ConfigHashBaseline, instance.Status.ConfigHash)
+	statefulSet = resource.BuildDesiredStatefulSet(instance, instance.Spec.MainNode, nil)
+	assert.Equal(t, instance.Status.ConfigHash, statefulSet.Spec.Template.Annotations[ConfigHashAnnotationKey])
+}
+
+func TestTeamCitiesReferencingSecretsAndConfigMaps(t *testing.T) {
+	user := newConfigHashTestTeamCity()
+	other := newDatabaseSecretTestTeamCity()
+	other.Name = "other"
+	other.Spec.DatabaseSecret.Secret = "other-database"
+	r := newTestTeamcityReconciler(t, user, other)
+	expected := types.NamespacedName{Name: "tc", Namespace: testNamespace}
+
+	requests := r.teamCitiesForSecret(context.Background(), newDatabaseSecretTestSecret())
+	require.Len(t, requests, 1)
+	assert.Equal(t, expected, requests[0].NamespacedName)
+
+	requests = r.teamCitiesForConfigMap(context.Background(), newConfigHashTestConfigMap("a"))
+	require.Len(t, requests, 1)
+	assert.Equal(t, expected, requests[0].NamespacedName)
+}
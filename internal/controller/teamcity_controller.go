@@ -25,8 +25,10 @@ import (
 
 	. "git.jetbrains.team/tch/teamcity-operator/api/v1beta1"
 	"git.jetbrains.team/tch/teamcity-operator/internal/checkpoint"
+	"git.jetbrains.team/tch/teamcity-operator/internal/metrics"
 	"git.jetbrains.team/tch/teamcity-operator/internal/predicate"
 	"git.jetbrains.team/tch/teamcity-operator/internal/resource"
+	"git.jetbrains.team/tch/teamcity-operator/internal/teamcity"
 	v1 "k8s.io/api/apps/v1"
 	v12 "k8s.io/api/core/v1"
 	netv1 "k8s.io/api/networking/v1"
@@ -41,6 +43,7 @@ import (
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/controller"
 	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
 	"sigs.k8s.io/controller-runtime/pkg/log"
 )
 
@@ -55,6 +58,11 @@ type TeamcityReconciler struct {
 	Clientset *kubernetes.Clientset
 	Scheme    *runtime.Scheme
 	Recorder  record.EventRecorder
+	// ClientFactory creates the REST client used to check for running builds and to move the responsibilities of
+	// upgraded secondary nodes; defaults to teamcity.NewClientForInstance.
+	ClientFactory teamcity.ClientFactory
+	// Now returns the current time for hibernation schedules; defaults to time.Now.
+	Now func() time.Time
 }
 
 //+kubebuilder:rbac:groups=jetbrains.com,resources=teamcities,verbs=get;list;watch;create;update;patch;delete
@@ -66,7 +74,9 @@ type TeamcityReconciler struct {
 //+kubebuilder:rbac:groups=networking.k8s.io,resources=ingresses,verbs=get;list;watch;create;update;patch;delete
 //+kubebuilder:rbac:groups=core,resources=serviceaccounts,verbs=get;list;watch;create;update;patch;delete
 //+kubebuilder:rbac:groups=core,resources=configmaps,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups=core,resources=secrets,verbs=get;list;watch;create;update;delete
 //+kubebuilder:rbac:groups=core,resources=events,verbs=create;patch
+//+kubebuilder:rbac:groups=core,resources=pods,verbs=get;delete
 
 // Reconcile is part of the main kubernetes reconciliation loop which aims to
 // move the current state of the cluster closer to the desired state.
@@ -107,19 +117,75 @@ func (r *TeamcityReconciler) Reconcile(ctx context.Context, req ctrl.Request) (c
 		return ctrl.Result{}, nil
 	}
 
+	// an upgrade started by an older operator goes on from its checkpoint ConfigMap
+	if migrated, err := checkpoint.NewCheckpoint(r.Client, teamcity).MigrateConfigMap(ctx); err != nil {
+		return ctrl.Result{}, err
+	} else if migrated {
+		if teamcity, err = getTeamCityObjectE(r, ctx, req.NamespacedName); err != nil {
+			return ctrl.Result{}, err
+		}
+	}
+
+	hibernationRequeueAfter, err := r.reconcileHibernation(ctx, &teamcity)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+
+	if err := r.reconcileManagedDatabase(ctx, &teamcity); err != nil {
+		return ctrl.Result{}, err
+	}
+	// the Secret watch re-queues the instance once the Secret is fixed
+	if databaseSecretValid, err := r.checkDatabaseSecret(ctx, &teamcity); err != nil || !databaseSecretValid {
+		return ctrl.Result{}, err
+	}
+	if err := r.reconcileConfigHash(ctx, &teamcity); err != nil {
+		return ctrl.Result{}, err
+	}
+
 	resourceBuilder := resource.TeamCityResourceBuilder{
 		Instance: &teamcity,
 		Scheme:   r.Scheme,
 		Client:   r.Client,
 	}
 	isOngoingUpdate := ongoingZeroDowntimeUpgrade(r, ctx, &teamcity)
-	if teamcity.UsesZeroDownTimeUpgradePolicy() || isOngoingUpdate {
+	changeApproved, err := r.reconcileChangeApproval(ctx, &teamcity, isOngoingUpdate)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	resuming, err := anyNodeScaledToZero(ctx, r.Client, &teamcity, teamcity.GetAllNodes())
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	if teamcity.IsStopped() {
+		if err := r.scaleUpdateReplica(ctx, &teamcity, 0); err != nil {
+			return ctrl.Result{}, err
+		}
+	}
+	zeroDowntime := teamcity.UsesZeroDownTimeUpgradePolicy()
+	if zeroDowntime && !isOngoingUpdate {
+		if zeroDowntime, err = r.zeroDowntimeUpgradeSupported(ctx, &teamcity); err != nil {
+			return ctrl.Result{}, err
+		}
+	}
+	// stopped nodes and a restore have nothing to keep available; the checkpoint is kept and the upgrade
+	// continues from it once every node has been started again
+	held := !changeApproved || teamcity.IsStopped() || teamcity.InRestoreMode() || resuming
+	if isOngoingUpdate {
+		if err := setUpgradeHeld(r, ctx, &teamcity, held); err != nil {
+			return ctrl.Result{}, err
+		}
+	}
+	if !held && (zeroDowntime || isOngoingUpdate) {
+		if err := r.scaleUpdateReplica(ctx, &teamcity, 1); err != nil {
+			return ctrl.Result{}, err
+		}
 		requeue, err := r.performZeroDowntimeUpgradeOrRequeue(ctx, &teamcity, isOngoingUpdate)
 		if err != nil {
 			return ctrl.Result{}, err
 		}
 		if requeue {
 			log.V(1).Info("Update request will be re-queued")
+			_ = updateTeamCityObjectStatusE(r, ctx, req.NamespacedName, TEAMCITY_CRD_OBJECT_UPDATING_STATE, "Zero-downtime upgrade in progress")
 			return ctrl.Result{Requeue: true, RequeueAfter: reconciliationRequeueInterval}, nil
 		}
 	}
@@ -127,6 +193,14 @@ func (r *TeamcityReconciler) Reconcile(ctx context.Context, req ctrl.Request) (c
 	builders := resourceBuilder.ResourceBuilders()
 
 	for _, builder := range builders {
+		if teamcity.UpgradeRolledBack() && isNodeStatefulSetBuilder(builder) {
+			log.V(1).Info("Skipping the node StatefulSets, the upgrade to the current spec was rolled back")
+			continue
+		}
+		if !changeApproved && isNodeStatefulSetBuilder(builder) {
+			log.V(1).Info("Skipping the node StatefulSets, the change waits for approval")
+			continue
+		}
 		if _, err := r.reconcileDelete(ctx, builder); err != nil {
 			return ctrl.Result{}, err
 		}
@@ -141,15 +215,24 @@ func (r *TeamcityReconciler) Reconcile(ctx context.Context, req ctrl.Request) (c
 				r.reportRecreateBlocked(ctx, &teamcity, recreateBlocked)
 				return ctrl.Result{}, nil
 			}
+			_ = updateTeamCityObjectStatusE(r, ctx, req.NamespacedName, TEAMCITY_CRD_OBJECT_ERROR_STATE, err.Error())
 			return ctrl.Result{}, err
 		}
 	}
-	_ = updateTeamCityObjectStatusE(r, ctx, req.NamespacedName, TEAMCITY_CRD_OBJECT_SUCCESS_STATE, "Successfully reconciled TeamCity")
+	if teamcity.IsStopped() {
+		result, err := r.reportStopped(ctx, &teamcity)
+		return withRequeueAfter(result, hibernationRequeueAfter), err
+	}
+	message := "Successfully reconciled TeamCity"
+	if !changeApproved {
+		message = fmt.Sprintf("Generation %d restarts nodes and waits for approval, see status.pendingChange", teamcity.Generation)
+	}
+	_ = updateTeamCityObjectStatusE(r, ctx, req.NamespacedName, TEAMCITY_CRD_OBJECT_SUCCESS_STATE, message)
 	if ongoingZeroDowntimeUpgrade(r, ctx, &teamcity) {
 		log.V(1).Info("Detected an ongoing zero-downtime update. Update request will be re-queued")
 		return ctrl.Result{Requeue: true, RequeueAfter: reconciliationRequeueInterval}, nil
 	}
-	return ctrl.Result{}, nil
+	return withRequeueAfter(ctrl.Result{}, hibernationRequeueAfter), nil
 }
 
 // SetupWithManager sets up the controller with the Manager.
@@ -161,21 +244,19 @@ func (r *TeamcityReconciler) SetupWithManager(mgr ctrl.Manager) error {
 		Owns(&netv1.Ingress{}).
 		Owns(&v12.ServiceAccount{}).
 		Owns(&v12.PersistentVolumeClaim{}, builder.WithPredicates(predicate.PersistentVolumeClaimEventPredicates())).
+		Watches(&v12.Secret{}, handler.EnqueueRequestsFromMapFunc(r.teamCitiesForSecret)).
+		Watches(&v12.ConfigMap{}, handler.EnqueueRequestsFromMapFunc(r.teamCitiesForConfigMap)).
 		WithOptions(controller.Options{MaxConcurrentReconciles: 1}).
 		Complete(r)
 }
 
 func (r *TeamcityReconciler) finalizeTeamCity(ctx context.Context, teamcity *TeamCity) error {
 	log := log.FromContext(ctx)
-	isOngoingUpdate := ongoingZeroDowntimeUpgrade(r, ctx, teamcity)
-	if isOngoingUpdate {
-		log.V(1).Info("Detected ongoing zero-downtime update. Cleaning up TeamCity's checkpoint object")
-		currentCheckpoint := checkpoint.NewCheckpoint(r.Client, *teamcity)
-		err := currentCheckpoint.Delete(ctx)
-		if err != nil {
-			return err
-		}
+	// the checkpoint in the status goes away with the object, only a ConfigMap of an older operator is left over
+	if err := checkpoint.NewCheckpoint(r.Client, *teamcity).DeleteConfigMap(ctx); err != nil {
+		return err
 	}
+	metrics.ForgetInstance(teamcity.Namespace, teamcity.Name)
 	log.V(1).Info("Ran finalizers TeamCity object successfully")
 	return nil
 }
@@ -236,13 +317,62 @@ func (r *TeamcityReconciler) reconcileDelete(ctx context.Context, builder resour
 	return ctrl.Result{}, nil
 }
 
+// scaleUpdateReplica scales the read-only replica of an ongoing zero-downtime upgrade, if there is one.
+func (r *TeamcityReconciler) scaleUpdateReplica(ctx context.Context, instance *TeamCity, replicas int32) error {
+	var statefulSet v1.StatefulSet
+	if err := r.Get(ctx, resource.GetROStatefulSetNamespacedName(instance), &statefulSet); err != nil {
+		if errors.IsNotFound(err) {
+			return nil
+		}
+		return err
+	}
+	if statefulSet.Spec.Replicas != nil && *statefulSet.Spec.Replicas == replicas {
+		return nil
+	}
+	statefulSet.Spec.Replicas = &replicas
+	return r.Update(ctx, &statefulSet)
+}
+
+// reportStopped writes the Stopped state once no node is running, and requeues while the pods are terminating.
+func (r *TeamcityReconciler) reportStopped(ctx context.Context, instance *TeamCity) (ctrl.Result, error) {
+	namespacedName := types.NamespacedName{Name: instance.Name, Namespace: instance.Namespace}
+	stopped, err := nodesStopped(ctx, r.Client, instance, instance.GetAllNodes())
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	if !stopped {
+		_ = updateTeamCityObjectStatusE(r, ctx, namespacedName, TEAMCITY_CRD_OBJECT_UPDATING_STATE, "Stopping nodes")
+		return ctrl.Result{Requeue: true, RequeueAfter: reconciliationRequeueInterval}, nil
+	}
+	_ = updateTeamCityObjectStatusE(r, ctx, namespacedName, TEAMCITY_CRD_OBJECT_STOPPED_STATE, "All nodes are stopped")
+	return ctrl.Result{}, nil
+}
+
 func (r *TeamcityReconciler) validatePreconditions(ctx context.Context, builder resource.ResourceBuilder, instance TeamCity) (preconditionSuccessful bool) {
 	log := log.FromContext(ctx)
 	preconditionSuccessful = true
 
 	switch builder.(type) {
+	case *resource.StatefulSetBuilder:
+		if instance.IsStopped() {
+			log.V(1).Info("Checking if the secondary nodes have stopped before stopping the main node")
+			updateReplica := resource.BuildRoNode(&instance, resource.GetROStatefulSetNamespacedName(&instance).Name)
+			stopped, err := nodesStopped(ctx, r.Client, &instance, append([]Node{updateReplica}, instance.Spec.SecondaryNodes...))
+			if err != nil {
+				log.V(1).Error(err, "Unable to get replica information of the secondary nodes")
+			}
+			preconditionSuccessful = stopped
+		} else if instance.UsesManagedDatabase() {
+			log.V(1).Info("Checking if the managed database is ready before starting the main node")
+			ready, err := managedDatabaseReady(ctx, r.Client, &instance)
+			if err != nil {
+				log.V(1).Error(err, "Unable to get readiness of the managed database")
+			}
+			preconditionSuccessful = ready
+		}
 	case *resource.SecondaryStatefulSetBuilder:
-		if instance.IsMultiNode() {
+		// stopping the secondary nodes does not depend on the main node
+		if instance.IsMultiNode() && !instance.IsStopped() {
 			log.V(1).Info("Checking if the main node has started before starting secondary nodes")
 			mainNodeNamespacedName := types.NamespacedName{
 				Namespace: instance.Namespace,
@@ -259,28 +389,55 @@ func (r *TeamcityReconciler) validatePreconditions(ctx context.Context, builder
 			}
 
 			ongoingUpdate := ongoingZeroDowntimeUpgrade(r, ctx, &instance)
+			// an upgrade stopped by spec.stopped continues only once the secondary nodes run again
+			resuming, err := anyNodeScaledToZero(ctx, r.Client, &instance, instance.Spec.SecondaryNodes)
+			if err != nil {
+				log.V(1).Error(err, "Unable to get replica information of the secondary nodes")
+			}
 
 			log.V(1).Info(fmt.Sprintf("Newest generation: %s", strconv.FormatBool(newestGeneration)))
 			log.V(1).Info(fmt.Sprintf("Main node updated: %s", strconv.FormatBool(updated)))
 			log.V(1).Info(fmt.Sprintf("Ongoing update: %s", strconv.FormatBool(ongoingUpdate)))
-			preconditionSuccessful = newestGeneration && updated && !ongoingUpdate
+			preconditionSuccessful = newestGeneration && updated && (!ongoingUpdate || resuming)
 		}
 	}
 	return preconditionSuccessful
 }
 
+func isNodeStatefulSetBuilder(builder resource.ResourceBuilder) bool {
+	switch builder.(type) {
+	case *resource.StatefulSetBuilder, *resource.SecondaryStatefulSetBuilder:
+		return true
+	default:
+		return false
+	}
+}
+
 func (r *TeamcityReconciler) performZeroDowntimeUpgradeOrRequeue(ctx context.Context, teamcity *TeamCity, ongoingUpdate bool) (bool, error) {
 	var err error
 	statefulSetsWillBeRestarted := false
 	if statefulSetsWillBeRestarted, err = doesNodesUpdateChangeStatefulSetSpec(r, ctx, teamcity); err != nil {
 		return false, nil
 	}
+	if !ongoingUpdate {
+		if err := resetUpgradeControl(r, ctx, teamcity); err != nil {
+			return false, err
+		}
+		// a rolled back spec is not retried until it changes
+		if teamcity.UpgradeRolledBack() {
+			return false, nil
+		}
+	}
 	if statefulSetsWillBeRestarted || ongoingUpdate {
 		currentCheckpoint := checkpoint.NewCheckpoint(r.Client, *teamcity)
-		err := currentCheckpoint.UpdateStageFromConfigMap(ctx)
-		if err != nil {
-			if !errors.IsNotFound(err) {
-				return false, err
+		currentCheckpoint.Now = r.Now
+		if err := currentCheckpoint.UpdateStageFromStatus(ctx); err != nil {
+			return false, err
+		}
+		if ongoingUpdate {
+			held, err := applyUpgradeControl(r, ctx, teamcity, currentCheckpoint)
+			if err != nil || held {
+				return held, err
 			}
 		}
 		requeue, err := doActionBasedOnCheckpointOrRequeue(r, ctx, currentCheckpoint)
@@ -0,0 +1,98 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	. "git.jetbrains.team/tch/teamcity-operator/api/v1beta1"
+	v12 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+const (
+	eventReasonDatabaseSecretInvalid = "DatabaseSecretInvalid"
+	conditionReasonSecretNotFound    = "SecretNotFound"
+	conditionReasonSecretKeysMissing = "SecretKeysMissing"
+	conditionReasonSecretValid       = "SecretValid"
+)
+
+// checkDatabaseSecret verifies that spec.databaseSecret exists and has every key the nodes read, so that
+// a typo is reported on the TeamCity instead of leaving pods in CreateContainerConfigError.
+// It returns false when reconciliation must wait for the Secret to be fixed.
+func (r *TeamcityReconciler) checkDatabaseSecret(ctx context.Context, instance *TeamCity) (bool, error) {
+	if !instance.DatabaseSecretProvided() {
+		return true, nil
+	}
+	reason, message, err := r.databaseSecretProblem(ctx, instance)
+	if err != nil {
+		return false, err
+	}
+	if reason == "" {
+		if meta.IsStatusConditionTrue(instance.Status.Conditions, ConditionDatabaseSecretInvalid) {
+			return true, r.setDatabaseSecretCondition(ctx, instance, metav1.ConditionFalse, conditionReasonSecretValid, "")
+		}
+		return true, nil
+	}
+	log.FromContext(ctx).Info("Database Secret is invalid", "secret", instance.Spec.DatabaseSecret.Secret, "reason", reason)
+	if err := updateTeamCityObjectStatusE(r, ctx, types.NamespacedName{Name: instance.Name, Namespace: instance.Namespace},
+		TEAMCITY_CRD_OBJECT_ERROR_STATE, message); err != nil {
+		return false, err
+	}
+	if err := r.setDatabaseSecretCondition(ctx, instance, metav1.ConditionTrue, reason, message); err != nil {
+		return false, err
+	}
+	r.recordEvent(instance, v12.EventTypeWarning, eventReasonDatabaseSecretInvalid, message)
+	return false, nil
+}
+
+func (r *TeamcityReconciler) databaseSecretProblem(ctx context.Context, instance *TeamCity) (reason string, message string, err error) {
+	secretName := instance.Spec.DatabaseSecret.Secret
+	var secret v12.Secret
+	if err := r.Get(ctx, types.NamespacedName{Name: secretName, Namespace: instance.Namespace}, &secret); err != nil {
+		if errors.IsNotFound(err) {
+			return conditionReasonSecretNotFound, fmt.Sprintf("Database Secret %q does not exist", secretName), nil
+		}
+		return "", "", err
+	}
+	var missing []string
+	for _, key := range instance.Spec.DatabaseSecret.Keys.All() {
+		// the API server merges stringData into data, it is never returned
+		if _, found := secret.Data[key]; !found {
+			missing = append(missing, key)
+		}
+	}
+	if len(missing) > 0 {
+		return conditionReasonSecretKeysMissing,
+			fmt.Sprintf("Database Secret %q is missing keys: %s", secretName, strings.Join(missing, ", ")), nil
+	}
+	return "", "", nil
+}
+
+func (r *TeamcityReconciler) setDatabaseSecretCondition(ctx context.Context, instance *TeamCity, status metav1.ConditionStatus, reason string, message string) error {
+	teamcity, err := getTeamCityObjectE(r, ctx, types.NamespacedName{Name: instance.Name, Namespace: instance.Namespace})
+	if err != nil {
+		return err
+	}
+	current := meta.FindStatusCondition(teamcity.Status.Conditions, ConditionDatabaseSecretInvalid)
+	if current != nil && current.Status == status && current.Reason == reason && current.Message == message &&
+		current.ObservedGeneration == teamcity.Generation {
+		return nil
+	}
+	meta.SetStatusCondition(&teamcity.Status.Conditions, metav1.Condition{
+		Type:               ConditionDatabaseSecretInvalid,
+		Status:             status,
+		ObservedGeneration: teamcity.Generation,
+		Reason:             reason,
+		Message:            message,
+	})
+	if err := r.Status().Update(ctx, &teamcity); err != nil {
+		return err
+	}
+	instance.Status = teamcity.Status
+	return nil
+}
@@ -0,0 +1,121 @@
+package controller
+
+import (
+	"context"
+	"testing"
+
+	. "git.jetbrains.team/tch/teamcity-operator/api/v1beta1"
+	"git.jetbrains.team/tch/teamcity-operator/internal/resource"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	v12 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+)
+
+func newDatabaseSecretTestTeamCity() *TeamCity {
+	instance := newTestTeamCity()
+	instance.Spec.DatabaseSecret = DatabaseSecret{Secret: "database-properties"}
+	return instance
+}
+
+func newDatabaseSecretTestSecret(keys ...string) *v12.Secret {
+	secret := &v12.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "database-properties", Namespace: testNamespace},
+		Data:       map[string][]byte{},
+	}
+	for _, key := range keys {
+		secret.Data[key] = []byte("value")
+	}
+	return secret
+}
+
+func TestCheckDatabaseSecret(t *testing.T) {
+	tests := []struct {
+		name    string
+		secret  *v12.Secret
+		valid   bool
+		reason  string
+		message string
+	}{
+		{
+			name:   "all keys present",
+			secret: newDatabaseSecretTestSecret(DatabaseSecretKeys{}.All()...),
+			valid:  true,
+		},
+		{
+			name:    "secret missing",
+			valid:   false,
+			reason:  conditionReasonSecretNotFound,
+			message: `Database Secret "database-properties" does not exist`,
+		},
+		{
+			name:    "key misspelled",
+			secret:  newDatabaseSecretTestSecret(resource.TEAMCITY_DB_URL_SECRET_KEY, "connectionProperties.username", resource.TEAMCITY_DB_PASSWORD_SECRET_KEY),
+			valid:   false,
+			reason:  conditionReasonSecretKeysMissing,
+			message: `Database Secret "database-properties" is missing keys: connectionProperties.user`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			instance := newDatabaseSecretTestTeamCity()
+			r := newTestTeamcityReconciler(t, instance)
+			if tt.secret != nil {
+				r = newTestTeamcityReconciler(t, instance, tt.secret)
+			}
+			recorder := record.NewFakeRecorder(10)
+			r.Recorder = recorder
+
+			valid, err := r.checkDatabaseSecret(context.Background(), instance)
+			require.NoError(t, err)
+			assert.Equal(t, tt.valid, valid)
+
+			var updated TeamCity
+			require.NoError(t, r.Get(context.Background(), types.NamespacedName{Name: "tc", Namespace: testNamespace}, &updated))
+			condition := meta.FindStatusCondition(updated.Status.Conditions, ConditionDatabaseSecretInvalid)
+			if tt.valid {
+				assert.Nil(t, condition)
+				assert.Empty(t, recorder.Events)
+				return
+			}
+			require.NotNil(t, condition)
+			assert.Equal(t, metav1.ConditionTrue, condition.Status)
+			assert.Equal(t, tt.reason, condition.Reason)
+			assert.Equal(t, tt.message, condition.Message)
+			assert.Equal(t, TEAMCITY_CRD_OBJECT_ERROR_STATE, updated.Status.State)
+			require.Len(t, recorder.Events, 1)
+			assert.Contains(t, <-recorder.Events, eventReasonDatabaseSecretInvalid)
+		})
+	}
+}
+
+func TestCheckDatabaseSecretClearsConditionOnceFixed(t *testing.T) {
+	instance := newDatabaseSecretTestTeamCity()
+	instance.Status.Conditions = []metav1.Condition{{
+		Type:   ConditionDatabaseSecretInvalid,
+		Status: metav1.ConditionTrue,
+		Reason: conditionReasonSecretNotFound,
+	}}
+	r := newTestTeamcityReconciler(t, instance, newDatabaseSecretTestSecret(DatabaseSecretKeys{}.All()...))
+
+	valid, err := r.checkDatabaseSecret(context.Background(), instance)
+	require.NoError(t, err)
+	assert.True(t, valid)
+
+	var updated TeamCity
+	require.NoError(t, r.Get(context.Background(), types.NamespacedName{Name: "tc", Namespace: testNamespace}, &updated))
+	assert.True(t, meta.IsStatusConditionFalse(updated.Status.Conditions, ConditionDatabaseSecretInvalid))
+}
+
+func TestCheckDatabaseSecretSkippedWithoutDatabase(t *testing.T) {
+	instance := newDatabaseSecretTestTeamCity()
+	instance.Spec.DatabaseSecret = DatabaseSecret{}
+	r := newTestTeamcityReconciler(t, instance)
+
+	valid, err := r.checkDatabaseSecret(context.Background(), instance)
+	require.NoError(t, err)
+	assert.True(t, valid)
+}
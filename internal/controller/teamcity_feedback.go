@@ -6,6 +6,7 @@ import (
 	"strings"
 
 	. "git.jetbrains.team/tch/teamcity-operator/api/v1beta1"
+	"git.jetbrains.team/tch/teamcity-operator/internal/metrics"
 	"git.jetbrains.team/tch/teamcity-operator/internal/resource"
 	v12 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/types"
@@ -71,6 +72,8 @@ func (r *TeamcityReconciler) reportRecreateBlocked(
 		"requiredAnnotation", AllowStsRecreateAnnotationKey,
 	)
 
+	metrics.StatefulSetRecreationsBlocked.WithLabelValues(instance.Namespace, instance.Name).Inc()
+
 	if err := updateTeamCityObjectStatusE(r, ctx, types.NamespacedName{
 		Name:      instance.Name,
 		Namespace: instance.Namespace,
@@ -104,6 +107,8 @@ func (r *TeamcityReconciler) reportRecreateInProgress(
 		"changes", resource.FormatImmutableStatefulSetFieldChanges(changes),
 	)
 
+	metrics.StatefulSetRecreations.WithLabelValues(instance.Namespace, instance.Name).Inc()
+
 	if err := updateTeamCityObjectStatusE(r, ctx, types.NamespacedName{
 		Name:      instance.Name,
 		Namespace: instance.Namespace,
@@ -0,0 +1,174 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"time"
+
+	. "git.jetbrains.team/tch/teamcity-operator/api/v1beta1"
+	"git.jetbrains.team/tch/teamcity-operator/internal/teamcity"
+	"github.com/robfig/cron/v3"
+	v12 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+const (
+	// hibernationLookback bounds how far back the schedules are evaluated before the first transition
+	hibernationLookback = 35 * 24 * time.Hour
+	// hibernationPostponeInterval is how often running builds are checked while the sleep is postponed
+	hibernationPostponeInterval = time.Minute
+
+	eventReasonHibernating          = "Hibernating"
+	eventReasonWakingUp             = "WakingUp"
+	eventReasonHibernationPostponed = "HibernationPostponed"
+)
+
+// reconcileHibernation updates status.hibernation from spec.hibernation and returns when the next transition is due.
+// The nodes follow through instance.IsStopped, so this runs before the resource builders.
+func (r *TeamcityReconciler) reconcileHibernation(ctx context.Context, instance *TeamCity) (time.Duration, error) {
+	if instance.Spec.Hibernation == nil {
+		if instance.Status.Hibernation == nil {
+			return 0, nil
+		}
+		instance.Status.Hibernation = nil
+		return 0, r.Status().Update(ctx, instance)
+	}
+
+	original := instance.Status.Hibernation.DeepCopy()
+	status := instance.Status.Hibernation
+	if status == nil {
+		status = &HibernationStatus{}
+		instance.Status.Hibernation = status
+	}
+	requeueAfter, err := r.updateHibernationStatus(ctx, instance, status)
+	if err != nil {
+		return 0, err
+	}
+	if !reflect.DeepEqual(original, status) {
+		if err := r.Status().Update(ctx, instance); err != nil {
+			return 0, err
+		}
+	}
+	return requeueAfter, nil
+}
+
+func (r *TeamcityReconciler) updateHibernationStatus(ctx context.Context, instance *TeamCity, status *HibernationStatus) (time.Duration, error) {
+	spec := instance.Spec.Hibernation
+	sleep, err := cron.ParseStandard(spec.Sleep)
+	if err != nil {
+		status.Message = fmt.Sprintf("Invalid sleep schedule %q: %s", spec.Sleep, err)
+		return 0, nil
+	}
+	wake, err := cron.ParseStandard(spec.Wake)
+	if err != nil {
+		status.Message = fmt.Sprintf("Invalid wake schedule %q: %s", spec.Wake, err)
+		return 0, nil
+	}
+
+	now := r.now()
+	since := now.Add(-hibernationLookback)
+	if status.LastTransitionTime != nil && status.LastTransitionTime.Time.After(since) {
+		since = status.LastTransitionTime.Time
+	}
+	shouldSleep := hibernationTarget(sleep, wake, since, now, status.Hibernating)
+
+	status.Message = ""
+	var postponeAfter time.Duration
+	switch {
+	case shouldSleep && !status.Hibernating:
+		runningBuilds, err := r.runningBuilds(ctx, instance)
+		switch {
+		case err != nil:
+			status.Message = fmt.Sprintf("Sleep postponed, unable to check running builds: %s", err)
+			postponeAfter = hibernationPostponeInterval
+		case runningBuilds > 0:
+			status.Message = fmt.Sprintf("Sleep postponed, %d builds are running", runningBuilds)
+			postponeAfter = hibernationPostponeInterval
+		default:
+			status.Hibernating = true
+			status.LastTransitionTime = &metav1.Time{Time: now}
+			r.recordEvent(instance, v12.EventTypeNormal, eventReasonHibernating, "Stopping all nodes on the sleep schedule")
+		}
+		if postponeAfter > 0 {
+			log.FromContext(ctx).V(1).Info("Hibernation postponed", "reason", status.Message)
+			r.recordEvent(instance, v12.EventTypeNormal, eventReasonHibernationPostponed, status.Message)
+		}
+	case !shouldSleep && status.Hibernating:
+		status.Hibernating = false
+		status.LastTransitionTime = &metav1.Time{Time: now}
+		r.recordEvent(instance, v12.EventTypeNormal, eventReasonWakingUp, "Starting all nodes on the wake schedule")
+	}
+
+	next := sleep.Next(now)
+	status.NextTransition = HibernationTransitionSleep
+	if status.Hibernating {
+		next = wake.Next(now)
+		status.NextTransition = HibernationTransitionWake
+	}
+	status.NextTransitionTime = &metav1.Time{Time: next}
+
+	requeueAfter := next.Sub(now)
+	if postponeAfter > 0 && postponeAfter < requeueAfter {
+		requeueAfter = postponeAfter
+	}
+	return requeueAfter, nil
+}
+
+// runningBuilds returns the number of running builds, or zero when the instance does not wait for them.
+func (r *TeamcityReconciler) runningBuilds(ctx context.Context, instance *TeamCity) (int, error) {
+	if !instance.Spec.Hibernation.WaitForRunningBuilds || !instance.APITokenSecretProvided() {
+		return 0, nil
+	}
+	tcClient, err := r.clientFactory()(ctx, r.Client, instance)
+	if err != nil {
+		return 0, err
+	}
+	return tcClient.RunningBuildsCount(ctx)
+}
+
+func (r *TeamcityReconciler) clientFactory() teamcity.ClientFactory {
+	if r.ClientFactory != nil {
+		return r.ClientFactory
+	}
+	return teamcity.NewClientForInstance
+}
+
+func (r *TeamcityReconciler) now() time.Time {
+	if r.Now != nil {
+		return r.Now()
+	}
+	return time.Now()
+}
+
+func (r *TeamcityReconciler) recordEvent(instance *TeamCity, eventType string, reason string, message string) {
+	if r.Recorder != nil {
+		r.Recorder.Event(instance, eventType, reason, message)
+	}
+}
+
+// hibernationTarget reports whether the nodes should sleep at now. The later of the last sleep and the last wake
+// time since the previous transition wins; without either, the current state is kept.
+func hibernationTarget(sleep cron.Schedule, wake cron.Schedule, since time.Time, now time.Time, hibernating bool) bool {
+	lastSleep, sleepDue := mostRecentScheduleTime(sleep, since, now)
+	lastWake, wakeDue := mostRecentScheduleTime(wake, since, now)
+	switch {
+	case sleepDue && wakeDue:
+		return lastSleep.After(lastWake)
+	case sleepDue:
+		return true
+	case wakeDue:
+		return false
+	}
+	return hibernating
+}
+
+// withRequeueAfter makes sure result is requeued no later than after; a zero after leaves result unchanged.
+func withRequeueAfter(result ctrl.Result, after time.Duration) ctrl.Result {
+	if after > 0 && (result.RequeueAfter == 0 || after < result.RequeueAfter) {
+		result.RequeueAfter = after
+	}
+	return result
+}
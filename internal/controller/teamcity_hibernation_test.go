@@ -0,0 +1,151 @@
+package controller
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	. "git.jetbrains.team/tch/teamcity-operator/api/v1beta1"
+	"git.jetbrains.team/tch/teamcity-operator/internal/teamcity"
+	"git.jetbrains.team/tch/teamcity-operator/internal/teamcity/teamcitytest"
+	"github.com/robfig/cron/v3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	v12 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// Monday, 2024-03-04
+var hibernationTestDay = time.Date(2024, time.March, 4, 0, 0, 0, 0, time.UTC)
+
+func newHibernationTestTeamCity() *TeamCity {
+	instance := newTestTeamCity()
+	instance.Spec.APITokenSecret = &v12.SecretKeySelector{LocalObjectReference: v12.LocalObjectReference{Name: "token"}, Key: "token"}
+	instance.Spec.Hibernation = &HibernationSpec{
+		Sleep:                "0 20 * * 1-5",
+		Wake:                 "0 7 * * 1-5",
+		WaitForRunningBuilds: true,
+	}
+	return instance
+}
+
+func newHibernationTestReconciler(t *testing.T, server *teamcitytest.Server, now time.Time, objects ...client.Object) *TeamcityReconciler {
+	r := newTestTeamcityReconciler(t, objects...)
+	r.Now = func() time.Time { return now }
+	r.ClientFactory = func(ctx context.Context, reader client.Reader, instance *TeamCity) (*teamcity.Client, error) {
+		return teamcity.NewClient(server.URL, server.Token, http.DefaultClient), nil
+	}
+	return r
+}
+
+func reconcileHibernation(t *testing.T, r *TeamcityReconciler) (time.Duration, TeamCity) {
+	var instance TeamCity
+	namespacedName := types.NamespacedName{Name: "tc", Namespace: testNamespace}
+	require.NoError(t, r.Get(context.Background(), namespacedName, &instance))
+	requeueAfter, err := r.reconcileHibernation(context.Background(), &instance)
+	require.NoError(t, err)
+	require.NoError(t, r.Get(context.Background(), namespacedName, &instance))
+	return requeueAfter, instance
+}
+
+func TestHibernationTarget(t *testing.T) {
+	sleep, err := cron.ParseStandard("0 20 * * 1-5")
+	require.NoError(t, err)
+	wake, err := cron.ParseStandard("0 7 * * 1-5")
+	require.NoError(t, err)
+
+	for name, tc := range map[string]struct {
+		since       time.Time
+		now         time.Time
+		hibernating bool
+		expected    bool
+	}{
+		"working hours":           {since: hibernationTestDay.Add(-hibernationLookback), now: hibernationTestDay.Add(12 * time.Hour), expected: false},
+		"night":                   {since: hibernationTestDay.Add(-hibernationLookback), now: hibernationTestDay.Add(22 * time.Hour), expected: true},
+		"weekend":                 {since: hibernationTestDay.Add(-hibernationLookback), now: hibernationTestDay.Add(-24 * time.Hour), expected: true},
+		"no event since sleeping": {since: hibernationTestDay.Add(21 * time.Hour), now: hibernationTestDay.Add(22 * time.Hour), hibernating: true, expected: true},
+		"no event since waking":   {since: hibernationTestDay.Add(8 * time.Hour), now: hibernationTestDay.Add(9 * time.Hour), expected: false},
+		"wake after postponement": {since: hibernationTestDay.Add(20*time.Hour + time.Minute), now: hibernationTestDay.Add(31 * time.Hour), hibernating: true, expected: false},
+	} {
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, tc.expected, hibernationTarget(sleep, wake, tc.since, tc.now, tc.hibernating))
+		})
+	}
+}
+
+func TestHibernationSleepsAndWakesOnSchedule(t *testing.T) {
+	server := teamcitytest.NewServer("")
+	defer server.Close()
+	night := hibernationTestDay.Add(22 * time.Hour)
+	r := newHibernationTestReconciler(t, server, night, newHibernationTestTeamCity())
+
+	requeueAfter, instance := reconcileHibernation(t, r)
+	require.NotNil(t, instance.Status.Hibernation)
+	assert.True(t, instance.Status.Hibernation.Hibernating)
+	assert.True(t, instance.IsStopped())
+	assert.Equal(t, HibernationTransitionWake, instance.Status.Hibernation.NextTransition)
+	assert.Equal(t, hibernationTestDay.Add(31*time.Hour), instance.Status.Hibernation.NextTransitionTime.Time.UTC())
+	assert.Equal(t, 9*time.Hour, requeueAfter)
+
+	r.Now = func() time.Time { return hibernationTestDay.Add(31 * time.Hour) }
+	requeueAfter, instance = reconcileHibernation(t, r)
+	assert.False(t, instance.Status.Hibernation.Hibernating)
+	assert.False(t, instance.IsStopped())
+	assert.Equal(t, HibernationTransitionSleep, instance.Status.Hibernation.NextTransition)
+	assert.Equal(t, 13*time.Hour, requeueAfter)
+}
+
+func TestHibernationWaitsForRunningBuilds(t *testing.T) {
+	server := teamcitytest.NewServer("")
+	defer server.Close()
+	server.SetRunningBuilds(2)
+	night := hibernationTestDay.Add(20*time.Hour + time.Minute)
+	r := newHibernationTestReconciler(t, server, night, newHibernationTestTeamCity())
+
+	requeueAfter, instance := reconcileHibernation(t, r)
+	assert.False(t, instance.Status.Hibernation.Hibernating)
+	assert.Contains(t, instance.Status.Hibernation.Message, "2 builds are running")
+	assert.Equal(t, hibernationPostponeInterval, requeueAfter)
+
+	server.SetRunningBuilds(0)
+	_, instance = reconcileHibernation(t, r)
+	assert.True(t, instance.Status.Hibernation.Hibernating)
+	assert.Empty(t, instance.Status.Hibernation.Message)
+}
+
+func TestHibernationWithoutRunningBuildsCheck(t *testing.T) {
+	server := teamcitytest.NewServer("")
+	defer server.Close()
+	server.SetRunningBuilds(2)
+	instance := newHibernationTestTeamCity()
+	instance.Spec.APITokenSecret = nil
+	r := newHibernationTestReconciler(t, server, hibernationTestDay.Add(22*time.Hour), instance)
+
+	_, updated := reconcileHibernation(t, r)
+	assert.True(t, updated.Status.Hibernation.Hibernating)
+}
+
+func TestHibernationStatusIsClearedWhenDisabled(t *testing.T) {
+	server := teamcitytest.NewServer("")
+	defer server.Close()
+	r := newHibernationTestReconciler(t, server, hibernationTestDay.Add(22*time.Hour), newHibernationTestTeamCity())
+	_, instance := reconcileHibernation(t, r)
+	require.True(t, instance.IsStopped())
+
+	instance.Spec.Hibernation = nil
+	require.NoError(t, r.Update(context.Background(), &instance))
+	requeueAfter, instance := reconcileHibernation(t, r)
+	assert.Nil(t, instance.Status.Hibernation)
+	assert.False(t, instance.IsStopped())
+	assert.Zero(t, requeueAfter)
+}
+
+func TestWithRequeueAfter(t *testing.T) {
+	assert.Equal(t, ctrl.Result{}, withRequeueAfter(ctrl.Result{}, 0))
+	assert.Equal(t, ctrl.Result{RequeueAfter: time.Hour}, withRequeueAfter(ctrl.Result{}, time.Hour))
+	assert.Equal(t, ctrl.Result{Requeue: true, RequeueAfter: time.Second},
+		withRequeueAfter(ctrl.Result{Requeue: true, RequeueAfter: time.Second}, time.Hour))
+}
@@ -0,0 +1,44 @@
+package controller
+
+import (
+	"context"
+
+	. "git.jetbrains.team/tch/teamcity-operator/api/v1beta1"
+	"git.jetbrains.team/tch/teamcity-operator/internal/resource"
+	v1 "k8s.io/api/apps/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// reconcileManagedDatabase creates the PostgreSQL of spec.managedDatabase, or deletes it once the field is removed.
+// It runs before the database Secret is checked, as that Secret is generated here.
+func (r *TeamcityReconciler) reconcileManagedDatabase(ctx context.Context, instance *TeamCity) error {
+	resourceBuilder := resource.TeamCityResourceBuilder{
+		Instance: instance,
+		Scheme:   r.Scheme,
+		Client:   r.Client,
+	}
+	builder := resourceBuilder.ManagedDatabase()
+	if _, err := r.reconcileDelete(ctx, builder); err != nil {
+		return err
+	}
+	_, err := r.reconcileCreateOrUpdate(ctx, builder, instance, types.NamespacedName{Name: instance.Name, Namespace: instance.Namespace})
+	return err
+}
+
+// managedDatabaseReady reports whether the nodes can connect to the database of spec.managedDatabase.
+// TeamCity does not wait for an unreachable database on startup, so the main node is only started once it is ready.
+func managedDatabaseReady(ctx context.Context, c client.Client, instance *TeamCity) (bool, error) {
+	if !instance.UsesManagedDatabase() {
+		return true, nil
+	}
+	var statefulSet v1.StatefulSet
+	if err := c.Get(ctx, types.NamespacedName{Name: instance.ManagedDatabaseName(), Namespace: instance.Namespace}, &statefulSet); err != nil {
+		if errors.IsNotFound(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	return statefulSet.Status.ReadyReplicas > 0, nil
+}
@@ -0,0 +1,67 @@
+package controller
+
+import (
+	"context"
+	"testing"
+
+	. "git.jetbrains.team/tch/teamcity-operator/api/v1beta1"
+	"git.jetbrains.team/tch/teamcity-operator/internal/resource"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	v1 "k8s.io/api/apps/v1"
+	v12 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	resourceapi "k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+func newManagedDatabaseTestTeamCity() *TeamCity {
+	instance := newTestTeamCity()
+	instance.UID = "tc-uid"
+	instance.Spec.ManagedDatabase = &ManagedDatabase{Image: DefaultManagedDatabaseImage, Storage: resourceapi.MustParse(DefaultManagedDatabaseStorage)}
+	instance.Spec.DatabaseSecret.Secret = instance.ManagedDatabaseName()
+	return instance
+}
+
+func TestReconcileManagedDatabase(t *testing.T) {
+	instance := newManagedDatabaseTestTeamCity()
+	r := newTestTeamcityReconciler(t, instance)
+	ctx := context.Background()
+	name := types.NamespacedName{Name: "tc-postgresql", Namespace: testNamespace}
+
+	require.NoError(t, r.reconcileManagedDatabase(ctx, instance))
+	var secret v12.Secret
+	require.NoError(t, r.Get(ctx, name, &secret))
+	password := secret.Data[DatabasePasswordProperty]
+	assert.NotEmpty(t, password)
+	require.NoError(t, r.Get(ctx, name, &v12.Service{}))
+	require.NoError(t, r.Get(ctx, name, &v1.StatefulSet{}))
+
+	valid, err := r.checkDatabaseSecret(ctx, instance)
+	require.NoError(t, err)
+	assert.True(t, valid)
+
+	require.NoError(t, r.reconcileManagedDatabase(ctx, instance))
+	require.NoError(t, r.Get(ctx, name, &secret))
+	assert.Equal(t, password, secret.Data[DatabasePasswordProperty], "the password is generated once")
+
+	instance.Spec.ManagedDatabase = nil
+	require.NoError(t, r.reconcileManagedDatabase(ctx, instance))
+	assert.True(t, errors.IsNotFound(r.Get(ctx, name, &v1.StatefulSet{})))
+	assert.True(t, errors.IsNotFound(r.Get(ctx, name, &v12.Service{})))
+	assert.True(t, errors.IsNotFound(r.Get(ctx, name, &v12.Secret{})))
+}
+
+func TestMainNodeWaitsForManagedDatabase(t *testing.T) {
+	instance := newManagedDatabaseTestTeamCity()
+	builder := &resource.TeamCityResourceBuilder{Instance: instance}
+
+	r := newTestTeamcityReconciler(t, instance)
+	assert.False(t, r.validatePreconditions(context.Background(), builder.StatefulSet(), *instance))
+
+	r = newTestTeamcityReconciler(t, instance, newTestStatefulSet("tc-postgresql", 0))
+	assert.False(t, r.validatePreconditions(context.Background(), builder.StatefulSet(), *instance))
+
+	r = newTestTeamcityReconciler(t, instance, newTestStatefulSet("tc-postgresql", 1))
+	assert.True(t, r.validatePreconditions(context.Background(), builder.StatefulSet(), *instance))
+}
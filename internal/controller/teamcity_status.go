@@ -0,0 +1,186 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	. "git.jetbrains.team/tch/teamcity-operator/api/v1beta1"
+	"git.jetbrains.team/tch/teamcity-operator/internal/checkpoint"
+	"git.jetbrains.team/tch/teamcity-operator/internal/resource"
+	v1 "k8s.io/api/apps/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	conditionReasonAllNodesReady       = "AllNodesReady"
+	conditionReasonNodesNotReady       = "NodesNotReady"
+	conditionReasonReconcileFailed     = "ReconcileFailed"
+	conditionReasonReconcileSucceeded  = "ReconcileSucceeded"
+	conditionReasonNodesRollingOut     = "NodesRollingOut"
+	conditionReasonReconciliationDone  = "ReconciliationComplete"
+	conditionReasonZeroDowntimeUpgrade = "ZeroDowntimeUpgrade"
+	conditionReasonNoUpgradeCheckpoint = "NoUpgradeInProgress"
+	conditionReasonUpdating            = "Updating"
+	conditionReasonStopped             = "Stopped"
+	conditionReasonUpgradeFailed       = "UpgradeFailed"
+	conditionReasonUpgradeAborted      = "UpgradeAborted"
+	conditionReasonAwaitingApproval    = "AwaitingApproval"
+
+	conditionReasonZeroDowntimeUpgradeSkipped = "ZeroDowntimeUpgradeSkipped"
+)
+
+// collectNodeStatuses reads the StatefulSet of every node, main node first.
+func collectNodeStatuses(r *TeamcityReconciler, ctx context.Context, instance *TeamCity) ([]NodeStatus, error) {
+	nodes := make([]NodeStatus, 0, len(instance.Spec.SecondaryNodes)+1)
+	mainStatus, err := nodeStatusFromCluster(r, ctx, instance, instance.Spec.MainNode, "main")
+	if err != nil {
+		return nil, err
+	}
+	nodes = append(nodes, mainStatus)
+	for _, node := range instance.Spec.SecondaryNodes {
+		secondaryStatus, err := nodeStatusFromCluster(r, ctx, instance, node, "secondary")
+		if err != nil {
+			return nil, err
+		}
+		nodes = append(nodes, secondaryStatus)
+	}
+	return nodes, nil
+}
+
+func nodeStatusFromCluster(r *TeamcityReconciler, ctx context.Context, instance *TeamCity, node Node, role string) (NodeStatus, error) {
+	statefulSet, err := getStatefulSetByName(r, ctx, node.GetNamespacedNameFromNamespace(instance.Namespace))
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return NodeStatus{Name: node.Name, StatefulSetName: node.Name, Role: role}, nil
+		}
+		return NodeStatus{}, err
+	}
+	return buildNodeStatus(node.Name, role, &statefulSet), nil
+}
+
+func buildNodeStatus(nodeName string, role string, statefulSet *v1.StatefulSet) NodeStatus {
+	status := NodeStatus{
+		Name:            nodeName,
+		StatefulSetName: statefulSet.Name,
+		Role:            role,
+		Ready:           isStatefulSetUpdateFinished(statefulSet),
+		CurrentRevision: statefulSet.Status.CurrentRevision,
+		UpdateRevision:  statefulSet.Status.UpdateRevision,
+	}
+	for _, container := range statefulSet.Spec.Template.Spec.Containers {
+		if container.Name == resource.TEAMCITY_CONTAINER_NAME {
+			status.Image = container.Image
+		}
+	}
+	return status
+}
+
+func readyNodesSummary(nodes []NodeStatus) string {
+	return fmt.Sprintf("%d/%d", countReadyNodes(nodes), len(nodes))
+}
+
+func countReadyNodes(nodes []NodeStatus) int {
+	ready := 0
+	for _, node := range nodes {
+		if node.Ready {
+			ready++
+		}
+	}
+	return ready
+}
+
+func notReadyNodeNames(nodes []NodeStatus) []string {
+	var names []string
+	for _, node := range nodes {
+		if !node.Ready {
+			names = append(names, node.Name)
+		}
+	}
+	return names
+}
+
+func mainNodeImage(nodes []NodeStatus) string {
+	for _, node := range nodes {
+		if node.Role == "main" {
+			return node.Image
+		}
+	}
+	return ""
+}
+
+// currentUpgradeStage returns the stage of the zero-downtime upgrade checkpoint, if there is one.
+func currentUpgradeStage(r *TeamcityReconciler, ctx context.Context, instance *TeamCity) (string, bool) {
+	stage, err := checkpoint.NewCheckpoint(r.Client, *instance).FetchCurrentStageFromCluster(ctx)
+	if err != nil {
+		return "", false
+	}
+	return stage.String(), true
+}
+
+// setStatusConditions derives the standard conditions from the state written by the reconciler,
+// the node statuses and the presence of an upgrade checkpoint.
+func setStatusConditions(status *TeamCityStatus, generation int64, upgradeStage string, upgradeInProgress bool) {
+	notReady := notReadyNodeNames(status.Nodes)
+	allNodesReady := len(status.Nodes) > 0 && len(notReady) == 0
+
+	if status.State == TEAMCITY_CRD_OBJECT_ERROR_STATE {
+		setCondition(status, generation, ConditionDegraded, metav1.ConditionTrue, conditionReasonReconcileFailed, status.Message)
+	} else if upgrade := status.Upgrade; upgrade != nil && upgrade.Generation == generation && upgrade.Phase == UpgradePhaseFailed {
+		setCondition(status, generation, ConditionDegraded, metav1.ConditionTrue, conditionReasonUpgradeFailed, upgrade.Message)
+	} else if upgrade != nil && upgrade.Generation == generation && upgrade.Phase == UpgradePhaseAborted {
+		setCondition(status, generation, ConditionDegraded, metav1.ConditionTrue, conditionReasonUpgradeAborted, upgrade.Message)
+	} else {
+		setCondition(status, generation, ConditionDegraded, metav1.ConditionFalse, conditionReasonReconcileSucceeded, "")
+	}
+
+	if upgradeInProgress {
+		setCondition(status, generation, ConditionUpgradeInProgress, metav1.ConditionTrue, conditionReasonZeroDowntimeUpgrade,
+			fmt.Sprintf("Zero-downtime upgrade is at stage %s", upgradeStage))
+	} else if skipped := meta.FindStatusCondition(status.Conditions, ConditionUpgradeInProgress); skipped == nil ||
+		skipped.Reason != conditionReasonZeroDowntimeUpgradeSkipped || skipped.ObservedGeneration != generation {
+		setCondition(status, generation, ConditionUpgradeInProgress, metav1.ConditionFalse, conditionReasonNoUpgradeCheckpoint, "")
+	}
+
+	switch {
+	case upgradeInProgress:
+		setCondition(status, generation, ConditionProgressing, metav1.ConditionTrue, conditionReasonZeroDowntimeUpgrade,
+			fmt.Sprintf("Zero-downtime upgrade is at stage %s", upgradeStage))
+	case status.State == TEAMCITY_CRD_OBJECT_UPDATING_STATE:
+		setCondition(status, generation, ConditionProgressing, metav1.ConditionTrue, conditionReasonUpdating, status.Message)
+	case status.State == TEAMCITY_CRD_OBJECT_STOPPED_STATE:
+		setCondition(status, generation, ConditionProgressing, metav1.ConditionFalse, conditionReasonStopped, status.Message)
+	case status.PendingChange != nil && status.PendingChange.Generation == generation:
+		setCondition(status, generation, ConditionProgressing, metav1.ConditionFalse, conditionReasonAwaitingApproval,
+			fmt.Sprintf("Generation %d restarts nodes and waits for the %s annotation", generation, ApprovedGenerationAnnotationKey))
+	case !allNodesReady:
+		setCondition(status, generation, ConditionProgressing, metav1.ConditionTrue, conditionReasonNodesRollingOut,
+			fmt.Sprintf("Waiting for nodes: %s", strings.Join(notReady, ", ")))
+	default:
+		setCondition(status, generation, ConditionProgressing, metav1.ConditionFalse, conditionReasonReconciliationDone, "")
+	}
+
+	switch {
+	case status.State == TEAMCITY_CRD_OBJECT_ERROR_STATE:
+		setCondition(status, generation, ConditionReady, metav1.ConditionFalse, conditionReasonReconcileFailed, status.Message)
+	case status.State == TEAMCITY_CRD_OBJECT_STOPPED_STATE:
+		setCondition(status, generation, ConditionReady, metav1.ConditionFalse, conditionReasonStopped, status.Message)
+	case !allNodesReady:
+		setCondition(status, generation, ConditionReady, metav1.ConditionFalse, conditionReasonNodesNotReady,
+			fmt.Sprintf("Nodes not ready: %s", strings.Join(notReady, ", ")))
+	default:
+		setCondition(status, generation, ConditionReady, metav1.ConditionTrue, conditionReasonAllNodesReady, "")
+	}
+}
+
+func setCondition(status *TeamCityStatus, generation int64, conditionType string, conditionStatus metav1.ConditionStatus, reason string, message string) {
+	meta.SetStatusCondition(&status.Conditions, metav1.Condition{
+		Type:               conditionType,
+		Status:             conditionStatus,
+		ObservedGeneration: generation,
+		Reason:             reason,
+		Message:            message,
+	})
+}
@@ -0,0 +1,155 @@
+package controller
+
+import (
+	"testing"
+
+	. "git.jetbrains.team/tch/teamcity-operator/api/v1beta1"
+	"git.jetbrains.team/tch/teamcity-operator/internal/resource"
+	v1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestBuildNodeStatus(t *testing.T) {
+	statefulSet := &v1.StatefulSet{
+		ObjectMeta: metav1.ObjectMeta{Name: "main-node"},
+		Spec: v1.StatefulSetSpec{
+			Template: corev1.PodTemplateSpec{
+				Spec: corev1.PodSpec{
+					Containers: []corev1.Container{
+						{Name: "sidecar", Image: "busybox"},
+						{Name: resource.TEAMCITY_CONTAINER_NAME, Image: "jetbrains/teamcity-server:2024.12"},
+					},
+				},
+			},
+		},
+		Status: v1.StatefulSetStatus{ReadyReplicas: 1, CurrentRevision: "rev-1", UpdateRevision: "rev-1"},
+	}
+
+	status := buildNodeStatus("main-node", "main", statefulSet)
+	if !status.Ready {
+		t.Fatal("expected node with finished rollout to be ready")
+	}
+	if status.Image != "jetbrains/teamcity-server:2024.12" {
+		t.Fatalf("expected image of the TeamCity container, got %q", status.Image)
+	}
+
+	statefulSet.Status.UpdateRevision = "rev-2"
+	status = buildNodeStatus("main-node", "main", statefulSet)
+	if status.Ready {
+		t.Fatal("did not expect node with pending revision to be ready")
+	}
+}
+
+func TestReadyNodesSummary(t *testing.T) {
+	nodes := []NodeStatus{{Name: "main", Ready: true}, {Name: "secondary", Ready: false}}
+	if summary := readyNodesSummary(nodes); summary != "1/2" {
+		t.Fatalf("expected 1/2, got %s", summary)
+	}
+}
+
+func TestSetStatusConditions(t *testing.T) {
+	cases := []struct {
+		name              string
+		status            TeamCityStatus
+		upgradeInProgress bool
+		ready             metav1.ConditionStatus
+		progressing       metav1.ConditionStatus
+		degraded          metav1.ConditionStatus
+		upgrade           metav1.ConditionStatus
+	}{
+		{
+			name: "all nodes ready",
+			status: TeamCityStatus{
+				State: TEAMCITY_CRD_OBJECT_SUCCESS_STATE,
+				Nodes: []NodeStatus{{Name: "main", Ready: true}},
+			},
+			ready:       metav1.ConditionTrue,
+			progressing: metav1.ConditionFalse,
+			degraded:    metav1.ConditionFalse,
+			upgrade:     metav1.ConditionFalse,
+		},
+		{
+			name: "node rolling out",
+			status: TeamCityStatus{
+				State: TEAMCITY_CRD_OBJECT_SUCCESS_STATE,
+				Nodes: []NodeStatus{{Name: "main", Ready: true}, {Name: "secondary", Ready: false}},
+			},
+			ready:       metav1.ConditionFalse,
+			progressing: metav1.ConditionTrue,
+			degraded:    metav1.ConditionFalse,
+			upgrade:     metav1.ConditionFalse,
+		},
+		{
+			name: "reconcile failed",
+			status: TeamCityStatus{
+				State:   TEAMCITY_CRD_OBJECT_ERROR_STATE,
+				Message: "boom",
+				Nodes:   []NodeStatus{{Name: "main", Ready: true}},
+			},
+			ready:       metav1.ConditionFalse,
+			progressing: metav1.ConditionFalse,
+			degraded:    metav1.ConditionTrue,
+			upgrade:     metav1.ConditionFalse,
+		},
+		{
+			name: "stopped",
+			status: TeamCityStatus{
+				State: TEAMCITY_CRD_OBJECT_STOPPED_STATE,
+				Nodes: []NodeStatus{{Name: "main", Ready: false}},
+			},
+			ready:       metav1.ConditionFalse,
+			progressing: metav1.ConditionFalse,
+			degraded:    metav1.ConditionFalse,
+			upgrade:     metav1.ConditionFalse,
+		},
+		{
+			name: "change awaiting approval",
+			status: TeamCityStatus{
+				State:         TEAMCITY_CRD_OBJECT_SUCCESS_STATE,
+				Nodes:         []NodeStatus{{Name: "main", Ready: true}},
+				PendingChange: &PendingChange{Generation: 3, Nodes: []PendingNodeChange{{Name: "main"}}},
+			},
+			ready:       metav1.ConditionTrue,
+			progressing: metav1.ConditionFalse,
+			degraded:    metav1.ConditionFalse,
+			upgrade:     metav1.ConditionFalse,
+		},
+		{
+			name: "zero-downtime upgrade",
+			status: TeamCityStatus{
+				State: TEAMCITY_CRD_OBJECT_UPDATING_STATE,
+				Nodes: []NodeStatus{{Name: "main", Ready: true}},
+			},
+			upgradeInProgress: true,
+			ready:             metav1.ConditionTrue,
+			progressing:       metav1.ConditionTrue,
+			degraded:          metav1.ConditionFalse,
+			upgrade:           metav1.ConditionTrue,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			status := c.status
+			setStatusConditions(&status, 3, "ReplicaReady", c.upgradeInProgress)
+			for conditionType, expected := range map[string]metav1.ConditionStatus{
+				ConditionReady:             c.ready,
+				ConditionProgressing:       c.progressing,
+				ConditionDegraded:          c.degraded,
+				ConditionUpgradeInProgress: c.upgrade,
+			} {
+				condition := meta.FindStatusCondition(status.Conditions, conditionType)
+				if condition == nil {
+					t.Fatalf("expected condition %s to be set", conditionType)
+				}
+				if condition.Status != expected {
+					t.Fatalf("expected condition %s to be %s, got %s", conditionType, expected, condition.Status)
+				}
+				if condition.ObservedGeneration != 3 {
+					t.Fatalf("expected condition %s to observe generation 3, got %d", conditionType, condition.ObservedGeneration)
+				}
+			}
+		})
+	}
+}
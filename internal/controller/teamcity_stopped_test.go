@@ -0,0 +1,80 @@
+package controller
+
+import (
+	"context"
+	"testing"
+
+	. "git.jetbrains.team/tch/teamcity-operator/api/v1beta1"
+	"git.jetbrains.team/tch/teamcity-operator/internal/resource"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	v1 "k8s.io/api/apps/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+func newStoppedTestTeamCity() *TeamCity {
+	instance := newTestTeamCity()
+	instance.Spec.SecondaryNodes = []Node{{Name: "secondary"}}
+	instance.Spec.Stopped = true
+	return instance
+}
+
+func TestStoppedMainNodeWaitsForSecondaryNodes(t *testing.T) {
+	instance := newStoppedTestTeamCity()
+	r := newTestTeamcityReconciler(t, instance, newTestStatefulSet("main", 1), newTestStatefulSet("secondary", 1))
+	builder := &resource.TeamCityResourceBuilder{Instance: instance}
+
+	assert.True(t, r.validatePreconditions(context.Background(), builder.SecondaryStatefulSet(), *instance))
+	assert.False(t, r.validatePreconditions(context.Background(), builder.StatefulSet(), *instance))
+
+	r = newTestTeamcityReconciler(t, instance, newTestStatefulSet("main", 1), newTestStatefulSet("secondary", 0))
+	assert.True(t, r.validatePreconditions(context.Background(), builder.StatefulSet(), *instance))
+}
+
+func TestReportStopped(t *testing.T) {
+	instance := newStoppedTestTeamCity()
+	r := newTestTeamcityReconciler(t, instance, newTestStatefulSet("main", 1), newTestStatefulSet("secondary", 0))
+
+	result, err := r.reportStopped(context.Background(), instance)
+	require.NoError(t, err)
+	assert.True(t, result.Requeue)
+	var updated TeamCity
+	require.NoError(t, r.Get(context.Background(), types.NamespacedName{Name: "tc", Namespace: testNamespace}, &updated))
+	assert.Equal(t, TEAMCITY_CRD_OBJECT_UPDATING_STATE, updated.Status.State)
+
+	r = newTestTeamcityReconciler(t, instance, newTestStatefulSet("main", 0), newTestStatefulSet("secondary", 0))
+	result, err = r.reportStopped(context.Background(), instance)
+	require.NoError(t, err)
+	assert.False(t, result.Requeue)
+	require.NoError(t, r.Get(context.Background(), types.NamespacedName{Name: "tc", Namespace: testNamespace}, &updated))
+	assert.Equal(t, TEAMCITY_CRD_OBJECT_STOPPED_STATE, updated.Status.State)
+	assert.Equal(t, "0/2", updated.Status.ReadyNodes)
+}
+
+func TestStoppedMainNodeWaitsForUpdateReplica(t *testing.T) {
+	instance := newStoppedTestTeamCity()
+	instance.Spec.SecondaryNodes = nil
+	updateReplica := newTestStatefulSet(resource.GetROStatefulSetNamespacedName(instance).Name, 1)
+	r := newTestTeamcityReconciler(t, instance, newTestStatefulSet("main", 1), updateReplica)
+	builder := &resource.TeamCityResourceBuilder{Instance: instance}
+
+	assert.False(t, r.validatePreconditions(context.Background(), builder.StatefulSet(), *instance))
+
+	require.NoError(t, r.scaleUpdateReplica(context.Background(), instance, 0))
+	var scaled v1.StatefulSet
+	require.NoError(t, r.Get(context.Background(), resource.GetROStatefulSetNamespacedName(instance), &scaled))
+	assert.Equal(t, int32(0), *scaled.Spec.Replicas)
+}
+
+func TestAnyNodeScaledToZero(t *testing.T) {
+	instance := newStoppedTestTeamCity()
+	r := newTestTeamcityReconciler(t, instance, newTestStatefulSet("main", 1), newTestStatefulSet("secondary", 0))
+
+	resuming, err := anyNodeScaledToZero(context.Background(), r.Client, instance, instance.GetAllNodes())
+	require.NoError(t, err)
+	assert.True(t, resuming)
+
+	resuming, err = anyNodeScaledToZero(context.Background(), r.Client, instance, []Node{instance.Spec.MainNode})
+	require.NoError(t, err)
+	assert.False(t, resuming)
+}
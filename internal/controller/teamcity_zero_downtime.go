@@ -0,0 +1,90 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+
+	. "git.jetbrains.team/tch/teamcity-operator/api/v1beta1"
+	"git.jetbrains.team/tch/teamcity-operator/internal/resource"
+	v12 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/util/retry"
+)
+
+const eventReasonZeroDowntimeUpgradeSkipped = "ZeroDowntimeUpgradeSkipped"
+
+// zeroDowntimeUpgradeSupported reports whether the main node can move from its running image to spec.image
+// with the zero-downtime flow. When it cannot, an event and the UpgradeInProgress condition record once per generation
+// that the nodes are restarted instead.
+// Versions that cannot be determined are assumed to be compatible, as before versions were checked.
+func (r *TeamcityReconciler) zeroDowntimeUpgradeSupported(ctx context.Context, instance *TeamCity) (bool, error) {
+	mainStatefulSet, err := getStatefulSetByName(r, ctx, instance.Spec.MainNode.GetNamespacedNameFromNamespace(instance.Namespace))
+	if errors.IsNotFound(err) {
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	var runningImage string
+	for _, container := range mainStatefulSet.Spec.Template.Spec.Containers {
+		if container.Name == resource.TEAMCITY_CONTAINER_NAME {
+			runningImage = container.Image
+		}
+	}
+	if runningImage == "" || runningImage == instance.Spec.Image {
+		return true, nil
+	}
+	runningVersion, err := ParseTeamCityVersion(ImageTag(runningImage))
+	if err != nil {
+		return true, nil
+	}
+	targetVersion, err := instance.ImageVersion()
+	if err != nil {
+		return true, nil
+	}
+	if runningVersion.SupportsZeroDowntimeUpgradeTo(targetVersion) {
+		return true, nil
+	}
+	if zeroDowntimeUpgradeSkipped(instance) {
+		return false, nil
+	}
+	message := fmt.Sprintf("Restarting every node to upgrade from TeamCity %s to %s: zero-downtime upgrades only work between bugfix releases of the same release",
+		runningVersion, targetVersion)
+	if err := setZeroDowntimeUpgradeSkipped(r, ctx, instance, message); err != nil {
+		return false, err
+	}
+	r.recordEvent(instance, v12.EventTypeWarning, eventReasonZeroDowntimeUpgradeSkipped, message)
+	return false, nil
+}
+
+// zeroDowntimeUpgradeSkipped reports whether the skip was already recorded for the generation, e.g. while the
+// restart waits for approval.
+func zeroDowntimeUpgradeSkipped(instance *TeamCity) bool {
+	condition := meta.FindStatusCondition(instance.Status.Conditions, ConditionUpgradeInProgress)
+	return condition != nil && condition.Reason == conditionReasonZeroDowntimeUpgradeSkipped &&
+		condition.ObservedGeneration == instance.Generation
+}
+
+// setZeroDowntimeUpgradeSkipped sets the UpgradeInProgress condition to ZeroDowntimeUpgradeSkipped for the generation.
+// setStatusConditions keeps it until the generation changes or a zero-downtime upgrade starts.
+func setZeroDowntimeUpgradeSkipped(r *TeamcityReconciler, ctx context.Context, instance *TeamCity, message string) error {
+	namespacedName := types.NamespacedName{Name: instance.Name, Namespace: instance.Namespace}
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		teamcity, err := getTeamCityObjectE(r, ctx, namespacedName)
+		if err != nil {
+			return err
+		}
+		setCondition(&teamcity.Status, instance.Generation, ConditionUpgradeInProgress, metav1.ConditionFalse,
+			conditionReasonZeroDowntimeUpgradeSkipped, message)
+		return r.Status().Update(ctx, &teamcity)
+	})
+	if err != nil {
+		return err
+	}
+	setCondition(&instance.Status, instance.Generation, ConditionUpgradeInProgress, metav1.ConditionFalse,
+		conditionReasonZeroDowntimeUpgradeSkipped, message)
+	return nil
+}
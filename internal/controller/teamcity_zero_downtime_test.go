@@ -0,0 +1,101 @@
+package controller
+
+import (
+	"context"
+	"testing"
+
+	. "git.jetbrains.team/tch/teamcity-operator/api/v1beta1"
+	"git.jetbrains.team/tch/teamcity-operator/internal/resource"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	v1 "k8s.io/api/apps/v1"
+	v12 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+func newZeroDowntimeTestTeamCity(image string) *TeamCity {
+	instance := newTestTeamCity()
+	instance.Annotations = map[string]string{UpdatePolicyAnnotationKey: ZeroDownTimeAnnotation}
+	instance.Spec.Image = image
+	return instance
+}
+
+func newZeroDowntimeTestStatefulSet(image string) *v1.StatefulSet {
+	statefulSet := newTestStatefulSet("main", 1)
+	statefulSet.Spec.Template.Spec.Containers = []v12.Container{{Name: resource.TEAMCITY_CONTAINER_NAME, Image: image}}
+	return statefulSet
+}
+
+func TestZeroDowntimeUpgradeSupported(t *testing.T) {
+	tests := []struct {
+		name         string
+		runningImage string
+		image        string
+		supported    bool
+	}{
+		{name: "bugfix upgrade", runningImage: "jetbrains/teamcity-server:2024.07.1", image: "jetbrains/teamcity-server:2024.07.3", supported: true},
+		{name: "major upgrade", runningImage: "jetbrains/teamcity-server:2024.07.3", image: "jetbrains/teamcity-server:2024.12", supported: false},
+		{name: "unknown running version", runningImage: "jetbrains/teamcity-server:latest", image: "jetbrains/teamcity-server:2024.12", supported: true},
+		{name: "unchanged image", runningImage: "jetbrains/teamcity-server:2024.12-eap1", image: "jetbrains/teamcity-server:2024.12-eap1", supported: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			instance := newZeroDowntimeTestTeamCity(tt.image)
+			r := newTestTeamcityReconciler(t, instance, newZeroDowntimeTestStatefulSet(tt.runningImage))
+			recorder := record.NewFakeRecorder(10)
+			r.Recorder = recorder
+
+			supported, err := r.zeroDowntimeUpgradeSupported(context.Background(), instance)
+			require.NoError(t, err)
+			assert.Equal(t, tt.supported, supported)
+			if !tt.supported {
+				require.Len(t, recorder.Events, 1)
+				assert.Contains(t, <-recorder.Events, eventReasonZeroDowntimeUpgradeSkipped)
+			}
+		})
+	}
+}
+
+func TestZeroDowntimeUpgradeSupportedForNewInstance(t *testing.T) {
+	instance := newZeroDowntimeTestTeamCity("jetbrains/teamcity-server:2024.12")
+	r := newTestTeamcityReconciler(t, instance)
+
+	supported, err := r.zeroDowntimeUpgradeSupported(context.Background(), instance)
+	require.NoError(t, err)
+	assert.True(t, supported)
+}
+
+func TestZeroDowntimeUpgradeSkippedOncePerGeneration(t *testing.T) {
+	instance := newZeroDowntimeTestTeamCity("jetbrains/teamcity-server:2024.12")
+	instance.Generation = 2
+	r := newTestTeamcityReconciler(t, instance, newZeroDowntimeTestStatefulSet("jetbrains/teamcity-server:2024.07.3"))
+	recorder := record.NewFakeRecorder(10)
+	r.Recorder = recorder
+
+	for i := 0; i < 2; i++ {
+		supported, err := r.zeroDowntimeUpgradeSupported(context.Background(), instance)
+		require.NoError(t, err)
+		assert.False(t, supported)
+	}
+	require.Len(t, recorder.Events, 1, "a restart waiting for approval does not repeat the event")
+	<-recorder.Events
+
+	var stored TeamCity
+	require.NoError(t, r.Get(context.Background(), client.ObjectKeyFromObject(instance), &stored))
+	condition := meta.FindStatusCondition(stored.Status.Conditions, ConditionUpgradeInProgress)
+	require.NotNil(t, condition)
+	assert.Equal(t, conditionReasonZeroDowntimeUpgradeSkipped, condition.Reason)
+	setStatusConditions(&stored.Status, stored.Generation, "", false)
+	assert.Equal(t, conditionReasonZeroDowntimeUpgradeSkipped,
+		meta.FindStatusCondition(stored.Status.Conditions, ConditionUpgradeInProgress).Reason, "kept for the generation")
+	setStatusConditions(&stored.Status, stored.Generation+1, "", false)
+	assert.Equal(t, conditionReasonNoUpgradeCheckpoint,
+		meta.FindStatusCondition(stored.Status.Conditions, ConditionUpgradeInProgress).Reason)
+
+	instance.Generation = 3
+	_, err := r.zeroDowntimeUpgradeSupported(context.Background(), instance)
+	require.NoError(t, err)
+	assert.Len(t, recorder.Events, 1, "a new generation is reported again")
+}
@@ -0,0 +1,151 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	. "git.jetbrains.team/tch/teamcity-operator/api/v1beta1"
+	v12 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	defaultAgentScaleDownDelay = 10 * time.Minute
+	// podDeletionCostAnnotationKey makes the ReplicaSet remove idle agents before busy ones when scaling down
+	podDeletionCostAnnotationKey = "controller.kubernetes.io/pod-deletion-cost"
+	busyAgentPodDeletionCost     = "1000"
+
+	eventReasonAgentsScaled = "AgentsScaled"
+)
+
+// validateAgentAutoscaling requires spec.authorization.pool with spec.autoscaling. The build queue of the server is
+// shared by every agent, so without a dedicated agent pool the agents would be scaled to builds they cannot run.
+func validateAgentAutoscaling(pool *TeamCityAgentPool) error {
+	if pool.Spec.Autoscaling == nil || (pool.Spec.Authorization != nil && pool.Spec.Authorization.Pool != "") {
+		return nil
+	}
+	return fmt.Errorf("spec.autoscaling requires spec.authorization.pool, only the builds queued for that agent pool are counted")
+}
+
+// reconcileAutoscaling sets status.autoscaling.desiredReplicas to the queued builds plus the busy agents, within
+// the bounds of spec.autoscaling. More agents are added right away, idle ones are only removed after the cool-down.
+func (r *TeamCityAgentPoolReconciler) reconcileAutoscaling(ctx context.Context, pool *TeamCityAgentPool, state *agentPoolServerState, status *TeamCityAgentPoolStatus) error {
+	autoscaling := pool.Spec.Autoscaling
+	queued, err := state.client.QueuedBuildsCount(ctx, &state.agentPool.ID)
+	if err != nil {
+		return err
+	}
+	busy := busyAgentNames(state)
+
+	needed := clampReplicas(int32(len(busy)+queued), autoscaling.MinReplicas, autoscaling.MaxReplicas)
+	if pool.UsesStatefulSet() {
+		// a StatefulSet removes the agents with the highest ordinals, so it is never scaled below a busy one
+		if floor := highestBusyOrdinal(pool, busy) + 1; needed < floor {
+			needed = floor
+		}
+	}
+
+	now := r.now()
+	previous := status.Autoscaling
+	desired := needed
+	lastScaleTime := &metav1.Time{Time: now}
+	if previous != nil {
+		desired = previous.DesiredReplicas
+		lastScaleTime = previous.LastScaleTime
+		coolDownOver := lastScaleTime == nil || !now.Before(lastScaleTime.Add(agentScaleDownDelay(autoscaling)))
+		if needed > desired || desired > autoscaling.MaxReplicas || (needed < desired && coolDownOver) {
+			r.recordEvent(pool, v12.EventTypeNormal, eventReasonAgentsScaled,
+				fmt.Sprintf("Scaled agents from %d to %d for %d queued builds and %d busy agents", desired, needed, queued, len(busy)))
+			desired = needed
+			lastScaleTime = &metav1.Time{Time: now}
+		}
+	}
+	status.Autoscaling = &AgentAutoscalingStatus{
+		DesiredReplicas: desired,
+		QueuedBuilds:    int32(queued),
+		BusyAgents:      int32(len(busy)),
+		LastScaleTime:   lastScaleTime,
+	}
+
+	if pool.UsesStatefulSet() {
+		return nil
+	}
+	return r.setPodDeletionCosts(ctx, state, busy)
+}
+
+// setPodDeletionCosts marks the pods of busy agents, so a Deployment scale down removes idle agents first.
+func (r *TeamCityAgentPoolReconciler) setPodDeletionCosts(ctx context.Context, state *agentPoolServerState, busy map[string]bool) error {
+	for name, pod := range state.pods {
+		cost := ""
+		if busy[name] {
+			cost = busyAgentPodDeletionCost
+		}
+		if pod.Annotations[podDeletionCostAnnotationKey] == cost {
+			continue
+		}
+		patch := client.MergeFrom(pod.DeepCopy())
+		if cost == "" {
+			delete(pod.Annotations, podDeletionCostAnnotationKey)
+		} else {
+			if pod.Annotations == nil {
+				pod.Annotations = map[string]string{}
+			}
+			pod.Annotations[podDeletionCostAnnotationKey] = cost
+		}
+		if err := r.Patch(ctx, pod, patch); client.IgnoreNotFound(err) != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *TeamCityAgentPoolReconciler) now() time.Time {
+	if r.Now != nil {
+		return r.Now()
+	}
+	return time.Now()
+}
+
+// busyAgentNames returns the agents of the pool that are running a build.
+func busyAgentNames(state *agentPoolServerState) map[string]bool {
+	busy := map[string]bool{}
+	for _, agent := range state.agents {
+		if state.pods[agent.Name] != nil && agent.Build != nil {
+			busy[agent.Name] = true
+		}
+	}
+	return busy
+}
+
+// highestBusyOrdinal returns the highest StatefulSet ordinal of the busy agents, or -1 without busy agents.
+func highestBusyOrdinal(pool *TeamCityAgentPool, busy map[string]bool) int32 {
+	highest := int32(-1)
+	for name := range busy {
+		ordinal, err := strconv.ParseInt(strings.TrimPrefix(name, pool.Name+"-"), 10, 32)
+		if err == nil && int32(ordinal) > highest {
+			highest = int32(ordinal)
+		}
+	}
+	return highest
+}
+
+func clampReplicas(replicas int32, minReplicas int32, maxReplicas int32) int32 {
+	if replicas > maxReplicas {
+		replicas = maxReplicas
+	}
+	if replicas < minReplicas {
+		replicas = minReplicas
+	}
+	return replicas
+}
+
+func agentScaleDownDelay(autoscaling *AgentAutoscaling) time.Duration {
+	if autoscaling.ScaleDownDelay != nil {
+		return autoscaling.ScaleDownDelay.Duration
+	}
+	return defaultAgentScaleDownDelay
+}
@@ -0,0 +1,152 @@
+package controller
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	. "git.jetbrains.team/tch/teamcity-operator/api/v1beta1"
+	"git.jetbrains.team/tch/teamcity-operator/internal/teamcity"
+	"git.jetbrains.team/tch/teamcity-operator/internal/teamcity/teamcitytest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	v1 "k8s.io/api/apps/v1"
+	v12 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// newAutoscalingTestAgentPool returns a pool scaled with the builds queued for the "Linux" agent pool.
+func newAutoscalingTestAgentPool() *TeamCityAgentPool {
+	pool := newTestAgentPool()
+	pool.Spec.Authorization = &AgentAuthorization{Pool: "Linux"}
+	pool.Spec.Autoscaling = &AgentAutoscaling{
+		MinReplicas:    0,
+		MaxReplicas:    4,
+		ScaleDownDelay: &metav1.Duration{Duration: 10 * time.Minute},
+	}
+	return pool
+}
+
+func getAgentPoolReplicas(t *testing.T, r *TeamCityAgentPoolReconciler, workload string) int32 {
+	namespacedName := types.NamespacedName{Name: "linux", Namespace: testNamespace}
+	if workload == workloadKindStatefulSet {
+		var statefulSet v1.StatefulSet
+		require.NoError(t, r.Get(context.Background(), namespacedName, &statefulSet))
+		return *statefulSet.Spec.Replicas
+	}
+	var deployment v1.Deployment
+	require.NoError(t, r.Get(context.Background(), namespacedName, &deployment))
+	return *deployment.Spec.Replicas
+}
+
+func TestAgentPoolScalesUpWithTheQueueAndDownAfterTheCoolDown(t *testing.T) {
+	server := teamcitytest.NewServer("")
+	defer server.Close()
+	now := time.Date(2024, time.March, 4, 12, 0, 0, 0, time.UTC)
+	poolID := server.AddAgentPool("Linux")
+	r := newAgentPoolTestReconciler(t, server, newAgentPoolTestTeamCity(), newAutoscalingTestAgentPool())
+	r.Now = func() time.Time { return now }
+
+	_, pool := reconcileAgentPool(t, r)
+	require.NotNil(t, pool.Status.Autoscaling)
+	assert.Equal(t, int32(0), pool.Status.Autoscaling.DesiredReplicas)
+	assert.Equal(t, int32(0), getAgentPoolReplicas(t, r, workloadKindDeployment))
+
+	// builds queued for other agent pools are not counted
+	server.SetQueuedBuilds(0, 3)
+	_, pool = reconcileAgentPool(t, r)
+	assert.Equal(t, int32(0), pool.Status.Autoscaling.QueuedBuilds)
+
+	server.SetQueuedBuilds(poolID, 6)
+	now = now.Add(time.Minute)
+	_, pool = reconcileAgentPool(t, r)
+	assert.Equal(t, int32(4), pool.Status.Autoscaling.DesiredReplicas)
+	assert.Equal(t, int32(6), pool.Status.Autoscaling.QueuedBuilds)
+	assert.Equal(t, int32(4), getAgentPoolReplicas(t, r, workloadKindDeployment))
+
+	server.SetQueuedBuilds(poolID, 0)
+	now = now.Add(5 * time.Minute)
+	_, pool = reconcileAgentPool(t, r)
+	assert.Equal(t, int32(4), pool.Status.Autoscaling.DesiredReplicas, "scaled down during the cool-down")
+
+	now = now.Add(5 * time.Minute)
+	_, pool = reconcileAgentPool(t, r)
+	assert.Equal(t, int32(0), pool.Status.Autoscaling.DesiredReplicas)
+	assert.Equal(t, int32(0), getAgentPoolReplicas(t, r, workloadKindDeployment))
+}
+
+func TestAgentPoolKeepsBusyAgents(t *testing.T) {
+	server := teamcitytest.NewServer("")
+	defer server.Close()
+	server.AddAgentPool("Linux")
+	server.AddAgent("linux-a")
+	server.AddAgent("linux-b")
+	server.SetAgentRunningBuild("linux-b", 42)
+	r := newAgentPoolTestReconciler(t, server, newAgentPoolTestTeamCity(), newAutoscalingTestAgentPool(),
+		newAgentTestPod("linux-a"), newAgentTestPod("linux-b"))
+
+	_, pool := reconcileAgentPool(t, r)
+	assert.Equal(t, int32(1), pool.Status.Autoscaling.BusyAgents)
+	assert.Equal(t, int32(1), pool.Status.Autoscaling.DesiredReplicas)
+
+	var busyPod, idlePod v12.Pod
+	require.NoError(t, r.Get(context.Background(), types.NamespacedName{Name: "linux-b", Namespace: testNamespace}, &busyPod))
+	require.NoError(t, r.Get(context.Background(), types.NamespacedName{Name: "linux-a", Namespace: testNamespace}, &idlePod))
+	assert.Equal(t, busyAgentPodDeletionCost, busyPod.Annotations[podDeletionCostAnnotationKey])
+	assert.NotContains(t, idlePod.Annotations, podDeletionCostAnnotationKey)
+}
+
+func TestAgentPoolStatefulSetKeepsTheHighestBusyOrdinal(t *testing.T) {
+	server := teamcitytest.NewServer("")
+	defer server.Close()
+	server.AddAgentPool("Linux")
+	server.AddAgent("linux-2")
+	server.SetAgentRunningBuild("linux-2", 42)
+	pool := newAutoscalingTestAgentPool()
+	pool.Spec.WorkVolumeClaim = &v12.PersistentVolumeClaimSpec{}
+	r := newAgentPoolTestReconciler(t, server, newAgentPoolTestTeamCity(), pool, newAgentTestPod("linux-2"))
+
+	_, updated := reconcileAgentPool(t, r)
+	assert.Equal(t, int32(3), updated.Status.Autoscaling.DesiredReplicas)
+	assert.Equal(t, int32(3), getAgentPoolReplicas(t, r, workloadKindStatefulSet))
+}
+
+func TestAgentPoolWithoutServerKeepsMinReplicas(t *testing.T) {
+	server := teamcitytest.NewServer("token")
+	defer server.Close()
+	pool := newAutoscalingTestAgentPool()
+	pool.Spec.Autoscaling.MinReplicas = 1
+	r := newAgentPoolTestReconciler(t, server, newAgentPoolTestTeamCity(), pool)
+	r.ClientFactory = func(ctx context.Context, reader client.Reader, instance *TeamCity) (*teamcity.Client, error) {
+		return teamcity.NewClient(server.URL, "wrong", http.DefaultClient), nil
+	}
+
+	_, updated := reconcileAgentPool(t, r)
+	assert.Contains(t, updated.Status.Message, "401")
+	assert.Nil(t, updated.Status.Autoscaling)
+	assert.Equal(t, int32(1), getAgentPoolReplicas(t, r, workloadKindDeployment))
+}
+
+func TestAgentPoolAutoscalingRequiresAnAgentPool(t *testing.T) {
+	server := teamcitytest.NewServer("")
+	defer server.Close()
+	server.SetQueuedBuilds(0, 6)
+	pool := newAutoscalingTestAgentPool()
+	pool.Spec.Authorization = nil
+	pool.Spec.Autoscaling.MinReplicas = 1
+	r := newAgentPoolTestReconciler(t, server, newAgentPoolTestTeamCity(), pool)
+
+	_, updated := reconcileAgentPool(t, r)
+	assert.Contains(t, updated.Status.Message, "spec.autoscaling requires spec.authorization.pool")
+	assert.Nil(t, updated.Status.Autoscaling)
+	assert.Equal(t, int32(1), getAgentPoolReplicas(t, r, workloadKindDeployment))
+}
+
+func TestClampReplicas(t *testing.T) {
+	assert.Equal(t, int32(1), clampReplicas(0, 1, 3))
+	assert.Equal(t, int32(2), clampReplicas(2, 1, 3))
+	assert.Equal(t, int32(3), clampReplicas(7, 1, 3))
+}
@@ -0,0 +1,340 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	. "git.jetbrains.team/tch/teamcity-operator/api/v1beta1"
+	"git.jetbrains.team/tch/teamcity-operator/internal/metadata"
+	"git.jetbrains.team/tch/teamcity-operator/internal/resource"
+	"git.jetbrains.team/tch/teamcity-operator/internal/teamcity"
+	v1 "k8s.io/api/apps/v1"
+	v12 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+const (
+	// agentPoolPollInterval is how often new agents are authorized and the state of the TeamCity is picked up
+	agentPoolPollInterval = 30 * time.Second
+
+	workloadKindDeployment  = "Deployment"
+	workloadKindStatefulSet = "StatefulSet"
+
+	eventReasonAgentAuthorized      = "AgentAuthorized"
+	eventReasonAgentUnauthorized    = "AgentUnauthorized"
+	eventReasonAgentAuthorizeFailed = "AgentAuthorizationFailed"
+	eventReasonServerURLUnavailable = "ServerURLUnavailable"
+)
+
+// TeamCityAgentPoolReconciler reconciles a TeamCityAgentPool object
+type TeamCityAgentPoolReconciler struct {
+	client.Client
+	Scheme   *runtime.Scheme
+	Recorder record.EventRecorder
+	// ClientFactory creates the REST client for the referenced TeamCity; defaults to teamcity.NewClientForInstance.
+	ClientFactory teamcity.ClientFactory
+	// Now returns the current time; defaults to time.Now.
+	Now func() time.Time
+}
+
+//+kubebuilder:rbac:groups=jetbrains.com,resources=teamcityagentpools,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups=jetbrains.com,resources=teamcityagentpools/status,verbs=get;update;patch
+//+kubebuilder:rbac:groups=apps,resources=deployments,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups=core,resources=pods,verbs=get;list;watch;patch
+
+// Reconcile runs the agents of the pool as a Deployment, or as a StatefulSet when they have work volume claims,
+// authorizes them on the server when spec.authorization is set and sizes them to the build queue when
+// spec.autoscaling is set. The pool is polled, so a stopped TeamCity, newly connected agents and the queue
+// are picked up without watching the server.
+func (r *TeamCityAgentPoolReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	log := log.FromContext(ctx)
+
+	var pool TeamCityAgentPool
+	if err := r.Get(ctx, req.NamespacedName, &pool); err != nil {
+		if errors.IsNotFound(err) {
+			return ctrl.Result{}, nil
+		}
+		return ctrl.Result{}, err
+	}
+
+	var instance TeamCity
+	if err := r.Get(ctx, pool.GetTeamCityNamespacedName(), &instance); err != nil {
+		if errors.IsNotFound(err) {
+			log.V(1).Info("Referenced TeamCity does not exist yet", "teamcity", pool.Spec.TeamCityRef)
+			return r.requeueWithMessage(ctx, &pool, fmt.Sprintf("TeamCity %q not found", pool.Spec.TeamCityRef))
+		}
+		return ctrl.Result{}, err
+	}
+
+	serverURL, err := agentServerURL(&pool, &instance)
+	if err != nil {
+		r.recordEvent(&pool, v12.EventTypeWarning, eventReasonServerURLUnavailable, err.Error())
+		return r.requeueWithMessage(ctx, &pool, err.Error())
+	}
+
+	status := pool.Status.DeepCopy()
+	status.ServerURL = serverURL
+	status.Message = ""
+	if err := validateAgentAutoscaling(&pool); err != nil {
+		// the agents run at spec.autoscaling.minReplicas until the spec is fixed
+		status.Message = err.Error()
+		status.Autoscaling = nil
+	} else if pool.Spec.Authorization != nil || pool.Spec.Autoscaling != nil {
+		if err := r.reconcileWithServer(ctx, &pool, &instance, status); err != nil {
+			log.V(1).Info("Unable to manage agents through the REST API", "error", err.Error())
+			status.Message = fmt.Sprintf("Unable to manage agents through the REST API: %s", err)
+		}
+	}
+	if pool.Spec.Autoscaling == nil {
+		status.Autoscaling = nil
+	}
+	if err := r.reconcileWorkload(ctx, &pool, &instance, serverURL, status); err != nil {
+		return ctrl.Result{}, err
+	}
+	if !equality.Semantic.DeepEqual(&pool.Status, status) {
+		pool.Status = *status
+		if err := r.Status().Update(ctx, &pool); err != nil {
+			return ctrl.Result{}, err
+		}
+	}
+	return ctrl.Result{RequeueAfter: agentPoolPollInterval}, nil
+}
+
+// reconcileWorkload creates or updates the workload of the pool and deletes the one of the other kind,
+// which is left behind when spec.workVolumeClaim is added or removed.
+func (r *TeamCityAgentPoolReconciler) reconcileWorkload(ctx context.Context, pool *TeamCityAgentPool, instance *TeamCity, serverURL string, status *TeamCityAgentPoolStatus) error {
+	replicas := int32(1)
+	switch {
+	case status.Autoscaling != nil:
+		replicas = status.Autoscaling.DesiredReplicas
+	case pool.Spec.Autoscaling != nil:
+		replicas = pool.Spec.Autoscaling.MinReplicas
+	case pool.Spec.Replicas != nil:
+		replicas = *pool.Spec.Replicas
+	}
+	if instance.IsStopped() {
+		replicas = 0
+	}
+
+	objectMeta := metav1.ObjectMeta{Name: pool.Name, Namespace: pool.Namespace}
+	deployment := &v1.Deployment{ObjectMeta: objectMeta}
+	statefulSet := &v1.StatefulSet{ObjectMeta: *objectMeta.DeepCopy()}
+	if pool.UsesStatefulSet() {
+		if err := r.deleteOwned(ctx, pool, deployment); err != nil {
+			return err
+		}
+		if _, err := controllerutil.CreateOrUpdate(ctx, r.Client, statefulSet, func() error {
+			resource.ConfigureAgentStatefulSet(pool, replicas, serverURL, statefulSet)
+			return controllerutil.SetControllerReference(pool, statefulSet, r.Scheme)
+		}); err != nil {
+			return err
+		}
+		status.WorkloadKind = workloadKindStatefulSet
+		status.Replicas = statefulSet.Status.Replicas
+		status.ReadyReplicas = statefulSet.Status.ReadyReplicas
+		return nil
+	}
+
+	if err := r.deleteOwned(ctx, pool, statefulSet); err != nil {
+		return err
+	}
+	if _, err := controllerutil.CreateOrUpdate(ctx, r.Client, deployment, func() error {
+		resource.ConfigureAgentDeployment(pool, replicas, serverURL, deployment)
+		return controllerutil.SetControllerReference(pool, deployment, r.Scheme)
+	}); err != nil {
+		return err
+	}
+	status.WorkloadKind = workloadKindDeployment
+	status.Replicas = deployment.Status.Replicas
+	status.ReadyReplicas = deployment.Status.ReadyReplicas
+	return nil
+}
+
+func (r *TeamCityAgentPoolReconciler) deleteOwned(ctx context.Context, pool *TeamCityAgentPool, object client.Object) error {
+	if err := r.Get(ctx, client.ObjectKeyFromObject(object), object); err != nil {
+		if errors.IsNotFound(err) {
+			return nil
+		}
+		return err
+	}
+	if !metav1.IsControlledBy(object, pool) {
+		return nil
+	}
+	return client.IgnoreNotFound(r.Delete(ctx, object))
+}
+
+// agentPoolServerState is what the server reports about the agents of a pool.
+type agentPoolServerState struct {
+	client *teamcity.Client
+	agents []teamcity.Agent
+	// pods are the running pods of the pool by name, which is also the name of their agent
+	pods map[string]*v12.Pod
+	// agentPool is the agent pool of spec.authorization.pool, if set
+	agentPool *teamcity.AgentPoolRef
+}
+
+// reconcileWithServer reads the agents from the server once for authorization and autoscaling.
+func (r *TeamCityAgentPoolReconciler) reconcileWithServer(ctx context.Context, pool *TeamCityAgentPool, instance *TeamCity, status *TeamCityAgentPoolStatus) error {
+	pods, err := r.agentPods(ctx, pool)
+	if err != nil {
+		return err
+	}
+	tcClient, err := r.clientFactory()(ctx, r.Client, instance)
+	if err != nil {
+		return err
+	}
+	agents, err := tcClient.ListAgents(ctx)
+	if err != nil {
+		return err
+	}
+	state := &agentPoolServerState{client: tcClient, agents: agents, pods: pods}
+	if pool.Spec.Authorization != nil && pool.Spec.Authorization.Pool != "" {
+		name := pool.Spec.Authorization.Pool
+		found, err := tcClient.GetAgentPool(ctx, name)
+		if err != nil {
+			return fmt.Errorf("agent pool %q: %w", name, err)
+		}
+		state.agentPool = &found
+	}
+
+	if pool.Spec.Authorization != nil {
+		if err := r.reconcileAuthorization(ctx, pool, state, status); err != nil {
+			return err
+		}
+	}
+	if pool.Spec.Autoscaling != nil {
+		return r.reconcileAutoscaling(ctx, pool, state, status)
+	}
+	return nil
+}
+
+// reconcileAuthorization authorizes the agents named after the running pods of the pool, moves them to the
+// configured agent pool and unauthorizes the agents it authorized earlier once their pod is gone.
+func (r *TeamCityAgentPoolReconciler) reconcileAuthorization(ctx context.Context, pool *TeamCityAgentPool, state *agentPoolServerState, status *TeamCityAgentPoolStatus) error {
+	tcClient := state.client
+	authorized := map[string]bool{}
+	for _, name := range status.AuthorizedAgents {
+		authorized[name] = true
+	}
+	registered := map[string]bool{}
+	for _, agent := range state.agents {
+		registered[agent.Name] = true
+		switch {
+		case state.pods[agent.Name] != nil:
+			if err := r.authorizeAgent(ctx, pool, tcClient, agent, state.agentPool); err != nil {
+				r.recordEvent(pool, v12.EventTypeWarning, eventReasonAgentAuthorizeFailed, fmt.Sprintf("Agent %s: %s", agent.Name, err))
+				return err
+			}
+			authorized[agent.Name] = true
+		case authorized[agent.Name]:
+			if agent.Authorized {
+				if err := tcClient.SetAgentAuthorized(ctx, agent.ID, false); err != nil {
+					return err
+				}
+				r.recordEvent(pool, v12.EventTypeNormal, eventReasonAgentUnauthorized, fmt.Sprintf("Unauthorized agent %s, its pod is gone", agent.Name))
+			}
+			delete(authorized, agent.Name)
+		}
+	}
+
+	// agents deleted on the server need no cleanup
+	status.AuthorizedAgents = make([]string, 0, len(authorized))
+	for name := range authorized {
+		if registered[name] {
+			status.AuthorizedAgents = append(status.AuthorizedAgents, name)
+		}
+	}
+	sort.Strings(status.AuthorizedAgents)
+	return nil
+}
+
+func (r *TeamCityAgentPoolReconciler) authorizeAgent(ctx context.Context, pool *TeamCityAgentPool, tcClient *teamcity.Client, agent teamcity.Agent, agentPool *teamcity.AgentPoolRef) error {
+	if agentPool != nil && (agent.Pool == nil || agent.Pool.ID != agentPool.ID) {
+		if err := tcClient.AssignAgentToPool(ctx, agentPool.ID, agent.ID); err != nil {
+			return err
+		}
+	}
+	if !agent.Authorized {
+		if err := tcClient.SetAgentAuthorized(ctx, agent.ID, true); err != nil {
+			return err
+		}
+		r.recordEvent(pool, v12.EventTypeNormal, eventReasonAgentAuthorized, fmt.Sprintf("Authorized agent %s", agent.Name))
+	}
+	return nil
+}
+
+func (r *TeamCityAgentPoolReconciler) agentPods(ctx context.Context, pool *TeamCityAgentPool) (map[string]*v12.Pod, error) {
+	var pods v12.PodList
+	if err := r.List(ctx, &pods, client.InNamespace(pool.Namespace), client.MatchingLabels(metadata.GetAgentPoolSelectorLabels(pool.Name))); err != nil {
+		return nil, err
+	}
+	byName := map[string]*v12.Pod{}
+	for i := range pods.Items {
+		if pods.Items[i].DeletionTimestamp == nil {
+			byName[pods.Items[i].Name] = &pods.Items[i]
+		}
+	}
+	return byName, nil
+}
+
+func (r *TeamCityAgentPoolReconciler) requeueWithMessage(ctx context.Context, pool *TeamCityAgentPool, message string) (ctrl.Result, error) {
+	if pool.Status.Message != message {
+		pool.Status.Message = message
+		if err := r.Status().Update(ctx, pool); err != nil {
+			return ctrl.Result{}, err
+		}
+	}
+	return ctrl.Result{RequeueAfter: agentPoolPollInterval}, nil
+}
+
+func (r *TeamCityAgentPoolReconciler) clientFactory() teamcity.ClientFactory {
+	if r.ClientFactory != nil {
+		return r.ClientFactory
+	}
+	return teamcity.NewClientForInstance
+}
+
+func (r *TeamCityAgentPoolReconciler) recordEvent(pool *TeamCityAgentPool, eventType string, reason string, message string) {
+	if r.Recorder != nil {
+		r.Recorder.Event(pool, eventType, reason, message)
+	}
+}
+
+// SetupWithManager sets up the controller with the Manager.
+func (r *TeamCityAgentPoolReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewControllerManagedBy(mgr).
+		For(&TeamCityAgentPool{}).
+		Owns(&v1.Deployment{}).
+		Owns(&v1.StatefulSet{}).
+		Complete(r)
+}
+
+// agentServerURL returns spec.serverURL, the URL of spec.serviceName or the URL of the main node.
+func agentServerURL(pool *TeamCityAgentPool, instance *TeamCity) (string, error) {
+	if pool.Spec.ServerURL != "" {
+		return pool.Spec.ServerURL, nil
+	}
+	if pool.Spec.ServiceName == "" {
+		return teamcity.MainNodeURL(instance)
+	}
+	for _, service := range instance.Spec.ServiceList {
+		if service.Name != pool.Spec.ServiceName {
+			continue
+		}
+		if len(service.ServiceSpec.Ports) == 0 {
+			return "", fmt.Errorf("service %q of TeamCity %s has no ports", service.Name, instance.Name)
+		}
+		return fmt.Sprintf("http://%s.%s.svc:%d", service.Name, instance.Namespace, service.ServiceSpec.Ports[0].Port), nil
+	}
+	return "", fmt.Errorf("spec.serviceName %q is not in spec.serviceList of TeamCity %s", pool.Spec.ServiceName, instance.Name)
+}
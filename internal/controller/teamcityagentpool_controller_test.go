@@ -0,0 +1,183 @@
+package controller
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	. "git.jetbrains.team/tch/teamcity-operator/api/v1beta1"
+	"git.jetbrains.team/tch/teamcity-operator/internal/metadata"
+	"git.jetbrains.team/tch/teamcity-operator/internal/teamcity"
+	"git.jetbrains.team/tch/teamcity-operator/internal/teamcity/teamcitytest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	v1 "k8s.io/api/apps/v1"
+	v12 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/utils/pointer"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func newAgentPoolTestReconciler(t *testing.T, server *teamcitytest.Server, objects ...client.Object) *TeamCityAgentPoolReconciler {
+	testScheme := newTestScheme(t)
+	fakeClient := fake.NewClientBuilder().
+		WithScheme(testScheme).
+		WithObjects(objects...).
+		WithStatusSubresource(&TeamCityAgentPool{}).
+		Build()
+	return &TeamCityAgentPoolReconciler{
+		Client: fakeClient,
+		Scheme: testScheme,
+		ClientFactory: func(ctx context.Context, reader client.Reader, instance *TeamCity) (*teamcity.Client, error) {
+			return teamcity.NewClient(server.URL, server.Token, http.DefaultClient), nil
+		},
+	}
+}
+
+func newAgentPoolTestTeamCity() *TeamCity {
+	instance := newTestTeamCity()
+	instance.Spec.MainNode.Spec.ServiceName = "tc-headless"
+	instance.Spec.ServiceList = []Service{
+		{Name: "tc-web", ServiceSpec: v12.ServiceSpec{Ports: []v12.ServicePort{{Port: 80}}}},
+	}
+	return instance
+}
+
+func newTestAgentPool() *TeamCityAgentPool {
+	return &TeamCityAgentPool{
+		ObjectMeta: metav1.ObjectMeta{Name: "linux", Namespace: testNamespace},
+		Spec: TeamCityAgentPoolSpec{
+			TeamCityRef: "tc",
+			Replicas:    pointer.Int32(2),
+			Image:       "jetbrains/teamcity-agent",
+		},
+	}
+}
+
+func newAgentTestPod(name string) *v12.Pod {
+	return &v12.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: testNamespace, Labels: metadata.GetAgentPoolSelectorLabels("linux")},
+	}
+}
+
+func reconcileAgentPool(t *testing.T, r *TeamCityAgentPoolReconciler) (ctrl.Result, TeamCityAgentPool) {
+	namespacedName := types.NamespacedName{Name: "linux", Namespace: testNamespace}
+	result, err := r.Reconcile(context.Background(), ctrl.Request{NamespacedName: namespacedName})
+	require.NoError(t, err)
+	var pool TeamCityAgentPool
+	require.NoError(t, r.Get(context.Background(), namespacedName, &pool))
+	return result, pool
+}
+
+func TestAgentPoolCreatesDeploymentPointingAtTheServer(t *testing.T) {
+	server := teamcitytest.NewServer("")
+	defer server.Close()
+	r := newAgentPoolTestReconciler(t, server, newAgentPoolTestTeamCity(), newTestAgentPool())
+
+	result, pool := reconcileAgentPool(t, r)
+	assert.Equal(t, agentPoolPollInterval, result.RequeueAfter)
+	assert.Equal(t, workloadKindDeployment, pool.Status.WorkloadKind)
+	assert.Equal(t, "http://main-0.tc-headless.default.svc:8111", pool.Status.ServerURL)
+
+	var deployment v1.Deployment
+	require.NoError(t, r.Get(context.Background(), types.NamespacedName{Name: "linux", Namespace: testNamespace}, &deployment))
+	assert.Equal(t, int32(2), *deployment.Spec.Replicas)
+	assert.Equal(t, "linux", deployment.OwnerReferences[0].Name)
+	assert.Contains(t, deployment.Spec.Template.Spec.Containers[0].Env, v12.EnvVar{Name: "SERVER_URL", Value: pool.Status.ServerURL})
+}
+
+func TestAgentPoolServerURLFromServiceName(t *testing.T) {
+	instance := newAgentPoolTestTeamCity()
+	pool := newTestAgentPool()
+
+	pool.Spec.ServiceName = "tc-web"
+	serverURL, err := agentServerURL(pool, instance)
+	require.NoError(t, err)
+	assert.Equal(t, "http://tc-web.default.svc:80", serverURL)
+
+	pool.Spec.ServiceName = "missing"
+	_, err = agentServerURL(pool, instance)
+	assert.ErrorContains(t, err, "spec.serviceList")
+
+	pool.Spec.ServerURL = "https://teamcity.example.com"
+	serverURL, err = agentServerURL(pool, instance)
+	require.NoError(t, err)
+	assert.Equal(t, "https://teamcity.example.com", serverURL)
+}
+
+func TestAgentPoolScalesToZeroWhileTeamCityIsStopped(t *testing.T) {
+	server := teamcitytest.NewServer("")
+	defer server.Close()
+	instance := newAgentPoolTestTeamCity()
+	instance.Spec.Stopped = true
+	r := newAgentPoolTestReconciler(t, server, instance, newTestAgentPool())
+
+	reconcileAgentPool(t, r)
+	var deployment v1.Deployment
+	require.NoError(t, r.Get(context.Background(), types.NamespacedName{Name: "linux", Namespace: testNamespace}, &deployment))
+	assert.Equal(t, int32(0), *deployment.Spec.Replicas)
+}
+
+func TestAgentPoolSwitchesToStatefulSetForWorkVolumes(t *testing.T) {
+	server := teamcitytest.NewServer("")
+	defer server.Close()
+	r := newAgentPoolTestReconciler(t, server, newAgentPoolTestTeamCity(), newTestAgentPool())
+	reconcileAgentPool(t, r)
+
+	pool := newTestAgentPool()
+	require.NoError(t, r.Get(context.Background(), types.NamespacedName{Name: "linux", Namespace: testNamespace}, pool))
+	pool.Spec.WorkVolumeClaim = &v12.PersistentVolumeClaimSpec{AccessModes: []v12.PersistentVolumeAccessMode{v12.ReadWriteOnce}}
+	require.NoError(t, r.Update(context.Background(), pool))
+
+	_, updated := reconcileAgentPool(t, r)
+	assert.Equal(t, workloadKindStatefulSet, updated.Status.WorkloadKind)
+	var statefulSet v1.StatefulSet
+	require.NoError(t, r.Get(context.Background(), types.NamespacedName{Name: "linux", Namespace: testNamespace}, &statefulSet))
+	assert.Len(t, statefulSet.Spec.VolumeClaimTemplates, 1)
+	err := r.Get(context.Background(), types.NamespacedName{Name: "linux", Namespace: testNamespace}, &v1.Deployment{})
+	assert.True(t, errors.IsNotFound(err), "expected the Deployment to be deleted, got %v", err)
+}
+
+func TestAgentPoolAuthorizesAgentsOfItsPods(t *testing.T) {
+	server := teamcitytest.NewServer("token")
+	defer server.Close()
+	server.AddAgent("linux-a")
+	server.AddAgent("other-agent")
+	server.AddAgentPool("Linux")
+	pool := newTestAgentPool()
+	pool.Spec.Authorization = &AgentAuthorization{Pool: "Linux"}
+	r := newAgentPoolTestReconciler(t, server, newAgentPoolTestTeamCity(), pool, newAgentTestPod("linux-a"))
+
+	_, updated := reconcileAgentPool(t, r)
+	assert.Empty(t, updated.Status.Message)
+	assert.Equal(t, []string{"linux-a"}, updated.Status.AuthorizedAgents)
+	agent, _ := server.Agent("linux-a")
+	assert.True(t, agent.Authorized)
+	assert.Equal(t, "Linux", agent.Pool.Name)
+	other, _ := server.Agent("other-agent")
+	assert.False(t, other.Authorized)
+
+	require.NoError(t, r.Delete(context.Background(), newAgentTestPod("linux-a")))
+	_, updated = reconcileAgentPool(t, r)
+	assert.Empty(t, updated.Status.AuthorizedAgents)
+	agent, _ = server.Agent("linux-a")
+	assert.False(t, agent.Authorized)
+}
+
+func TestAgentPoolReportsMissingServerAgentPool(t *testing.T) {
+	server := teamcitytest.NewServer("")
+	defer server.Close()
+	server.AddAgent("linux-a")
+	pool := newTestAgentPool()
+	pool.Spec.Authorization = &AgentAuthorization{Pool: "Windows"}
+	r := newAgentPoolTestReconciler(t, server, newAgentPoolTestTeamCity(), pool, newAgentTestPod("linux-a"))
+
+	_, updated := reconcileAgentPool(t, r)
+	assert.Contains(t, updated.Status.Message, `agent pool "Windows"`)
+	agent, _ := server.Agent("linux-a")
+	assert.False(t, agent.Authorized)
+}
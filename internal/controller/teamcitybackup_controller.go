@@ -0,0 +1,214 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	. "git.jetbrains.team/tch/teamcity-operator/api/v1beta1"
+	"git.jetbrains.team/tch/teamcity-operator/internal/teamcity"
+	v12 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+const (
+	backupPollInterval = 10 * time.Second
+
+	eventReasonBackupStarted   = "BackupStarted"
+	eventReasonBackupSucceeded = "BackupSucceeded"
+	eventReasonBackupFailed    = "BackupFailed"
+)
+
+// TeamCityBackupReconciler reconciles a TeamCityBackup object
+type TeamCityBackupReconciler struct {
+	client.Client
+	Scheme   *runtime.Scheme
+	Recorder record.EventRecorder
+	// ClientFactory creates the REST client for the referenced TeamCity; defaults to teamcity.NewClientForInstance.
+	ClientFactory teamcity.ClientFactory
+}
+
+//+kubebuilder:rbac:groups=jetbrains.com,resources=teamcitybackups,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups=jetbrains.com,resources=teamcitybackups/status,verbs=get;update;patch
+//+kubebuilder:rbac:groups=core,resources=secrets,verbs=get;list;watch
+
+// Reconcile starts the backup on the main node of the referenced TeamCity and polls it until the server reports
+// a final status. Finished backups are never started again.
+func (r *TeamCityBackupReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	log := log.FromContext(ctx)
+
+	var backup TeamCityBackup
+	if err := r.Get(ctx, req.NamespacedName, &backup); err != nil {
+		if errors.IsNotFound(err) {
+			return ctrl.Result{}, nil
+		}
+		return ctrl.Result{}, err
+	}
+	if backup.IsFinished() {
+		return ctrl.Result{}, nil
+	}
+
+	var instance TeamCity
+	if err := r.Get(ctx, backup.GetTeamCityNamespacedName(), &instance); err != nil {
+		if errors.IsNotFound(err) {
+			log.V(1).Info("Referenced TeamCity does not exist yet", "teamcity", backup.Spec.TeamCityRef)
+			return r.requeueWithStatus(ctx, &backup, BackupPhasePending, fmt.Sprintf("TeamCity %q not found", backup.Spec.TeamCityRef))
+		}
+		return ctrl.Result{}, err
+	}
+
+	tcClient, err := r.clientFactory()(ctx, r.Client, &instance)
+	if err != nil {
+		return r.requeueWithStatus(ctx, &backup, BackupPhasePending, err.Error())
+	}
+
+	if backup.Status.Phase == BackupPhaseRunning {
+		return r.pollBackup(ctx, &backup, tcClient)
+	}
+	return r.startBackup(ctx, &backup, tcClient)
+}
+
+func (r *TeamCityBackupReconciler) startBackup(ctx context.Context, backup *TeamCityBackup, tcClient *teamcity.Client) (ctrl.Result, error) {
+	log := log.FromContext(ctx)
+
+	status, err := tcClient.GetBackupStatus(ctx)
+	if err != nil {
+		return r.requeueWithStatus(ctx, backup, BackupPhasePending, err.Error())
+	}
+	if status.IsRunning() {
+		return r.requeueWithStatus(ctx, backup, BackupPhasePending, "Another backup is running on the server")
+	}
+
+	fileName, err := tcClient.StartBackup(ctx, backupOptionsFromSpec(backup.Spec.TeamCityBackupOptions))
+	if err != nil {
+		if teamcity.IsConflict(err) {
+			return r.requeueWithStatus(ctx, backup, BackupPhasePending, "Another backup is running on the server")
+		}
+		return r.requeueWithStatus(ctx, backup, BackupPhasePending, err.Error())
+	}
+	log.V(1).Info("Backup started", "file", fileName)
+
+	now := metav1.Now()
+	backup.Status.Phase = BackupPhaseRunning
+	backup.Status.Message = "Backup is running"
+	backup.Status.FileName = fileName
+	backup.Status.StartTime = &now
+	if err := r.Status().Update(ctx, backup); err != nil {
+		return ctrl.Result{}, err
+	}
+	r.recordEvent(backup, v12.EventTypeNormal, eventReasonBackupStarted, fmt.Sprintf("Backup to %s started", fileName))
+	return ctrl.Result{RequeueAfter: backupPollInterval}, nil
+}
+
+func (r *TeamCityBackupReconciler) pollBackup(ctx context.Context, backup *TeamCityBackup, tcClient *teamcity.Client) (ctrl.Result, error) {
+	status, err := tcClient.GetBackupStatus(ctx)
+	if err != nil {
+		return r.requeueWithStatus(ctx, backup, BackupPhaseRunning, err.Error())
+	}
+	if status.IsRunning() {
+		return ctrl.Result{RequeueAfter: backupPollInterval}, nil
+	}
+	if status.IsFailed() {
+		return r.failBackup(ctx, backup, fmt.Sprintf("Server reported backup status %s", status))
+	}
+	// Idle means the server has no backup process, e.g. after it was restarted during the backup,
+	// so the backup only succeeded if its file was written
+	if status == teamcity.BackupStatusIdle {
+		file, err := tcClient.GetBackupFile(ctx, backup.Status.FileName)
+		if teamcity.IsNotFound(err) {
+			return r.failBackup(ctx, backup, fmt.Sprintf(
+				"Server reports backup status %s and has no file %s, it was probably restarted during the backup", status, backup.Status.FileName))
+		}
+		if err != nil {
+			return r.requeueWithStatus(ctx, backup, BackupPhaseRunning, err.Error())
+		}
+		return r.completeBackup(ctx, backup, file.Size)
+	}
+	if !status.IsFinished() {
+		return r.requeueWithStatus(ctx, backup, BackupPhaseRunning, fmt.Sprintf("Waiting for the server to finish the backup, it reports status %s", status))
+	}
+
+	// the size is informational, a server without file metadata still produced the backup
+	var size int64
+	if file, err := tcClient.GetBackupFile(ctx, backup.Status.FileName); err == nil {
+		size = file.Size
+	} else {
+		log.FromContext(ctx).V(1).Info("Unable to read backup file metadata", "file", backup.Status.FileName, "error", err.Error())
+	}
+	return r.completeBackup(ctx, backup, size)
+}
+
+func (r *TeamCityBackupReconciler) completeBackup(ctx context.Context, backup *TeamCityBackup, size int64) (ctrl.Result, error) {
+	now := metav1.Now()
+	backup.Status.CompletionTime = &now
+	backup.Status.Size = size
+	backup.Status.Phase = BackupPhaseSucceeded
+	backup.Status.Message = "Backup finished"
+	if err := r.Status().Update(ctx, backup); err != nil {
+		return ctrl.Result{}, err
+	}
+	r.recordEvent(backup, v12.EventTypeNormal, eventReasonBackupSucceeded, fmt.Sprintf("Backup to %s finished", backup.Status.FileName))
+	return ctrl.Result{}, nil
+}
+
+func (r *TeamCityBackupReconciler) failBackup(ctx context.Context, backup *TeamCityBackup, message string) (ctrl.Result, error) {
+	now := metav1.Now()
+	backup.Status.CompletionTime = &now
+	backup.Status.Phase = BackupPhaseFailed
+	backup.Status.Message = message
+	if err := r.Status().Update(ctx, backup); err != nil {
+		return ctrl.Result{}, err
+	}
+	r.recordEvent(backup, v12.EventTypeWarning, eventReasonBackupFailed, backup.Status.Message)
+	return ctrl.Result{}, nil
+}
+
+func (r *TeamCityBackupReconciler) requeueWithStatus(ctx context.Context, backup *TeamCityBackup, phase BackupPhase, message string) (ctrl.Result, error) {
+	if backup.Status.Phase != phase || backup.Status.Message != message {
+		backup.Status.Phase = phase
+		backup.Status.Message = message
+		if err := r.Status().Update(ctx, backup); err != nil {
+			return ctrl.Result{}, err
+		}
+	}
+	return ctrl.Result{RequeueAfter: backupPollInterval}, nil
+}
+
+func (r *TeamCityBackupReconciler) clientFactory() teamcity.ClientFactory {
+	if r.ClientFactory != nil {
+		return r.ClientFactory
+	}
+	return teamcity.NewClientForInstance
+}
+
+func (r *TeamCityBackupReconciler) recordEvent(backup *TeamCityBackup, eventType string, reason string, message string) {
+	if r.Recorder != nil {
+		r.Recorder.Event(backup, eventType, reason, message)
+	}
+}
+
+func backupOptionsFromSpec(spec TeamCityBackupOptions) teamcity.BackupOptions {
+	return teamcity.BackupOptions{
+		FileName:                 spec.FileName,
+		AddTimestamp:             spec.AddTimestamp,
+		IncludeConfigs:           spec.IncludeConfigs,
+		IncludeDatabase:          spec.IncludeDatabase,
+		IncludeBuildLogs:         spec.IncludeBuildLogs,
+		IncludePersonalChanges:   spec.IncludePersonalChanges,
+		IncludeRunningBuilds:     spec.IncludeRunningBuilds,
+		IncludeSupplimentaryData: spec.IncludeSupplimentaryData,
+	}
+}
+
+// SetupWithManager sets up the controller with the Manager.
+func (r *TeamCityBackupReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewControllerManagedBy(mgr).
+		For(&TeamCityBackup{}).
+		Complete(r)
+}
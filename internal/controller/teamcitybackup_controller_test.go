@@ -0,0 +1,164 @@
+package controller
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	. "git.jetbrains.team/tch/teamcity-operator/api/v1beta1"
+	"git.jetbrains.team/tch/teamcity-operator/internal/teamcity"
+	"git.jetbrains.team/tch/teamcity-operator/internal/teamcity/teamcitytest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func newBackupTestReconciler(t *testing.T, server *teamcitytest.Server, objects ...client.Object) *TeamCityBackupReconciler {
+	testScheme := newTestScheme(t)
+	fakeClient := fake.NewClientBuilder().
+		WithScheme(testScheme).
+		WithObjects(objects...).
+		WithStatusSubresource(&TeamCityBackup{}).
+		Build()
+	return &TeamCityBackupReconciler{
+		Client: fakeClient,
+		Scheme: testScheme,
+		ClientFactory: func(ctx context.Context, reader client.Reader, instance *TeamCity) (*teamcity.Client, error) {
+			return teamcity.NewClient(server.URL, server.Token, http.DefaultClient), nil
+		},
+	}
+}
+
+func newTestBackup(name string) *TeamCityBackup {
+	return &TeamCityBackup{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: testNamespace},
+		Spec: TeamCityBackupSpec{
+			TeamCityRef: "tc",
+			TeamCityBackupOptions: TeamCityBackupOptions{
+				FileName:        "nightly",
+				IncludeConfigs:  true,
+				IncludeDatabase: true,
+			},
+		},
+	}
+}
+
+func reconcileBackup(t *testing.T, r *TeamCityBackupReconciler, name string) (ctrl.Result, TeamCityBackup) {
+	namespacedName := types.NamespacedName{Name: name, Namespace: testNamespace}
+	result, err := r.Reconcile(context.Background(), ctrl.Request{NamespacedName: namespacedName})
+	require.NoError(t, err)
+	var backup TeamCityBackup
+	require.NoError(t, r.Get(context.Background(), namespacedName, &backup))
+	return result, backup
+}
+
+func TestBackupReconcilerRunsBackupToCompletion(t *testing.T) {
+	server := teamcitytest.NewServer("token")
+	defer server.Close()
+	instance := &TeamCity{ObjectMeta: metav1.ObjectMeta{Name: "tc", Namespace: testNamespace}}
+	r := newBackupTestReconciler(t, server, instance, newTestBackup("backup"))
+
+	result, backup := reconcileBackup(t, r, "backup")
+	assert.Equal(t, BackupPhaseRunning, backup.Status.Phase)
+	assert.Equal(t, "nightly.zip", backup.Status.FileName)
+	assert.NotNil(t, backup.Status.StartTime)
+	assert.Equal(t, backupPollInterval, result.RequeueAfter)
+
+	_, backup = reconcileBackup(t, r, "backup")
+	assert.Equal(t, BackupPhaseRunning, backup.Status.Phase)
+
+	server.FinishBackup(4096)
+	result, backup = reconcileBackup(t, r, "backup")
+	assert.Equal(t, BackupPhaseSucceeded, backup.Status.Phase)
+	assert.Equal(t, int64(4096), backup.Status.Size)
+	assert.NotNil(t, backup.Status.CompletionTime)
+	assert.Zero(t, result.RequeueAfter)
+
+	_, _ = reconcileBackup(t, r, "backup")
+	assert.Len(t, server.BackupRequests(), 1, "a finished backup must not be started again")
+}
+
+func TestBackupReconcilerReportsFailedBackup(t *testing.T) {
+	server := teamcitytest.NewServer("")
+	defer server.Close()
+	instance := &TeamCity{ObjectMeta: metav1.ObjectMeta{Name: "tc", Namespace: testNamespace}}
+	r := newBackupTestReconciler(t, server, instance, newTestBackup("backup"))
+
+	_, _ = reconcileBackup(t, r, "backup")
+	server.FailBackup()
+	_, backup := reconcileBackup(t, r, "backup")
+	assert.Equal(t, BackupPhaseFailed, backup.Status.Phase)
+	assert.Contains(t, backup.Status.Message, string(teamcity.BackupStatusFaulted))
+}
+
+func TestBackupReconcilerKeepsPollingUntilBackupIsFinished(t *testing.T) {
+	server := teamcitytest.NewServer("")
+	defer server.Close()
+	instance := &TeamCity{ObjectMeta: metav1.ObjectMeta{Name: "tc", Namespace: testNamespace}}
+	r := newBackupTestReconciler(t, server, instance, newTestBackup("backup"))
+
+	_, _ = reconcileBackup(t, r, "backup")
+	server.SetBackupStatus("Unknown")
+	result, backup := reconcileBackup(t, r, "backup")
+	assert.Equal(t, BackupPhaseRunning, backup.Status.Phase)
+	assert.Contains(t, backup.Status.Message, "Unknown")
+	assert.Nil(t, backup.Status.CompletionTime)
+	assert.Equal(t, backupPollInterval, result.RequeueAfter)
+
+	server.FinishBackup(1024)
+	_, backup = reconcileBackup(t, r, "backup")
+	assert.Equal(t, BackupPhaseSucceeded, backup.Status.Phase)
+	assert.Len(t, server.BackupRequests(), 1)
+}
+
+func TestBackupReconcilerFailsBackupLostByServerRestart(t *testing.T) {
+	server := teamcitytest.NewServer("")
+	defer server.Close()
+	instance := &TeamCity{ObjectMeta: metav1.ObjectMeta{Name: "tc", Namespace: testNamespace}}
+	r := newBackupTestReconciler(t, server, instance, newTestBackup("backup"))
+
+	_, backup := reconcileBackup(t, r, "backup")
+	require.Equal(t, BackupPhaseRunning, backup.Status.Phase)
+	// the server restarts in the middle of the backup and forgets it
+	server.SetBackupStatus(teamcity.BackupStatusIdle)
+	result, backup := reconcileBackup(t, r, "backup")
+	assert.Equal(t, BackupPhaseFailed, backup.Status.Phase)
+	assert.Contains(t, backup.Status.Message, "probably restarted during the backup")
+	assert.NotNil(t, backup.Status.CompletionTime)
+	assert.Zero(t, result.RequeueAfter)
+}
+
+func TestBackupReconcilerCompletesBackupFinishedBeforeServerRestart(t *testing.T) {
+	server := teamcitytest.NewServer("")
+	defer server.Close()
+	instance := &TeamCity{ObjectMeta: metav1.ObjectMeta{Name: "tc", Namespace: testNamespace}}
+	r := newBackupTestReconciler(t, server, instance, newTestBackup("backup"))
+
+	_, backup := reconcileBackup(t, r, "backup")
+	server.AddBackupFile(backup.Status.FileName, 2048)
+	server.SetBackupStatus(teamcity.BackupStatusIdle)
+	_, backup = reconcileBackup(t, r, "backup")
+	assert.Equal(t, BackupPhaseSucceeded, backup.Status.Phase)
+	assert.Equal(t, int64(2048), backup.Status.Size)
+}
+
+func TestBackupReconcilerWaitsForRunningBackupAndMissingTeamCity(t *testing.T) {
+	server := teamcitytest.NewServer("")
+	defer server.Close()
+	r := newBackupTestReconciler(t, server, newTestBackup("backup"))
+
+	result, backup := reconcileBackup(t, r, "backup")
+	assert.Equal(t, BackupPhasePending, backup.Status.Phase)
+	assert.Contains(t, backup.Status.Message, "not found")
+	assert.Equal(t, backupPollInterval, result.RequeueAfter)
+
+	require.NoError(t, r.Create(context.Background(), &TeamCity{ObjectMeta: metav1.ObjectMeta{Name: "tc", Namespace: testNamespace}}))
+	server.SetBackupStatus(teamcity.BackupStatusRunning)
+	_, backup = reconcileBackup(t, r, "backup")
+	assert.Equal(t, BackupPhasePending, backup.Status.Phase)
+	assert.Empty(t, server.BackupRequests())
+}
@@ -0,0 +1,384 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	. "git.jetbrains.team/tch/teamcity-operator/api/v1beta1"
+	"git.jetbrains.team/tch/teamcity-operator/internal/resource"
+	"github.com/robfig/cron/v3"
+	batchv1 "k8s.io/api/batch/v1"
+	v12 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+const (
+	backupScheduleMissingTeamCityRequeueInterval = time.Minute
+	// scheduleLookBackStart is the first window mostRecentScheduleTime looks back from now
+	scheduleLookBackStart = time.Minute
+
+	eventReasonBackupScheduled   = "BackupScheduled"
+	eventReasonBackupSkipped     = "BackupSkipped"
+	eventReasonInvalidSchedule   = "InvalidSchedule"
+	eventReasonBackupsPruned     = "BackupsPruned"
+	eventReasonBackupPruneFailed = "BackupPruneFailed"
+)
+
+// TeamCityBackupScheduleReconciler reconciles a TeamCityBackupSchedule object
+type TeamCityBackupScheduleReconciler struct {
+	client.Client
+	Scheme   *runtime.Scheme
+	Recorder record.EventRecorder
+	// Now returns the current time; defaults to time.Now.
+	Now func() time.Time
+}
+
+//+kubebuilder:rbac:groups=jetbrains.com,resources=teamcitybackupschedules,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups=jetbrains.com,resources=teamcitybackupschedules/status,verbs=get;update;patch
+//+kubebuilder:rbac:groups=batch,resources=jobs,verbs=get;list;watch;create;update;patch;delete
+
+// Reconcile creates a TeamCityBackup for the latest due run of the schedule, records the results of finished
+// backups and deletes backups beyond the retention together with their files.
+func (r *TeamCityBackupScheduleReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	log := log.FromContext(ctx)
+
+	var schedule TeamCityBackupSchedule
+	if err := r.Get(ctx, req.NamespacedName, &schedule); err != nil {
+		if errors.IsNotFound(err) {
+			return ctrl.Result{}, nil
+		}
+		return ctrl.Result{}, err
+	}
+	original := schedule.Status.DeepCopy()
+
+	cronSchedule, err := cron.ParseStandard(schedule.Spec.Schedule)
+	if err != nil {
+		message := fmt.Sprintf("Invalid schedule %q: %s", schedule.Spec.Schedule, err)
+		if schedule.Status.Message != message {
+			r.recordEvent(&schedule, v12.EventTypeWarning, eventReasonInvalidSchedule, message)
+		}
+		schedule.Status.Message = message
+		schedule.Status.NextScheduleTime = nil
+		return ctrl.Result{}, r.updateScheduleStatus(ctx, &schedule, original)
+	}
+
+	var instance TeamCity
+	if err := r.Get(ctx, schedule.GetTeamCityNamespacedName(), &instance); err != nil {
+		if errors.IsNotFound(err) {
+			schedule.Status.Message = fmt.Sprintf("TeamCity %q not found", schedule.Spec.TeamCityRef)
+			return ctrl.Result{RequeueAfter: backupScheduleMissingTeamCityRequeueInterval}, r.updateScheduleStatus(ctx, &schedule, original)
+		}
+		return ctrl.Result{}, err
+	}
+
+	var backupList TeamCityBackupList
+	if err := r.List(ctx, &backupList, client.InNamespace(schedule.Namespace), client.MatchingLabels{BackupScheduleLabelKey: schedule.Name}); err != nil {
+		return ctrl.Result{}, err
+	}
+	active, succeeded, failed := classifyBackups(backupList.Items)
+	r.recordBackupResults(&schedule, succeeded, failed)
+
+	now := r.now()
+	if err := r.pruneBackups(ctx, &schedule, &instance, succeeded, failed, now); err != nil {
+		return ctrl.Result{}, err
+	}
+
+	schedule.Status.Active = nil
+	for _, backup := range active {
+		schedule.Status.Active = append(schedule.Status.Active, backup.Name)
+	}
+	schedule.Status.Message = ""
+
+	earliest := schedule.CreationTimestamp.Time
+	if schedule.Status.LastScheduleTime != nil {
+		earliest = schedule.Status.LastScheduleTime.Time
+	}
+	if scheduledTime, due := mostRecentScheduleTime(cronSchedule, earliest, now); due && !schedule.Spec.Suspend {
+		if len(active) > 0 {
+			message := fmt.Sprintf("Skipped the run scheduled at %s because backup %s is still running", scheduledTime.Format(time.RFC3339), active[0].Name)
+			r.recordEvent(&schedule, v12.EventTypeNormal, eventReasonBackupSkipped, message)
+		} else {
+			backup, err := r.createScheduledBackup(ctx, &schedule, scheduledTime)
+			if err != nil {
+				return ctrl.Result{}, err
+			}
+			log.V(1).Info("Scheduled backup created", "backup", backup.Name)
+			schedule.Status.Active = append(schedule.Status.Active, backup.Name)
+		}
+		schedule.Status.LastScheduleTime = &metav1.Time{Time: scheduledTime}
+	}
+
+	next := cronSchedule.Next(now)
+	schedule.Status.NextScheduleTime = &metav1.Time{Time: next}
+	if err := r.updateScheduleStatus(ctx, &schedule, original); err != nil {
+		return ctrl.Result{}, err
+	}
+	return ctrl.Result{RequeueAfter: next.Sub(now)}, nil
+}
+
+func (r *TeamCityBackupScheduleReconciler) createScheduledBackup(ctx context.Context, schedule *TeamCityBackupSchedule, scheduledTime time.Time) (*TeamCityBackup, error) {
+	backup := &TeamCityBackup{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      fmt.Sprintf("%s-%d", schedule.Name, scheduledTime.Unix()/60),
+			Namespace: schedule.Namespace,
+			Labels:    map[string]string{BackupScheduleLabelKey: schedule.Name},
+		},
+		Spec: TeamCityBackupSpec{
+			TeamCityRef:           schedule.Spec.TeamCityRef,
+			TeamCityBackupOptions: schedule.Spec.BackupTemplate,
+		},
+	}
+	if err := controllerutil.SetControllerReference(schedule, backup, r.Scheme); err != nil {
+		return nil, err
+	}
+	if err := r.Create(ctx, backup); err != nil {
+		// created by a reconciliation whose status update conflicted
+		if errors.IsAlreadyExists(err) {
+			return backup, nil
+		}
+		return nil, err
+	}
+	r.recordEvent(schedule, v12.EventTypeNormal, eventReasonBackupScheduled, fmt.Sprintf("Created backup %s", backup.Name))
+	return backup, nil
+}
+
+// recordBackupResults stores the newest successful and failed backups in status and reports new results as Events.
+func (r *TeamCityBackupScheduleReconciler) recordBackupResults(schedule *TeamCityBackupSchedule, succeeded []TeamCityBackup, failed []TeamCityBackup) {
+	if len(succeeded) > 0 {
+		newest := succeeded[0]
+		if schedule.Status.LastSuccessfulBackup != newest.Name {
+			schedule.Status.LastSuccessfulBackup = newest.Name
+			schedule.Status.LastSuccessfulTime = backupCompletionTime(&newest)
+			r.recordEvent(schedule, v12.EventTypeNormal, eventReasonBackupSucceeded,
+				fmt.Sprintf("Backup %s finished: %s", newest.Name, newest.Status.FileName))
+		}
+	}
+	if len(failed) > 0 {
+		newest := failed[0]
+		if schedule.Status.LastFailedBackup != newest.Name {
+			schedule.Status.LastFailedBackup = newest.Name
+			schedule.Status.LastFailureTime = backupCompletionTime(&newest)
+			schedule.Status.LastFailureMessage = newest.Status.Message
+			r.recordEvent(schedule, v12.EventTypeWarning, eventReasonBackupFailed,
+				fmt.Sprintf("Backup %s failed: %s", newest.Name, newest.Status.Message))
+		}
+	}
+}
+
+// pruneBackups deletes TeamCityBackups beyond the retention. Files of successful backups are deleted first by a Job;
+// the TeamCityBackups are only deleted once the Job succeeded, so a failed Job is retried on a later reconciliation.
+func (r *TeamCityBackupScheduleReconciler) pruneBackups(ctx context.Context, schedule *TeamCityBackupSchedule, instance *TeamCity, succeeded []TeamCityBackup, failed []TeamCityBackup, now time.Time) error {
+	prunedSucceeded, prunedFailed := selectBackupsToPrune(succeeded, failed, schedule.Spec.Retention, now)
+	for i := range prunedFailed {
+		if err := r.Delete(ctx, &prunedFailed[i]); client.IgnoreNotFound(err) != nil {
+			return err
+		}
+	}
+	if len(prunedSucceeded) == 0 {
+		return nil
+	}
+
+	var jobList batchv1.JobList
+	if err := r.List(ctx, &jobList, client.InNamespace(schedule.Namespace), client.MatchingLabels{BackupScheduleLabelKey: schedule.Name}); err != nil {
+		return err
+	}
+	if len(jobList.Items) > 0 {
+		return r.completePruneJob(ctx, schedule, &jobList.Items[0])
+	}
+
+	files := filesOnlyUsedByPrunedBackups(prunedSucceeded, succeeded)
+	var names []string
+	for _, backup := range prunedSucceeded {
+		names = append(names, backup.Name)
+	}
+	if len(files) == 0 {
+		return r.deleteBackupsByName(ctx, schedule.Namespace, names)
+	}
+
+	job := resource.BuildBackupPruneJob(instance, fmt.Sprintf("%s-prune-%d", schedule.Name, now.Unix()), schedule.Namespace, names, files)
+	job.Labels[BackupScheduleLabelKey] = schedule.Name
+	if err := controllerutil.SetControllerReference(schedule, job, r.Scheme); err != nil {
+		return err
+	}
+	if err := r.Create(ctx, job); err != nil && !errors.IsAlreadyExists(err) {
+		return err
+	}
+	return nil
+}
+
+func (r *TeamCityBackupScheduleReconciler) completePruneJob(ctx context.Context, schedule *TeamCityBackupSchedule, job *batchv1.Job) error {
+	switch {
+	case jobHasCondition(job, batchv1.JobComplete):
+		names := strings.Split(job.Annotations[resource.PrunedBackupsAnnotationKey], ",")
+		if err := r.deleteBackupsByName(ctx, schedule.Namespace, names); err != nil {
+			return err
+		}
+		r.recordEvent(schedule, v12.EventTypeNormal, eventReasonBackupsPruned, fmt.Sprintf("Deleted backups %s", strings.Join(names, ", ")))
+	case jobHasCondition(job, batchv1.JobFailed):
+		r.recordEvent(schedule, v12.EventTypeWarning, eventReasonBackupPruneFailed,
+			fmt.Sprintf("Job %s failed to delete backup files, it will be retried", job.Name))
+	default:
+		return nil
+	}
+	background := metav1.DeletePropagationBackground
+	return client.IgnoreNotFound(r.Delete(ctx, job, &client.DeleteOptions{PropagationPolicy: &background}))
+}
+
+func (r *TeamCityBackupScheduleReconciler) deleteBackupsByName(ctx context.Context, namespace string, names []string) error {
+	for _, name := range names {
+		if name == "" {
+			continue
+		}
+		backup := &TeamCityBackup{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: namespace}}
+		if err := r.Delete(ctx, backup); client.IgnoreNotFound(err) != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *TeamCityBackupScheduleReconciler) updateScheduleStatus(ctx context.Context, schedule *TeamCityBackupSchedule, original *TeamCityBackupScheduleStatus) error {
+	if equality.Semantic.DeepEqual(*original, schedule.Status) {
+		return nil
+	}
+	return r.Status().Update(ctx, schedule)
+}
+
+func (r *TeamCityBackupScheduleReconciler) now() time.Time {
+	if r.Now != nil {
+		return r.Now()
+	}
+	return time.Now()
+}
+
+func (r *TeamCityBackupScheduleReconciler) recordEvent(schedule *TeamCityBackupSchedule, eventType string, reason string, message string) {
+	if r.Recorder != nil {
+		r.Recorder.Event(schedule, eventType, reason, message)
+	}
+}
+
+// SetupWithManager sets up the controller with the Manager.
+func (r *TeamCityBackupScheduleReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewControllerManagedBy(mgr).
+		For(&TeamCityBackupSchedule{}).
+		Owns(&TeamCityBackup{}).
+		Owns(&batchv1.Job{}).
+		Complete(r)
+}
+
+// mostRecentScheduleTime returns the latest scheduled time after earliest that is not after now. It looks back from
+// now in doubling windows, so after a long operator downtime the missed runs before the latest one are not walked.
+func mostRecentScheduleTime(schedule cron.Schedule, earliest time.Time, now time.Time) (time.Time, bool) {
+	elapsed := now.Sub(earliest)
+	for window := scheduleLookBackStart; window <= elapsed/2; window *= 2 {
+		if latest, due := latestScheduleTimeBetween(schedule, now.Add(-window), now); due {
+			return latest, true
+		}
+	}
+	return latestScheduleTimeBetween(schedule, earliest, now)
+}
+
+// latestScheduleTimeBetween returns the latest scheduled time after start that is not after end.
+// Next returns the zero time for a schedule without a run in the next five years.
+func latestScheduleTimeBetween(schedule cron.Schedule, start time.Time, end time.Time) (time.Time, bool) {
+	var latest time.Time
+	due := false
+	for t := schedule.Next(start); !t.IsZero() && !t.After(end); t = schedule.Next(t) {
+		latest = t
+		due = true
+	}
+	return latest, due
+}
+
+// classifyBackups splits backups by phase; every group is sorted newest first.
+func classifyBackups(backups []TeamCityBackup) (active []TeamCityBackup, succeeded []TeamCityBackup, failed []TeamCityBackup) {
+	sorted := append([]TeamCityBackup(nil), backups...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		ti, tj := sorted[i].CreationTimestamp, sorted[j].CreationTimestamp
+		if ti.Equal(&tj) {
+			return sorted[i].Name > sorted[j].Name
+		}
+		return tj.Before(&ti)
+	})
+	for _, backup := range sorted {
+		switch backup.Status.Phase {
+		case BackupPhaseSucceeded:
+			succeeded = append(succeeded, backup)
+		case BackupPhaseFailed:
+			failed = append(failed, backup)
+		default:
+			active = append(active, backup)
+		}
+	}
+	return
+}
+
+// selectBackupsToPrune applies the retention to backups sorted newest first. The newest successful backup is never pruned.
+func selectBackupsToPrune(succeeded []TeamCityBackup, failed []TeamCityBackup, retention BackupRetention, now time.Time) (prunedSucceeded []TeamCityBackup, prunedFailed []TeamCityBackup) {
+	for i, backup := range succeeded {
+		if i == 0 {
+			continue
+		}
+		tooMany := retention.Count > 0 && i >= int(retention.Count)
+		tooOld := retention.MaxAge != nil && now.Sub(backupCompletionTime(&backup).Time) > retention.MaxAge.Duration
+		if tooMany || tooOld {
+			prunedSucceeded = append(prunedSucceeded, backup)
+		}
+	}
+	if len(failed) > int(retention.FailedCount) {
+		prunedFailed = failed[retention.FailedCount:]
+	}
+	return
+}
+
+// filesOnlyUsedByPrunedBackups protects files that a kept backup still points to, e.g. when addTimestamp is disabled.
+func filesOnlyUsedByPrunedBackups(pruned []TeamCityBackup, all []TeamCityBackup) []string {
+	prunedNames := map[string]bool{}
+	for _, backup := range pruned {
+		prunedNames[backup.Name] = true
+	}
+	keptFiles := map[string]bool{}
+	for _, backup := range all {
+		if !prunedNames[backup.Name] {
+			keptFiles[backup.Status.FileName] = true
+		}
+	}
+	var files []string
+	seen := map[string]bool{}
+	for _, backup := range pruned {
+		file := backup.Status.FileName
+		if file == "" || keptFiles[file] || seen[file] {
+			continue
+		}
+		seen[file] = true
+		files = append(files, file)
+	}
+	return files
+}
+
+func backupCompletionTime(backup *TeamCityBackup) *metav1.Time {
+	if backup.Status.CompletionTime != nil {
+		return backup.Status.CompletionTime
+	}
+	return &backup.CreationTimestamp
+}
+
+func jobHasCondition(job *batchv1.Job, conditionType batchv1.JobConditionType) bool {
+	for _, condition := range job.Status.Conditions {
+		if condition.Type == conditionType && condition.Status == v12.ConditionTrue {
+			return true
+		}
+	}
+	return false
+}
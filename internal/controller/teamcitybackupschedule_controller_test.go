@@ -0,0 +1,227 @@
+package controller
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	. "git.jetbrains.team/tch/teamcity-operator/api/v1beta1"
+	"git.jetbrains.team/tch/teamcity-operator/internal/resource"
+	"github.com/robfig/cron/v3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	batchv1 "k8s.io/api/batch/v1"
+	v12 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+var scheduleTestCreated = time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+
+func newScheduleTestReconciler(t *testing.T, now *time.Time, objects ...client.Object) *TeamCityBackupScheduleReconciler {
+	testScheme := newTestScheme(t)
+	fakeClient := fake.NewClientBuilder().
+		WithScheme(testScheme).
+		WithObjects(objects...).
+		WithStatusSubresource(&TeamCityBackupSchedule{}, &TeamCityBackup{}).
+		Build()
+	return &TeamCityBackupScheduleReconciler{
+		Client: fakeClient,
+		Scheme: testScheme,
+		Now:    func() time.Time { return *now },
+	}
+}
+
+func newTestSchedule() *TeamCityBackupSchedule {
+	return &TeamCityBackupSchedule{
+		ObjectMeta: metav1.ObjectMeta{Name: "nightly", Namespace: testNamespace, CreationTimestamp: metav1.NewTime(scheduleTestCreated)},
+		Spec: TeamCityBackupScheduleSpec{
+			TeamCityRef: "tc",
+			Schedule:    "0 2 * * *",
+			Retention:   BackupRetention{Count: 2, FailedCount: 1},
+		},
+	}
+}
+
+func newScheduleTestTeamCity() *TeamCity {
+	instance := newTestTeamCity()
+	instance.Spec.Image = "jetbrains/teamcity-server"
+	instance.Spec.DataDirVolumeClaim = CustomPersistentVolumeClaim{
+		Name:        "data",
+		VolumeMount: v12.VolumeMount{Name: "data", MountPath: "/storage"},
+	}
+	return instance
+}
+
+func newFinishedScheduledBackup(name string, phase BackupPhase, fileName string, created time.Time) *TeamCityBackup {
+	completed := metav1.NewTime(created.Add(time.Minute))
+	return &TeamCityBackup{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:              name,
+			Namespace:         testNamespace,
+			Labels:            map[string]string{BackupScheduleLabelKey: "nightly"},
+			CreationTimestamp: metav1.NewTime(created),
+		},
+		Spec:   TeamCityBackupSpec{TeamCityRef: "tc"},
+		Status: TeamCityBackupStatus{Phase: phase, FileName: fileName, CompletionTime: &completed},
+	}
+}
+
+func reconcileSchedule(t *testing.T, r *TeamCityBackupScheduleReconciler) (ctrl.Result, TeamCityBackupSchedule) {
+	namespacedName := types.NamespacedName{Name: "nightly", Namespace: testNamespace}
+	result, err := r.Reconcile(context.Background(), ctrl.Request{NamespacedName: namespacedName})
+	require.NoError(t, err)
+	var schedule TeamCityBackupSchedule
+	require.NoError(t, r.Get(context.Background(), namespacedName, &schedule))
+	return result, schedule
+}
+
+func listScheduledBackups(t *testing.T, r *TeamCityBackupScheduleReconciler) []TeamCityBackup {
+	var backups TeamCityBackupList
+	require.NoError(t, r.List(context.Background(), &backups, client.MatchingLabels{BackupScheduleLabelKey: "nightly"}))
+	return backups.Items
+}
+
+func TestBackupScheduleCreatesBackupOncePerRun(t *testing.T) {
+	now := scheduleTestCreated.Add(time.Hour)
+	r := newScheduleTestReconciler(t, &now, newTestSchedule(), newScheduleTestTeamCity())
+
+	result, schedule := reconcileSchedule(t, r)
+	assert.Empty(t, listScheduledBackups(t, r), "no run is due before 02:00")
+	assert.Equal(t, time.Date(2024, 3, 2, 2, 0, 0, 0, time.UTC), schedule.Status.NextScheduleTime.Time.UTC())
+	assert.Equal(t, 13*time.Hour, result.RequeueAfter)
+
+	now = time.Date(2024, 3, 2, 2, 0, 30, 0, time.UTC)
+	_, schedule = reconcileSchedule(t, r)
+	backups := listScheduledBackups(t, r)
+	require.Len(t, backups, 1)
+	assert.Equal(t, "tc", backups[0].Spec.TeamCityRef)
+	assert.Equal(t, []string{backups[0].Name}, schedule.Status.Active)
+	assert.Equal(t, "nightly", backups[0].OwnerReferences[0].Name)
+
+	_, _ = reconcileSchedule(t, r)
+	assert.Len(t, listScheduledBackups(t, r), 1, "the same run must not create a second backup")
+}
+
+func TestBackupScheduleReportsOnlyCreatedBackups(t *testing.T) {
+	now := time.Date(2024, 3, 2, 2, 0, 30, 0, time.UTC)
+	r := newScheduleTestReconciler(t, &now, newTestSchedule(), newScheduleTestTeamCity())
+	recorder := record.NewFakeRecorder(10)
+	r.Recorder = recorder
+	schedule := newTestSchedule()
+	scheduledTime := time.Date(2024, 3, 2, 2, 0, 0, 0, time.UTC)
+
+	created, err := r.createScheduledBackup(context.Background(), schedule, scheduledTime)
+	require.NoError(t, err)
+	assert.Contains(t, <-recorder.Events, eventReasonBackupScheduled)
+
+	existing, err := r.createScheduledBackup(context.Background(), schedule, scheduledTime)
+	require.NoError(t, err)
+	assert.Equal(t, created.Name, existing.Name)
+	assert.Len(t, listScheduledBackups(t, r), 1)
+	assert.Empty(t, recorder.Events, "an existing backup is not reported as created")
+}
+
+func TestMostRecentScheduleTime(t *testing.T) {
+	now := time.Date(2024, 3, 2, 2, 30, 30, 0, time.UTC)
+	everyMinute, err := cron.ParseStandard("* * * * *")
+	require.NoError(t, err)
+	nightly, err := cron.ParseStandard("0 2 * * *")
+	require.NoError(t, err)
+	never, err := cron.ParseStandard("0 0 30 2 *")
+	require.NoError(t, err)
+
+	latest, due := mostRecentScheduleTime(everyMinute, now.AddDate(-10, 0, 0), now)
+	assert.True(t, due)
+	assert.Equal(t, time.Date(2024, 3, 2, 2, 30, 0, 0, time.UTC), latest)
+
+	latest, due = mostRecentScheduleTime(nightly, now.AddDate(0, -2, 0), now)
+	assert.True(t, due)
+	assert.Equal(t, time.Date(2024, 3, 2, 2, 0, 0, 0, time.UTC), latest)
+
+	_, due = mostRecentScheduleTime(nightly, now.Add(-time.Minute), now)
+	assert.False(t, due)
+
+	_, due = mostRecentScheduleTime(never, now.AddDate(-1, 0, 0), now)
+	assert.False(t, due)
+}
+
+func TestBackupScheduleSkipsRunWhileBackupIsActive(t *testing.T) {
+	now := time.Date(2024, 3, 2, 2, 0, 30, 0, time.UTC)
+	running := newFinishedScheduledBackup("nightly-running", BackupPhaseRunning, "", scheduleTestCreated)
+	running.Status.CompletionTime = nil
+	r := newScheduleTestReconciler(t, &now, newTestSchedule(), newScheduleTestTeamCity(), running)
+
+	_, schedule := reconcileSchedule(t, r)
+	assert.Len(t, listScheduledBackups(t, r), 1)
+	assert.NotNil(t, schedule.Status.LastScheduleTime, "the skipped run is not retried")
+}
+
+func TestBackupScheduleRecordsResultsAndPrunesOldBackups(t *testing.T) {
+	now := scheduleTestCreated.Add(time.Hour)
+	day := 24 * time.Hour
+	r := newScheduleTestReconciler(t, &now,
+		newTestSchedule(),
+		newScheduleTestTeamCity(),
+		newFinishedScheduledBackup("b1", BackupPhaseSucceeded, "b1.zip", scheduleTestCreated.Add(-3*day)),
+		newFinishedScheduledBackup("b2", BackupPhaseSucceeded, "b2.zip", scheduleTestCreated.Add(-2*day)),
+		newFinishedScheduledBackup("b3", BackupPhaseSucceeded, "b3.zip", scheduleTestCreated.Add(-1*day)),
+		newFinishedScheduledBackup("f1", BackupPhaseFailed, "", scheduleTestCreated.Add(-3*day)),
+		newFinishedScheduledBackup("f2", BackupPhaseFailed, "", scheduleTestCreated.Add(-2*day)),
+	)
+
+	_, schedule := reconcileSchedule(t, r)
+	assert.Equal(t, "b3", schedule.Status.LastSuccessfulBackup)
+	assert.Equal(t, "f2", schedule.Status.LastFailedBackup)
+
+	var jobs batchv1.JobList
+	require.NoError(t, r.List(context.Background(), &jobs))
+	require.Len(t, jobs.Items, 1)
+	job := jobs.Items[0]
+	assert.Equal(t, []string{"rm", "-f", "--", "/storage/backup/b1.zip"}, job.Spec.Template.Spec.Containers[0].Command)
+	assert.Equal(t, "b1", job.Annotations[resource.PrunedBackupsAnnotationKey])
+
+	names := func() []string {
+		var result []string
+		for _, backup := range listScheduledBackups(t, r) {
+			result = append(result, backup.Name)
+		}
+		return result
+	}
+	assert.ElementsMatch(t, []string{"b1", "b2", "b3", "f2"}, names(), "failed backups beyond the retention are deleted right away")
+
+	job.Status.Conditions = []batchv1.JobCondition{{Type: batchv1.JobComplete, Status: v12.ConditionTrue}}
+	require.NoError(t, r.Status().Update(context.Background(), &job))
+	_, _ = reconcileSchedule(t, r)
+	assert.ElementsMatch(t, []string{"b2", "b3", "f2"}, names())
+	require.NoError(t, r.List(context.Background(), &jobs))
+	assert.Empty(t, jobs.Items)
+}
+
+func TestSelectBackupsToPrune(t *testing.T) {
+	now := scheduleTestCreated
+	day := 24 * time.Hour
+	succeeded := []TeamCityBackup{
+		*newFinishedScheduledBackup("new", BackupPhaseSucceeded, "new.zip", now.Add(-40*day)),
+		*newFinishedScheduledBackup("old", BackupPhaseSucceeded, "old.zip", now.Add(-50*day)),
+	}
+
+	pruned, _ := selectBackupsToPrune(succeeded, nil, BackupRetention{Count: 5, MaxAge: &metav1.Duration{Duration: 30 * day}}, now)
+	require.Len(t, pruned, 1, "the newest successful backup is kept even when it is too old")
+	assert.Equal(t, "old", pruned[0].Name)
+
+	pruned, _ = selectBackupsToPrune(succeeded, nil, BackupRetention{Count: 5}, now)
+	assert.Empty(t, pruned)
+}
+
+func TestFilesOnlyUsedByPrunedBackups(t *testing.T) {
+	kept := *newFinishedScheduledBackup("kept", BackupPhaseSucceeded, "TeamCity_Backup.zip", scheduleTestCreated)
+	pruned := *newFinishedScheduledBackup("pruned", BackupPhaseSucceeded, "TeamCity_Backup.zip", scheduleTestCreated.Add(-time.Hour))
+
+	files := filesOnlyUsedByPrunedBackups([]TeamCityBackup{pruned}, []TeamCityBackup{kept, pruned})
+	assert.Empty(t, files, "a file still referenced by a kept backup must not be deleted")
+}
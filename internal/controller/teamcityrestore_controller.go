@@ -0,0 +1,303 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	. "git.jetbrains.team/tch/teamcity-operator/api/v1beta1"
+	"git.jetbrains.team/tch/teamcity-operator/internal/resource"
+	v1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	v12 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+const (
+	restorePollInterval = 10 * time.Second
+
+	eventReasonRestoreStarted   = "RestoreStarted"
+	eventReasonRestoreSucceeded = "RestoreSucceeded"
+	eventReasonRestoreFailed    = "RestoreFailed"
+)
+
+// TeamCityRestoreReconciler reconciles a TeamCityRestore object
+type TeamCityRestoreReconciler struct {
+	client.Client
+	Scheme   *runtime.Scheme
+	Recorder record.EventRecorder
+}
+
+//+kubebuilder:rbac:groups=jetbrains.com,resources=teamcityrestores,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups=jetbrains.com,resources=teamcityrestores/status,verbs=get;update;patch
+//+kubebuilder:rbac:groups=batch,resources=jobs,verbs=get;list;watch;create;update;patch;delete
+
+// Reconcile moves the restore through its phases. The TeamCity controller follows the restore mode annotation
+// set here: Stopping scales every node to zero, Restoring runs maintainDB in a Job, Starting starts the nodes with
+// a relaxed startup probe and removing the annotation returns the probes to the NodeSpec settings.
+func (r *TeamCityRestoreReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	log := log.FromContext(ctx)
+
+	var restore TeamCityRestore
+	if err := r.Get(ctx, req.NamespacedName, &restore); err != nil {
+		if errors.IsNotFound(err) {
+			return ctrl.Result{}, nil
+		}
+		return ctrl.Result{}, err
+	}
+	if restore.IsFinished() {
+		return ctrl.Result{}, nil
+	}
+
+	var instance TeamCity
+	if err := r.Get(ctx, restore.GetTeamCityNamespacedName(), &instance); err != nil {
+		if errors.IsNotFound(err) {
+			log.V(1).Info("Referenced TeamCity does not exist yet", "teamcity", restore.Spec.TeamCityRef)
+			return r.requeueWithStatus(ctx, &restore, RestorePhasePending, fmt.Sprintf("TeamCity %q not found", restore.Spec.TeamCityRef))
+		}
+		return ctrl.Result{}, err
+	}
+
+	switch restore.Status.Phase {
+	case RestorePhaseStopping:
+		return r.stopInstance(ctx, &restore, &instance)
+	case RestorePhaseRestoring:
+		return r.pollRestoreJob(ctx, &restore, &instance)
+	case RestorePhaseStarting:
+		return r.startInstance(ctx, &restore, &instance)
+	default:
+		return r.prepareRestore(ctx, &restore, &instance)
+	}
+}
+
+func (r *TeamCityRestoreReconciler) prepareRestore(ctx context.Context, restore *TeamCityRestore, instance *TeamCity) (ctrl.Result, error) {
+	if err := validateRestoreSource(restore.Spec.Source); err != nil {
+		return ctrl.Result{}, r.fail(ctx, restore, err.Error())
+	}
+	if err := validateRestoreDatabaseSecret(restore, instance); err != nil {
+		return ctrl.Result{}, r.fail(ctx, restore, err.Error())
+	}
+	if instance.InRestoreMode() {
+		return r.requeueWithStatus(ctx, restore, RestorePhasePending, "Another restore is in progress on the TeamCity")
+	}
+
+	backupFile, message, err := r.resolveBackupFile(ctx, restore, instance)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	if backupFile == "" {
+		return r.requeueWithStatus(ctx, restore, RestorePhasePending, message)
+	}
+
+	now := metav1.Now()
+	restore.Status.Phase = RestorePhaseStopping
+	restore.Status.Message = "Stopping TeamCity nodes"
+	restore.Status.BackupFile = backupFile
+	restore.Status.StartTime = &now
+	if err := r.Status().Update(ctx, restore); err != nil {
+		return ctrl.Result{}, err
+	}
+	r.recordEvent(restore, v12.EventTypeNormal, eventReasonRestoreStarted, fmt.Sprintf("Restoring %s into TeamCity %s", backupFile, instance.Name))
+	return ctrl.Result{Requeue: true}, nil
+}
+
+// resolveBackupFile returns the path of the backup file inside the restore Job, or a message when it is not available yet.
+func (r *TeamCityRestoreReconciler) resolveBackupFile(ctx context.Context, restore *TeamCityRestore, instance *TeamCity) (string, string, error) {
+	source := restore.Spec.Source
+	if source.BackupRef == "" {
+		return resource.RestoreBackupFilePath(instance, source, source.FileName), "", nil
+	}
+
+	var backup TeamCityBackup
+	if err := r.Get(ctx, types.NamespacedName{Name: source.BackupRef, Namespace: restore.Namespace}, &backup); err != nil {
+		if errors.IsNotFound(err) {
+			return "", fmt.Sprintf("TeamCityBackup %q not found", source.BackupRef), nil
+		}
+		return "", "", err
+	}
+	if backup.Status.Phase != BackupPhaseSucceeded {
+		return "", fmt.Sprintf("TeamCityBackup %q has not succeeded", source.BackupRef), nil
+	}
+	return resource.RestoreBackupFilePath(instance, source, backup.Status.FileName), "", nil
+}
+
+func (r *TeamCityRestoreReconciler) stopInstance(ctx context.Context, restore *TeamCityRestore, instance *TeamCity) (ctrl.Result, error) {
+	if err := r.setRestoreMode(ctx, instance, RestoreModeStopped); err != nil {
+		return ctrl.Result{}, err
+	}
+	stopped, err := nodesStopped(ctx, r.Client, instance, instance.GetAllNodes())
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	if !stopped {
+		return r.requeueWithStatus(ctx, restore, RestorePhaseStopping, "Waiting for TeamCity nodes to stop")
+	}
+
+	job := resource.BuildRestoreJob(instance, restore, restore.Name+"-restore", restore.Status.BackupFile, instance.Spec.DatabaseSecret.Secret)
+	if err := controllerutil.SetControllerReference(restore, job, r.Scheme); err != nil {
+		return ctrl.Result{}, err
+	}
+	if err := r.Create(ctx, job); err != nil && !errors.IsAlreadyExists(err) {
+		return ctrl.Result{}, err
+	}
+
+	restore.Status.Phase = RestorePhaseRestoring
+	restore.Status.Message = "Restoring the backup"
+	restore.Status.JobName = job.Name
+	if err := r.Status().Update(ctx, restore); err != nil {
+		return ctrl.Result{}, err
+	}
+	return ctrl.Result{RequeueAfter: restorePollInterval}, nil
+}
+
+func (r *TeamCityRestoreReconciler) pollRestoreJob(ctx context.Context, restore *TeamCityRestore, instance *TeamCity) (ctrl.Result, error) {
+	var job batchv1.Job
+	if err := r.Get(ctx, types.NamespacedName{Name: restore.Status.JobName, Namespace: restore.Namespace}, &job); err != nil {
+		if errors.IsNotFound(err) {
+			return ctrl.Result{}, r.fail(ctx, restore, restoreFailedMessage(fmt.Sprintf("Job %s was deleted", restore.Status.JobName)))
+		}
+		return ctrl.Result{}, err
+	}
+
+	switch {
+	case jobHasCondition(&job, batchv1.JobFailed):
+		return ctrl.Result{}, r.fail(ctx, restore, restoreFailedMessage(fmt.Sprintf("Job %s failed, see its logs", job.Name)))
+	case jobHasCondition(&job, batchv1.JobComplete):
+		if err := r.setRestoreMode(ctx, instance, RestoreModeStarting); err != nil {
+			return ctrl.Result{}, err
+		}
+		return r.requeueWithStatus(ctx, restore, RestorePhaseStarting, "Waiting for the main node to start")
+	}
+	return ctrl.Result{RequeueAfter: restorePollInterval}, nil
+}
+
+func (r *TeamCityRestoreReconciler) startInstance(ctx context.Context, restore *TeamCityRestore, instance *TeamCity) (ctrl.Result, error) {
+	if err := r.setRestoreMode(ctx, instance, RestoreModeStarting); err != nil {
+		return ctrl.Result{}, err
+	}
+	var mainNode v1.StatefulSet
+	if err := r.Get(ctx, instance.Spec.MainNode.GetNamespacedNameFromNamespace(instance.Namespace), &mainNode); err != nil {
+		if errors.IsNotFound(err) {
+			return ctrl.Result{RequeueAfter: restorePollInterval}, nil
+		}
+		return ctrl.Result{}, err
+	}
+	if !isStatefulSetUpdateFinished(&mainNode) {
+		return ctrl.Result{RequeueAfter: restorePollInterval}, nil
+	}
+
+	// the TeamCity controller rolls the nodes once more to apply the startup probe from NodeSpec
+	if err := r.setRestoreMode(ctx, instance, ""); err != nil {
+		return ctrl.Result{}, err
+	}
+	now := metav1.Now()
+	restore.Status.Phase = RestorePhaseSucceeded
+	restore.Status.Message = "Backup restored"
+	restore.Status.CompletionTime = &now
+	if err := r.Status().Update(ctx, restore); err != nil {
+		return ctrl.Result{}, err
+	}
+	r.recordEvent(restore, v12.EventTypeNormal, eventReasonRestoreSucceeded, fmt.Sprintf("Restored %s into TeamCity %s", restore.Status.BackupFile, instance.Name))
+	return ctrl.Result{}, nil
+}
+
+// setRestoreMode patches the restore mode annotation of the TeamCity; an empty mode removes it.
+func (r *TeamCityRestoreReconciler) setRestoreMode(ctx context.Context, instance *TeamCity, mode string) error {
+	if instance.Annotations[RestoreModeAnnotationKey] == mode {
+		return nil
+	}
+	patch := client.MergeFrom(instance.DeepCopy())
+	if mode == "" {
+		delete(instance.Annotations, RestoreModeAnnotationKey)
+	} else {
+		if instance.Annotations == nil {
+			instance.Annotations = map[string]string{}
+		}
+		instance.Annotations[RestoreModeAnnotationKey] = mode
+	}
+	return r.Patch(ctx, instance, patch)
+}
+
+func (r *TeamCityRestoreReconciler) fail(ctx context.Context, restore *TeamCityRestore, message string) error {
+	now := metav1.Now()
+	restore.Status.Phase = RestorePhaseFailed
+	restore.Status.Message = message
+	restore.Status.CompletionTime = &now
+	if err := r.Status().Update(ctx, restore); err != nil {
+		return err
+	}
+	r.recordEvent(restore, v12.EventTypeWarning, eventReasonRestoreFailed, message)
+	return nil
+}
+
+func (r *TeamCityRestoreReconciler) requeueWithStatus(ctx context.Context, restore *TeamCityRestore, phase RestorePhase, message string) (ctrl.Result, error) {
+	if restore.Status.Phase != phase || restore.Status.Message != message {
+		restore.Status.Phase = phase
+		restore.Status.Message = message
+		if err := r.Status().Update(ctx, restore); err != nil {
+			return ctrl.Result{}, err
+		}
+	}
+	return ctrl.Result{RequeueAfter: restorePollInterval}, nil
+}
+
+func (r *TeamCityRestoreReconciler) recordEvent(restore *TeamCityRestore, eventType string, reason string, message string) {
+	if r.Recorder != nil {
+		r.Recorder.Event(restore, eventType, reason, message)
+	}
+}
+
+// SetupWithManager sets up the controller with the Manager.
+func (r *TeamCityRestoreReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewControllerManagedBy(mgr).
+		For(&TeamCityRestore{}).
+		Owns(&batchv1.Job{}).
+		Complete(r)
+}
+
+func validateRestoreSource(source RestoreSource) error {
+	set := 0
+	if source.FileName != "" {
+		set++
+	}
+	if source.BackupRef != "" {
+		set++
+	}
+	if source.PersistentVolumeClaim != nil {
+		if source.PersistentVolumeClaim.ClaimName == "" || source.PersistentVolumeClaim.Path == "" {
+			return fmt.Errorf("spec.source.persistentVolumeClaim requires claimName and path")
+		}
+		set++
+	}
+	if set != 1 {
+		return fmt.Errorf("exactly one of spec.source.fileName, spec.source.backupRef and spec.source.persistentVolumeClaim must be set")
+	}
+	return nil
+}
+
+// validateRestoreDatabaseSecret requires the backup to be restored into the database of the TeamCity,
+// as the nodes started after the restore connect to spec.databaseSecret of the TeamCity.
+func validateRestoreDatabaseSecret(restore *TeamCityRestore, instance *TeamCity) error {
+	secret := instance.Spec.DatabaseSecret.Secret
+	if secret == "" {
+		return fmt.Errorf("TeamCity %s has no spec.databaseSecret.secret to restore the database into", instance.Name)
+	}
+	if restore.Spec.DatabaseSecret != "" && restore.Spec.DatabaseSecret != secret {
+		return fmt.Errorf("spec.databaseSecret %q differs from spec.databaseSecret.secret %q of TeamCity %s, whose nodes would not use the restored database. "+
+			"Point the TeamCity at the target database first", restore.Spec.DatabaseSecret, secret, instance.Name)
+	}
+	return nil
+}
+
+func restoreFailedMessage(reason string) string {
+	return fmt.Sprintf("%s. TeamCity stays stopped; fix the data directory and database, then remove annotation %s from the TeamCity to start it",
+		reason, RestoreModeAnnotationKey)
+}
@@ -0,0 +1,202 @@
+package controller
+
+import (
+	"context"
+	"testing"
+
+	. "git.jetbrains.team/tch/teamcity-operator/api/v1beta1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	v1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	v12 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/utils/pointer"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func newRestoreTestReconciler(t *testing.T, objects ...client.Object) *TeamCityRestoreReconciler {
+	testScheme := newTestScheme(t)
+	fakeClient := fake.NewClientBuilder().
+		WithScheme(testScheme).
+		WithObjects(objects...).
+		WithStatusSubresource(&TeamCityRestore{}, &TeamCityBackup{}, &v1.StatefulSet{}, &batchv1.Job{}).
+		Build()
+	return &TeamCityRestoreReconciler{
+		Client: fakeClient,
+		Scheme: testScheme,
+	}
+}
+
+func newTestRestore(source RestoreSource) *TeamCityRestore {
+	return &TeamCityRestore{
+		ObjectMeta: metav1.ObjectMeta{Name: "restore", Namespace: testNamespace},
+		Spec: TeamCityRestoreSpec{
+			TeamCityRef:    "tc",
+			Source:         source,
+			DatabaseSecret: "target-db",
+		},
+	}
+}
+
+func newRestoreTestTeamCity() *TeamCity {
+	instance := newScheduleTestTeamCity()
+	instance.Spec.DatabaseSecret.Secret = "target-db"
+	return instance
+}
+
+func newRestoreTestStatefulSet(replicas int32, readyReplicas int32) *v1.StatefulSet {
+	statefulSet := newTestStatefulSet("main", replicas)
+	statefulSet.Status = v1.StatefulSetStatus{Replicas: readyReplicas, ReadyReplicas: readyReplicas}
+	return statefulSet
+}
+
+func reconcileRestore(t *testing.T, r *TeamCityRestoreReconciler) (ctrl.Result, TeamCityRestore) {
+	namespacedName := types.NamespacedName{Name: "restore", Namespace: testNamespace}
+	result, err := r.Reconcile(context.Background(), ctrl.Request{NamespacedName: namespacedName})
+	require.NoError(t, err)
+	var restore TeamCityRestore
+	require.NoError(t, r.Get(context.Background(), namespacedName, &restore))
+	return result, restore
+}
+
+func getRestoreTestTeamCity(t *testing.T, r *TeamCityRestoreReconciler) TeamCity {
+	var instance TeamCity
+	require.NoError(t, r.Get(context.Background(), types.NamespacedName{Name: "tc", Namespace: testNamespace}, &instance))
+	return instance
+}
+
+func setStatefulSetStatus(t *testing.T, r *TeamCityRestoreReconciler, replicas int32, readyReplicas int32) {
+	var statefulSet v1.StatefulSet
+	require.NoError(t, r.Get(context.Background(), types.NamespacedName{Name: "main", Namespace: testNamespace}, &statefulSet))
+	statefulSet.Spec.Replicas = pointer.Int32(replicas)
+	require.NoError(t, r.Update(context.Background(), &statefulSet))
+	statefulSet.Status.Replicas = readyReplicas
+	statefulSet.Status.ReadyReplicas = readyReplicas
+	require.NoError(t, r.Status().Update(context.Background(), &statefulSet))
+}
+
+func finishRestoreJob(t *testing.T, r *TeamCityRestoreReconciler, conditionType batchv1.JobConditionType) {
+	var job batchv1.Job
+	require.NoError(t, r.Get(context.Background(), types.NamespacedName{Name: "restore-restore", Namespace: testNamespace}, &job))
+	job.Status.Conditions = append(job.Status.Conditions, batchv1.JobCondition{Type: conditionType, Status: v12.ConditionTrue})
+	require.NoError(t, r.Status().Update(context.Background(), &job))
+}
+
+func TestRestoreStopsRestoresAndStartsTheInstance(t *testing.T) {
+	r := newRestoreTestReconciler(t, newRestoreTestTeamCity(), newRestoreTestStatefulSet(1, 1),
+		newTestRestore(RestoreSource{FileName: "TeamCity_Backup.zip"}))
+
+	_, restore := reconcileRestore(t, r)
+	assert.Equal(t, RestorePhaseStopping, restore.Status.Phase)
+	assert.Equal(t, "/storage/backup/TeamCity_Backup.zip", restore.Status.BackupFile)
+
+	_, restore = reconcileRestore(t, r)
+	assert.Equal(t, RestorePhaseStopping, restore.Status.Phase)
+	instance := getRestoreTestTeamCity(t, r)
+	assert.Equal(t, RestoreModeStopped, instance.Annotations[RestoreModeAnnotationKey])
+
+	setStatefulSetStatus(t, r, 0, 0)
+	_, restore = reconcileRestore(t, r)
+	assert.Equal(t, RestorePhaseRestoring, restore.Status.Phase)
+	var job batchv1.Job
+	require.NoError(t, r.Get(context.Background(), types.NamespacedName{Name: restore.Status.JobName, Namespace: testNamespace}, &job))
+	assert.Equal(t, "restore", job.OwnerReferences[0].Name)
+
+	finishRestoreJob(t, r, batchv1.JobComplete)
+	_, restore = reconcileRestore(t, r)
+	assert.Equal(t, RestorePhaseStarting, restore.Status.Phase)
+	instance = getRestoreTestTeamCity(t, r)
+	assert.Equal(t, RestoreModeStarting, instance.Annotations[RestoreModeAnnotationKey])
+
+	setStatefulSetStatus(t, r, 1, 1)
+	result, restore := reconcileRestore(t, r)
+	assert.Equal(t, RestorePhaseSucceeded, restore.Status.Phase)
+	assert.NotNil(t, restore.Status.CompletionTime)
+	assert.Zero(t, result.RequeueAfter)
+	instance = getRestoreTestTeamCity(t, r)
+	assert.NotContains(t, instance.Annotations, RestoreModeAnnotationKey)
+}
+
+func TestRestoreFailureKeepsInstanceStopped(t *testing.T) {
+	r := newRestoreTestReconciler(t, newRestoreTestTeamCity(), newRestoreTestStatefulSet(0, 0),
+		newTestRestore(RestoreSource{FileName: "TeamCity_Backup.zip"}))
+
+	reconcileRestore(t, r)
+	_, restore := reconcileRestore(t, r)
+	require.Equal(t, RestorePhaseRestoring, restore.Status.Phase)
+
+	finishRestoreJob(t, r, batchv1.JobFailed)
+	_, restore = reconcileRestore(t, r)
+	assert.Equal(t, RestorePhaseFailed, restore.Status.Phase)
+	assert.Contains(t, restore.Status.Message, RestoreModeAnnotationKey)
+	instance := getRestoreTestTeamCity(t, r)
+	assert.Equal(t, RestoreModeStopped, instance.Annotations[RestoreModeAnnotationKey])
+}
+
+func TestRestoreWaitsForBackupRef(t *testing.T) {
+	backup := &TeamCityBackup{
+		ObjectMeta: metav1.ObjectMeta{Name: "nightly", Namespace: testNamespace},
+		Spec:       TeamCityBackupSpec{TeamCityRef: "tc"},
+		Status:     TeamCityBackupStatus{Phase: BackupPhaseRunning},
+	}
+	r := newRestoreTestReconciler(t, newRestoreTestTeamCity(), backup, newTestRestore(RestoreSource{BackupRef: "nightly"}))
+
+	result, restore := reconcileRestore(t, r)
+	assert.Equal(t, RestorePhasePending, restore.Status.Phase)
+	assert.Equal(t, restorePollInterval, result.RequeueAfter)
+
+	backup.Status = TeamCityBackupStatus{Phase: BackupPhaseSucceeded, FileName: "TeamCity_Backup_20240301.zip"}
+	require.NoError(t, r.Status().Update(context.Background(), backup))
+	_, restore = reconcileRestore(t, r)
+	assert.Equal(t, RestorePhaseStopping, restore.Status.Phase)
+	assert.Equal(t, "/storage/backup/TeamCity_Backup_20240301.zip", restore.Status.BackupFile)
+}
+
+func TestRestoreRejectsInvalidSpec(t *testing.T) {
+	otherDatabase := newTestRestore(RestoreSource{FileName: "TeamCity_Backup.zip"})
+	otherDatabase.Spec.DatabaseSecret = "other-db"
+
+	for name, tt := range map[string]struct {
+		instance *TeamCity
+		restore  *TeamCityRestore
+	}{
+		"no source":          {newRestoreTestTeamCity(), newTestRestore(RestoreSource{})},
+		"two sources":        {newRestoreTestTeamCity(), newTestRestore(RestoreSource{FileName: "a.zip", BackupRef: "nightly"})},
+		"claim without path": {newRestoreTestTeamCity(), newTestRestore(RestoreSource{PersistentVolumeClaim: &RestoreSourceVolume{ClaimName: "backups"}})},
+		"no database secret": {newScheduleTestTeamCity(), newTestRestore(RestoreSource{FileName: "TeamCity_Backup.zip"})},
+		"other database":     {newRestoreTestTeamCity(), otherDatabase},
+	} {
+		t.Run(name, func(t *testing.T) {
+			r := newRestoreTestReconciler(t, tt.instance, tt.restore)
+			_, got := reconcileRestore(t, r)
+			assert.Equal(t, RestorePhaseFailed, got.Status.Phase)
+			instance := getRestoreTestTeamCity(t, r)
+			assert.False(t, instance.InRestoreMode())
+		})
+	}
+}
+
+func TestRestoreDefaultsToTheDatabaseOfTheTeamCity(t *testing.T) {
+	restore := newTestRestore(RestoreSource{FileName: "TeamCity_Backup.zip"})
+	restore.Spec.DatabaseSecret = ""
+	r := newRestoreTestReconciler(t, newRestoreTestTeamCity(), newRestoreTestStatefulSet(0, 0), restore)
+
+	_, got := reconcileRestore(t, r)
+	require.Equal(t, RestorePhaseStopping, got.Status.Phase)
+	_, got = reconcileRestore(t, r)
+	require.Equal(t, RestorePhaseRestoring, got.Status.Phase)
+
+	var job batchv1.Job
+	require.NoError(t, r.Get(context.Background(), types.NamespacedName{Name: "restore-restore", Namespace: testNamespace}, &job))
+	var secrets []string
+	for _, env := range job.Spec.Template.Spec.Containers[0].Env {
+		if env.ValueFrom != nil && env.ValueFrom.SecretKeyRef != nil {
+			secrets = append(secrets, env.ValueFrom.SecretKeyRef.Name)
+		}
+	}
+	assert.Contains(t, secrets, "target-db")
+}
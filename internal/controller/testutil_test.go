@@ -0,0 +1,55 @@
+package controller
+
+import (
+	"testing"
+
+	. "git.jetbrains.team/tch/teamcity-operator/api/v1beta1"
+	"github.com/stretchr/testify/require"
+	v1 "k8s.io/api/apps/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/utils/pointer"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+// testNamespace is the namespace of the objects the controller tests create.
+const testNamespace = "default"
+
+func newTestScheme(t *testing.T) *runtime.Scheme {
+	testScheme := runtime.NewScheme()
+	require.NoError(t, clientgoscheme.AddToScheme(testScheme))
+	require.NoError(t, AddToScheme(testScheme))
+	return testScheme
+}
+
+// newTestTeamcityReconciler returns a TeamCity reconciler on a fake client that holds the objects.
+func newTestTeamcityReconciler(t *testing.T, objects ...client.Object) *TeamcityReconciler {
+	testScheme := newTestScheme(t)
+	return &TeamcityReconciler{
+		Client: fake.NewClientBuilder().
+			WithScheme(testScheme).
+			WithObjects(objects...).
+			WithStatusSubresource(&TeamCity{}).
+			Build(),
+		Scheme: testScheme,
+	}
+}
+
+// newTestTeamCity returns the TeamCity "tc" with only the main node "main".
+func newTestTeamCity() *TeamCity {
+	return &TeamCity{
+		ObjectMeta: metav1.ObjectMeta{Name: "tc", Namespace: testNamespace},
+		Spec:       TeamCitySpec{MainNode: Node{Name: "main"}},
+	}
+}
+
+// newTestStatefulSet returns a node StatefulSet whose replicas are all ready.
+func newTestStatefulSet(name string, replicas int32) *v1.StatefulSet {
+	return &v1.StatefulSet{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: testNamespace},
+		Spec:       v1.StatefulSetSpec{Replicas: pointer.Int32(replicas)},
+		Status:     v1.StatefulSetStatus{Replicas: replicas, ReadyReplicas: replicas},
+	}
+}
@@ -4,11 +4,13 @@ import (
 	"context"
 	. "git.jetbrains.team/tch/teamcity-operator/api/v1beta1"
 	"git.jetbrains.team/tch/teamcity-operator/internal/checkpoint"
+	"git.jetbrains.team/tch/teamcity-operator/internal/metrics"
 	"git.jetbrains.team/tch/teamcity-operator/internal/resource"
 	v1 "k8s.io/api/apps/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/types"
 	"reflect"
+	"sigs.k8s.io/controller-runtime/pkg/client"
 )
 
 func getTeamCityObjectE(r *TeamcityReconciler, ctx context.Context, namespacedName types.NamespacedName) (teamcity TeamCity, err error) {
@@ -23,7 +25,18 @@ func updateTeamCityObjectStatusE(r *TeamcityReconciler, ctx context.Context, nam
 	if teamcity, err = getTeamCityObjectE(r, ctx, namespacedName); err != nil {
 		return err
 	}
-	teamcityStatus := TeamCityStatus{State: state, Message: status}
+	teamcityStatus := *teamcity.Status.DeepCopy()
+	teamcityStatus.State = state
+	teamcityStatus.Message = status
+	teamcityStatus.ObservedGeneration = teamcity.Generation
+	if teamcityStatus.Nodes, err = collectNodeStatuses(r, ctx, &teamcity); err != nil {
+		return err
+	}
+	teamcityStatus.ReadyNodes = readyNodesSummary(teamcityStatus.Nodes)
+	metrics.SetNodes(teamcity.Namespace, teamcity.Name, countReadyNodes(teamcityStatus.Nodes), len(teamcityStatus.Nodes))
+	teamcityStatus.CurrentImage = mainNodeImage(teamcityStatus.Nodes)
+	upgradeStage, upgradeInProgress := currentUpgradeStage(r, ctx, &teamcity)
+	setStatusConditions(&teamcityStatus, teamcity.Generation, upgradeStage, upgradeInProgress)
 	if !reflect.DeepEqual(teamcity.Status, teamcityStatus) {
 		teamcity.Status = teamcityStatus
 		err = r.Status().Update(ctx, &teamcity)
@@ -57,10 +70,32 @@ func isNodeUpdateFinished(r *TeamcityReconciler, ctx context.Context, namespaced
 	if statefulSet, err = getStatefulSetByName(r, ctx, namespacedName); err != nil {
 		return false, err
 	}
-	if statefulSet.Status.CurrentRevision == statefulSet.Status.UpdateRevision && statefulSet.Status.ReadyReplicas == int32(1) {
-		return true, nil
+	return isStatefulSetUpdateFinished(&statefulSet), nil
+}
+
+// mainNodeServerReady reports whether TeamCity on the main node answers its readiness check, and the version it runs.
+// The pod probes come from the NodeSpec and may pass while the server still starts or waits on the maintenance page
+// for a data upgrade. Without spec.apiTokenSecret the server is not asked and counts as ready.
+func mainNodeServerReady(r *TeamcityReconciler, ctx context.Context, instance *TeamCity) (ready bool, version string, err error) {
+	if !instance.APITokenSecretProvided() {
+		return true, "", nil
+	}
+	tcClient, err := r.clientFactory()(ctx, r.Client, instance)
+	if err != nil {
+		return false, "", err
+	}
+	if ready, err = tcClient.IsReady(ctx); err != nil || !ready {
+		return false, "", err
 	}
-	return false, nil
+	info, err := tcClient.GetServerInfo(ctx)
+	if err != nil {
+		return false, "", err
+	}
+	return true, info.Version, nil
+}
+
+func isStatefulSetUpdateFinished(statefulSet *v1.StatefulSet) bool {
+	return statefulSet.Status.CurrentRevision == statefulSet.Status.UpdateRevision && statefulSet.Status.ReadyReplicas == int32(1)
 }
 
 func doesNodesUpdateChangeStatefulSetSpec(r *TeamcityReconciler, ctx context.Context, instance *TeamCity) (bool, error) {
@@ -88,3 +123,37 @@ func ongoingZeroDowntimeUpgrade(r *TeamcityReconciler, ctx context.Context, inst
 	}
 	return true
 }
+
+// nodesStopped reports whether no pod of the given nodes is running. A node without a StatefulSet is stopped.
+func nodesStopped(ctx context.Context, reader client.Reader, instance *TeamCity, nodes []Node) (bool, error) {
+	for _, node := range nodes {
+		var statefulSet v1.StatefulSet
+		if err := reader.Get(ctx, node.GetNamespacedNameFromNamespace(instance.Namespace), &statefulSet); err != nil {
+			if errors.IsNotFound(err) {
+				continue
+			}
+			return false, err
+		}
+		if statefulSet.Spec.Replicas == nil || *statefulSet.Spec.Replicas != 0 || statefulSet.Status.Replicas != 0 {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// anyNodeScaledToZero reports whether one of the given nodes is still scaled to zero, e.g. after spec.stopped was cleared.
+func anyNodeScaledToZero(ctx context.Context, reader client.Reader, instance *TeamCity, nodes []Node) (bool, error) {
+	for _, node := range nodes {
+		var statefulSet v1.StatefulSet
+		if err := reader.Get(ctx, node.GetNamespacedNameFromNamespace(instance.Namespace), &statefulSet); err != nil {
+			if errors.IsNotFound(err) {
+				continue
+			}
+			return false, err
+		}
+		if statefulSet.Spec.Replicas != nil && *statefulSet.Spec.Replicas == 0 {
+			return true, nil
+		}
+	}
+	return false, nil
+}
@@ -29,6 +29,11 @@ func GetStatefulSetLabels(instanceName string, nodeName string, nodeRole string,
 	return mergeLabels(commonStatefulSetLabels, nodeNameLabel)
 }
 
+// GetNodeSelectorLabels select the pods of a single TeamCity node, whatever its role.
+func GetNodeSelectorLabels(instanceName string, nodeName string) Labels {
+	return mergeLabels(getDefaultLabelsFromInstanceName(instanceName), getNodeNameLabel(nodeName))
+}
+
 func GetStatefulSetCommonLabels(instanceName string, nodeRole string, instanceLabels map[string]string) Labels {
 	commonLabels := GetLabels(instanceName, instanceLabels)
 	nodeResponsibility := getNodeResponsibilityLabel(nodeRole)
@@ -64,3 +69,47 @@ func mergeLabels(l1 Labels, l2 Labels) Labels {
 	}
 	return merged
 }
+
+// GetManagedDatabaseSelectorLabels select the PostgreSQL pod of spec.managedDatabase. The component differs from
+// the server labels, so the database is never mistaken for an obsolete node, Service or PVC of the instance.
+func GetManagedDatabaseSelectorLabels(instanceName string) Labels {
+	return Labels{
+		"app.kubernetes.io/name":      instanceName,
+		"app.kubernetes.io/component": "database",
+		"app.kubernetes.io/part-of":   "teamcity",
+	}
+}
+
+func GetManagedDatabaseLabels(instanceName string, instanceLabels map[string]string) Labels {
+	labels := GetManagedDatabaseSelectorLabels(instanceName)
+	for key, value := range instanceLabels {
+		if _, isLabelPresent := labels[key]; !isLabelPresent {
+			labels[key] = value
+		}
+	}
+	return labels
+}
+
+func getDefaultAgentPoolLabels(poolName string) Labels {
+	return Labels{
+		"app.kubernetes.io/name":      poolName,
+		"app.kubernetes.io/component": "teamcity-agent",
+		"app.kubernetes.io/part-of":   "teamcity",
+	}
+}
+
+// GetAgentPoolSelectorLabels are the labels selecting the agent pods of a TeamCityAgentPool.
+// The component differs from the server labels, so Services of the TeamCity never select agents.
+func GetAgentPoolSelectorLabels(poolName string) Labels {
+	return getDefaultAgentPoolLabels(poolName)
+}
+
+func GetAgentPoolLabels(poolName string, poolLabels map[string]string) Labels {
+	labels := getDefaultAgentPoolLabels(poolName)
+	for key, value := range poolLabels {
+		if _, isLabelPresent := labels[key]; !isLabelPresent {
+			labels[key] = value
+		}
+	}
+	return labels
+}
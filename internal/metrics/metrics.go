@@ -0,0 +1,165 @@
+package metrics
+
+import (
+	"sync"
+	"time"
+
+	"git.jetbrains.team/tch/teamcity-operator/internal/checkpoint"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	namespace = "teamcity_operator"
+
+	labelNamespace = "namespace"
+	labelName      = "name"
+	labelStage     = "stage"
+)
+
+var (
+	// UpgradeStage is 1 for the current zero-downtime checkpoint stage of an instance, named by the stage label.
+	// Only the current stage has a series, and it is removed when no upgrade is ongoing.
+	UpgradeStage = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "upgrade_stage",
+		Help:      "Current zero-downtime upgrade checkpoint stage of a TeamCity instance, set to 1 for the stage in the label.",
+	}, []string{labelNamespace, labelName, labelStage})
+
+	// UpgradeStageDuration is the time an instance spent in a zero-downtime checkpoint stage before moving on.
+	UpgradeStageDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "upgrade_stage_duration_seconds",
+		Help:      "Time spent by a TeamCity instance in a zero-downtime upgrade checkpoint stage.",
+		Buckets:   prometheus.ExponentialBuckets(5, 2, 10),
+	}, []string{labelNamespace, labelName, labelStage})
+
+	// UpgradeRollbacks counts zero-downtime upgrades rolled back because the stage in the label timed out.
+	UpgradeRollbacks = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "upgrade_rollbacks_total",
+		Help:      "Number of zero-downtime upgrades rolled back after a checkpoint stage timed out.",
+	}, []string{labelNamespace, labelName, labelStage})
+
+	// StatefulSetRecreations counts StatefulSets deleted by the operator to change immutable fields.
+	StatefulSetRecreations = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "statefulset_recreations_total",
+		Help:      "Number of StatefulSets recreated because immutable fields changed.",
+	}, []string{labelNamespace, labelName})
+
+	// StatefulSetRecreationsBlocked counts reconciliations stopped because a recreate was required but not allowed.
+	StatefulSetRecreationsBlocked = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "statefulset_recreations_blocked_total",
+		Help:      "Number of StatefulSet recreations blocked because the allow-sts-recreate annotation is missing.",
+	}, []string{labelNamespace, labelName})
+
+	// ReadyNodes is the number of TeamCity nodes of an instance that finished their rollout.
+	ReadyNodes = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "ready_nodes",
+		Help:      "Number of ready TeamCity nodes of an instance.",
+	}, []string{labelNamespace, labelName})
+
+	// Nodes is the number of TeamCity nodes declared in the spec of an instance.
+	Nodes = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "nodes",
+		Help:      "Number of TeamCity nodes declared for an instance.",
+	}, []string{labelNamespace, labelName})
+
+	stages = newStageTracker(time.Now)
+)
+
+// Register adds the TeamCity collectors to the registry served by the manager.
+func Register(registry prometheus.Registerer) {
+	registry.MustRegister(
+		UpgradeStage,
+		UpgradeStageDuration,
+		UpgradeRollbacks,
+		StatefulSetRecreations,
+		StatefulSetRecreationsBlocked,
+		ReadyNodes,
+		Nodes,
+	)
+}
+
+// ObserveUpgradeStage records that the instance is currently in the given stage.
+// When the stage changed since the previous call, the time spent in the previous stage is observed and its series removed.
+func ObserveUpgradeStage(instanceNamespace string, instanceName string, stage checkpoint.Stage) {
+	UpgradeStage.WithLabelValues(instanceNamespace, instanceName, stage.String()).Set(1)
+	if previous, spent, changed := stages.enter(instanceNamespace+"/"+instanceName, stage); changed {
+		UpgradeStage.DeleteLabelValues(instanceNamespace, instanceName, previous.String())
+		UpgradeStageDuration.WithLabelValues(instanceNamespace, instanceName, previous.String()).Observe(spent.Seconds())
+	}
+}
+
+// FinishUpgrade observes the last stage of the instance and removes its stage series.
+func FinishUpgrade(instanceNamespace string, instanceName string) {
+	if previous, spent, ok := stages.forget(instanceNamespace + "/" + instanceName); ok {
+		UpgradeStageDuration.WithLabelValues(instanceNamespace, instanceName, previous.String()).Observe(spent.Seconds())
+	}
+	UpgradeStage.DeletePartialMatch(prometheus.Labels{labelNamespace: instanceNamespace, labelName: instanceName})
+}
+
+// SetNodes records the number of declared and ready nodes of the instance.
+func SetNodes(instanceNamespace string, instanceName string, ready int, total int) {
+	ReadyNodes.WithLabelValues(instanceNamespace, instanceName).Set(float64(ready))
+	Nodes.WithLabelValues(instanceNamespace, instanceName).Set(float64(total))
+}
+
+// ForgetInstance removes every per-instance series, e.g. after the instance was deleted.
+func ForgetInstance(instanceNamespace string, instanceName string) {
+	stages.forget(instanceNamespace + "/" + instanceName)
+	labels := prometheus.Labels{labelNamespace: instanceNamespace, labelName: instanceName}
+	UpgradeStage.DeletePartialMatch(labels)
+	UpgradeStageDuration.DeletePartialMatch(labels)
+	UpgradeRollbacks.DeletePartialMatch(labels)
+	StatefulSetRecreations.Delete(labels)
+	StatefulSetRecreationsBlocked.Delete(labels)
+	ReadyNodes.Delete(labels)
+	Nodes.Delete(labels)
+}
+
+// stageTracker remembers when an instance entered its current stage.
+// The state lives in memory only, so after an operator restart the current stage is timed from the first reconciliation.
+type stageTracker struct {
+	mu      sync.Mutex
+	now     func() time.Time
+	entered map[string]stageEntry
+}
+
+type stageEntry struct {
+	stage checkpoint.Stage
+	since time.Time
+}
+
+func newStageTracker(now func() time.Time) *stageTracker {
+	return &stageTracker{now: now, entered: map[string]stageEntry{}}
+}
+
+func (t *stageTracker) enter(key string, stage checkpoint.Stage) (checkpoint.Stage, time.Duration, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := t.now()
+	current, ok := t.entered[key]
+	if ok && current.stage == stage {
+		return stage, 0, false
+	}
+	t.entered[key] = stageEntry{stage: stage, since: now}
+	if !ok {
+		return stage, 0, false
+	}
+	return current.stage, now.Sub(current.since), true
+}
+
+func (t *stageTracker) forget(key string) (checkpoint.Stage, time.Duration, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	current, ok := t.entered[key]
+	if !ok {
+		return 0, 0, false
+	}
+	delete(t.entered, key)
+	return current.stage, t.now().Sub(current.since), true
+}
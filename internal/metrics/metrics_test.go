@@ -0,0 +1,62 @@
+package metrics
+
+import (
+	"testing"
+	"time"
+
+	"git.jetbrains.team/tch/teamcity-operator/internal/checkpoint"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStageTrackerMeasuresTimeInPreviousStage(t *testing.T) {
+	now := time.Date(2024, 1, 1, 10, 0, 0, 0, time.UTC)
+	tracker := newStageTracker(func() time.Time { return now })
+
+	_, _, changed := tracker.enter("default/tc", checkpoint.UpdateInitiated)
+	assert.False(t, changed, "first observation has no previous stage")
+
+	now = now.Add(30 * time.Second)
+	_, _, changed = tracker.enter("default/tc", checkpoint.UpdateInitiated)
+	assert.False(t, changed, "same stage must not be observed twice")
+
+	now = now.Add(30 * time.Second)
+	previous, spent, changed := tracker.enter("default/tc", checkpoint.ReplicaCreated)
+	assert.True(t, changed)
+	assert.Equal(t, checkpoint.UpdateInitiated, previous)
+	assert.Equal(t, time.Minute, spent)
+
+	now = now.Add(10 * time.Second)
+	previous, spent, ok := tracker.forget("default/tc")
+	assert.True(t, ok)
+	assert.Equal(t, checkpoint.ReplicaCreated, previous)
+	assert.Equal(t, 10*time.Second, spent)
+
+	_, _, ok = tracker.forget("default/tc")
+	assert.False(t, ok)
+}
+
+func TestObserveUpgradeStageSetsAndRemovesGauge(t *testing.T) {
+	ObserveUpgradeStage("metrics-test", "tc", checkpoint.ReplicaStarting)
+	assert.Equal(t, float64(1), testutil.ToFloat64(UpgradeStage.WithLabelValues("metrics-test", "tc", checkpoint.ReplicaStarting.String())))
+
+	// only the current stage has a series
+	ObserveUpgradeStage("metrics-test", "tc", checkpoint.ReplicaReady)
+	assert.Equal(t, 1, testutil.CollectAndCount(UpgradeStage, "teamcity_operator_upgrade_stage"))
+	assert.Equal(t, float64(1), testutil.ToFloat64(UpgradeStage.WithLabelValues("metrics-test", "tc", checkpoint.ReplicaReady.String())))
+	assert.Equal(t, 1, testutil.CollectAndCount(UpgradeStageDuration, "teamcity_operator_upgrade_stage_duration_seconds"))
+
+	FinishUpgrade("metrics-test", "tc")
+	assert.Equal(t, 0, testutil.CollectAndCount(UpgradeStage, "teamcity_operator_upgrade_stage"))
+	assert.Equal(t, 2, testutil.CollectAndCount(UpgradeStageDuration, "teamcity_operator_upgrade_stage_duration_seconds"))
+
+	ForgetInstance("metrics-test", "tc")
+	assert.Equal(t, 0, testutil.CollectAndCount(UpgradeStageDuration, "teamcity_operator_upgrade_stage_duration_seconds"))
+}
+
+func TestSetNodes(t *testing.T) {
+	SetNodes("metrics-test", "nodes", 1, 2)
+	assert.Equal(t, float64(1), testutil.ToFloat64(ReadyNodes.WithLabelValues("metrics-test", "nodes")))
+	assert.Equal(t, float64(2), testutil.ToFloat64(Nodes.WithLabelValues("metrics-test", "nodes")))
+	ForgetInstance("metrics-test", "nodes")
+}
@@ -88,12 +88,19 @@ func shouldFilterOutUpdateEventForStatefulSet(event event.UpdateEvent) bool {
 		return false
 	}
 	//if spec of StatefulSet did not change, the event is ignored
+	//unless the rollout progress reported in TeamCity status changed
 	if equal(oldStatefulSet.Spec, newStatefulSet.Spec) {
-		return false
+		return rolloutStatusChanged(oldStatefulSet.Status, newStatefulSet.Status)
 	}
 	return true
 }
 
+func rolloutStatusChanged(old, updated v1.StatefulSetStatus) bool {
+	return old.ReadyReplicas != updated.ReadyReplicas ||
+		old.CurrentRevision != updated.CurrentRevision ||
+		old.UpdateRevision != updated.UpdateRevision
+}
+
 func equal(x, y interface{}) bool {
 	//DeepEqual is not always capable of detecting identical objects due to various defaults and type conversions
 	//DeepDerivative is more reliable way since it does not care for defaults and types as much
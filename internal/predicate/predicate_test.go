@@ -102,6 +102,20 @@ var _ = Describe("Predicate", func() {
 				})
 				Expect(result).To(Equal(false))
 			})
+			By("returning true when ready replicas change without a Spec change", func() {
+				result := predicate.Update(event.UpdateEvent{
+					ObjectOld: &v1.StatefulSet{Status: v1.StatefulSetStatus{ReadyReplicas: 0, CurrentRevision: "rev-1", UpdateRevision: "rev-1"}},
+					ObjectNew: &v1.StatefulSet{Status: v1.StatefulSetStatus{ReadyReplicas: 1, CurrentRevision: "rev-1", UpdateRevision: "rev-1"}},
+				})
+				Expect(result).To(Equal(true))
+			})
+			By("returning true when the rollout revision changes without a Spec change", func() {
+				result := predicate.Update(event.UpdateEvent{
+					ObjectOld: &v1.StatefulSet{Status: v1.StatefulSetStatus{ReadyReplicas: 1, CurrentRevision: "rev-1", UpdateRevision: "rev-2"}},
+					ObjectNew: &v1.StatefulSet{Status: v1.StatefulSetStatus{ReadyReplicas: 1, CurrentRevision: "rev-2", UpdateRevision: "rev-2"}},
+				})
+				Expect(result).To(Equal(true))
+			})
 			By("returning false when update event has different objects", func() {
 				result := predicate.Update(event.UpdateEvent{
 					ObjectOld: &v1.StatefulSet{Spec: v1.StatefulSetSpec{Template: v12.PodTemplateSpec{Spec: v12.PodSpec{Containers: []v12.Container{{Image: "nginx"}}}}}},
@@ -0,0 +1,103 @@
+package resource
+
+import (
+	. "git.jetbrains.team/tch/teamcity-operator/api/v1beta1"
+	"git.jetbrains.team/tch/teamcity-operator/internal/metadata"
+	v1 "k8s.io/api/apps/v1"
+	v12 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/utils/pointer"
+)
+
+const (
+	AgentContainerName = "teamcity-agent"
+	// AgentWorkDirPath is the checkout directory of the jetbrains/teamcity-agent image
+	AgentWorkDirPath = "/opt/buildagent/work"
+	AgentTempDirPath = "/opt/buildagent/temp"
+
+	agentWorkVolumeName = "work"
+	agentTempVolumeName = "temp"
+)
+
+// ConfigureAgentDeployment sets the desired state of the Deployment running the agents of pool.
+func ConfigureAgentDeployment(pool *TeamCityAgentPool, replicas int32, serverURL string, deployment *v1.Deployment) {
+	deployment.Labels = metadata.GetAgentPoolLabels(pool.Name, pool.Labels)
+	deployment.Spec.Replicas = pointer.Int32(replicas)
+	deployment.Spec.Selector = &metav1.LabelSelector{MatchLabels: metadata.GetAgentPoolSelectorLabels(pool.Name)}
+	deployment.Spec.Template = buildAgentPodTemplate(pool, serverURL)
+}
+
+// ConfigureAgentStatefulSet sets the desired state of the StatefulSet running the agents of pool. Every agent gets
+// a claim from spec.workVolumeClaim; the claim template is immutable, so it is only set on a new StatefulSet.
+func ConfigureAgentStatefulSet(pool *TeamCityAgentPool, replicas int32, serverURL string, statefulSet *v1.StatefulSet) {
+	statefulSet.Labels = metadata.GetAgentPoolLabels(pool.Name, pool.Labels)
+	statefulSet.Spec.Replicas = pointer.Int32(replicas)
+	statefulSet.Spec.Selector = &metav1.LabelSelector{MatchLabels: metadata.GetAgentPoolSelectorLabels(pool.Name)}
+	statefulSet.Spec.PodManagementPolicy = v1.ParallelPodManagement
+	statefulSet.Spec.Template = buildAgentPodTemplate(pool, serverURL)
+	if statefulSet.CreationTimestamp.IsZero() {
+		statefulSet.Spec.VolumeClaimTemplates = []v12.PersistentVolumeClaim{
+			{
+				ObjectMeta: metav1.ObjectMeta{Name: agentWorkVolumeName},
+				Spec:       *pool.Spec.WorkVolumeClaim.DeepCopy(),
+			},
+		}
+	}
+}
+
+// buildAgentPodTemplate builds the agent pods. AGENT_NAME is the pod name, which is how the operator finds
+// the agents of the pool on the server.
+func buildAgentPodTemplate(pool *TeamCityAgentPool, serverURL string) v12.PodTemplateSpec {
+	env := []v12.EnvVar{
+		{Name: "SERVER_URL", Value: serverURL},
+		{
+			Name: "AGENT_NAME",
+			ValueFrom: &v12.EnvVarSource{
+				FieldRef: &v12.ObjectFieldSelector{FieldPath: "metadata.name"},
+			},
+		},
+	}
+	env = append(env, pool.Spec.Env...)
+
+	volumeMounts := []v12.VolumeMount{
+		{Name: agentWorkVolumeName, MountPath: AgentWorkDirPath},
+		{Name: agentTempVolumeName, MountPath: AgentTempDirPath},
+	}
+	volumes := []v12.Volume{
+		{
+			Name:         agentTempVolumeName,
+			VolumeSource: v12.VolumeSource{EmptyDir: &v12.EmptyDirVolumeSource{SizeLimit: pool.Spec.TempSizeLimit}},
+		},
+	}
+	if !pool.UsesStatefulSet() {
+		volumes = append(volumes, v12.Volume{
+			Name:         agentWorkVolumeName,
+			VolumeSource: v12.VolumeSource{EmptyDir: &v12.EmptyDirVolumeSource{}},
+		})
+	}
+
+	return v12.PodTemplateSpec{
+		ObjectMeta: metav1.ObjectMeta{Labels: metadata.GetAgentPoolLabels(pool.Name, pool.Labels)},
+		Spec: v12.PodSpec{
+			SecurityContext:    pool.Spec.PodSecurityContext,
+			ServiceAccountName: pool.Spec.ServiceAccountName,
+			NodeSelector:       pool.Spec.NodeSelector,
+			Affinity:           pool.Spec.Affinity,
+			Tolerations:        pool.Spec.Tolerations,
+			Containers: []v12.Container{
+				{
+					Name:            AgentContainerName,
+					Image:           pool.Spec.Image,
+					ImagePullPolicy: v12.PullIfNotPresent,
+					Env:             env,
+					Resources: v12.ResourceRequirements{
+						Requests: pool.Spec.Requests,
+						Limits:   pool.Spec.Limits,
+					},
+					VolumeMounts: volumeMounts,
+				},
+			},
+			Volumes: volumes,
+		},
+	}
+}
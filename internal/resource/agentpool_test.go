@@ -0,0 +1,81 @@
+package resource
+
+import (
+	. "git.jetbrains.team/tch/teamcity-operator/api/v1beta1"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	v1 "k8s.io/api/apps/v1"
+	v12 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+var _ = Describe("AgentPool", func() {
+	newPool := func() *TeamCityAgentPool {
+		return &TeamCityAgentPool{
+			ObjectMeta: metav1.ObjectMeta{Name: "linux", Namespace: "default"},
+			Spec: TeamCityAgentPoolSpec{
+				TeamCityRef: "tc",
+				Image:       "jetbrains/teamcity-agent:2024.12",
+				Env:         []v12.EnvVar{{Name: "DOCKER_IN_DOCKER", Value: "start"}},
+			},
+		}
+	}
+
+	It("points the agents at the server and names them after their pods", func() {
+		var deployment v1.Deployment
+		ConfigureAgentDeployment(newPool(), 3, "http://tc.default.svc:8111", &deployment)
+
+		Expect(*deployment.Spec.Replicas).To(Equal(int32(3)))
+		Expect(deployment.Spec.Selector.MatchLabels).To(HaveKeyWithValue("app.kubernetes.io/component", "teamcity-agent"))
+		container := deployment.Spec.Template.Spec.Containers[0]
+		Expect(container.Image).To(Equal("jetbrains/teamcity-agent:2024.12"))
+		Expect(container.Env[0]).To(Equal(v12.EnvVar{Name: "SERVER_URL", Value: "http://tc.default.svc:8111"}))
+		Expect(container.Env[1].ValueFrom.FieldRef.FieldPath).To(Equal("metadata.name"))
+		Expect(container.Env).To(ContainElement(v12.EnvVar{Name: "DOCKER_IN_DOCKER", Value: "start"}))
+	})
+
+	It("keeps work and temp directories on empty dirs for Deployments", func() {
+		pool := newPool()
+		limit := resource.MustParse("5Gi")
+		pool.Spec.TempSizeLimit = &limit
+		var deployment v1.Deployment
+		ConfigureAgentDeployment(pool, 1, "http://tc", &deployment)
+
+		podSpec := deployment.Spec.Template.Spec
+		Expect(podSpec.Containers[0].VolumeMounts).To(ConsistOf(
+			v12.VolumeMount{Name: "work", MountPath: AgentWorkDirPath},
+			v12.VolumeMount{Name: "temp", MountPath: AgentTempDirPath},
+		))
+		Expect(podSpec.Volumes).To(HaveLen(2))
+		for _, volume := range podSpec.Volumes {
+			Expect(volume.EmptyDir).NotTo(BeNil())
+			if volume.Name == "temp" {
+				Expect(volume.EmptyDir.SizeLimit.String()).To(Equal("5Gi"))
+			}
+		}
+	})
+
+	It("gives every agent of a StatefulSet its own work claim", func() {
+		pool := newPool()
+		pool.Spec.WorkVolumeClaim = &v12.PersistentVolumeClaimSpec{AccessModes: []v12.PersistentVolumeAccessMode{v12.ReadWriteOnce}}
+		var statefulSet v1.StatefulSet
+		ConfigureAgentStatefulSet(pool, 2, "http://tc", &statefulSet)
+
+		Expect(statefulSet.Spec.PodManagementPolicy).To(Equal(v1.ParallelPodManagement))
+		Expect(statefulSet.Spec.VolumeClaimTemplates).To(HaveLen(1))
+		Expect(statefulSet.Spec.VolumeClaimTemplates[0].Name).To(Equal("work"))
+		Expect(statefulSet.Spec.Template.Spec.Volumes).To(HaveLen(1))
+		Expect(statefulSet.Spec.Template.Spec.Volumes[0].Name).To(Equal("temp"))
+	})
+
+	It("does not change the claim template of an existing StatefulSet", func() {
+		pool := newPool()
+		pool.Spec.WorkVolumeClaim = &v12.PersistentVolumeClaimSpec{AccessModes: []v12.PersistentVolumeAccessMode{v12.ReadWriteMany}}
+		existing := v1.StatefulSet{ObjectMeta: metav1.ObjectMeta{CreationTimestamp: metav1.Now()}}
+		existing.Spec.VolumeClaimTemplates = []v12.PersistentVolumeClaim{{ObjectMeta: metav1.ObjectMeta{Name: "work"}}}
+		ConfigureAgentStatefulSet(pool, 2, "http://tc", &existing)
+
+		Expect(existing.Spec.VolumeClaimTemplates[0].Spec.AccessModes).To(BeEmpty())
+	})
+})
@@ -0,0 +1,88 @@
+package resource
+
+import (
+	"path"
+	"strings"
+
+	. "git.jetbrains.team/tch/teamcity-operator/api/v1beta1"
+	"git.jetbrains.team/tch/teamcity-operator/internal/metadata"
+	batchv1 "k8s.io/api/batch/v1"
+	v12 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/utils/pointer"
+)
+
+const (
+	BackupPruneContainerName = "prune-backups"
+	// PrunedBackupsAnnotationKey lists the TeamCityBackups whose files the Job deletes, comma separated.
+	PrunedBackupsAnnotationKey = "teamcity.jetbrains.com/pruned-backups"
+
+	backupDirectoryName          = "backup"
+	backupPruneJobTTLAfterFinish = 300
+)
+
+// BackupDirectoryPath is the directory TeamCity writes backup files to.
+func BackupDirectoryPath(instance *TeamCity) string {
+	return path.Join(instance.DataDirPath(), backupDirectoryName)
+}
+
+// BuildBackupPruneJob builds a Job that deletes backup files from the data directory.
+// The data directory claim may be ReadWriteOnce, so the pod prefers the node of the main node pod. The affinity is
+// not required, as there is no main node pod while the instance is stopped or hibernating.
+// It runs the TeamCity image, which is already present on that node.
+func BuildBackupPruneJob(instance *TeamCity, name string, namespace string, backups []string, files []string) *batchv1.Job {
+	backupDirectory := BackupDirectoryPath(instance)
+	command := []string{"rm", "-f", "--"}
+	for _, file := range files {
+		command = append(command, path.Join(backupDirectory, path.Base(file)))
+	}
+	mainNode := instance.Spec.MainNode
+	mainNodeLabels := metadata.GetStatefulSetLabels(instance.Name, mainNode.Name, "main", instance.Labels)
+	dataDirClaim := instance.Spec.DataDirVolumeClaim
+
+	return &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: namespace,
+			Labels:    metadata.GetLabels(instance.Name, instance.Labels),
+			Annotations: map[string]string{
+				PrunedBackupsAnnotationKey: strings.Join(backups, ","),
+			},
+		},
+		Spec: batchv1.JobSpec{
+			BackoffLimit:            pointer.Int32(2),
+			TTLSecondsAfterFinished: pointer.Int32(backupPruneJobTTLAfterFinish),
+			Template: v12.PodTemplateSpec{
+				Spec: v12.PodSpec{
+					RestartPolicy:   v12.RestartPolicyNever,
+					SecurityContext: mainNode.Spec.PodSecurityContext.DeepCopy(),
+					Affinity: &v12.Affinity{
+						PodAffinity: &v12.PodAffinity{
+							PreferredDuringSchedulingIgnoredDuringExecution: []v12.WeightedPodAffinityTerm{
+								{
+									Weight: 100,
+									PodAffinityTerm: v12.PodAffinityTerm{
+										LabelSelector: &metav1.LabelSelector{MatchLabels: mainNodeLabels},
+										TopologyKey:   v12.LabelHostname,
+									},
+								},
+							},
+						},
+					},
+					Containers: []v12.Container{
+						{
+							Name:            BackupPruneContainerName,
+							Image:           instance.Spec.Image,
+							ImagePullPolicy: v12.PullIfNotPresent,
+							Command:         command,
+							VolumeMounts: []v12.VolumeMount{
+								{Name: dataDirClaim.Name, MountPath: dataDirClaim.VolumeMount.MountPath},
+							},
+						},
+					},
+					Volumes: []v12.Volume{createVolumeFromCustomPersistentVolumeClaim(dataDirClaim)},
+				},
+			},
+		},
+	}
+}
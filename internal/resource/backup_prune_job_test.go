@@ -0,0 +1,46 @@
+package resource
+
+import (
+	. "git.jetbrains.team/tch/teamcity-operator/api/v1beta1"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	v12 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+var _ = Describe("BackupPruneJob", func() {
+	instance := &TeamCity{
+		ObjectMeta: metav1.ObjectMeta{Name: "tc", Namespace: "default"},
+		Spec: TeamCitySpec{
+			Image:    "jetbrains/teamcity-server:2024.12",
+			MainNode: Node{Name: "main"},
+			DataDirVolumeClaim: CustomPersistentVolumeClaim{
+				Name:        "data",
+				VolumeMount: v12.VolumeMount{Name: "data", MountPath: "/storage"},
+			},
+		},
+	}
+
+	It("deletes only the given files from the backup directory", func() {
+		job := BuildBackupPruneJob(instance, "prune", "default", []string{"b1"}, []string{"b1.zip", "../escape.zip"})
+
+		container := job.Spec.Template.Spec.Containers[0]
+		Expect(container.Command).To(Equal([]string{"rm", "-f", "--", "/storage/backup/b1.zip", "/storage/backup/escape.zip"}))
+		Expect(container.Image).To(Equal(instance.Spec.Image))
+		Expect(container.VolumeMounts).To(ConsistOf(v12.VolumeMount{Name: "data", MountPath: "/storage"}))
+		Expect(job.Spec.Template.Spec.Volumes[0].PersistentVolumeClaim.ClaimName).To(Equal("data"))
+		Expect(job.Annotations[PrunedBackupsAnnotationKey]).To(Equal("b1"))
+	})
+
+	It("prefers the node of the main node pod", func() {
+		job := BuildBackupPruneJob(instance, "prune", "default", nil, nil)
+
+		affinity := job.Spec.Template.Spec.Affinity.PodAffinity
+		Expect(affinity.RequiredDuringSchedulingIgnoredDuringExecution).To(BeEmpty())
+		terms := affinity.PreferredDuringSchedulingIgnoredDuringExecution
+		Expect(terms).To(HaveLen(1))
+		Expect(terms[0].PodAffinityTerm.TopologyKey).To(Equal(v12.LabelHostname))
+		Expect(terms[0].PodAffinityTerm.LabelSelector.MatchLabels).To(HaveKeyWithValue("teamcity.jetbrains.com/node-name", "main"))
+		Expect(terms[0].PodAffinityTerm.LabelSelector.MatchLabels).To(HaveKeyWithValue("teamcity.jetbrains.com/role", "main"))
+	})
+})
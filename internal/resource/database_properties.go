@@ -0,0 +1,107 @@
+package resource
+
+import (
+	"path"
+	"sort"
+	"strings"
+
+	. "git.jetbrains.team/tch/teamcity-operator/api/v1beta1"
+	v12 "k8s.io/api/core/v1"
+)
+
+const (
+	DatabasePropertiesInitContainerName = "database-properties"
+
+	databaseSecretVolumeName      = "teamcity-database-secret"
+	databaseSecretMountPath       = "/run/teamcity/database"
+	databasePropertiesFileEnvVar  = "TEAMCITY_DB_PROPERTIES_FILE"
+	databaseExtraPropertiesEnvVar = "TEAMCITY_DB_PROPERTIES"
+)
+
+// databasePropertiesScript renders database.properties from the mounted Secret, so the credentials never appear
+// in the environment of the server. Backslashes are escaped as the file is read as Java properties.
+const databasePropertiesScript = `set -e
+umask 077
+escape() { sed -e 's/\\/\\\\/g' "` + databaseSecretMountPath + `/$1"; }
+mkdir -p "$(dirname "$` + databasePropertiesFileEnvVar + `")"
+{
+  printf '` + DatabaseURLProperty + `=%s\n' "$(escape url)"
+  printf '` + DatabaseUserProperty + `=%s\n' "$(escape user)"
+  printf '` + DatabasePasswordProperty + `=%s\n' "$(escape password)"
+  printf '%s' "$` + databaseExtraPropertiesEnvVar + `"
+} > "$` + databasePropertiesFileEnvVar + `.tmp"
+mv "$` + databasePropertiesFileEnvVar + `.tmp" "$` + databasePropertiesFileEnvVar + `"
+`
+
+// DatabasePropertiesPath is where TeamCity reads the database settings from.
+func DatabasePropertiesPath(instance *TeamCity) string {
+	return path.Join(instance.DataDirPath(), "config", "database.properties")
+}
+
+// DatabaseSecretVolume projects the connection settings of spec.databaseSecret into the files read by
+// the database-properties init container.
+func DatabaseSecretVolume(instance *TeamCity) v12.Volume {
+	keys := instance.Spec.DatabaseSecret.Keys
+	return v12.Volume{
+		Name: databaseSecretVolumeName,
+		VolumeSource: v12.VolumeSource{
+			Secret: &v12.SecretVolumeSource{
+				SecretName: instance.Spec.DatabaseSecret.Secret,
+				Items: []v12.KeyToPath{
+					{Key: keys.URLKey(), Path: "url"},
+					{Key: keys.UserKey(), Path: "user"},
+					{Key: keys.PasswordKey(), Path: "password"},
+				},
+			},
+		},
+	}
+}
+
+// DatabasePropertiesInitContainer writes database.properties to the config folder of the data directory.
+func DatabasePropertiesInitContainer(instance *TeamCity) v12.Container {
+	dataDirClaim := instance.Spec.DataDirVolumeClaim
+	return v12.Container{
+		Name:            DatabasePropertiesInitContainerName,
+		Image:           instance.Spec.Image,
+		ImagePullPolicy: v12.PullIfNotPresent,
+		Command:         []string{"/bin/sh", "-c", databasePropertiesScript},
+		Env: []v12.EnvVar{
+			{Name: databasePropertiesFileEnvVar, Value: DatabasePropertiesPath(instance)},
+			DatabaseExtraPropertiesEnvVar(instance),
+		},
+		VolumeMounts: []v12.VolumeMount{
+			{Name: dataDirClaim.Name, MountPath: dataDirClaim.VolumeMount.MountPath},
+			{Name: databaseSecretVolumeName, MountPath: databaseSecretMountPath, ReadOnly: true},
+		},
+	}
+}
+
+// DatabaseExtraPropertiesEnvVar passes spec.databaseSecret.properties to the scripts writing database.properties.
+func DatabaseExtraPropertiesEnvVar(instance *TeamCity) v12.EnvVar {
+	return v12.EnvVar{Name: databaseExtraPropertiesEnvVar, Value: FormatDatabaseProperties(instance.Spec.DatabaseSecret.Properties)}
+}
+
+// FormatDatabaseProperties renders properties as Java properties lines, sorted by key.
+func FormatDatabaseProperties(properties map[string]string) string {
+	keys := make([]string, 0, len(properties))
+	for key := range properties {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var lines strings.Builder
+	for _, key := range keys {
+		lines.WriteString(escapeDatabaseProperty(key, true))
+		lines.WriteString("=")
+		lines.WriteString(escapeDatabaseProperty(properties[key], false))
+		lines.WriteString("\n")
+	}
+	return lines.String()
+}
+
+func escapeDatabaseProperty(value string, isKey bool) string {
+	replacements := []string{`\`, `\\`, "\n", `\n`, "\r", `\r`}
+	if isKey {
+		replacements = append(replacements, "=", `\=`, ":", `\:`, " ", `\ `)
+	}
+	return strings.NewReplacer(replacements...).Replace(value)
+}
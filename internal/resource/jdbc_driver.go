@@ -0,0 +1,134 @@
+package resource
+
+import (
+	"fmt"
+	"path"
+
+	. "git.jetbrains.team/tch/teamcity-operator/api/v1beta1"
+	v12 "k8s.io/api/core/v1"
+)
+
+const (
+	JDBCDriverInitContainerName       = "jdbc-driver"
+	JDBCDriverSourceInitContainerName = "jdbc-driver-source"
+
+	jdbcDriverVolumeName    = "teamcity-jdbc-driver"
+	jdbcDriverMountPath     = "/run/teamcity/jdbc"
+	jdbcDriverDirEnvVar     = "TEAMCITY_JDBC_DIR"
+	jdbcDriverFileEnvVar    = "TEAMCITY_JDBC_FILE"
+	jdbcDriverURLEnvVar     = "TEAMCITY_JDBC_URL"
+	jdbcDriverSourceEnvVar  = "TEAMCITY_JDBC_SOURCE"
+	mavenCentralURL         = "https://repo1.maven.org/maven2"
+	jdbcDriverManagedMarker = ".teamcity-operator"
+)
+
+// jdbcDriverScript places the driver in lib/jdbc. The marker file remembers the jar placed last, so that a driver
+// of another version is removed instead of ending up on the classpath next to the new one. Downloads are skipped
+// when the jar is already in place, so nodes restart without Maven Central being reachable.
+const jdbcDriverScript = `set -e
+dir="$` + jdbcDriverDirEnvVar + `"
+file="$` + jdbcDriverFileEnvVar + `"
+marker="$dir/` + jdbcDriverManagedMarker + `"
+mkdir -p "$dir"
+previous=""
+if [ -f "$marker" ]; then previous="$(basename "$(cat "$marker")")"; fi
+if [ -n "$` + jdbcDriverURLEnvVar + `" ] && [ "$previous" = "$file" ] && [ -f "$dir/$file" ]; then exit 0; fi
+if [ -n "$` + jdbcDriverURLEnvVar + `" ]; then
+  curl -fsSL -o "$dir/$file.tmp" "$` + jdbcDriverURLEnvVar + `"
+else
+  cp "$` + jdbcDriverSourceEnvVar + `" "$dir/$file.tmp"
+fi
+mv "$dir/$file.tmp" "$dir/$file"
+if [ -n "$previous" ] && [ "$previous" != "$file" ]; then rm -f "$dir/$previous"; fi
+printf '%s' "$file" > "$marker"
+`
+
+// mavenArtifacts are the Maven Central group and artifact paths of the drivers of spec.jdbcDriver.database.
+var mavenArtifacts = map[JDBCDatabase]string{
+	JDBCDatabasePostgreSQL: "org/postgresql/postgresql",
+	JDBCDatabaseMySQL:      "com/mysql/mysql-connector-j",
+	JDBCDatabaseMSSQL:      "com/microsoft/sqlserver/mssql-jdbc",
+	JDBCDatabaseOracle:     "com/oracle/database/jdbc/ojdbc11",
+}
+
+// JDBCDriverPath is the directory TeamCity loads JDBC drivers from.
+func JDBCDriverPath(instance *TeamCity) string {
+	return path.Join(instance.DataDirPath(), "lib", "jdbc")
+}
+
+// JDBCDriverFileName is the name of the jar in lib/jdbc.
+func JDBCDriverFileName(driver *JDBCDriver) string {
+	switch {
+	case driver.ConfigMap != nil:
+		return path.Base(driver.ConfigMap.Key)
+	case driver.Image != nil:
+		return path.Base(driver.Image.Path)
+	default:
+		return fmt.Sprintf("%s-%s.jar", path.Base(mavenArtifacts[driver.Database]), driver.Version)
+	}
+}
+
+// JDBCDriverDownloadURL is the Maven Central URL of the driver of spec.jdbcDriver.database.
+func JDBCDriverDownloadURL(driver *JDBCDriver) string {
+	artifact := mavenArtifacts[driver.Database]
+	return fmt.Sprintf("%s/%s/%s/%s", mavenCentralURL, artifact, driver.Version, JDBCDriverFileName(driver))
+}
+
+// JDBCDriverInitContainers builds the init containers placing spec.jdbcDriver in the data directory,
+// and the volumes they read the jar from.
+func JDBCDriverInitContainers(instance *TeamCity) ([]v12.Container, []v12.Volume) {
+	driver := instance.Spec.JDBCDriver
+	if driver == nil {
+		return nil, nil
+	}
+	dataDirClaim := instance.Spec.DataDirVolumeClaim
+	fileName := JDBCDriverFileName(driver)
+	install := v12.Container{
+		Name:            JDBCDriverInitContainerName,
+		Image:           instance.Spec.Image,
+		ImagePullPolicy: v12.PullIfNotPresent,
+		Command:         []string{"/bin/sh", "-c", jdbcDriverScript},
+		Env: []v12.EnvVar{
+			{Name: jdbcDriverDirEnvVar, Value: JDBCDriverPath(instance)},
+			{Name: jdbcDriverFileEnvVar, Value: fileName},
+		},
+		VolumeMounts: []v12.VolumeMount{
+			{Name: dataDirClaim.Name, MountPath: dataDirClaim.VolumeMount.MountPath},
+		},
+	}
+	if driver.ConfigMap == nil && driver.Image == nil {
+		install.Env = append(install.Env, v12.EnvVar{Name: jdbcDriverURLEnvVar, Value: JDBCDriverDownloadURL(driver)})
+		return []v12.Container{install}, nil
+	}
+
+	sourcePath := path.Join(jdbcDriverMountPath, fileName)
+	install.Env = append(install.Env, v12.EnvVar{Name: jdbcDriverSourceEnvVar, Value: sourcePath})
+	install.VolumeMounts = append(install.VolumeMounts, v12.VolumeMount{Name: jdbcDriverVolumeName, MountPath: jdbcDriverMountPath, ReadOnly: true})
+
+	if driver.ConfigMap != nil {
+		volume := v12.Volume{
+			Name: jdbcDriverVolumeName,
+			VolumeSource: v12.VolumeSource{
+				ConfigMap: &v12.ConfigMapVolumeSource{
+					LocalObjectReference: v12.LocalObjectReference{Name: driver.ConfigMap.Name},
+					Items:                []v12.KeyToPath{{Key: driver.ConfigMap.Key, Path: fileName}},
+				},
+			},
+		}
+		return []v12.Container{install}, []v12.Volume{volume}
+	}
+
+	// The driver image only needs cp: it copies the jar to an emptyDir the install container reads from.
+	source := v12.Container{
+		Name:            JDBCDriverSourceInitContainerName,
+		Image:           driver.Image.Image,
+		ImagePullPolicy: driver.Image.ImagePullPolicy,
+		Command:         []string{"cp", driver.Image.Path, sourcePath},
+		VolumeMounts:    []v12.VolumeMount{{Name: jdbcDriverVolumeName, MountPath: jdbcDriverMountPath}},
+	}
+	volume := v12.Volume{
+		Name:         jdbcDriverVolumeName,
+		VolumeSource: v12.VolumeSource{EmptyDir: &v12.EmptyDirVolumeSource{}},
+	}
+	return []v12.Container{source, install}, []v12.Volume{volume}
+}
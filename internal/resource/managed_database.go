@@ -0,0 +1,210 @@
+package resource
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+
+	. "git.jetbrains.team/tch/teamcity-operator/api/v1beta1"
+	"git.jetbrains.team/tch/teamcity-operator/internal/metadata"
+	v1 "k8s.io/api/apps/v1"
+	v12 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/utils/pointer"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+)
+
+const (
+	ManagedDatabaseContainerName = "postgresql"
+	ManagedDatabasePort          = 5432
+	ManagedDatabaseUser          = "teamcity"
+	ManagedDatabaseDatabase      = "teamcity"
+
+	managedDatabaseVolumeName     = "data"
+	managedDatabaseMountPath      = "/var/lib/postgresql/data"
+	managedDatabasePasswordLength = 24
+)
+
+// ManagedDatabaseBuilder builds the PostgreSQL StatefulSet, its Service and the credentials Secret of spec.managedDatabase.
+// The Secret has the keys of spec.databaseSecret, so the nodes read it like any other database Secret.
+type ManagedDatabaseBuilder struct {
+	*TeamCityResourceBuilder
+}
+
+func (builder *TeamCityResourceBuilder) ManagedDatabase() *ManagedDatabaseBuilder {
+	return &ManagedDatabaseBuilder{builder}
+}
+
+func (builder *ManagedDatabaseBuilder) BuildObjectList() ([]client.Object, error) {
+	if !builder.Instance.UsesManagedDatabase() {
+		return []client.Object{}, nil
+	}
+	objectMeta := metav1.ObjectMeta{Name: builder.Instance.ManagedDatabaseName(), Namespace: builder.Instance.Namespace}
+	return []client.Object{
+		&v12.Secret{ObjectMeta: objectMeta},
+		&v12.Service{ObjectMeta: objectMeta},
+		&v1.StatefulSet{ObjectMeta: objectMeta},
+	}, nil
+}
+
+func (builder *ManagedDatabaseBuilder) Update(object client.Object) error {
+	object.SetLabels(metadata.GetManagedDatabaseLabels(builder.Instance.Name, builder.Instance.Labels))
+	switch typed := object.(type) {
+	case *v12.Secret:
+		if err := builder.updateSecret(typed); err != nil {
+			return err
+		}
+	case *v12.Service:
+		builder.updateService(typed)
+	case *v1.StatefulSet:
+		builder.updateStatefulSet(typed)
+	default:
+		return fmt.Errorf("unexpected managed database object %T", object)
+	}
+	if err := controllerutil.SetControllerReference(builder.Instance, object, builder.Scheme); err != nil {
+		return fmt.Errorf("failed setting controller reference: %w", err)
+	}
+	return nil
+}
+
+// GetObsoleteObjects deletes the StatefulSet, Service and Secret once spec.managedDatabase is removed.
+// The volume goes with the StatefulSet, so the credentials are of no use anymore.
+func (builder *ManagedDatabaseBuilder) GetObsoleteObjects(ctx context.Context) ([]client.Object, error) {
+	obsoleteObjects := []client.Object{}
+	if builder.Instance.UsesManagedDatabase() {
+		return obsoleteObjects, nil
+	}
+	listOptions := []client.ListOption{
+		client.InNamespace(builder.Instance.Namespace),
+		client.MatchingLabels(metadata.GetManagedDatabaseSelectorLabels(builder.Instance.Name)),
+	}
+	statefulSetList := &v1.StatefulSetList{}
+	if err := builder.Client.List(ctx, statefulSetList, listOptions...); err != nil {
+		return nil, err
+	}
+	for idx := range statefulSetList.Items {
+		obsoleteObjects = append(obsoleteObjects, &statefulSetList.Items[idx])
+	}
+	serviceList := &v12.ServiceList{}
+	if err := builder.Client.List(ctx, serviceList, listOptions...); err != nil {
+		return nil, err
+	}
+	for idx := range serviceList.Items {
+		obsoleteObjects = append(obsoleteObjects, &serviceList.Items[idx])
+	}
+	secretList := &v12.SecretList{}
+	if err := builder.Client.List(ctx, secretList, listOptions...); err != nil {
+		return nil, err
+	}
+	for idx := range secretList.Items {
+		obsoleteObjects = append(obsoleteObjects, &secretList.Items[idx])
+	}
+	return obsoleteObjects, nil
+}
+
+func (builder *ManagedDatabaseBuilder) UpdateMayRequireStsRecreate() bool {
+	return false
+}
+
+// updateSecret generates the password once and keeps it afterwards, as PostgreSQL only reads it when the
+// data volume is initialized.
+func (builder *ManagedDatabaseBuilder) updateSecret(secret *v12.Secret) error {
+	if secret.Data == nil {
+		secret.Data = map[string][]byte{}
+	}
+	if len(secret.Data[DatabasePasswordProperty]) == 0 {
+		password, err := generateManagedDatabasePassword()
+		if err != nil {
+			return fmt.Errorf("failed generating the database password: %w", err)
+		}
+		secret.Data[DatabasePasswordProperty] = []byte(password)
+	}
+	secret.Data[DatabaseUserProperty] = []byte(ManagedDatabaseUser)
+	secret.Data[DatabaseURLProperty] = []byte(ManagedDatabaseURL(builder.Instance))
+	return nil
+}
+
+func (builder *ManagedDatabaseBuilder) updateService(service *v12.Service) {
+	service.Spec.Selector = metadata.GetManagedDatabaseSelectorLabels(builder.Instance.Name)
+	service.Spec.Ports = []v12.ServicePort{{
+		Name:       ManagedDatabaseContainerName,
+		Port:       ManagedDatabasePort,
+		TargetPort: intstr.FromInt(ManagedDatabasePort),
+	}}
+}
+
+func (builder *ManagedDatabaseBuilder) updateStatefulSet(statefulSet *v1.StatefulSet) {
+	instance := builder.Instance
+	database := instance.Spec.ManagedDatabase
+	name := instance.ManagedDatabaseName()
+	selectorLabels := metadata.GetManagedDatabaseSelectorLabels(instance.Name)
+
+	statefulSet.Spec.Replicas = pointer.Int32(1)
+	statefulSet.Spec.ServiceName = name
+	statefulSet.Spec.Selector = &metav1.LabelSelector{MatchLabels: selectorLabels}
+	statefulSet.Spec.Template.Labels = metadata.GetManagedDatabaseLabels(instance.Name, instance.Labels)
+	statefulSet.Spec.Template.Spec.Containers = []v12.Container{{
+		Name:            ManagedDatabaseContainerName,
+		Image:           database.Image,
+		ImagePullPolicy: v12.PullIfNotPresent,
+		Env: []v12.EnvVar{
+			{Name: "POSTGRES_DB", Value: ManagedDatabaseDatabase},
+			{Name: "POSTGRES_USER", ValueFrom: managedDatabaseSecretKeyRef(name, DatabaseUserProperty)},
+			{Name: "POSTGRES_PASSWORD", ValueFrom: managedDatabaseSecretKeyRef(name, DatabasePasswordProperty)},
+			// a subdirectory, as the root of a volume may contain lost+found
+			{Name: "PGDATA", Value: managedDatabaseMountPath + "/pgdata"},
+		},
+		Ports: []v12.ContainerPort{{Name: ManagedDatabaseContainerName, ContainerPort: ManagedDatabasePort}},
+		ReadinessProbe: &v12.Probe{
+			ProbeHandler: v12.ProbeHandler{
+				Exec: &v12.ExecAction{Command: []string{"pg_isready", "-U", ManagedDatabaseUser, "-d", ManagedDatabaseDatabase}},
+			},
+			PeriodSeconds: 5,
+		},
+		Resources:    database.Resources,
+		VolumeMounts: []v12.VolumeMount{{Name: managedDatabaseVolumeName, MountPath: managedDatabaseMountPath}},
+	}}
+	// volume claim templates are immutable, so storage settings only apply when the StatefulSet is created
+	if statefulSet.CreationTimestamp.IsZero() {
+		statefulSet.Spec.VolumeClaimTemplates = []v12.PersistentVolumeClaim{{
+			ObjectMeta: metav1.ObjectMeta{Name: managedDatabaseVolumeName, Labels: selectorLabels},
+			Spec: v12.PersistentVolumeClaimSpec{
+				AccessModes:      []v12.PersistentVolumeAccessMode{v12.ReadWriteOnce},
+				StorageClassName: database.StorageClassName,
+				Resources: v12.ResourceRequirements{
+					Requests: v12.ResourceList{v12.ResourceStorage: database.Storage},
+				},
+			},
+		}}
+		// the database is as disposable as the instance it belongs to
+		statefulSet.Spec.PersistentVolumeClaimRetentionPolicy = &v1.StatefulSetPersistentVolumeClaimRetentionPolicy{
+			WhenDeleted: v1.DeletePersistentVolumeClaimRetentionPolicyType,
+			WhenScaled:  v1.RetainPersistentVolumeClaimRetentionPolicyType,
+		}
+	}
+}
+
+// ManagedDatabaseURL is the JDBC URL of the database of spec.managedDatabase.
+func ManagedDatabaseURL(instance *TeamCity) string {
+	return fmt.Sprintf("jdbc:postgresql://%s.%s.svc:%d/%s", instance.ManagedDatabaseName(), instance.Namespace, ManagedDatabasePort, ManagedDatabaseDatabase)
+}
+
+func managedDatabaseSecretKeyRef(secretName string, key string) *v12.EnvVarSource {
+	return &v12.EnvVarSource{
+		SecretKeyRef: &v12.SecretKeySelector{
+			LocalObjectReference: v12.LocalObjectReference{Name: secretName},
+			Key:                  key,
+		},
+	}
+}
+
+func generateManagedDatabasePassword() (string, error) {
+	random := make([]byte, managedDatabasePasswordLength)
+	if _, err := rand.Read(random); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(random), nil
+}
@@ -0,0 +1,76 @@
+package resource
+
+import (
+	. "git.jetbrains.team/tch/teamcity-operator/api/v1beta1"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	v1 "k8s.io/api/apps/v1"
+	v12 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+var _ = Describe("ManagedDatabase", func() {
+	Context("TeamCity without a managed database", func() {
+		BeforeEach(func() {
+			BeforeEachBuild(func(teamcity *TeamCity) {})
+		})
+		It("builds no objects", func() {
+			objects, err := builder.ManagedDatabase().BuildObjectList()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(objects).To(BeEmpty())
+		})
+	})
+	Context("TeamCity with a managed database", func() {
+		BeforeEach(func() {
+			BeforeEachBuild(func(teamcity *TeamCity) {
+				teamcity.Spec.ManagedDatabase = &ManagedDatabase{Image: "postgres:16", Storage: resource.MustParse("2Gi")}
+			})
+		})
+		It("generates the credentials once", func() {
+			objects, err := builder.ManagedDatabase().BuildObjectList()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(objects).To(HaveLen(3))
+			secret := objects[0].(*v12.Secret)
+			Expect(builder.ManagedDatabase().Update(secret)).To(Succeed())
+
+			Expect(secret.Name).To(Equal(Instance.ManagedDatabaseName()))
+			Expect(string(secret.Data[DatabaseUserProperty])).To(Equal(ManagedDatabaseUser))
+			Expect(string(secret.Data[DatabaseURLProperty])).To(Equal("jdbc:postgresql://" + Instance.ManagedDatabaseName() + "." + TeamCityNamespace + ".svc:5432/teamcity"))
+			password := secret.Data[DatabasePasswordProperty]
+			Expect(password).To(HaveLen(32))
+
+			Expect(builder.ManagedDatabase().Update(secret)).To(Succeed())
+			Expect(secret.Data[DatabasePasswordProperty]).To(Equal(password))
+			Expect(secret.OwnerReferences).To(HaveLen(1))
+		})
+		It("runs PostgreSQL with the generated credentials", func() {
+			objects, err := builder.ManagedDatabase().BuildObjectList()
+			Expect(err).NotTo(HaveOccurred())
+			statefulSet := objects[2].(*v1.StatefulSet)
+			Expect(builder.ManagedDatabase().Update(statefulSet)).To(Succeed())
+
+			Expect(statefulSet.Labels).To(HaveKeyWithValue("app.kubernetes.io/component", "database"))
+			container := statefulSet.Spec.Template.Spec.Containers[0]
+			Expect(container.Image).To(Equal("postgres:16"))
+			Expect(container.Env).To(ContainElement(v12.EnvVar{Name: "POSTGRES_PASSWORD", ValueFrom: &v12.EnvVarSource{
+				SecretKeyRef: &v12.SecretKeySelector{
+					LocalObjectReference: v12.LocalObjectReference{Name: Instance.ManagedDatabaseName()},
+					Key:                  DatabasePasswordProperty,
+				},
+			}}))
+			Expect(statefulSet.Spec.VolumeClaimTemplates).To(HaveLen(1))
+			Expect(statefulSet.Spec.VolumeClaimTemplates[0].Spec.Resources.Requests[v12.ResourceStorage]).To(Equal(resource.MustParse("2Gi")))
+		})
+		It("keeps the volume claim templates of an existing StatefulSet", func() {
+			statefulSet := &v1.StatefulSet{ObjectMeta: metav1.ObjectMeta{
+				Name:              Instance.ManagedDatabaseName(),
+				Namespace:         TeamCityNamespace,
+				CreationTimestamp: metav1.Now(),
+			}}
+			Instance.Spec.ManagedDatabase.Storage = resource.MustParse("20Gi")
+			Expect(builder.ManagedDatabase().Update(statefulSet)).To(Succeed())
+			Expect(statefulSet.Spec.VolumeClaimTemplates).To(BeEmpty())
+		})
+	})
+})
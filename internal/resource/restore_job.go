@@ -0,0 +1,106 @@
+package resource
+
+import (
+	"path"
+
+	. "git.jetbrains.team/tch/teamcity-operator/api/v1beta1"
+	"git.jetbrains.team/tch/teamcity-operator/internal/metadata"
+	batchv1 "k8s.io/api/batch/v1"
+	v12 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/utils/pointer"
+)
+
+const (
+	RestoreContainerName = "restore"
+	// RestoreSourceMountPath is where the claim of a RestoreSource.PersistentVolumeClaim is mounted.
+	RestoreSourceMountPath = "/backup-source"
+
+	restoreSourceVolumeName = "backup-source"
+	restoreBackupFileEnvVar = "TEAMCITY_BACKUP_FILE"
+	maintainDBScriptPath    = "/opt/teamcity/bin/maintainDB.sh"
+)
+
+// restoreScript writes the target database.properties from the secret keys and spec.databaseSecret.properties,
+// and restores the backup into it.
+// Paths are passed through environment variables so they are never interpreted by the shell.
+const restoreScript = `printf 'connectionUrl=%s\nconnectionProperties.user=%s\nconnectionProperties.password=%s\n' ` +
+	`"$TEAMCITY_DB_URL" "$TEAMCITY_DB_USER" "$TEAMCITY_DB_PASSWORD" > /tmp/database.properties && ` +
+	`printf '%s' "$` + databaseExtraPropertiesEnvVar + `" >> /tmp/database.properties && ` +
+	`exec ` + maintainDBScriptPath + ` restore -A "$TEAMCITY_DATA_PATH" -F "$` + restoreBackupFileEnvVar + `" -T /tmp/database.properties`
+
+// RestoreBackupFilePath is the path of the backup file inside the restore Job.
+// dataDirFileName is the name of a file in the backup directory and is ignored for claim sources.
+func RestoreBackupFilePath(instance *TeamCity, source RestoreSource, dataDirFileName string) string {
+	if source.PersistentVolumeClaim != nil {
+		return path.Join(RestoreSourceMountPath, path.Clean("/"+source.PersistentVolumeClaim.Path))
+	}
+	return path.Join(BackupDirectoryPath(instance), path.Base(dataDirFileName))
+}
+
+// BuildRestoreJob builds a Job that runs maintainDB restore of backupFile into the data directory and the database
+// from databaseSecret. It must only run while every node is stopped, so it is not scheduled next to the main node.
+// A partially restored database cannot be restored into again, hence the Job is never retried.
+func BuildRestoreJob(instance *TeamCity, restore *TeamCityRestore, name string, backupFile string, databaseSecret string) *batchv1.Job {
+	mainNode := instance.Spec.MainNode
+	dataDirClaim := instance.Spec.DataDirVolumeClaim
+
+	env := []v12.EnvVar{
+		DataDirPathEnvVar(instance.DataDirPath()),
+		{Name: restoreBackupFileEnvVar, Value: backupFile},
+	}
+	env = append(env, DatabaseEnvVarBuilder(databaseSecret, instance.Spec.DatabaseSecret.Keys)...)
+	env = append(env, DatabaseExtraPropertiesEnvVar(instance))
+
+	volumeMounts := []v12.VolumeMount{
+		{Name: dataDirClaim.Name, MountPath: dataDirClaim.VolumeMount.MountPath},
+	}
+	volumes := []v12.Volume{createVolumeFromCustomPersistentVolumeClaim(dataDirClaim)}
+	// maintainDB loads the driver of the target database from the data directory as well.
+	initContainers, driverVolumes := JDBCDriverInitContainers(instance)
+	volumes = append(volumes, driverVolumes...)
+	if claim := restore.Spec.Source.PersistentVolumeClaim; claim != nil {
+		volumeMounts = append(volumeMounts, v12.VolumeMount{Name: restoreSourceVolumeName, MountPath: RestoreSourceMountPath, ReadOnly: true})
+		volumes = append(volumes, v12.Volume{
+			Name: restoreSourceVolumeName,
+			VolumeSource: v12.VolumeSource{
+				PersistentVolumeClaim: &v12.PersistentVolumeClaimVolumeSource{ClaimName: claim.ClaimName, ReadOnly: true},
+			},
+		})
+	}
+
+	return &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: restore.Namespace,
+			Labels:    metadata.GetLabels(instance.Name, instance.Labels),
+		},
+		Spec: batchv1.JobSpec{
+			BackoffLimit: pointer.Int32(0),
+			Template: v12.PodTemplateSpec{
+				Spec: v12.PodSpec{
+					RestartPolicy:      v12.RestartPolicyNever,
+					SecurityContext:    mainNode.Spec.PodSecurityContext.DeepCopy(),
+					ServiceAccountName: instance.Spec.ServiceAccount.Name,
+					NodeSelector:       mainNode.Spec.NodeSelector,
+					InitContainers:     initContainers,
+					Containers: []v12.Container{
+						{
+							Name:            RestoreContainerName,
+							Image:           instance.Spec.Image,
+							ImagePullPolicy: v12.PullIfNotPresent,
+							Command:         []string{"/bin/sh", "-c", restoreScript},
+							Env:             env,
+							Resources: v12.ResourceRequirements{
+								Requests: mainNode.Spec.Requests,
+								Limits:   mainNode.Spec.Limits,
+							},
+							VolumeMounts: volumeMounts,
+						},
+					},
+					Volumes: volumes,
+				},
+			},
+		},
+	}
+}
@@ -0,0 +1,79 @@
+package resource
+
+import (
+	. "git.jetbrains.team/tch/teamcity-operator/api/v1beta1"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	v12 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+var _ = Describe("RestoreJob", func() {
+	instance := &TeamCity{
+		ObjectMeta: metav1.ObjectMeta{Name: "tc", Namespace: "default"},
+		Spec: TeamCitySpec{
+			Image:    "jetbrains/teamcity-server:2024.12",
+			MainNode: Node{Name: "main"},
+			DataDirVolumeClaim: CustomPersistentVolumeClaim{
+				Name:        "data",
+				VolumeMount: v12.VolumeMount{Name: "data", MountPath: "/storage"},
+			},
+		},
+	}
+
+	It("resolves backup files in the data directory", func() {
+		source := RestoreSource{FileName: "../TeamCity_Backup.zip"}
+		Expect(RestoreBackupFilePath(instance, source, source.FileName)).To(Equal("/storage/backup/TeamCity_Backup.zip"))
+	})
+
+	It("resolves backup files in a claim", func() {
+		source := RestoreSource{PersistentVolumeClaim: &RestoreSourceVolume{ClaimName: "backups", Path: "../nightly/b.zip"}}
+		Expect(RestoreBackupFilePath(instance, source, "")).To(Equal("/backup-source/nightly/b.zip"))
+	})
+
+	It("restores into the target database without retries", func() {
+		restore := &TeamCityRestore{ObjectMeta: metav1.ObjectMeta{Name: "restore", Namespace: "default"}}
+		job := BuildRestoreJob(instance, restore, "restore-job", "/storage/backup/b.zip", "target-db")
+
+		Expect(*job.Spec.BackoffLimit).To(BeZero())
+		container := job.Spec.Template.Spec.Containers[0]
+		Expect(container.Image).To(Equal(instance.Spec.Image))
+		Expect(container.Command[2]).To(ContainSubstring("maintainDB.sh restore"))
+		Expect(container.Env).To(ContainElement(v12.EnvVar{Name: "TEAMCITY_BACKUP_FILE", Value: "/storage/backup/b.zip"}))
+		Expect(container.Env).To(ContainElement(v12.EnvVar{Name: "TEAMCITY_DATA_PATH", Value: "/storage"}))
+		for _, env := range container.Env {
+			if env.ValueFrom != nil {
+				Expect(env.ValueFrom.SecretKeyRef.Name).To(Equal("target-db"))
+			}
+		}
+		Expect(container.VolumeMounts).To(ConsistOf(v12.VolumeMount{Name: "data", MountPath: "/storage"}))
+	})
+
+	It("places the JDBC driver before restoring", func() {
+		withDriver := instance.DeepCopy()
+		withDriver.Spec.JDBCDriver = &JDBCDriver{Database: JDBCDatabaseMySQL, Version: "9.1.0"}
+		restore := &TeamCityRestore{ObjectMeta: metav1.ObjectMeta{Name: "restore", Namespace: "default"}}
+		job := BuildRestoreJob(withDriver, restore, "restore-job", "/storage/backup/b.zip", "target-db")
+
+		initContainers := job.Spec.Template.Spec.InitContainers
+		Expect(initContainers).To(HaveLen(1))
+		Expect(initContainers[0].Name).To(Equal(JDBCDriverInitContainerName))
+		Expect(initContainers[0].VolumeMounts).To(ConsistOf(v12.VolumeMount{Name: "data", MountPath: "/storage"}))
+		Expect(initContainers[0].Env).To(ContainElement(v12.EnvVar{Name: "TEAMCITY_JDBC_FILE", Value: "mysql-connector-j-9.1.0.jar"}))
+	})
+
+	It("mounts the source claim read-only", func() {
+		restore := &TeamCityRestore{
+			ObjectMeta: metav1.ObjectMeta{Name: "restore", Namespace: "default"},
+			Spec: TeamCityRestoreSpec{
+				Source: RestoreSource{PersistentVolumeClaim: &RestoreSourceVolume{ClaimName: "backups", Path: "b.zip"}},
+			},
+		}
+		job := BuildRestoreJob(instance, restore, "restore-job", "/backup-source/b.zip", "target-db")
+
+		Expect(job.Spec.Template.Spec.Containers[0].VolumeMounts).To(ContainElement(
+			v12.VolumeMount{Name: "backup-source", MountPath: RestoreSourceMountPath, ReadOnly: true}))
+		Expect(job.Spec.Template.Spec.Volumes).To(HaveLen(2))
+		Expect(job.Spec.Template.Spec.Volumes[1].PersistentVolumeClaim.ClaimName).To(Equal("backups"))
+	})
+})
@@ -14,15 +14,26 @@ import (
 
 type SecondaryStatefulSetBuilder struct {
 	*TeamCityResourceBuilder
+	// nodeNames limits the builder to these secondary nodes; nil means all of them.
+	nodeNames []string
 }
 
 func (builder *TeamCityResourceBuilder) SecondaryStatefulSet() *SecondaryStatefulSetBuilder {
-	return &SecondaryStatefulSetBuilder{builder}
+	return &SecondaryStatefulSetBuilder{TeamCityResourceBuilder: builder}
+}
+
+// SecondaryStatefulSetOf builds only the StatefulSets of the given secondary nodes, e.g. to restart a rolling upgrade
+// batch. It never reports obsolete StatefulSets.
+func (builder *TeamCityResourceBuilder) SecondaryStatefulSetOf(nodeNames ...string) *SecondaryStatefulSetBuilder {
+	return &SecondaryStatefulSetBuilder{TeamCityResourceBuilder: builder, nodeNames: nodeNames}
 }
 
 func (builder SecondaryStatefulSetBuilder) BuildObjectList() ([]client.Object, error) {
 	var objectList []client.Object
 	for _, secondaryNode := range builder.Instance.Spec.SecondaryNodes {
+		if !builder.includes(secondaryNode.Name) {
+			continue
+		}
 		nodeLabels := metadata.GetStatefulSetLabels(builder.Instance.Name, secondaryNode.Name, "secondary", builder.Instance.Labels)
 		node := CreateEmptyStatefulSet(secondaryNode.Name, builder.Instance.Namespace, nodeLabels)
 		objectList = append(objectList, &node)
@@ -53,6 +64,9 @@ func (builder SecondaryStatefulSetBuilder) Update(object client.Object) error {
 }
 
 func (builder SecondaryStatefulSetBuilder) GetObsoleteObjects(ctx context.Context) ([]client.Object, error) {
+	if builder.nodeNames != nil {
+		return nil, nil
+	}
 	currentStatefulList := &v1.StatefulSetList{}
 	obsoleteObjects := []client.Object{}
 	secondaryNodeLabels := metadata.GetStatefulSetCommonLabels(builder.Instance.Name, "secondary", builder.Instance.Labels)
@@ -77,6 +91,18 @@ func (builder SecondaryStatefulSetBuilder) UpdateMayRequireStsRecreate() bool {
 	return true
 }
 
+func (builder SecondaryStatefulSetBuilder) includes(nodeName string) bool {
+	if builder.nodeNames == nil {
+		return true
+	}
+	for _, name := range builder.nodeNames {
+		if name == nodeName {
+			return true
+		}
+	}
+	return false
+}
+
 func (builder SecondaryStatefulSetBuilder) getNodeIndex(object client.Object, nodeList []Node) int {
 	for idx, node := range nodeList {
 		if node.Name == object.GetName() {
@@ -135,6 +135,17 @@ var _ = Describe("Secondary StatefulSet", func() {
 			Expect(len(obsoleteObjects)).To(Equal(1))
 			Expect(obsoleteObjects[0].GetName()).To(Equal(StaleStatefulSetName))
 		})
+		It("builds only the selected nodes", func() {
+			builder := DefaultSecondaryStatefulSetBuilder.TeamCityResourceBuilder.SecondaryStatefulSetOf(getSecondaryNodes()[1].Name)
+			objectList, err := builder.BuildObjectList()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(len(objectList)).To(Equal(1))
+			Expect(objectList[0].GetName()).To(Equal(getSecondaryNodes()[1].Name))
+
+			obsoleteObjects, err := builder.GetObsoleteObjects(context.Background())
+			Expect(err).NotTo(HaveOccurred())
+			Expect(obsoleteObjects).To(BeEmpty())
+		})
 	})
 	Context("TeamCity with init containers", func() {
 		BeforeEach(func() {
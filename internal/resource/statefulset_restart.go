@@ -0,0 +1,124 @@
+package resource
+
+import (
+	"fmt"
+	"strings"
+
+	. "git.jetbrains.team/tch/teamcity-operator/api/v1beta1"
+	v1 "k8s.io/api/apps/v1"
+	v12 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+)
+
+// NodeRestartFieldChange describes one node StatefulSet field whose change restarts the node.
+// Current and Desired are only set for the image.
+type NodeRestartFieldChange struct {
+	Field   string
+	Current string
+	Desired string
+}
+
+// GetNodeRestartFieldChanges returns the node StatefulSet fields that differ from the spec and restart the node.
+// It is empty exactly when ChangesRequireNodeStatefulSetRestart is false.
+func GetNodeRestartFieldChanges(instance *TeamCity, node Node, existing *v1.StatefulSet) []NodeRestartFieldChange {
+	desired := desiredNodeStatefulSetSpec(instance, node, existing)
+	if equality.Semantic.DeepDerivative(desired, existing.Spec) {
+		return nil
+	}
+	var changes []NodeRestartFieldChange
+	if len(existing.Spec.Template.Spec.Containers) == 0 {
+		changes = append(changes, NodeRestartFieldChange{Field: "spec.template.spec.containers"})
+	} else {
+		changes = append(changes, containerRestartFieldChanges(desired.Template.Spec.Containers[0], existing.Spec.Template.Spec.Containers[0])...)
+	}
+	podSpecField := "spec.template.spec."
+	for _, field := range []struct {
+		name     string
+		desired  interface{}
+		existing interface{}
+	}{
+		{"spec.template.metadata.annotations", desired.Template.Annotations, existing.Spec.Template.Annotations},
+		{podSpecField + "volumes", desired.Template.Spec.Volumes, existing.Spec.Template.Spec.Volumes},
+		{podSpecField + "initContainers", desired.Template.Spec.InitContainers, existing.Spec.Template.Spec.InitContainers},
+		{podSpecField + "nodeSelector", desired.Template.Spec.NodeSelector, existing.Spec.Template.Spec.NodeSelector},
+		{podSpecField + "affinity", desired.Template.Spec.Affinity, existing.Spec.Template.Spec.Affinity},
+		{podSpecField + "securityContext", desired.Template.Spec.SecurityContext, existing.Spec.Template.Spec.SecurityContext},
+		{podSpecField + "serviceAccountName", desired.Template.Spec.ServiceAccountName, existing.Spec.Template.Spec.ServiceAccountName},
+		{"spec.serviceName", desired.ServiceName, existing.Spec.ServiceName},
+	} {
+		if !equality.Semantic.DeepDerivative(field.desired, field.existing) {
+			changes = append(changes, NodeRestartFieldChange{Field: field.name})
+		}
+	}
+	// a field the operator does not list, e.g. one set by another controller
+	if len(changes) == 0 {
+		changes = append(changes, NodeRestartFieldChange{Field: "spec"})
+	}
+	return changes
+}
+
+func containerRestartFieldChanges(desired v12.Container, existing v12.Container) []NodeRestartFieldChange {
+	if equality.Semantic.DeepDerivative(desired, existing) {
+		return nil
+	}
+	containerField := fmt.Sprintf("spec.template.spec.containers[%s]", desired.Name)
+	var changes []NodeRestartFieldChange
+	if desired.Image != existing.Image {
+		changes = append(changes, NodeRestartFieldChange{
+			Field:   containerField + ".image",
+			Current: displayStatefulSetFieldValue(existing.Image),
+			Desired: displayStatefulSetFieldValue(desired.Image),
+		})
+	}
+	for _, field := range []struct {
+		name     string
+		desired  interface{}
+		existing interface{}
+	}{
+		{"env", desired.Env, existing.Env},
+		{"resources", desired.Resources, existing.Resources},
+		{"ports", desired.Ports, existing.Ports},
+		{"volumeMounts", desired.VolumeMounts, existing.VolumeMounts},
+		{"livenessProbe", desired.LivenessProbe, existing.LivenessProbe},
+		{"readinessProbe", desired.ReadinessProbe, existing.ReadinessProbe},
+		{"startupProbe", desired.StartupProbe, existing.StartupProbe},
+		{"lifecycle", desired.Lifecycle, existing.Lifecycle},
+	} {
+		if !equality.Semantic.DeepDerivative(field.desired, field.existing) {
+			changes = append(changes, NodeRestartFieldChange{Field: containerField + "." + field.name})
+		}
+	}
+	if len(changes) == 0 {
+		changes = append(changes, NodeRestartFieldChange{Field: containerField})
+	}
+	return changes
+}
+
+// FormatNodeRestartFieldChange renders a field change for events and status.
+func FormatNodeRestartFieldChange(change NodeRestartFieldChange) string {
+	if change.Current == "" && change.Desired == "" {
+		return change.Field
+	}
+	return fmt.Sprintf("%s: current=%s, desired=%s", change.Field, change.Current, change.Desired)
+}
+
+// FormatNodeRestartFieldChanges renders the field changes of a node for logs and events.
+func FormatNodeRestartFieldChanges(changes []NodeRestartFieldChange) string {
+	parts := make([]string, 0, len(changes))
+	for _, change := range changes {
+		parts = append(parts, FormatNodeRestartFieldChange(change))
+	}
+	return strings.Join(parts, "; ")
+}
+
+// desiredNodeStatefulSetSpec is the node StatefulSet spec the operator would apply, keeping the running replicas,
+// as scaling does not restart the running pods.
+func desiredNodeStatefulSetSpec(instance *TeamCity, node Node, existing *v1.StatefulSet) v1.StatefulSetSpec {
+	var desired v1.StatefulSet
+	ConfigureStatefulSet(instance, node, &desired)
+	var container v12.Container
+	ConfigureContainer(instance, node, &container)
+	desired.Spec.Template.Spec.Containers = []v12.Container{container}
+	desired.Spec.Replicas = existing.Spec.Replicas
+	return desired.Spec
+}
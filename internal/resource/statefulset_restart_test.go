@@ -0,0 +1,61 @@
+package resource
+
+import (
+	"testing"
+
+	. "git.jetbrains.team/tch/teamcity-operator/api/v1beta1"
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+func teamCityForRestartTest() *TeamCity {
+	return &TeamCity{
+		Spec: TeamCitySpec{
+			Image: "jetbrains/teamcity-server:2024.07.1",
+			DataDirVolumeClaim: CustomPersistentVolumeClaim{
+				Name:        "data",
+				VolumeMount: corev1.VolumeMount{Name: "data", MountPath: "/storage"},
+			},
+			MainNode: Node{
+				Name: "main-node",
+				Spec: NodeSpec{Requests: corev1.ResourceList{"memory": resource.MustParse("1Gi")}},
+			},
+		},
+	}
+}
+
+func TestGetNodeRestartFieldChanges(t *testing.T) {
+	instance := teamCityForRestartTest()
+	existing := BuildDesiredStatefulSet(instance, instance.Spec.MainNode, nil)
+	assert.Empty(t, GetNodeRestartFieldChanges(instance, instance.Spec.MainNode, existing))
+
+	instance.Spec.Image = "jetbrains/teamcity-server:2024.07.3"
+	instance.Spec.MainNode.Spec.Requests = corev1.ResourceList{"memory": resource.MustParse("2Gi")}
+	instance.Spec.MainNode.Spec.NodeSelector = map[string]string{"disktype": "ssd"}
+	changes := GetNodeRestartFieldChanges(instance, instance.Spec.MainNode, existing)
+
+	assert.Equal(t, []NodeRestartFieldChange{
+		{
+			Field:   "spec.template.spec.containers[teamcity-server].image",
+			Current: "jetbrains/teamcity-server:2024.07.1",
+			Desired: "jetbrains/teamcity-server:2024.07.3",
+		},
+		{Field: "spec.template.spec.containers[teamcity-server].resources"},
+		{Field: "spec.template.spec.nodeSelector"},
+	}, changes)
+	assert.True(t, ChangesRequireNodeStatefulSetRestart(instance, instance.Spec.MainNode, existing))
+	assert.Equal(t, "spec.template.spec.containers[teamcity-server].image: current=jetbrains/teamcity-server:2024.07.1, "+
+		"desired=jetbrains/teamcity-server:2024.07.3; spec.template.spec.containers[teamcity-server].resources; spec.template.spec.nodeSelector",
+		FormatNodeRestartFieldChanges(changes))
+}
+
+func TestGetNodeRestartFieldChangesIgnoresScaling(t *testing.T) {
+	instance := teamCityForRestartTest()
+	existing := BuildDesiredStatefulSet(instance, instance.Spec.MainNode, nil)
+
+	instance.Spec.Stopped = true
+
+	assert.Empty(t, GetNodeRestartFieldChanges(instance, instance.Spec.MainNode, existing))
+	assert.False(t, ChangesRequireNodeStatefulSetRestart(instance, instance.Spec.MainNode, existing))
+}
@@ -273,6 +273,134 @@ var _ = Describe("StatefulSet", func() {
 			Expect(envVars[dbURLIdx].ValueFrom.SecretKeyRef.LocalObjectReference).To(Equal(v12.LocalObjectReference{Name: Instance.Spec.DatabaseSecret.Secret}))
 			Expect(envVars[dbURLIdx].ValueFrom.SecretKeyRef.Key).To(Equal("connectionUrl"))
 		})
+		It("stamps the config hash into the pod template", func() {
+			Instance.Status.ConfigHash = "abc123"
+			obj, err := DefaultStatefulSetBuilder.BuildObjectList()
+			Expect(err).NotTo(HaveOccurred())
+			statefulSet := obj[0].(*v1.StatefulSet)
+			Expect(DefaultStatefulSetBuilder.Update(statefulSet)).To(Succeed())
+
+			Expect(statefulSet.Spec.Template.Annotations).To(HaveKeyWithValue(ConfigHashAnnotationKey, "abc123"))
+			Expect(Instance.Spec.MainNode.Annotations).NotTo(HaveKey(ConfigHashAnnotationKey))
+		})
+	})
+	Context("TeamCity with custom database secret keys", func() {
+		BeforeEach(func() {
+			BeforeEachBuild(func(teamcity *TeamCity) {
+				teamcity.Spec.DatabaseSecret = getDatabaseSecret()
+				teamcity.Spec.DatabaseSecret.Keys = DatabaseSecretKeys{URL: "jdbc-url", User: "username"}
+			})
+		})
+		It("references the custom keys", func() {
+			obj, err := DefaultStatefulSetBuilder.BuildObjectList()
+			Expect(err).NotTo(HaveOccurred())
+			statefulSet := obj[0].(*v1.StatefulSet)
+			Expect(DefaultStatefulSetBuilder.Update(statefulSet)).To(Succeed())
+
+			envVars := statefulSet.Spec.Template.Spec.Containers[0].Env
+			keys := map[string]string{}
+			for _, env := range envVars {
+				if env.ValueFrom != nil && env.ValueFrom.SecretKeyRef != nil {
+					keys[env.Name] = env.ValueFrom.SecretKeyRef.Key
+				}
+			}
+			Expect(keys).To(Equal(map[string]string{
+				"TEAMCITY_DB_URL":      "jdbc-url",
+				"TEAMCITY_DB_USER":     "username",
+				"TEAMCITY_DB_PASSWORD": "connectionProperties.password",
+			}))
+		})
+	})
+	Context("TeamCity with database properties delivered as a file", func() {
+		BeforeEach(func() {
+			BeforeEachBuild(func(teamcity *TeamCity) {
+				teamcity.Spec.DatabaseSecret = getDatabaseSecret()
+				teamcity.Spec.DatabaseSecret.Delivery = DatabaseSecretDeliveryFile
+				teamcity.Spec.DatabaseSecret.Keys = DatabaseSecretKeys{Password: "pass"}
+				teamcity.Spec.DatabaseSecret.Properties = map[string]string{"maxConnections": "50", "connectionProperties.sslmode": "require"}
+			})
+		})
+		It("writes database.properties in an init container instead of passing env vars", func() {
+			obj, err := DefaultStatefulSetBuilder.BuildObjectList()
+			Expect(err).NotTo(HaveOccurred())
+			statefulSet := obj[0].(*v1.StatefulSet)
+			Expect(DefaultStatefulSetBuilder.Update(statefulSet)).To(Succeed())
+
+			podSpec := statefulSet.Spec.Template.Spec
+			for _, env := range podSpec.Containers[0].Env {
+				Expect(env.Name).NotTo(HavePrefix("TEAMCITY_DB_"))
+			}
+			initContainer := podSpec.InitContainers[0]
+			Expect(initContainer.Name).To(Equal(DatabasePropertiesInitContainerName))
+			Expect(initContainer.Env).To(ContainElements(
+				v12.EnvVar{Name: "TEAMCITY_DB_PROPERTIES_FILE", Value: Instance.DataDirPath() + "/config/database.properties"},
+				v12.EnvVar{Name: "TEAMCITY_DB_PROPERTIES", Value: "connectionProperties.sslmode=require\nmaxConnections=50\n"},
+			))
+
+			volumeIdx := slices.IndexFunc(podSpec.Volumes, func(v v12.Volume) bool { return v.Secret != nil })
+			Expect(volumeIdx).NotTo(Equal(-1))
+			Expect(podSpec.Volumes[volumeIdx].Secret.SecretName).To(Equal(Instance.Spec.DatabaseSecret.Secret))
+			Expect(podSpec.Volumes[volumeIdx].Secret.Items).To(ConsistOf(
+				v12.KeyToPath{Key: "connectionUrl", Path: "url"},
+				v12.KeyToPath{Key: "connectionProperties.user", Path: "user"},
+				v12.KeyToPath{Key: "pass", Path: "password"},
+			))
+		})
+	})
+	Context("TeamCity with a JDBC driver", func() {
+		BeforeEach(func() {
+			BeforeEachBuild(func(teamcity *TeamCity) {
+				teamcity.Spec.JDBCDriver = &JDBCDriver{Database: JDBCDatabasePostgreSQL, Version: "42.7.4"}
+			})
+		})
+		It("downloads the driver before the init containers of the node", func() {
+			Instance.Spec.MainNode.Spec.InitContainers = getInitContainers()
+			obj, err := DefaultStatefulSetBuilder.BuildObjectList()
+			Expect(err).NotTo(HaveOccurred())
+			statefulSet := obj[0].(*v1.StatefulSet)
+			Expect(DefaultStatefulSetBuilder.Update(statefulSet)).To(Succeed())
+
+			initContainers := statefulSet.Spec.Template.Spec.InitContainers
+			Expect(initContainers).To(HaveLen(1 + len(getInitContainers())))
+			Expect(initContainers[0].Name).To(Equal(JDBCDriverInitContainerName))
+			Expect(initContainers[0].Env).To(ContainElements(
+				v12.EnvVar{Name: "TEAMCITY_JDBC_DIR", Value: Instance.DataDirPath() + "/lib/jdbc"},
+				v12.EnvVar{Name: "TEAMCITY_JDBC_FILE", Value: "postgresql-42.7.4.jar"},
+				v12.EnvVar{Name: "TEAMCITY_JDBC_URL", Value: "https://repo1.maven.org/maven2/org/postgresql/postgresql/42.7.4/postgresql-42.7.4.jar"},
+			))
+			Expect(initContainers[1:]).To(Equal(getInitContainers()))
+		})
+		It("copies the driver from a ConfigMap", func() {
+			Instance.Spec.JDBCDriver = &JDBCDriver{ConfigMap: &JDBCDriverConfigMap{Name: "drivers", Key: "ojdbc11.jar"}}
+			obj, err := DefaultStatefulSetBuilder.BuildObjectList()
+			Expect(err).NotTo(HaveOccurred())
+			statefulSet := obj[0].(*v1.StatefulSet)
+			Expect(DefaultStatefulSetBuilder.Update(statefulSet)).To(Succeed())
+
+			podSpec := statefulSet.Spec.Template.Spec
+			Expect(podSpec.InitContainers[0].Env).To(ContainElement(v12.EnvVar{Name: "TEAMCITY_JDBC_SOURCE", Value: "/run/teamcity/jdbc/ojdbc11.jar"}))
+			volumeIdx := slices.IndexFunc(podSpec.Volumes, func(v v12.Volume) bool { return v.ConfigMap != nil })
+			Expect(volumeIdx).NotTo(Equal(-1))
+			Expect(podSpec.Volumes[volumeIdx].ConfigMap.Name).To(Equal("drivers"))
+		})
+		It("copies the driver out of an image", func() {
+			Instance.Spec.JDBCDriver = &JDBCDriver{Image: &JDBCDriverImage{Image: "registry.example.com/jdbc:1", Path: "/drivers/mysql.jar"}}
+			obj, err := DefaultStatefulSetBuilder.BuildObjectList()
+			Expect(err).NotTo(HaveOccurred())
+			statefulSet := obj[0].(*v1.StatefulSet)
+			Expect(DefaultStatefulSetBuilder.Update(statefulSet)).To(Succeed())
+
+			initContainers := statefulSet.Spec.Template.Spec.InitContainers
+			Expect(initContainers[0].Name).To(Equal(JDBCDriverSourceInitContainerName))
+			Expect(initContainers[0].Image).To(Equal("registry.example.com/jdbc:1"))
+			Expect(initContainers[0].Command).To(Equal([]string{"cp", "/drivers/mysql.jar", "/run/teamcity/jdbc/mysql.jar"}))
+			Expect(initContainers[1].Name).To(Equal(JDBCDriverInitContainerName))
+		})
+	})
+	Context("database properties", func() {
+		It("escapes keys and values", func() {
+			Expect(FormatDatabaseProperties(map[string]string{"b": "x\\ny", "a key": "1"})).To(Equal("a\\ key=1\nb=x\\\\ny\n"))
+		})
 	})
 	Context("TeamCity with startup properties", func() {
 		BeforeEach(func() {
@@ -436,5 +564,69 @@ var _ = Describe("StatefulSet", func() {
 			}
 		})
 	})
+	Context("TeamCity stopped", func() {
+		BeforeEach(func() {
+			BeforeEachBuild(func(teamcity *TeamCity) {
+				teamcity.Spec.Stopped = true
+			})
+		})
+		It("scales the node to zero", func() {
+			obj, err := DefaultStatefulSetBuilder.BuildObjectList()
+			Expect(err).NotTo(HaveOccurred())
+			stsObject := obj[0]
+			err = DefaultStatefulSetBuilder.Update(stsObject)
+			Expect(err).NotTo(HaveOccurred())
+			statefulSet := stsObject.(*v1.StatefulSet)
+
+			Expect(*statefulSet.Spec.Replicas).To(BeZero())
+		})
+		It("reconciles secondary nodes before the main node", func() {
+			resourceBuilder := TeamCityResourceBuilder{Instance: &Instance}
+			builders := resourceBuilder.ResourceBuilders()
+
+			Expect(builders[4]).To(BeAssignableToTypeOf(&SecondaryStatefulSetBuilder{}))
+			Expect(builders[5]).To(BeAssignableToTypeOf(&StatefulSetBuilder{}))
+		})
+	})
+	Context("TeamCity stopped for a restore", func() {
+		BeforeEach(func() {
+			BeforeEachBuild(func(teamcity *TeamCity) {
+				teamcity.Annotations = map[string]string{RestoreModeAnnotationKey: RestoreModeStopped}
+			})
+		})
+		It("scales the node to zero", func() {
+			obj, err := DefaultStatefulSetBuilder.BuildObjectList()
+			Expect(err).NotTo(HaveOccurred())
+			stsObject := obj[0]
+			err = DefaultStatefulSetBuilder.Update(stsObject)
+			Expect(err).NotTo(HaveOccurred())
+			statefulSet := stsObject.(*v1.StatefulSet)
+
+			Expect(*statefulSet.Spec.Replicas).To(BeZero())
+		})
+	})
+	Context("TeamCity starting after a restore", func() {
+		BeforeEach(func() {
+			BeforeEachBuild(func(teamcity *TeamCity) {
+				teamcity.Annotations = map[string]string{RestoreModeAnnotationKey: RestoreModeStarting}
+				teamcity.Spec.MainNode.Spec.StartupProbeSettings.PeriodSeconds = 20
+				teamcity.Spec.MainNode.Spec.StartupProbeSettings.FailureThreshold = 30
+			})
+		})
+		It("runs one replica with a relaxed startup probe", func() {
+			obj, err := DefaultStatefulSetBuilder.BuildObjectList()
+			Expect(err).NotTo(HaveOccurred())
+			stsObject := obj[0]
+			err = DefaultStatefulSetBuilder.Update(stsObject)
+			Expect(err).NotTo(HaveOccurred())
+			statefulSet := stsObject.(*v1.StatefulSet)
+
+			Expect(*statefulSet.Spec.Replicas).To(Equal(int32(1)))
+			startupProbe := statefulSet.Spec.Template.Spec.Containers[0].StartupProbe
+			Expect(startupProbe.PeriodSeconds).To(Equal(int32(20)))
+			Expect(startupProbe.FailureThreshold).To(Equal(int32(6 * 60 * 60 / 20)))
+			Expect(Instance.Spec.MainNode.Spec.StartupProbeSettings.FailureThreshold).To(Equal(int32(30)))
+		})
+	})
 
 })
@@ -13,9 +13,13 @@ import (
 
 const (
 	TEAMCITY_CONTAINER_NAME         = "teamcity-server"
-	TEAMCITY_DB_USER_SECRET_KEY     = "connectionProperties.user"
-	TEAMCITY_DB_PASSWORD_SECRET_KEY = "connectionProperties.password"
-	TEAMCITY_DB_URL_SECRET_KEY      = "connectionUrl"
+	TEAMCITY_DB_USER_SECRET_KEY     = DatabaseUserProperty
+	TEAMCITY_DB_PASSWORD_SECRET_KEY = DatabasePasswordProperty
+	TEAMCITY_DB_URL_SECRET_KEY      = DatabaseURLProperty
+
+	// restoreStartupTimeoutSeconds is how long the first start after a restore may take, it upgrades and reindexes the data
+	restoreStartupTimeoutSeconds = 6 * 60 * 60
+	defaultProbePeriodSeconds    = 10
 )
 
 func CreateEmptyStatefulSet(name string, namespace string, labels map[string]string) v1.StatefulSet {
@@ -176,6 +180,9 @@ func ConfigureContainer(instance *TeamCity, node Node, container *v12.Container)
 	container.LivenessProbe.ProbeHandler.HTTPGet = &instance.Spec.ReadinessEndpoint
 	container.ReadinessProbe.ProbeHandler.HTTPGet = &instance.Spec.ReadinessEndpoint
 	container.StartupProbe.ProbeHandler.HTTPGet = &instance.Spec.HealthEndpoint
+	if instance.InRestoreMode() {
+		relaxStartupProbe(container.StartupProbe)
+	}
 	allPersistentVolumeClaims := instance.GetAllCustomPersistentVolumeClaim()
 	volumeMounts := BuildVolumeMountsFromPersistentVolumeClaims(allPersistentVolumeClaims)
 	container.VolumeMounts = volumeMounts
@@ -184,13 +191,36 @@ func ConfigureContainer(instance *TeamCity, node Node, container *v12.Container)
 
 }
 
+func relaxStartupProbe(probe *v12.Probe) {
+	periodSeconds := probe.PeriodSeconds
+	if periodSeconds <= 0 {
+		periodSeconds = defaultProbePeriodSeconds
+	}
+	probe.FailureThreshold = restoreStartupTimeoutSeconds / periodSeconds
+}
+
 func ConfigureStatefulSet(instance *TeamCity, node Node, current *v1.StatefulSet) {
 	allPersistentVolumeClaims := instance.GetAllCustomPersistentVolumeClaim()
 	volumes := BuildVolumesFromPersistentVolumeClaims(allPersistentVolumeClaims)
 	current.Spec.Replicas = pointer.Int32(1)
+	if instance.IsStopped() {
+		current.Spec.Replicas = pointer.Int32(0)
+	}
 	current.Spec.Template.Annotations = node.Annotations
+	if configHash := instance.Status.ConfigHash; configHash != "" && configHash != instance.Status.ConfigHashBaseline {
+		annotations := make(map[string]string, len(node.Annotations)+1)
+		for key, value := range node.Annotations {
+			annotations[key] = value
+		}
+		annotations[ConfigHashAnnotationKey] = instance.Status.ConfigHash
+		current.Spec.Template.Annotations = annotations
+	}
 	current.Spec.Template.Spec.Volumes = volumes
 	current.Spec.Template.Spec.InitContainers = node.Spec.InitContainers
+	if initContainers, initVolumes := operatorInitContainers(instance); len(initContainers) > 0 {
+		current.Spec.Template.Spec.Volumes = append(volumes, initVolumes...)
+		current.Spec.Template.Spec.InitContainers = append(initContainers, node.Spec.InitContainers...)
+	}
 	current.Spec.Template.Spec.NodeSelector = node.Spec.NodeSelector
 	current.Spec.Template.Spec.Affinity = &node.Spec.Affinity
 	current.Spec.Template.Spec.SecurityContext = &node.Spec.PodSecurityContext
@@ -201,14 +231,24 @@ func ConfigureStatefulSet(instance *TeamCity, node Node, current *v1.StatefulSet
 	}
 }
 
-func DatabaseEnvVarBuilder(databaseSecretName string) []v12.EnvVar {
+// operatorInitContainers prepare the data directory before the init containers of the node run.
+func operatorInitContainers(instance *TeamCity) ([]v12.Container, []v12.Volume) {
+	initContainers, volumes := JDBCDriverInitContainers(instance)
+	if instance.DatabaseSecretAsFile() {
+		initContainers = append(initContainers, DatabasePropertiesInitContainer(instance))
+		volumes = append(volumes, DatabaseSecretVolume(instance))
+	}
+	return initContainers, volumes
+}
+
+func DatabaseEnvVarBuilder(databaseSecretName string, keys DatabaseSecretKeys) []v12.EnvVar {
 	return []v12.EnvVar{
 		{
 			Name: "TEAMCITY_DB_USER",
 			ValueFrom: &v12.EnvVarSource{
 				SecretKeyRef: &v12.SecretKeySelector{
 					LocalObjectReference: v12.LocalObjectReference{Name: databaseSecretName},
-					Key:                  TEAMCITY_DB_USER_SECRET_KEY,
+					Key:                  keys.UserKey(),
 				},
 			},
 		},
@@ -217,7 +257,7 @@ func DatabaseEnvVarBuilder(databaseSecretName string) []v12.EnvVar {
 			ValueFrom: &v12.EnvVarSource{
 				SecretKeyRef: &v12.SecretKeySelector{
 					LocalObjectReference: v12.LocalObjectReference{Name: databaseSecretName},
-					Key:                  TEAMCITY_DB_PASSWORD_SECRET_KEY,
+					Key:                  keys.PasswordKey(),
 				},
 			},
 		},
@@ -226,7 +266,7 @@ func DatabaseEnvVarBuilder(databaseSecretName string) []v12.EnvVar {
 			ValueFrom: &v12.EnvVarSource{
 				SecretKeyRef: &v12.SecretKeySelector{
 					LocalObjectReference: v12.LocalObjectReference{Name: databaseSecretName},
-					Key:                  TEAMCITY_DB_URL_SECRET_KEY,
+					Key:                  keys.URLKey(),
 				},
 			},
 		},
@@ -244,8 +284,8 @@ func BuildEnvVariablesFromGlobalAndNodeSpecificSettings(instance *TeamCity, node
 	xmxValue := XmxValueCalculator(instance.Spec.XmxPercentage, node.Spec.Requests.Memory().Value())
 	envVars := DefaultEnvironmentVariableBuilder(node.Name, xmxValue, dataDirPath, extraServerOpts)
 	envVars = append(envVars, node.Spec.Env...)
-	if instance.DatabaseSecretProvided() {
-		databaseEnvVars := DatabaseEnvVarBuilder(instance.Spec.DatabaseSecret.Secret)
+	if instance.DatabaseSecretProvided() && !instance.DatabaseSecretAsFile() {
+		databaseEnvVars := DatabaseEnvVarBuilder(instance.Spec.DatabaseSecret.Secret, instance.Spec.DatabaseSecret.Keys)
 		envVars = append(envVars, databaseEnvVars...)
 	}
 	return envVars
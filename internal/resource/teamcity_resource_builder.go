@@ -30,6 +30,10 @@ func (builder *TeamCityResourceBuilder) ResourceBuilders() []ResourceBuilder {
 		builder.StatefulSet(),
 		builder.SecondaryStatefulSet(),
 	}
+	// secondary nodes are stopped before the main node, and started after it
+	if builder.Instance.IsStopped() {
+		builders[4], builders[5] = builders[5], builders[4]
+	}
 
 	return builders
 }
@@ -5,7 +5,6 @@ import (
 	. "git.jetbrains.team/tch/teamcity-operator/api/v1beta1"
 	"git.jetbrains.team/tch/teamcity-operator/internal/metadata"
 	v1 "k8s.io/api/apps/v1"
-	v12 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/equality"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
@@ -15,7 +14,7 @@ import (
 
 const (
 	RoNodeRole    = "update-with-ro"
-	RoNodePostfix = "-update-replica"
+	RoNodePostfix = ReadOnlyReplicaNameSuffix
 )
 
 func BuildRoNode(instance *TeamCity, name string) Node {
@@ -66,14 +65,6 @@ func UpdateROStatefulSet(scheme *runtime.Scheme, instance *TeamCity,
 }
 
 func ChangesRequireNodeStatefulSetRestart(instance *TeamCity, node Node, existing *v1.StatefulSet) bool {
-	var desired v1.StatefulSet
-	ConfigureStatefulSet(instance, node, &desired)
-	var container v12.Container
-	ConfigureContainer(instance, node, &container)
-	desired.Spec.Template.Spec.Containers = []v12.Container{container}
-
-	if !equality.Semantic.DeepDerivative(desired.Spec, existing.Spec) {
-		return true
-	}
-	return false
+	desired := desiredNodeStatefulSetSpec(instance, node, existing)
+	return !equality.Semantic.DeepDerivative(desired, existing.Spec)
 }
@@ -160,5 +160,17 @@ var _ = Describe("UpdateWithROUtils", func() {
 			result := ChangesRequireNodeStatefulSetRestart(instance, node, existing)
 			Expect(result).To(BeTrue())
 		})
+
+		It("returns false when only replicas change", func() {
+			existing := &v1.StatefulSet{}
+			ConfigureStatefulSet(instance, node, existing)
+			var container v12.Container
+			ConfigureContainer(instance, node, &container)
+			existing.Spec.Template.Spec.Containers = []v12.Container{container}
+
+			instance.Spec.Stopped = true
+			result := ChangesRequireNodeStatefulSetRestart(instance, node, existing)
+			Expect(result).To(BeFalse())
+		})
 	})
 })
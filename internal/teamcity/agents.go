@@ -0,0 +1,69 @@
+package teamcity
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+// Agent is a build agent registered on the server.
+type Agent struct {
+	ID         int           `json:"id"`
+	Name       string        `json:"name"`
+	Authorized bool          `json:"authorized"`
+	Connected  bool          `json:"connected"`
+	Pool       *AgentPoolRef `json:"pool,omitempty"`
+	// Build is the build the agent is running, if any.
+	Build *BuildRef `json:"build,omitempty"`
+}
+
+// BuildRef identifies a build.
+type BuildRef struct {
+	ID int `json:"id"`
+}
+
+// AgentPoolRef identifies an agent pool.
+type AgentPoolRef struct {
+	ID   int    `json:"id"`
+	Name string `json:"name"`
+}
+
+// ListAgents returns every registered agent, including unauthorized and disconnected ones.
+func (c *Client) ListAgents(ctx context.Context) ([]Agent, error) {
+	var agents struct {
+		Agent []Agent `json:"agent"`
+	}
+	query := url.Values{
+		"locator": {"defaultFilter:false"},
+		"fields":  {"agent(id,name,authorized,connected,pool(id,name),build(id))"},
+	}
+	err := c.getJSON(ctx, AgentsPath, query, &agents)
+	return agents.Agent, err
+}
+
+// SetAgentAuthorized authorizes or unauthorizes an agent.
+func (c *Client) SetAgentAuthorized(ctx context.Context, agentID int, authorized bool) error {
+	_, err := c.doWithBody(ctx, http.MethodPut, AgentsPath+"/id:"+strconv.Itoa(agentID)+"/authorized", nil,
+		"text/plain", "text/plain", []byte(strconv.FormatBool(authorized)))
+	return err
+}
+
+// GetAgentPool looks an agent pool up by name.
+func (c *Client) GetAgentPool(ctx context.Context, name string) (AgentPoolRef, error) {
+	var pool AgentPoolRef
+	err := c.getJSON(ctx, AgentPoolsPath+"/name:"+url.PathEscape(name), url.Values{"fields": {"id,name"}}, &pool)
+	return pool, err
+}
+
+// AssignAgentToPool moves an agent to the agent pool with the given id.
+func (c *Client) AssignAgentToPool(ctx context.Context, poolID int, agentID int) error {
+	body, err := json.Marshal(map[string]int{"id": agentID})
+	if err != nil {
+		return err
+	}
+	_, err = c.doWithBody(ctx, http.MethodPost, AgentPoolsPath+"/id:"+strconv.Itoa(poolID)+"/agents", nil,
+		"application/json", "application/json", body)
+	return err
+}
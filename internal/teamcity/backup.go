@@ -0,0 +1,88 @@
+package teamcity
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// BackupStatus is the progress status the server reports for the current backup process.
+type BackupStatus string
+
+const (
+	BackupStatusIdle      BackupStatus = "Idle"
+	BackupStatusStarted   BackupStatus = "Started"
+	BackupStatusRunning   BackupStatus = "Running"
+	BackupStatusFinished  BackupStatus = "Finished"
+	BackupStatusCancelled BackupStatus = "Cancelled"
+	BackupStatusFaulted   BackupStatus = "Faulted"
+)
+
+func (s BackupStatus) IsRunning() bool {
+	return s == BackupStatusStarted || s == BackupStatusRunning
+}
+
+func (s BackupStatus) IsFinished() bool {
+	return s == BackupStatusFinished
+}
+
+func (s BackupStatus) IsFailed() bool {
+	return s == BackupStatusCancelled || s == BackupStatusFaulted
+}
+
+// BackupOptions are the query parameters of the backup endpoint.
+type BackupOptions struct {
+	FileName                 string
+	AddTimestamp             bool
+	IncludeConfigs           bool
+	IncludeDatabase          bool
+	IncludeBuildLogs         bool
+	IncludePersonalChanges   bool
+	IncludeRunningBuilds     bool
+	IncludeSupplimentaryData bool
+}
+
+func (o BackupOptions) query() url.Values {
+	return url.Values{
+		"fileName":                 {o.FileName},
+		"addTimestamp":             {strconv.FormatBool(o.AddTimestamp)},
+		"includeConfigs":           {strconv.FormatBool(o.IncludeConfigs)},
+		"includeDatabase":          {strconv.FormatBool(o.IncludeDatabase)},
+		"includeBuildLogs":         {strconv.FormatBool(o.IncludeBuildLogs)},
+		"includePersonalChanges":   {strconv.FormatBool(o.IncludePersonalChanges)},
+		"includeRunningBuilds":     {strconv.FormatBool(o.IncludeRunningBuilds)},
+		"includeSupplimentaryData": {strconv.FormatBool(o.IncludeSupplimentaryData)},
+	}
+}
+
+// BackupFile is the metadata of a file in the backup directory of the server.
+type BackupFile struct {
+	Name string `json:"name"`
+	Size int64  `json:"size"`
+}
+
+// StartBackup starts a backup and returns the name of the file the server writes.
+func (c *Client) StartBackup(ctx context.Context, options BackupOptions) (string, error) {
+	body, err := c.do(ctx, http.MethodPost, BackupPath, options.query(), "text/plain")
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(body)), nil
+}
+
+func (c *Client) GetBackupStatus(ctx context.Context) (BackupStatus, error) {
+	body, err := c.do(ctx, http.MethodGet, BackupPath, nil, "text/plain")
+	if err != nil {
+		return "", err
+	}
+	return BackupStatus(strings.TrimSpace(string(body))), nil
+}
+
+// GetBackupFile returns the metadata of a finished backup file.
+func (c *Client) GetBackupFile(ctx context.Context, fileName string) (BackupFile, error) {
+	var file BackupFile
+	err := c.getJSON(ctx, FilesPathRoot+"/backup/metadata/"+url.PathEscape(fileName), nil, &file)
+	return file, err
+}
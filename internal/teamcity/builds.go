@@ -0,0 +1,33 @@
+package teamcity
+
+import (
+	"context"
+	"net/url"
+	"strconv"
+)
+
+// RunningBuildsCount returns the number of builds running on any agent of the server.
+func (c *Client) RunningBuildsCount(ctx context.Context) (int, error) {
+	var builds struct {
+		Count int `json:"count"`
+	}
+	query := url.Values{
+		"locator": {"state:running,defaultFilter:false"},
+		"fields":  {"count"},
+	}
+	err := c.getJSON(ctx, BuildsPath, query, &builds)
+	return builds.Count, err
+}
+
+// QueuedBuildsCount returns the number of queued builds, limited to the agent pool with poolID when it is not nil.
+func (c *Client) QueuedBuildsCount(ctx context.Context, poolID *int) (int, error) {
+	var builds struct {
+		Count int `json:"count"`
+	}
+	query := url.Values{"fields": {"count"}}
+	if poolID != nil {
+		query.Set("locator", "pool:(id:"+strconv.Itoa(*poolID)+")")
+	}
+	err := c.getJSON(ctx, BuildQueuePath, query, &builds)
+	return builds.Count, err
+}
@@ -0,0 +1,126 @@
+package teamcity
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	ServerPath           = "/app/rest/server"
+	NodesPath            = "/app/rest/server/nodes"
+	HealthCheckReadyPath = "/healthCheck/ready"
+	BackupPath           = "/app/rest/server/backup"
+	CleanupPath          = "/app/rest/server/cleanup"
+	FilesPathRoot        = "/app/rest/server/files"
+	BuildsPath           = "/app/rest/builds"
+	BuildQueuePath       = "/app/rest/buildQueue"
+	AgentsPath           = "/app/rest/agents"
+	AgentPoolsPath       = "/app/rest/agentPools"
+
+	defaultRequestTimeout = 30 * time.Second
+)
+
+// Client talks to the REST API of a single TeamCity server.
+type Client struct {
+	serverURL  string
+	token      string
+	httpClient *http.Client
+}
+
+func NewClient(serverURL string, token string, httpClient *http.Client) *Client {
+	if httpClient == nil {
+		httpClient = &http.Client{Timeout: defaultRequestTimeout}
+	}
+	return &Client{
+		serverURL:  strings.TrimSuffix(serverURL, "/"),
+		token:      token,
+		httpClient: httpClient,
+	}
+}
+
+func (c *Client) ServerURL() string {
+	return c.serverURL
+}
+
+// APIError is returned when the server answers with a non-2xx status code.
+type APIError struct {
+	Method     string
+	Path       string
+	StatusCode int
+	Body       string
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("TeamCity REST API %s %s returned %d: %s", e.Method, e.Path, e.StatusCode, e.Body)
+}
+
+func IsNotFound(err error) bool {
+	apiErr, ok := err.(*APIError)
+	return ok && apiErr.StatusCode == http.StatusNotFound
+}
+
+func IsConflict(err error) bool {
+	apiErr, ok := err.(*APIError)
+	return ok && apiErr.StatusCode == http.StatusConflict
+}
+
+// IsUnavailable reports a 503, which the server answers with while it starts or waits on the maintenance page.
+func IsUnavailable(err error) bool {
+	apiErr, ok := err.(*APIError)
+	return ok && apiErr.StatusCode == http.StatusServiceUnavailable
+}
+
+func (c *Client) do(ctx context.Context, method string, path string, query url.Values, accept string) ([]byte, error) {
+	return c.doWithBody(ctx, method, path, query, accept, "", nil)
+}
+
+func (c *Client) doWithBody(ctx context.Context, method string, path string, query url.Values, accept string, contentType string, body []byte) ([]byte, error) {
+	requestURL := c.serverURL + path
+	if len(query) > 0 {
+		requestURL += "?" + query.Encode()
+	}
+	var requestBody io.Reader
+	if body != nil {
+		requestBody = bytes.NewReader(body)
+	}
+	request, err := http.NewRequestWithContext(ctx, method, requestURL, requestBody)
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Accept", accept)
+	if contentType != "" {
+		request.Header.Set("Content-Type", contentType)
+	}
+	if c.token != "" {
+		request.Header.Set("Authorization", "Bearer "+c.token)
+	}
+
+	response, err := c.httpClient.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	responseBody, err := io.ReadAll(response.Body)
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return nil, &APIError{Method: method, Path: path, StatusCode: response.StatusCode, Body: strings.TrimSpace(string(responseBody))}
+	}
+	return responseBody, nil
+}
+
+func (c *Client) getJSON(ctx context.Context, path string, query url.Values, target interface{}) error {
+	body, err := c.do(ctx, http.MethodGet, path, query, "application/json")
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(body, target)
+}
@@ -0,0 +1,258 @@
+package teamcity_test
+
+import (
+	"context"
+	"testing"
+
+	. "git.jetbrains.team/tch/teamcity-operator/api/v1beta1"
+	"git.jetbrains.team/tch/teamcity-operator/internal/teamcity"
+	"git.jetbrains.team/tch/teamcity-operator/internal/teamcity/teamcitytest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	v12 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestStartBackupSendsOptionsAndReturnsFileName(t *testing.T) {
+	server := teamcitytest.NewServer("token")
+	defer server.Close()
+	client := teamcity.NewClient(server.URL, "token", nil)
+
+	fileName, err := client.StartBackup(context.Background(), teamcity.BackupOptions{
+		FileName:        "nightly",
+		AddTimestamp:    true,
+		IncludeConfigs:  true,
+		IncludeDatabase: true,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "nightly"+teamcitytest.BackupTimestamp+".zip", fileName)
+
+	requests := server.BackupRequests()
+	require.Len(t, requests, 1)
+	assert.Equal(t, "true", requests[0].Get("includeDatabase"))
+	assert.Equal(t, "false", requests[0].Get("includeBuildLogs"))
+
+	status, err := client.GetBackupStatus(context.Background())
+	require.NoError(t, err)
+	assert.True(t, status.IsRunning())
+
+	_, err = client.StartBackup(context.Background(), teamcity.BackupOptions{FileName: "second"})
+	assert.True(t, teamcity.IsConflict(err), "expected conflict while another backup is running, got %v", err)
+}
+
+func TestGetBackupFile(t *testing.T) {
+	server := teamcitytest.NewServer("")
+	defer server.Close()
+	server.AddBackupFile("backup.zip", 2048)
+	client := teamcity.NewClient(server.URL, "", nil)
+
+	file, err := client.GetBackupFile(context.Background(), "backup.zip")
+	require.NoError(t, err)
+	assert.Equal(t, int64(2048), file.Size)
+
+	_, err = client.GetBackupFile(context.Background(), "missing.zip")
+	assert.True(t, teamcity.IsNotFound(err), "expected not found, got %v", err)
+}
+
+func TestRunningBuildsCount(t *testing.T) {
+	server := teamcitytest.NewServer("")
+	defer server.Close()
+	client := teamcity.NewClient(server.URL, "", nil)
+
+	count, err := client.RunningBuildsCount(context.Background())
+	require.NoError(t, err)
+	assert.Zero(t, count)
+
+	server.SetRunningBuilds(3)
+	count, err = client.RunningBuildsCount(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, 3, count)
+}
+
+func TestQueuedBuildsCount(t *testing.T) {
+	server := teamcitytest.NewServer("")
+	defer server.Close()
+	poolID := server.AddAgentPool("Linux")
+	server.SetQueuedBuilds(0, 2)
+	server.SetQueuedBuilds(poolID, 3)
+	client := teamcity.NewClient(server.URL, "", nil)
+
+	count, err := client.QueuedBuildsCount(context.Background(), nil)
+	require.NoError(t, err)
+	assert.Equal(t, 5, count)
+
+	count, err = client.QueuedBuildsCount(context.Background(), &poolID)
+	require.NoError(t, err)
+	assert.Equal(t, 3, count)
+}
+
+func TestAuthorizeAgentAndAssignPool(t *testing.T) {
+	server := teamcitytest.NewServer("token")
+	defer server.Close()
+	agentID := server.AddAgent("linux-0")
+	poolID := server.AddAgentPool("Linux")
+	client := teamcity.NewClient(server.URL, "token", nil)
+
+	agents, err := client.ListAgents(context.Background())
+	require.NoError(t, err)
+	require.Len(t, agents, 1)
+	assert.Equal(t, "linux-0", agents[0].Name)
+	assert.False(t, agents[0].Authorized)
+
+	require.NoError(t, client.SetAgentAuthorized(context.Background(), agentID, true))
+	pool, err := client.GetAgentPool(context.Background(), "Linux")
+	require.NoError(t, err)
+	assert.Equal(t, poolID, pool.ID)
+	require.NoError(t, client.AssignAgentToPool(context.Background(), pool.ID, agentID))
+
+	agent, _ := server.Agent("linux-0")
+	assert.True(t, agent.Authorized)
+	assert.Equal(t, "Linux", agent.Pool.Name)
+
+	_, err = client.GetAgentPool(context.Background(), "Windows")
+	assert.True(t, teamcity.IsNotFound(err), "expected not found, got %v", err)
+}
+
+func TestGetServerInfo(t *testing.T) {
+	server := teamcitytest.NewServer("token")
+	defer server.Close()
+	server.SetServerInfo(teamcity.ServerInfo{Version: "2023.11.4 (build 147586)", VersionMajor: 2023, VersionMinor: 11, BuildNumber: "147586"})
+	client := teamcity.NewClient(server.URL, "token", nil)
+
+	info, err := client.GetServerInfo(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, 2023, info.VersionMajor)
+	assert.Equal(t, 11, info.VersionMinor)
+	assert.Equal(t, "147586", info.BuildNumber)
+}
+
+func TestNodesAndResponsibilities(t *testing.T) {
+	server := teamcitytest.NewServer("token")
+	defer server.Close()
+	server.AddNode("secondary-0", teamcity.ResponsibilityVCSChangesCollector)
+	server.SetNodeState("secondary-0", "starting")
+	client := teamcity.NewClient(server.URL, "token", nil)
+
+	nodes, err := client.ListNodes(context.Background())
+	require.NoError(t, err)
+	require.Len(t, nodes, 2)
+	assert.Equal(t, teamcitytest.MainNodeID, nodes[0].ID)
+	assert.True(t, nodes[0].EffectiveResponsibilities.Has(teamcity.ResponsibilityMainNode))
+	assert.False(t, nodes[1].Online)
+	assert.True(t, nodes[1].EnabledResponsibilities.Has(teamcity.ResponsibilityVCSChangesCollector))
+
+	require.NoError(t, client.SetNodeResponsibility(context.Background(), "secondary-0", teamcity.ResponsibilityBuildMessagesProcessor, true))
+	require.NoError(t, client.SetNodeResponsibility(context.Background(), "secondary-0", teamcity.ResponsibilityVCSChangesCollector, false))
+	node, _ := server.Node("secondary-0")
+	assert.True(t, node.EnabledResponsibilities.Has(teamcity.ResponsibilityBuildMessagesProcessor))
+	assert.False(t, node.EnabledResponsibilities.Has(teamcity.ResponsibilityVCSChangesCollector))
+
+	err = client.SetNodeResponsibility(context.Background(), "missing", teamcity.ResponsibilityVCSChangesCollector, true)
+	assert.True(t, teamcity.IsNotFound(err), "expected not found, got %v", err)
+}
+
+func TestIsReadyDuringMaintenance(t *testing.T) {
+	server := teamcitytest.NewServer("token")
+	defer server.Close()
+	client := teamcity.NewClient(server.URL, "", nil)
+
+	ready, err := client.IsReady(context.Background())
+	require.NoError(t, err)
+	assert.True(t, ready)
+
+	server.SetMaintenance(true)
+	ready, err = client.IsReady(context.Background())
+	require.NoError(t, err)
+	assert.False(t, ready)
+	_, err = client.GetServerInfo(context.Background())
+	assert.True(t, teamcity.IsUnavailable(err), "expected unavailable, got %v", err)
+}
+
+func TestCleanupSettings(t *testing.T) {
+	server := teamcitytest.NewServer("token")
+	defer server.Close()
+	client := teamcity.NewClient(server.URL, "token", nil)
+
+	settings, err := client.GetCleanupSettings(context.Background())
+	require.NoError(t, err)
+	assert.True(t, settings.Enabled)
+	require.NotNil(t, settings.Daily)
+	assert.Equal(t, 3, settings.Daily.Hour)
+
+	settings = teamcity.CleanupSettings{Enabled: true, MaxCleanupDuration: 60, Cron: &teamcity.CleanupCron{
+		Minute: "0", Hour: "1", Day: "?", Month: "*", DayOfWeek: "SUN",
+	}}
+	require.NoError(t, client.SetCleanupSettings(context.Background(), settings))
+	assert.Equal(t, settings, server.CleanupSettings())
+	got, err := client.GetCleanupSettings(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, settings, got)
+
+	server.SetMaintenance(true)
+	_, err = client.GetCleanupSettings(context.Background())
+	assert.True(t, teamcity.IsUnavailable(err), "expected unavailable, got %v", err)
+}
+
+func TestClientReportsAuthenticationErrors(t *testing.T) {
+	server := teamcitytest.NewServer("token")
+	defer server.Close()
+	client := teamcity.NewClient(server.URL, "wrong", nil)
+
+	_, err := client.GetBackupStatus(context.Background())
+	var apiErr *teamcity.APIError
+	require.ErrorAs(t, err, &apiErr)
+	assert.Equal(t, 401, apiErr.StatusCode)
+}
+
+func TestMainNodeURL(t *testing.T) {
+	cases := []struct {
+		name     string
+		instance TeamCity
+		expected string
+		wantErr  bool
+	}{
+		{
+			name: "headless service of the main node",
+			instance: TeamCity{
+				ObjectMeta: metav1.ObjectMeta{Name: "tc", Namespace: "ci"},
+				Spec: TeamCitySpec{
+					MainNode:           Node{Name: "main", Spec: NodeSpec{ServiceName: "tc-headless"}},
+					TeamCityServerPort: v12.ContainerPort{ContainerPort: 8111},
+				},
+			},
+			expected: "http://main-0.tc-headless.ci.svc:8111",
+		},
+		{
+			name: "first service of the service list",
+			instance: TeamCity{
+				ObjectMeta: metav1.ObjectMeta{Name: "tc", Namespace: "ci"},
+				Spec: TeamCitySpec{
+					MainNode: Node{Name: "main"},
+					ServiceList: []Service{
+						{Name: "tc-svc", ServiceSpec: v12.ServiceSpec{Ports: []v12.ServicePort{{Port: 80}}}},
+					},
+				},
+			},
+			expected: "http://tc-svc.ci.svc:80",
+		},
+		{
+			name: "no way to reach the server",
+			instance: TeamCity{
+				ObjectMeta: metav1.ObjectMeta{Name: "tc", Namespace: "ci"},
+				Spec:       TeamCitySpec{MainNode: Node{Name: "main"}},
+			},
+			wantErr: true,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			url, err := teamcity.MainNodeURL(&c.instance)
+			if c.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, c.expected, url)
+		})
+	}
+}
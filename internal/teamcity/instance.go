@@ -0,0 +1,67 @@
+package teamcity
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	. "git.jetbrains.team/tch/teamcity-operator/api/v1beta1"
+	v12 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const defaultServerPort = 8111
+
+// ClientFactory builds a REST client for the main node of a TeamCity instance.
+// Reconcilers take it as a field so tests can point them to a fake server.
+type ClientFactory func(ctx context.Context, reader client.Reader, instance *TeamCity) (*Client, error)
+
+// NewClientForInstance is the ClientFactory used by the manager.
+func NewClientForInstance(ctx context.Context, reader client.Reader, instance *TeamCity) (*Client, error) {
+	serverURL, err := MainNodeURL(instance)
+	if err != nil {
+		return nil, err
+	}
+	token, err := readAPIToken(ctx, reader, instance)
+	if err != nil {
+		return nil, err
+	}
+	return NewClient(serverURL, token, nil), nil
+}
+
+// MainNodeURL returns the in-cluster URL of the main node. The pod DNS name of the governing
+// headless service is preferred because only the main node accepts backups and other administrative requests.
+func MainNodeURL(instance *TeamCity) (string, error) {
+	mainNode := instance.Spec.MainNode
+	if mainNode.Spec.ServiceName != "" {
+		port := instance.Spec.TeamCityServerPort.ContainerPort
+		if port == 0 {
+			port = defaultServerPort
+		}
+		return fmt.Sprintf("http://%s-0.%s.%s.svc:%d", mainNode.Name, mainNode.Spec.ServiceName, instance.Namespace, port), nil
+	}
+	for _, service := range instance.Spec.ServiceList {
+		if len(service.ServiceSpec.Ports) == 0 {
+			continue
+		}
+		return fmt.Sprintf("http://%s.%s.svc:%d", service.Name, instance.Namespace, service.ServiceSpec.Ports[0].Port), nil
+	}
+	return "", fmt.Errorf("TeamCity %s/%s has neither spec.mainNode.spec.serviceName nor a Service in spec.serviceList to reach the server", instance.Namespace, instance.Name)
+}
+
+func readAPIToken(ctx context.Context, reader client.Reader, instance *TeamCity) (string, error) {
+	if !instance.APITokenSecretProvided() {
+		return "", fmt.Errorf("TeamCity %s/%s has no spec.apiTokenSecret, which is required for REST API calls", instance.Namespace, instance.Name)
+	}
+	selector := instance.Spec.APITokenSecret
+	var secret v12.Secret
+	if err := reader.Get(ctx, types.NamespacedName{Name: selector.Name, Namespace: instance.Namespace}, &secret); err != nil {
+		return "", err
+	}
+	token, ok := secret.Data[selector.Key]
+	if !ok {
+		return "", fmt.Errorf("secret %s/%s has no key %q", instance.Namespace, selector.Name, selector.Key)
+	}
+	return strings.TrimSpace(string(token)), nil
+}
@@ -0,0 +1,49 @@
+package teamcity
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+)
+
+// CleanupSettings are the settings of the server clean-up, which removes old builds and data according to the
+// clean-up rules of the projects. It runs on the main node and slows it down, so backups are best scheduled apart.
+type CleanupSettings struct {
+	Enabled bool `json:"enabled"`
+	// MaxCleanupDuration in minutes; 0 lets the clean-up run until it is done.
+	MaxCleanupDuration int           `json:"maxCleanupDuration"`
+	Daily              *CleanupDaily `json:"daily,omitempty"`
+	Cron               *CleanupCron  `json:"cron,omitempty"`
+}
+
+// CleanupDaily starts the clean-up every day at the given server time.
+type CleanupDaily struct {
+	Hour   int `json:"hour"`
+	Minute int `json:"minute"`
+}
+
+// CleanupCron starts the clean-up on a cron-like schedule in server time.
+type CleanupCron struct {
+	Minute    string `json:"minute"`
+	Hour      string `json:"hour"`
+	Day       string `json:"day"`
+	Month     string `json:"month"`
+	DayOfWeek string `json:"dayWeek"`
+}
+
+// GetCleanupSettings returns the clean-up settings of the server.
+func (c *Client) GetCleanupSettings(ctx context.Context) (CleanupSettings, error) {
+	var settings CleanupSettings
+	err := c.getJSON(ctx, CleanupPath, nil, &settings)
+	return settings, err
+}
+
+// SetCleanupSettings replaces the clean-up settings of the server, e.g. to disable the clean-up for a maintenance window.
+func (c *Client) SetCleanupSettings(ctx context.Context, settings CleanupSettings) error {
+	body, err := json.Marshal(settings)
+	if err != nil {
+		return err
+	}
+	_, err = c.doWithBody(ctx, http.MethodPut, CleanupPath, nil, "application/json", "application/json", body)
+	return err
+}
@@ -0,0 +1,67 @@
+package teamcity
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+// Responsibilities a node of a multinode setup can take over from the main node.
+const (
+	ResponsibilityMainNode               = "MAIN_NODE"
+	ResponsibilityBuildMessagesProcessor = "CAN_PROCESS_BUILD_MESSAGES"
+	ResponsibilityVCSChangesCollector    = "CAN_CHECK_FOR_CHANGES"
+	ResponsibilityBuildTriggersProcessor = "CAN_PROCESS_BUILD_TRIGGERS"
+	ResponsibilityUserDataModifications  = "CAN_PROCESS_USER_DATA_MODIFICATION_REQUESTS"
+)
+
+// ServerNode is a server node of a multinode setup, including the main node.
+type ServerNode struct {
+	ID     string `json:"id"`
+	URL    string `json:"url"`
+	Role   string `json:"role"`
+	State  string `json:"state"`
+	Online bool   `json:"online"`
+	// EnabledResponsibilities are the responsibilities assigned to the node, EffectiveResponsibilities the ones it
+	// currently holds; they differ while another node still holds a responsibility, e.g. during a main node switch.
+	EnabledResponsibilities   Responsibilities `json:"enabledResponsibilities"`
+	EffectiveResponsibilities Responsibilities `json:"effectiveResponsibilities"`
+}
+
+type Responsibilities struct {
+	Responsibility []Responsibility `json:"responsibility"`
+}
+
+type Responsibility struct {
+	Name string `json:"name"`
+}
+
+// Has reports whether the responsibility with the given name is in the list.
+func (r Responsibilities) Has(name string) bool {
+	for _, responsibility := range r.Responsibility {
+		if responsibility.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// ListNodes returns every node known to the server, including offline ones.
+func (c *Client) ListNodes(ctx context.Context) ([]ServerNode, error) {
+	var nodes struct {
+		Node []ServerNode `json:"node"`
+	}
+	query := url.Values{
+		"fields": {"node(id,url,role,state,online,enabledResponsibilities(responsibility(name)),effectiveResponsibilities(responsibility(name)))"},
+	}
+	err := c.getJSON(ctx, NodesPath, query, &nodes)
+	return nodes.Node, err
+}
+
+// SetNodeResponsibility enables or disables a responsibility of the node with the given id.
+func (c *Client) SetNodeResponsibility(ctx context.Context, nodeID string, name string, enabled bool) error {
+	_, err := c.doWithBody(ctx, http.MethodPut, NodesPath+"/id:"+url.PathEscape(nodeID)+"/enabledResponsibilities/"+url.PathEscape(name), nil,
+		"text/plain", "text/plain", []byte(strconv.FormatBool(enabled)))
+	return err
+}
@@ -0,0 +1,35 @@
+package teamcity
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+)
+
+// ServerInfo is the version information the server reports about itself.
+type ServerInfo struct {
+	// Version is the display version, e.g. "2024.03 (build 156287)".
+	Version      string `json:"version"`
+	VersionMajor int    `json:"versionMajor"`
+	VersionMinor int    `json:"versionMinor"`
+	BuildNumber  string `json:"buildNumber"`
+	// StartTime uses the TeamCity date format, e.g. "20240101T120000+0000".
+	StartTime string `json:"startTime,omitempty"`
+}
+
+// GetServerInfo returns the version of the node the client talks to.
+func (c *Client) GetServerInfo(ctx context.Context) (ServerInfo, error) {
+	var info ServerInfo
+	err := c.getJSON(ctx, ServerPath, url.Values{"fields": {"version,versionMajor,versionMinor,buildNumber,startTime"}}, &info)
+	return info, err
+}
+
+// IsReady reports whether the node accepts requests. A node that is starting, waiting on the maintenance
+// page for a data upgrade or shutting down answers the readiness check with 503, which is not an error here.
+func (c *Client) IsReady(ctx context.Context) (bool, error) {
+	_, err := c.do(ctx, http.MethodGet, HealthCheckReadyPath, nil, "text/plain")
+	if IsUnavailable(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
@@ -0,0 +1,485 @@
+// Package teamcitytest provides an in-process fake of the TeamCity REST API for tests.
+package teamcitytest
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+
+	"git.jetbrains.team/tch/teamcity-operator/internal/teamcity"
+)
+
+// BackupTimestamp is appended to the file name of backups started with addTimestamp=true.
+const BackupTimestamp = "_20240101_120000"
+
+// MainNodeID is the id of the main node every fake server starts with.
+const MainNodeID = "main"
+
+// Server is a fake TeamCity server. Tests drive long-running operations explicitly,
+// e.g. a started backup stays Running until FinishBackup or FailBackup is called.
+type Server struct {
+	*httptest.Server
+
+	Token string
+
+	mu             sync.Mutex
+	backupStatus   teamcity.BackupStatus
+	currentBackup  string
+	backupRequests []url.Values
+	files          map[string]int64
+	runningBuilds  int
+	agents         []teamcity.Agent
+	agentPools     []teamcity.AgentPoolRef
+	queuedBuilds   map[int]int
+	serverInfo     teamcity.ServerInfo
+	nodes          []teamcity.ServerNode
+	maintenance    bool
+	cleanup        teamcity.CleanupSettings
+}
+
+// NewServer starts a fake server that requires the given bearer token; an empty token disables authentication.
+func NewServer(token string) *Server {
+	s := &Server{
+		Token:        token,
+		backupStatus: teamcity.BackupStatusIdle,
+		files:        map[string]int64{},
+		agentPools:   []teamcity.AgentPoolRef{{ID: 0, Name: "Default"}},
+		queuedBuilds: map[int]int{},
+		serverInfo: teamcity.ServerInfo{
+			Version:      "2024.03 (build 156287)",
+			VersionMajor: 2024,
+			VersionMinor: 3,
+			BuildNumber:  "156287",
+		},
+		nodes: []teamcity.ServerNode{{
+			ID:                        MainNodeID,
+			Role:                      "main_node",
+			State:                     "online",
+			Online:                    true,
+			EnabledResponsibilities:   responsibilities(teamcity.ResponsibilityMainNode),
+			EffectiveResponsibilities: responsibilities(teamcity.ResponsibilityMainNode),
+		}},
+		cleanup: teamcity.CleanupSettings{Enabled: true, Daily: &teamcity.CleanupDaily{Hour: 3}},
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc(teamcity.ServerPath, s.handleServerInfo)
+	mux.HandleFunc(teamcity.NodesPath, s.handleNodes)
+	mux.HandleFunc(teamcity.NodesPath+"/", s.handleNode)
+	mux.HandleFunc(teamcity.HealthCheckReadyPath, s.handleReady)
+	mux.HandleFunc(teamcity.BackupPath, s.handleBackup)
+	mux.HandleFunc(teamcity.CleanupPath, s.handleCleanup)
+	mux.HandleFunc(teamcity.FilesPathRoot+"/backup/metadata/", s.handleBackupFile)
+	mux.HandleFunc(teamcity.BuildsPath, s.handleBuilds)
+	mux.HandleFunc(teamcity.BuildQueuePath, s.handleBuildQueue)
+	mux.HandleFunc(teamcity.AgentsPath, s.handleAgents)
+	mux.HandleFunc(teamcity.AgentsPath+"/", s.handleAgent)
+	mux.HandleFunc(teamcity.AgentPoolsPath+"/", s.handleAgentPool)
+	s.Server = httptest.NewServer(s.authenticate(mux))
+	return s
+}
+
+// authenticate also answers every request with 503 in maintenance, like the maintenance page of a real server.
+// The readiness check does not require a token.
+func (s *Server) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		maintenance := s.maintenance
+		s.mu.Unlock()
+		if maintenance {
+			http.Error(w, "TeamCity is in maintenance", http.StatusServiceUnavailable)
+			return
+		}
+		if s.Token != "" && r.URL.Path != teamcity.HealthCheckReadyPath && r.Header.Get("Authorization") != "Bearer "+s.Token {
+			http.Error(w, "Authentication required", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (s *Server) handleServerInfo(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(s.serverInfo)
+}
+
+func (s *Server) handleReady(w http.ResponseWriter, r *http.Request) {
+	_, _ = w.Write([]byte("ready"))
+}
+
+func (s *Server) handleNodes(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string][]teamcity.ServerNode{"node": s.nodes})
+}
+
+// handleNode supports PUT id:<id>/enabledResponsibilities/<name> with a text/plain true or false body.
+// Enabled responsibilities become effective right away.
+func (s *Server) handleNode(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, teamcity.NodesPath+"/"), "/")
+	node := s.nodeByID(strings.TrimPrefix(parts[0], "id:"))
+	if node == nil {
+		http.Error(w, "No node found", http.StatusNotFound)
+		return
+	}
+	if r.Method != http.MethodPut || len(parts) != 3 || parts[1] != "enabledResponsibilities" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	body, _ := io.ReadAll(r.Body)
+	enabled := strings.TrimSpace(string(body)) == "true"
+	node.EnabledResponsibilities = withResponsibility(node.EnabledResponsibilities, parts[2], enabled)
+	node.EffectiveResponsibilities = withResponsibility(node.EffectiveResponsibilities, parts[2], enabled)
+	_, _ = w.Write([]byte(strconv.FormatBool(enabled)))
+}
+
+func (s *Server) nodeByID(id string) *teamcity.ServerNode {
+	for i := range s.nodes {
+		if s.nodes[i].ID == id {
+			return &s.nodes[i]
+		}
+	}
+	return nil
+}
+
+func responsibilities(names ...string) teamcity.Responsibilities {
+	result := teamcity.Responsibilities{}
+	for _, name := range names {
+		result.Responsibility = append(result.Responsibility, teamcity.Responsibility{Name: name})
+	}
+	return result
+}
+
+func withResponsibility(current teamcity.Responsibilities, name string, enabled bool) teamcity.Responsibilities {
+	result := teamcity.Responsibilities{}
+	for _, responsibility := range current.Responsibility {
+		if responsibility.Name != name {
+			result.Responsibility = append(result.Responsibility, responsibility)
+		}
+	}
+	if enabled {
+		result.Responsibility = append(result.Responsibility, teamcity.Responsibility{Name: name})
+	}
+	return result
+}
+
+func (s *Server) handleBackup(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch r.Method {
+	case http.MethodGet:
+		_, _ = w.Write([]byte(s.backupStatus))
+	case http.MethodPost:
+		if s.backupStatus.IsRunning() {
+			http.Error(w, "Another backup process is already running", http.StatusConflict)
+			return
+		}
+		query := r.URL.Query()
+		s.backupRequests = append(s.backupRequests, query)
+		fileName := query.Get("fileName")
+		if query.Get("addTimestamp") == "true" {
+			fileName += BackupTimestamp
+		}
+		if !strings.HasSuffix(fileName, ".zip") {
+			fileName += ".zip"
+		}
+		s.currentBackup = fileName
+		s.backupStatus = teamcity.BackupStatusRunning
+		_, _ = w.Write([]byte(fileName))
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *Server) handleCleanup(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		var settings teamcity.CleanupSettings
+		if err := json.NewDecoder(r.Body).Decode(&settings); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		s.cleanup = settings
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(s.cleanup)
+}
+
+func (s *Server) handleBackupFile(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	name := strings.TrimPrefix(r.URL.Path, teamcity.FilesPathRoot+"/backup/metadata/")
+	size, ok := s.files[name]
+	if !ok {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(teamcity.BackupFile{Name: name, Size: size})
+}
+
+// handleBuilds answers count queries for running builds, the only builds locator the operator uses.
+func (s *Server) handleBuilds(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !strings.Contains(r.URL.Query().Get("locator"), "state:running") {
+		http.Error(w, "Unsupported locator", http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]int{"count": s.runningBuilds})
+}
+
+// handleBuildQueue answers count queries for the whole queue or for a pool:(id:<id>) locator.
+func (s *Server) handleBuildQueue(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	count := 0
+	locator := r.URL.Query().Get("locator")
+	for poolID, queued := range s.queuedBuilds {
+		if locator == "" || locator == "pool:(id:"+strconv.Itoa(poolID)+")" {
+			count += queued
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]int{"count": count})
+}
+
+func (s *Server) handleAgents(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string][]teamcity.Agent{"agent": s.agents})
+}
+
+// handleAgent supports PUT id:<id>/authorized with a text/plain true or false body.
+func (s *Server) handleAgent(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	locator, field, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, teamcity.AgentsPath+"/"), "/")
+	agent := s.agentByLocator(locator)
+	if agent == nil {
+		http.Error(w, "No agent found", http.StatusNotFound)
+		return
+	}
+	if r.Method != http.MethodPut || field != "authorized" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	body, _ := io.ReadAll(r.Body)
+	agent.Authorized = strings.TrimSpace(string(body)) == "true"
+	_, _ = w.Write([]byte(strconv.FormatBool(agent.Authorized)))
+}
+
+// handleAgentPool supports GET name:<name> and POST id:<id>/agents with an agent id in the body.
+func (s *Server) handleAgentPool(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	locator, field, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, teamcity.AgentPoolsPath+"/"), "/")
+	var pool *teamcity.AgentPoolRef
+	for i := range s.agentPools {
+		if locator == "name:"+s.agentPools[i].Name || locator == "id:"+strconv.Itoa(s.agentPools[i].ID) {
+			pool = &s.agentPools[i]
+		}
+	}
+	if pool == nil {
+		http.Error(w, "No agent pool found", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	switch {
+	case r.Method == http.MethodGet && field == "":
+		_ = json.NewEncoder(w).Encode(pool)
+	case r.Method == http.MethodPost && field == "agents":
+		var ref struct {
+			ID int `json:"id"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&ref); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		agent := s.agentByLocator("id:" + strconv.Itoa(ref.ID))
+		if agent == nil {
+			http.Error(w, "No agent found", http.StatusNotFound)
+			return
+		}
+		agent.Pool = &teamcity.AgentPoolRef{ID: pool.ID, Name: pool.Name}
+		_ = json.NewEncoder(w).Encode(agent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *Server) agentByLocator(locator string) *teamcity.Agent {
+	for i := range s.agents {
+		if locator == "id:"+strconv.Itoa(s.agents[i].ID) {
+			return &s.agents[i]
+		}
+	}
+	return nil
+}
+
+// FinishBackup completes the running backup and makes its file available with the given size.
+func (s *Server) FinishBackup(size int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.backupStatus = teamcity.BackupStatusFinished
+	s.files[s.currentBackup] = size
+}
+
+// FailBackup marks the running backup as faulted.
+func (s *Server) FailBackup() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.backupStatus = teamcity.BackupStatusFaulted
+}
+
+// SetBackupStatus overrides the status reported by the server, e.g. to simulate a backup started from the UI.
+func (s *Server) SetBackupStatus(status teamcity.BackupStatus) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.backupStatus = status
+}
+
+// BackupRequests returns the query parameters of every accepted backup request.
+func (s *Server) BackupRequests() []url.Values {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]url.Values(nil), s.backupRequests...)
+}
+
+// AddBackupFile makes a file available in the backup directory.
+func (s *Server) AddBackupFile(name string, size int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.files[name] = size
+}
+
+// SetRunningBuilds sets the number of builds the server reports as running.
+func (s *Server) SetRunningBuilds(count int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.runningBuilds = count
+}
+
+// AddAgent registers a connected, unauthorized agent in the default pool, as if it had just connected to the server.
+func (s *Server) AddAgent(name string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	id := len(s.agents) + 1
+	s.agents = append(s.agents, teamcity.Agent{ID: id, Name: name, Connected: true, Pool: &teamcity.AgentPoolRef{ID: 0, Name: "Default"}})
+	return id
+}
+
+// Agent returns the registered agent with the given name.
+func (s *Server) Agent(name string) (teamcity.Agent, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, agent := range s.agents {
+		if agent.Name == name {
+			return agent, true
+		}
+	}
+	return teamcity.Agent{}, false
+}
+
+// AddAgentPool creates an agent pool and returns its id.
+func (s *Server) AddAgentPool(name string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	id := len(s.agentPools)
+	s.agentPools = append(s.agentPools, teamcity.AgentPoolRef{ID: id, Name: name})
+	return id
+}
+
+// SetQueuedBuilds sets the number of builds queued for the agent pool with the given id; the default pool has id 0.
+func (s *Server) SetQueuedBuilds(poolID int, count int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.queuedBuilds[poolID] = count
+}
+
+// SetAgentRunningBuild makes the agent run a build with the given id; zero makes it idle.
+func (s *Server) SetAgentRunningBuild(name string, buildID int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := range s.agents {
+		if s.agents[i].Name != name {
+			continue
+		}
+		s.agents[i].Build = nil
+		if buildID != 0 {
+			s.agents[i].Build = &teamcity.BuildRef{ID: buildID}
+		}
+	}
+}
+
+// SetServerInfo overrides the version the server reports, e.g. to simulate an upgraded main node.
+func (s *Server) SetServerInfo(info teamcity.ServerInfo) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.serverInfo = info
+}
+
+// SetMaintenance makes every endpoint answer with 503, as a server starting or waiting on the maintenance page does.
+func (s *Server) SetMaintenance(maintenance bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.maintenance = maintenance
+}
+
+// CleanupSettings returns the clean-up settings; the server starts with a daily clean-up at 3:00.
+func (s *Server) CleanupSettings() teamcity.CleanupSettings {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.cleanup
+}
+
+// AddNode registers an online secondary node holding the given responsibilities.
+func (s *Server) AddNode(id string, responsibilityNames ...string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.nodes = append(s.nodes, teamcity.ServerNode{
+		ID:                        id,
+		Role:                      "secondary_node",
+		State:                     "online",
+		Online:                    true,
+		EnabledResponsibilities:   responsibilities(responsibilityNames...),
+		EffectiveResponsibilities: responsibilities(responsibilityNames...),
+	})
+}
+
+// SetNodeState sets the state of a node, e.g. "starting" or "stopping"; only "online" nodes are reported online.
+func (s *Server) SetNodeState(id string, state string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if node := s.nodeByID(id); node != nil {
+		node.State = state
+		node.Online = state == "online"
+	}
+}
+
+// Node returns the node with the given id.
+func (s *Server) Node(id string) (teamcity.ServerNode, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if node := s.nodeByID(id); node != nil {
+		return *node, true
+	}
+	return teamcity.ServerNode{}, false
+}